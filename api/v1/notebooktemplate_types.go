@@ -0,0 +1,47 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +kubebuilder:object:root=true
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+// +kubebuilder:resource:path=notebooktemplates,singular=notebooktemplate,scope=Cluster
+// NotebookTemplate is a notebook preset defined by the cluster admins, e.g. a
+// GPU flavor with a curated image. The Notebooks referencing it through
+// spec.templateRef get its image, resources and volumes, unless they set
+// their own.
+type NotebookTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// Template is merged into the template of the referencing Notebooks.
+	Template NotebookTemplateSpec `json:"template,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// NotebookTemplateList contains a list of NotebookTemplate
+type NotebookTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []NotebookTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NotebookTemplate{}, &NotebookTemplateList{})
+}
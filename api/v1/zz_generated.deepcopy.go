@@ -55,6 +55,7 @@ func (in *Notebook) DeepCopyObject() runtime.Object {
 func (in *NotebookCondition) DeepCopyInto(out *NotebookCondition) {
 	*out = *in
 	in.LastProbeTime.DeepCopyInto(&out.LastProbeTime)
+	in.FirstProbeTime.DeepCopyInto(&out.FirstProbeTime)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NotebookCondition.
@@ -67,6 +68,37 @@ func (in *NotebookCondition) DeepCopy() *NotebookCondition {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NotebookCullRecord) DeepCopyInto(out *NotebookCullRecord) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NotebookCullRecord.
+func (in *NotebookCullRecord) DeepCopy() *NotebookCullRecord {
+	if in == nil {
+		return nil
+	}
+	out := new(NotebookCullRecord)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NotebookExistingVolumeClaim) DeepCopyInto(out *NotebookExistingVolumeClaim) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NotebookExistingVolumeClaim.
+func (in *NotebookExistingVolumeClaim) DeepCopy() *NotebookExistingVolumeClaim {
+	if in == nil {
+		return nil
+	}
+	out := new(NotebookExistingVolumeClaim)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NotebookList) DeepCopyInto(out *NotebookList) {
 	*out = *in
@@ -99,6 +131,21 @@ func (in *NotebookList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NotebookPort) DeepCopyInto(out *NotebookPort) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NotebookPort.
+func (in *NotebookPort) DeepCopy() *NotebookPort {
+	if in == nil {
+		return nil
+	}
+	out := new(NotebookPort)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NotebookSpec) DeepCopyInto(out *NotebookSpec) {
 	*out = *in
@@ -108,6 +155,16 @@ func (in *NotebookSpec) DeepCopyInto(out *NotebookSpec) {
 		copy(*out, *in)
 	}
 	in.Template.DeepCopyInto(&out.Template)
+	if in.Ports != nil {
+		in, out := &in.Ports, &out.Ports
+		*out = make([]NotebookPort, len(*in))
+		copy(*out, *in)
+	}
+	if in.ExistingVolumeClaims != nil {
+		in, out := &in.ExistingVolumeClaims, &out.ExistingVolumeClaims
+		*out = make([]NotebookExistingVolumeClaim, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NotebookSpec.
@@ -131,6 +188,17 @@ func (in *NotebookStatus) DeepCopyInto(out *NotebookStatus) {
 		}
 	}
 	in.ContainerState.DeepCopyInto(&out.ContainerState)
+	if in.CullWarning != nil {
+		in, out := &in.CullWarning, &out.CullWarning
+		*out = (*in).DeepCopy()
+	}
+	if in.CullHistory != nil {
+		in, out := &in.CullHistory, &out.CullHistory
+		*out = make([]NotebookCullRecord, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NotebookStatus.
@@ -143,9 +211,68 @@ func (in *NotebookStatus) DeepCopy() *NotebookStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NotebookTemplate) DeepCopyInto(out *NotebookTemplate) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Template.DeepCopyInto(&out.Template)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NotebookTemplate.
+func (in *NotebookTemplate) DeepCopy() *NotebookTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(NotebookTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *NotebookTemplate) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NotebookTemplateList) DeepCopyInto(out *NotebookTemplateList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]NotebookTemplate, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NotebookTemplateList.
+func (in *NotebookTemplateList) DeepCopy() *NotebookTemplateList {
+	if in == nil {
+		return nil
+	}
+	out := new(NotebookTemplateList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *NotebookTemplateList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *NotebookTemplateSpec) DeepCopyInto(out *NotebookTemplateSpec) {
 	*out = *in
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
 }
 
@@ -28,9 +28,52 @@ type NotebookSpec struct {
 	// Template describes the notebooks that will be created.
 	VolumeClaim []NotebookVolumeClaim `json:"volumeClaim,omitempty"`
 	Template NotebookTemplateSpec `json:"template,omitempty"`
+	// Ports are additional ports of the notebook container exposed by its
+	// Service, e.g. for TensorBoard or a dask dashboard.
+	// +optional
+	Ports []NotebookPort `json:"ports,omitempty"`
+	// TemplateRef is the name of a cluster NotebookTemplate merged into the
+	// template. The fields set by the Notebook take precedence.
+	// +optional
+	TemplateRef string `json:"templateRef,omitempty"`
+	// ExistingVolumeClaims are PVCs of the namespace mounted into the
+	// notebook container, e.g. shared team datasets. Unlike VolumeClaim, the
+	// controller neither creates nor owns them.
+	// +optional
+	ExistingVolumeClaims []NotebookExistingVolumeClaim `json:"existingVolumeClaims,omitempty"`
+}
+
+// NotebookPort is an additional port of the notebook container. Like the
+// notebook port without the gatekeeper, it is reachable without logging in.
+type NotebookPort struct {
+	// Name of the Service port, a DNS label.
+	Name string `json:"name"`
+	// Port the notebook container serves on, also used as the Service port.
+	Port int32 `json:"port"`
+	// Path routes the port under the notebook prefix through the Ingress or
+	// the VirtualService, e.g. "tensorboard". It isn't routed if empty.
+	// +optional
+	Path string `json:"path,omitempty"`
+}
+
+// NotebookExistingVolumeClaim is a PVC managed outside of the Notebook, mounted
+// into the notebook container.
+type NotebookExistingVolumeClaim struct {
+	// ClaimName is the name of the PVC in the Notebook's namespace.
+	ClaimName string `json:"claimName"`
+	// MountPath is where the volume is mounted in the notebook container.
+	MountPath string `json:"mountPath"`
+	// ReadOnly mounts the volume read-only.
+	// +optional
+	ReadOnly bool `json:"readOnly,omitempty"`
 }
 
 type NotebookTemplateSpec struct {
+	// The annotations of the metadata are set on the notebook pod, e.g. for
+	// prometheus scraping or vault injection.
+	// +optional
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
 	Spec corev1.PodSpec `json:"spec,omitempty"`
 }
 
@@ -42,10 +85,39 @@ type NotebookStatus struct {
 	ReadyReplicas int32 `json:"readyReplicas"`
 	// ContainerState is the state of underlying container.
 	ContainerState corev1.ContainerState `json:"containerState"`
+	// RestartCount is the number of times the notebook container restarted.
+	// +optional
+	RestartCount int32 `json:"restartCount,omitempty"`
+	// LastTerminationReason is the reason the notebook container last
+	// terminated, e.g. OOMKilled.
+	// +optional
+	LastTerminationReason string `json:"lastTerminationReason,omitempty"`
+	// LastTerminationExitCode is the exit code of the last termination of the
+	// notebook container.
+	// +optional
+	LastTerminationExitCode int32 `json:"lastTerminationExitCode,omitempty"`
+	// CullWarning is the time the idle notebook is scheduled to be culled. It
+	// is only set during the warning period before the cull, and cleared on
+	// activity.
+	// +optional
+	CullWarning *metav1.Time `json:"cullWarning,omitempty"`
+	// CullHistory records the last times the notebook was stopped, and why,
+	// oldest first. It is capped to the controller's CULL_HISTORY_LIMIT.
+	// +optional
+	CullHistory []NotebookCullRecord `json:"cullHistory,omitempty"`
+}
+
+// NotebookCullRecord is a stop of the notebook.
+type NotebookCullRecord struct {
+	// Time the notebook was stopped at.
+	Time metav1.Time `json:"time"`
+	// Reason the notebook was stopped. Possible values are
+	// Idle|Lifetime|Maintenance|Manual
+	Reason string `json:"reason"`
 }
 
 type NotebookCondition struct {
-	// Type is the type of the condition. Possible values are Running|Waiting|Terminated
+	// Type is the type of the condition. Possible values are Pending|Running|Waiting|Terminated|EndpointReady
 	Type string `json:"type"`
 	// Last time we probed the condition.
 	// +optional
@@ -56,10 +128,24 @@ type NotebookCondition struct {
 	// Message regarding why the container is in the current state.
 	// +optional
 	Message string `json:"message,omitempty"`
+	// Status of the condition, one of True, False, Unknown. Only set for the
+	// conditions that aren't container states, e.g. EndpointReady.
+	// +optional
+	Status corev1.ConditionStatus `json:"status,omitempty"`
+	// Count is the number of consecutive conditions of this type compacted
+	// into this one, when the condition compaction is enabled.
+	// +optional
+	Count int32 `json:"count,omitempty"`
+	// First time we probed the compacted conditions.
+	// +optional
+	FirstProbeTime metav1.Time `json:"firstProbeTime,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Ready",type="integer",JSONPath=".status.readyReplicas"
+// +kubebuilder:printcolumn:name="Restarts",type="integer",JSONPath=".status.restartCount"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
 // Notebook is the Schema for the notebooks API
 type Notebook struct {
@@ -83,6 +169,9 @@ type NotebookVolumeClaim struct {
 	Name         string `json:"name"`
 	Size         string `json:"size"`
 	StorageClass string `json:"storageClass,omitempty"`
+	// AccessMode of the claim. Defaults to the controller's PVC_ACCESS_MODE.
+	// +optional
+	AccessMode corev1.PersistentVolumeAccessMode `json:"accessMode,omitempty"`
 }
 
 func init() {
@@ -0,0 +1,166 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/go-logr/logr"
+	"github.com/tmax-cloud/notebook-controller-go/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// CleanupFinalizer holds the deletion of a Notebook until its cleanup steps
+// ran. It is only set while at least one step is enabled.
+const CleanupFinalizer = "notebook.tmaxcloud.org/cleanup"
+
+// CleanupStep is run when a Notebook is deleted, e.g. to remove what isn't
+// garbage collected through owner references. The steps run in order and a
+// failed step is retried with the steps after it, so they must be idempotent.
+type CleanupStep struct {
+	Name string
+	// Enabled returns true if the step runs for the Notebook. A step without
+	// it is always enabled.
+	Enabled func(instance *v1.Notebook) bool
+	Run     func(ctx context.Context, instance *v1.Notebook) error
+}
+
+// enabledCleanupSteps returns the steps enabled for the Notebook, without the
+// ones named in the comma-separated DISABLED_CLEANUP_STEPS.
+func (r *NotebookReconciler) enabledCleanupSteps(instance *v1.Notebook) []CleanupStep {
+	disabled := make(map[string]bool)
+	for _, name := range splitList(os.Getenv("DISABLED_CLEANUP_STEPS")) {
+		disabled[name] = true
+	}
+	steps := r.CleanupSteps
+	if steps == nil {
+		steps = r.defaultCleanupSteps()
+	}
+	var enabled []CleanupStep
+	for _, step := range steps {
+		if disabled[step.Name] || (step.Enabled != nil && !step.Enabled(instance)) {
+			continue
+		}
+		enabled = append(enabled, step)
+	}
+	return enabled
+}
+
+// defaultCleanupSteps returns the cleanup of the Notebook features. The owned
+// objects are deleted before the Notebook instead of after it by the garbage
+// collector, so a Notebook recreated with the same name doesn't adopt them.
+func (r *NotebookReconciler) defaultCleanupSteps() []CleanupStep {
+	return []CleanupStep{
+		{
+			Name:    "snapshot",
+			Enabled: useSnapshot,
+			Run:     r.waitForSnapshot,
+		},
+		{
+			Name:    "pvc",
+			Enabled: func(instance *v1.Notebook) bool { return reclaimPVC() },
+			Run: func(ctx context.Context, instance *v1.Notebook) error {
+				for _, claim := range instance.Spec.VolumeClaim {
+					if err := r.deleteIfOwned(ctx, instance, &corev1.PersistentVolumeClaim{}, claim.Name); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Name:    "tls-secret",
+			Enabled: func(instance *v1.Notebook) bool { return useCertificate(instance) && reclaimCertSecret() },
+			Run: func(ctx context.Context, instance *v1.Notebook) error {
+				return r.deleteIfOwned(ctx, instance, &corev1.Secret{}, tlsSecretName(instance))
+			},
+		},
+		{
+			Name:    "activity-lease",
+			Enabled: func(instance *v1.Notebook) bool { return useActivityLease() },
+			Run: func(ctx context.Context, instance *v1.Notebook) error {
+				return r.deleteIfOwned(ctx, instance, &coordinationv1.Lease{}, activityLeaseName(instance.Name))
+			},
+		},
+	}
+}
+
+// waitForSnapshot deletes the StatefulSet of the Notebook and fails until its
+// pod is gone, so the snapshot sidecar synced the working directory from its
+// preStop hook before the volumes are deleted.
+func (r *NotebookReconciler) waitForSnapshot(ctx context.Context, instance *v1.Notebook) error {
+	if err := r.deleteIfOwned(ctx, instance, &appsv1.StatefulSet{}, instance.Name); err != nil {
+		return err
+	}
+	pod := &corev1.Pod{}
+	err := r.Get(ctx, types.NamespacedName{Name: instance.Name + "-0", Namespace: instance.Namespace}, pod)
+	if err == nil {
+		return fmt.Errorf("pod %s is still syncing its snapshot", pod.Name)
+	}
+	return ignoreNotFound(err)
+}
+
+// deleteIfOwned deletes the named object if it exists and the Notebook is one
+// of its owners. It is read uncached, since not every kind is watched.
+func (r *NotebookReconciler) deleteIfOwned(ctx context.Context, instance *v1.Notebook, obj client.Object, name string) error {
+	if err := r.apiReader().Get(ctx, types.NamespacedName{Name: name, Namespace: instance.Namespace}, obj); err != nil {
+		return ignoreNotFound(err)
+	}
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.UID == instance.UID {
+			return ignoreNotFound(r.Delete(ctx, obj))
+		}
+	}
+	return nil
+}
+
+// reconcileCleanup keeps CleanupFinalizer on the Notebook while it has enabled
+// cleanup steps. Once the Notebook is deleted, it runs the steps and removes
+// the finalizer. It returns true if the Notebook is being deleted and the
+// reconcile is done.
+func (r *NotebookReconciler) reconcileCleanup(ctx context.Context, instance *v1.Notebook, log logr.Logger) (bool, error) {
+	steps := r.enabledCleanupSteps(instance)
+	if instance.DeletionTimestamp.IsZero() {
+		if len(steps) > 0 == controllerutil.ContainsFinalizer(instance, CleanupFinalizer) {
+			return false, nil
+		}
+		if len(steps) > 0 {
+			controllerutil.AddFinalizer(instance, CleanupFinalizer)
+		} else {
+			controllerutil.RemoveFinalizer(instance, CleanupFinalizer)
+		}
+		return false, r.Update(ctx, instance)
+	}
+
+	if !controllerutil.ContainsFinalizer(instance, CleanupFinalizer) {
+		return false, nil
+	}
+	for _, step := range steps {
+		log.Info("Running cleanup step", "step", step.Name)
+		if err := step.Run(ctx, instance); err != nil {
+			return true, fmt.Errorf("cleanup step %s error: %v", step.Name, err)
+		}
+	}
+	controllerutil.RemoveFinalizer(instance, CleanupFinalizer)
+	return true, r.Update(ctx, instance)
+}
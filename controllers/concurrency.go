@@ -0,0 +1,136 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/tmax-cloud/notebook-controller-go/api/v1"
+	"github.com/tmax-cloud/notebook-controller-go/pkg/culler"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The condition that is True while a Notebook is kept stopped because its
+// namespace already runs MAX_RUNNING_NOTEBOOKS_PER_NAMESPACE notebooks.
+const NotebookConditionConcurrencyLimited = "ConcurrencyLimited"
+
+// A Notebook kept stopped by the concurrency limit is checked again after this
+// delay, as the other notebooks of the namespace may have stopped meanwhile.
+const ConcurrencyLimitRequeueDelay = time.Minute
+
+// getMaxRunningNotebooks returns how many notebooks may run at once in a
+// namespace, or 0 for no limit. Uses ENV var: MAX_RUNNING_NOTEBOOKS_PER_NAMESPACE
+func getMaxRunningNotebooks() int {
+	if limit, err := strconv.Atoi(os.Getenv("MAX_RUNNING_NOTEBOOKS_PER_NAMESPACE")); err == nil && limit > 0 {
+		return limit
+	}
+	return 0
+}
+
+// reconcileConcurrencyLimit returns true if the Notebook has to stay stopped,
+// as its namespace already runs as many notebooks as allowed. Only notebooks
+// starting are held back, the running ones are never stopped by the limit.
+// The ConcurrencyLimited condition and event tell the user why it doesn't start.
+func (r *NotebookReconciler) reconcileConcurrencyLimit(ctx context.Context, instance *v1.Notebook, log logr.Logger) (bool, error) {
+	limit := getMaxRunningNotebooks()
+	queued := false
+	running := 0
+	if limit > 0 && !culler.StopAnnotationIsSet(instance.ObjectMeta) {
+		var err error
+		if running, err = r.countOtherRunningNotebooks(ctx, instance); err != nil {
+			log.Error(err, "unable to count the running notebooks")
+			return false, err
+		}
+		queued = running >= limit
+		if queued {
+			// A notebook already running keeps running.
+			foundStateful := &appsv1.StatefulSet{}
+			err := r.Get(ctx, types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}, foundStateful)
+			if err != nil && !apierrs.IsNotFound(err) {
+				log.Error(err, "error getting Statefulset")
+				return false, err
+			}
+			queued = err != nil || foundStateful.Spec.Replicas == nil || *foundStateful.Spec.Replicas == 0
+		}
+	}
+
+	condition := v1.NotebookCondition{
+		Type:          NotebookConditionConcurrencyLimited,
+		LastProbeTime: metav1.Now(),
+		Status:        corev1.ConditionFalse,
+	}
+	if queued {
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = "MaxRunningNotebooks"
+		condition.Message = fmt.Sprintf("namespace %s already runs %d notebooks, the limit is %d",
+			instance.Namespace, running, limit)
+	} else if !hasCondition(instance.Status.Conditions, NotebookConditionConcurrencyLimited) {
+		return false, nil
+	}
+	if setCondition(&instance.Status, condition) {
+		log.Info("Updating the concurrency limit condition", "queued", queued, "running", running)
+		if err := r.Status().Update(ctx, instance); err != nil {
+			return false, err
+		}
+	}
+	key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}.String() + "|" +
+		NotebookConditionConcurrencyLimited
+	if queued && !r.eventCache().Seen(key, time.Now(), getEventDedupWindow()) {
+		r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonConcurrencyLimited,
+			"The Notebook is kept stopped, %s", condition.Message)
+	}
+	return queued, nil
+}
+
+// countOtherRunningNotebooks returns how many other notebooks of the namespace
+// have their StatefulSet scaled up.
+func (r *NotebookReconciler) countOtherRunningNotebooks(ctx context.Context, instance *v1.Notebook) (int, error) {
+	statefulSets := &appsv1.StatefulSetList{}
+	if err := r.List(ctx, statefulSets, client.InNamespace(instance.Namespace)); err != nil {
+		return 0, err
+	}
+	running := 0
+	for _, sts := range statefulSets.Items {
+		owner := metav1.GetControllerOf(&sts)
+		if owner == nil || owner.Kind != "Notebook" || owner.Name == instance.Name {
+			continue
+		}
+		if sts.Spec.Replicas != nil && *sts.Spec.Replicas > 0 {
+			running++
+		}
+	}
+	return running, nil
+}
+
+// hasCondition returns true if a condition of the type is set.
+func hasCondition(conditions []v1.NotebookCondition, conditionType string) bool {
+	for _, condition := range conditions {
+		if condition.Type == conditionType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// An event re-emitted on a Notebook isn't re-emitted again for this many
+// seconds, so crash-looping pods don't flood the Notebook with duplicates.
+// Uses ENV var: EVENT_DEDUP_WINDOW
+const DefaultEventDedupWindow = 60
+
+// The maximum number of re-emitted events remembered at once.
+const DefaultEventCacheSize = 1024
+
+// eventCache remembers recently re-emitted events until their window expires.
+type eventCache struct {
+	mu      sync.Mutex
+	size    int
+	expires map[string]time.Time
+}
+
+func newEventCache(size int) *eventCache {
+	return &eventCache{
+		size:    size,
+		expires: map[string]time.Time{},
+	}
+}
+
+// eventKey identifies an event by the Notebook it is re-emitted on, the object
+// it is about, its reason and a hash of its message.
+func eventKey(notebook types.NamespacedName, event *corev1.Event) string {
+	h := fnv.New64a()
+	h.Write([]byte(event.Message))
+	return fmt.Sprintf("%s|%s/%s|%s|%x", notebook, event.InvolvedObject.Kind,
+		event.InvolvedObject.Name, event.Reason, h.Sum64())
+}
+
+// Seen returns true if key was recorded less than window ago. Otherwise it
+// records key and returns false.
+func (c *eventCache) Seen(key string, now time.Time, window time.Duration) bool {
+	if window <= 0 {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if expires, ok := c.expires[key]; ok && now.Before(expires) {
+		return true
+	}
+	if len(c.expires) >= c.size {
+		c.evict(now)
+	}
+	c.expires[key] = now.Add(window)
+	return false
+}
+
+// evict drops the expired entries, or the one closest to expiring if there
+// are none.
+func (c *eventCache) evict(now time.Time) {
+	oldestKey := ""
+	var oldest time.Time
+	for key, expires := range c.expires {
+		if !now.Before(expires) {
+			delete(c.expires, key)
+		} else if oldestKey == "" || expires.Before(oldest) {
+			oldestKey, oldest = key, expires
+		}
+	}
+	if len(c.expires) >= c.size {
+		delete(c.expires, oldestKey)
+	}
+}
+
+// getEventDedupWindow returns the window re-emitted events are deduplicated
+// in. Zero disables deduplication.
+func getEventDedupWindow() time.Duration {
+	window := DefaultEventDedupWindow
+	if value, ok := os.LookupEnv("EVENT_DEDUP_WINDOW"); ok {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			window = seconds
+		}
+	}
+	return time.Duration(window) * time.Second
+}
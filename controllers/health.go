@@ -0,0 +1,95 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// The reconciles may fail for this many seconds in a row before the liveness
+// check fails, e.g. when the controller lost access to the API server.
+// Uses ENV var: RECONCILE_STALENESS
+const DefaultReconcileStaleness = 600
+
+// The readiness check waits this long for the informer caches to sync.
+const CacheSyncTimeout = time.Second
+
+// cacheSyncer is implemented by the manager cache.
+type cacheSyncer interface {
+	WaitForCacheSync(ctx context.Context) bool
+}
+
+// NewCacheSyncCheck returns a readiness check that fails until the informer
+// caches are synced, so the controller only reports ready once it can
+// reconcile from an up to date view of the cluster.
+func NewCacheSyncCheck(c cacheSyncer) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), CacheSyncTimeout)
+		defer cancel()
+		if !c.WaitForCacheSync(ctx) {
+			return errors.New("informer caches are not synced")
+		}
+		return nil
+	}
+}
+
+func getReconcileStaleness() time.Duration {
+	staleness := DefaultReconcileStaleness
+	if value, ok := os.LookupEnv("RECONCILE_STALENESS"); ok {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			staleness = seconds
+		}
+	}
+	return time.Duration(staleness) * time.Second
+}
+
+// recordReconcile tracks the last successful and failed reconciles.
+func (r *NotebookReconciler) recordReconcile(err error, now time.Time) {
+	atomic.CompareAndSwapInt64(&r.firstReconcile, 0, now.UnixNano())
+	if err != nil {
+		atomic.StoreInt64(&r.lastFailure, now.UnixNano())
+		return
+	}
+	atomic.StoreInt64(&r.lastSuccess, now.UnixNano())
+}
+
+// ReconcileHealthCheck is a liveness check that fails when the reconciles
+// have been failing for longer than RECONCILE_STALENESS. A controller without
+// anything to reconcile stays healthy.
+func (r *NotebookReconciler) ReconcileHealthCheck(req *http.Request) error {
+	lastFailure := atomic.LoadInt64(&r.lastFailure)
+	lastSuccess := atomic.LoadInt64(&r.lastSuccess)
+	if lastFailure <= lastSuccess {
+		return nil
+	}
+	// Before the first success, the failures count from the first reconcile.
+	if lastSuccess == 0 {
+		lastSuccess = atomic.LoadInt64(&r.firstReconcile)
+	}
+	if since := time.Since(time.Unix(0, lastSuccess)); since > getReconcileStaleness() {
+		return fmt.Errorf("no successful reconcile for %s", since.Round(time.Second))
+	}
+	return nil
+}
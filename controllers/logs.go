@@ -0,0 +1,190 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tmax-cloud/notebook-controller-go/api/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The logs of a notebook are served under this path, as
+// <prefix><namespace>/<name>, when ENABLE_LOGS_ENDPOINT is "true". They are
+// only served over TLS by the webhook server, on port 9443 with the tls.crt
+// and tls.key of its cert dir, and the manager doesn't start without them.
+const LogsPathPrefix = "/notebook-logs/"
+
+// The lines of the notebook logs returned unless the tailLines query
+// parameter is set.
+const DefaultLogsTailLines = int64(100)
+
+// LogSource streams the logs of a pod container.
+type LogSource interface {
+	Logs(ctx context.Context, namespace, pod string, opts *corev1.PodLogOptions) (io.ReadCloser, error)
+}
+
+// podLogSource reads the logs from the kubelets through the API server.
+type podLogSource struct {
+	clientset kubernetes.Interface
+}
+
+func (s *podLogSource) Logs(ctx context.Context, namespace, pod string, opts *corev1.PodLogOptions) (io.ReadCloser, error) {
+	return s.clientset.CoreV1().Pods(namespace).GetLogs(pod, opts).Stream(ctx)
+}
+
+// LogsHandler serves the logs of the notebook containers, e.g. for a
+// dashboard. The callers authenticate with a bearer token, and need to be
+// allowed to get the pods/log of the notebook namespace.
+type LogsHandler struct {
+	client.Client
+	Source    LogSource
+	Clientset kubernetes.Interface
+}
+
+// NewLogsHandler returns a LogsHandler reading the logs through the API server.
+func NewLogsHandler(c client.Client, clientset kubernetes.Interface) *LogsHandler {
+	return &LogsHandler{
+		Client:    c,
+		Source:    &podLogSource{clientset: clientset},
+		Clientset: clientset,
+	}
+}
+
+func (h *LogsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, LogsPathPrefix), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		http.NotFound(w, req)
+		return
+	}
+	key := types.NamespacedName{Namespace: parts[0], Name: parts[1]}
+
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == req.Header.Get("Authorization") {
+		http.Error(w, "bearer token required", http.StatusUnauthorized)
+		return
+	}
+	allowed, err := h.authorize(req.Context(), token, key.Namespace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	instance := &v1.Notebook{}
+	if err := h.Get(req.Context(), key, instance); err != nil {
+		if apierrs.IsNotFound(err) {
+			http.NotFound(w, req)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	tailLines := DefaultLogsTailLines
+	if value := req.URL.Query().Get("tailLines"); value != "" {
+		if lines, err := strconv.ParseInt(value, 10, 64); err == nil && lines > 0 {
+			tailLines = lines
+		}
+	}
+	follow := req.URL.Query().Get("follow") == "true"
+	logs, err := h.Source.Logs(req.Context(), instance.Namespace, instance.Name+"-0", &corev1.PodLogOptions{
+		Container: notebookContainerName(instance),
+		TailLines: &tailLines,
+		Follow:    follow,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer logs.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	flusher, ok := w.(http.Flusher)
+	if !follow || !ok {
+		_, _ = io.Copy(w, logs)
+		return
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := logs.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// authorize returns true if the user of the token may get the pods/log of the
+// namespace, as reviewed by the API server.
+func (h *LogsHandler) authorize(ctx context.Context, token, namespace string) (bool, error) {
+	review, err := h.Clientset.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+	if !review.Status.Authenticated {
+		return false, nil
+	}
+
+	user := review.Status.User
+	extra := make(map[string]authorizationv1.ExtraValue)
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	access, err := h.Clientset.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.Username,
+			UID:    user.UID,
+			Groups: user.Groups,
+			Extra:  extra,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   namespace,
+				Verb:        "get",
+				Resource:    "pods",
+				Subresource: "log",
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+	return access.Status.Allowed, nil
+}
@@ -17,10 +17,18 @@ package controllers
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"net"
 	"os"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	"k8s.io/utils/pointer"
@@ -31,32 +39,319 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 	netv1 "k8s.io/api/networking/v1"
 	appsv1 "k8s.io/api/apps/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 const DefaultContainerPort = 8888
+const GatekeeperPort = 3000
 const DefaultServingPort = 80
 const HttpsServingPort = 443
 const AnnotationRewriteURI = "notebooks.kubeflow.org/http-rewrite-uri"
 const AnnotationHeadersRequestSet = "notebooks.kubeflow.org/http-headers-request-set"
+const AnnotationHTTPTimeout = "notebooks.kubeflow.org/http-timeout"
+const AnnotationHTTPRetries = "notebooks.kubeflow.org/http-retries"
+const AnnotationHTTPCorsPolicy = "notebooks.kubeflow.org/http-cors-policy"
+const AnnotationIstioGateway = "notebooks.kubeflow.org/istio-gateway"
+const AnnotationIstioHost = "notebooks.kubeflow.org/istio-host"
+
+// Set to "true" or "false" on a Notebook to opt its pod in or out of the istio
+// sidecar, e.g. for mTLS to mesh services, whatever its namespace label says.
+const AnnotationIstioInject = "notebooks.kubeflow.org/istio-inject"
+const AnnotationNodePool = "notebook.tmaxcloud.org/node-pool"
+
+// Set on a Notebook to pin its pod to a node, e.g. when it uses a hostPath or
+// local PV that only exists there. The pod then only schedules on that node.
+const AnnotationNodeName = "notebook.tmaxcloud.org/node-name"
+
+// Set to "true" on a Notebook to skip its Certificate, e.g. when it is served
+// behind mesh mTLS. It then mounts SHARED_TLS_SECRET if set, and no secret
+// otherwise, in which case the gatekeeper serves a self-signed certificate.
+const AnnotationDisableCertificate = "notebook.tmaxcloud.org/disable-certificate"
+
+// Set to "true" on a Notebook to snapshot its home directory to object storage
+// on shutdown. Only honored when ENABLE_SNAPSHOT is "true".
+const AnnotationSnapshot = "notebook.tmaxcloud.org/snapshot"
+
+// Set on a Notebook to request only a fraction of its CPU and memory limits,
+// so idle notebooks pack densely but can still burst. The value is "true" for
+// BURSTABLE_REQUEST_FRACTION, or the fraction itself, e.g. "0.1".
+const AnnotationBurstable = "notebook.tmaxcloud.org/burstable"
+
+// Set to "true" on a Notebook to let it run on spot/preemptible nodes. Only
+// honored when SPOT_TOLERATIONS is set.
+const AnnotationSpot = "notebook.tmaxcloud.org/spot"
+
+// Set on a Notebook whose image serves on another port than
+// DefaultContainerPort, e.g. "8080". It takes precedence over the first port
+// of the notebook container.
+const AnnotationContainerPort = "notebook.tmaxcloud.org/container-port"
+
+// Set to "true" on a Notebook to replace its service account token with a
+// short-lived projected one. Only honored when ENABLE_PROJECTED_TOKEN is "true".
+const AnnotationProjectedToken = "notebook.tmaxcloud.org/projected-token"
+
+// Set on a Notebook to override GATEKEEPER_ROLES, e.g. to let only one team
+// reach it.
+const AnnotationGatekeeperRoles = "notebook.tmaxcloud.org/gatekeeper-roles"
+
+// Set on a Notebook to override LOG_LEVEL for its gatekeeper, e.g. "debug"
+// while looking into the login issues of one user.
+const AnnotationGatekeeperLogLevel = "notebook.tmaxcloud.org/gatekeeper-log-level"
+
+// Set to "true" on a Notebook to allocate stdin and a TTY to its notebook
+// container, e.g. for images that need them to debug with kubectl exec -it.
+const AnnotationTTY = "notebook.tmaxcloud.org/tty"
+
+// Set on a Notebook to override MAX_NOTEBOOK_LIFETIME, as a duration, e.g.
+// "72h" for a long training run. "0" never stops it.
+const AnnotationMaxLifetime = "notebook.tmaxcloud.org/max-lifetime"
+
+// Set on a Notebook to mount an emptyDir scratch volume of that size limit,
+// e.g. "20Gi", for temporary data that doesn't need a PVC. It is lost when the
+// pod stops.
+const AnnotationScratchSize = "notebook.tmaxcloud.org/scratch-size"
+
+// Set on a Notebook to mount its scratch volume elsewhere than SCRATCH_PATH.
+const AnnotationScratchPath = "notebook.tmaxcloud.org/scratch-path"
+
+// Set on a Notebook to override JUPYTER_TOKEN_POLICY, "none" or "required".
+const AnnotationJupyterToken = "notebook.tmaxcloud.org/jupyter-token"
+
+// Set on a Notebook to override JUPYTER_ALLOW_ORIGIN, e.g. with the origin of
+// the dashboard embedding it.
+const AnnotationJupyterAllowOrigin = "notebook.tmaxcloud.org/jupyter-allow-origin"
+
+// Set to "paused" on a Notebook to stop reconciling it, e.g. while debugging
+// manual edits to its StatefulSet. Its owned resources are left as they are
+// until the annotation is removed. Deleting it still runs the cleanup steps.
+const AnnotationReconcile = "notebook.tmaxcloud.org/reconcile"
+const ReconcilePaused = "paused"
+
+// Whether Jupyter requires a token. With "required" it reads JUPYTER_TOKEN,
+// from JUPYTER_TOKEN_SECRET if set, or else generates one it logs.
+const (
+	JupyterTokenPolicyNone     = "none"
+	JupyterTokenPolicyRequired = "required"
+)
+
+// Set on the Notebooks stopped by the maintenance mode, so that only they are
+// started again once it clears.
+const AnnotationMaintenanceStopped = "notebook.tmaxcloud.org/maintenance-stopped"
+
+// Selects how a Notebook is routed: on its own host (subdomain) or under
+// /notebook/<namespace>/<name> on the shared domain (path). The Ingress, the
+// VirtualService and NB_PREFIX all follow it.
+const AnnotationRoutingMode = "notebook.tmaxcloud.org/routing-mode"
+
+const (
+	RoutingModeSubdomain = "subdomain"
+	RoutingModePath      = "path"
+)
+
+// Set on a Notebook to serve it on its own external hostname, e.g.
+// "lab.example.com". It drives the Ingress host, the TLS secret, the
+// Certificate and the VirtualService hosts together, so they always match.
+const AnnotationExternalHostname = "notebook.tmaxcloud.org/external-hostname"
+
+// Set to "true" on a Notebook to give it a headless Service as well, so its
+// pods get stable DNS names, e.g. for dask workers addressing the scheduler.
+// The StatefulSets created after it is set are governed by that Service.
+// Defaults to HEADLESS_SERVICE.
+const AnnotationHeadlessService = "notebook.tmaxcloud.org/headless-service"
+
+// Set on a Notebook running several containers, e.g. jupyter next to
+// code-server, to the name of the one serving the notebook. NB_PREFIX, the
+// port, the probes and the other notebook defaults only apply to it. It is
+// ignored if no container has that name.
+const AnnotationPrimaryContainer = "notebook.tmaxcloud.org/primary-container"
+
+// Set to "false" on a Notebook to pull its image as is, rather than through
+// the REGISTRY_NAME mirror when MIRROR_NOTEBOOK_IMAGE is "true".
+const AnnotationRegistryMirror = "notebook.tmaxcloud.org/registry-mirror"
+
+// Set on a Notebook to run its pod as that ServiceAccount of its namespace,
+// e.g. one bound to a cloud IAM role. An empty or invalid name is ignored.
+const AnnotationServiceAccount = "notebook.tmaxcloud.org/service-account"
+
+// Namespaces with this label set to "enabled" get the istio sidecar injected.
+const IstioInjectionLabel = "istio-injection"
+
+// Set on a Namespace to override CUSTOM_DOMAIN for the notebooks in it.
+const AnnotationCustomDomain = "notebook.tmaxcloud.org/custom-domain"
+
+// The IngressClass of the notebook Ingresses.
+// Uses ENV var: INGRESS_CLASS_NAME
+const DefaultIngressClassName = "tmax-cloud"
+
+// Notebook traffic is mostly long-lived WebSockets, and kernels can be slow to
+// start, so the route timeout is much longer than the istio default.
+const DefaultHTTPTimeout = "300s"
+
+// The networking paths that can be selected with EXPOSE_MODE. When it isn't
+// set, USE_INGRESS and USE_ISTIO choose the paths independently.
+const (
+	ExposeModeIngress = "ingress"
+	ExposeModeIstio   = "istio"
+	ExposeModeNone    = "none"
+)
+
+// Nodes of a dedicated notebook pool are labeled and tainted with this key,
+// e.g. dedicated=notebooks:NoSchedule.
+const NodePoolKey = "dedicated"
 
 const PrefixEnvVar = "NB_PREFIX"
 
+// The env var the message of the day is passed to the notebook in, for the
+// startup scripts of the image to print.
+const MOTDEnvVar = "NOTEBOOK_MOTD"
+
+// The reasons of the events the controller emits on Notebooks, so they can be
+// matched by alerting. Events re-emitted from the Pod and StatefulSet keep
+// their original reason.
+const (
+	EventReasonNotebookCreated          = "NotebookCreated"
+	EventReasonNotebookCreateFailed     = "NotebookCreateFailed"
+	EventReasonQuotaExceeded            = "QuotaExceeded"
+	EventReasonConcurrencyLimited       = "ConcurrencyLimited"
+	EventReasonCullingNotebook          = "CullingNotebook"
+	EventReasonContainerCreatingTimeout = "ContainerCreatingTimeout"
+	EventReasonNoStorageClass           = "NoStorageClass"
+	EventReasonVolumeExpanded           = "VolumeExpanded"
+	EventReasonVolumeExpansionFailed    = "VolumeExpansionFailed"
+	EventReasonVolumeShrinkRejected     = "VolumeShrinkRejected"
+	EventReasonVolumeRecreated          = "VolumeRecreated"
+	EventReasonVolumeMissing            = "VolumeMissing"
+	EventReasonNameTruncated            = "NameTruncated"
+	EventReasonNodeNotFound             = "NodeNotFound"
+	EventReasonLifetimeExceeded         = "LifetimeExceeded"
+	EventReasonTemplateNotFound         = "TemplateNotFound"
+	EventReasonStorageClassNotFound     = "StorageClassNotFound"
+	EventReasonScaleReverted            = "ScaleReverted"
+	EventReasonVolumePending            = "VolumePending"
+	EventReasonExistingVolumeNotFound   = "ExistingVolumeNotFound"
+)
+
+// A notebook runs a single pod, as its ReadWriteOnce volumes can't be shared
+// safely. A StatefulSet scaled past it by hand is scaled back.
+const MaxReplicas = 1
+
+// How the status is read when the StatefulSet runs several pods: from the pod
+// in the worst state, so a failing replica is visible, or from pod-0 only.
+const (
+	PodStatusAggregationWorst = "worst"
+	PodStatusAggregationFirst = "first"
+)
+
+// The condition that is True once every container serving the notebook is
+// Ready. Unlike the container state conditions it is updated in place.
+const NotebookConditionEndpointReady = "EndpointReady"
+
+// The condition that is True once every PVC of the notebook is Bound, and
+// False with the VolumePending reason while one isn't.
+const NotebookConditionVolumeBound = "VolumeBound"
+
+// A PVC still Pending after this many seconds is reported with an event on
+// the Notebook, e.g. when no volume can be provisioned for it.
+// Uses ENV var: VOLUME_PENDING_GRACE_PERIOD
+const DefaultVolumePendingGracePeriod = 120
+
+// Condition reasons and messages longer than this are truncated, so that huge
+// termination messages (e.g. stack traces) don't bloat the Notebook status.
+// Uses ENV var: CONDITION_MESSAGE_MAX_LENGTH
+const DefaultConditionMessageMaxLength = 1024
+
+// A container waiting in ContainerCreating is reported as Pending for this
+// many seconds after the pod is created, e.g. while a large image is pulled.
+// Uses ENV var: CONTAINER_CREATING_GRACE_PERIOD
+const DefaultContainerCreatingGracePeriod = 120
+
+// The seconds a notebook container is given to start serving before its
+// liveness probe takes over, e.g. for multi-GB images activating a conda env.
+// "0" disables the startup probe. Uses ENV var: STARTUP_PROBE_TIMEOUT
+const DefaultStartupProbeTimeout = 600
+
+// The seconds a notebook pod is given to shut its kernels down cleanly when it
+// is culled or deleted, unless the Notebook sets its own.
+// Uses ENV var: NOTEBOOK_TERMINATION_GRACE_PERIOD
+const DefaultTerminationGracePeriod = 30
+
+// Conflicts and AlreadyExists errors, e.g. from racing with the StatefulSet
+// controller, are requeued with a jittered exponential backoff between these
+// delays instead of being returned to controller-runtime.
+const DefaultConflictBaseDelay = 100 * time.Millisecond
+const DefaultConflictMaxDelay = 30 * time.Second
+
+// The default fraction of the limits requested by burstable notebooks.
+// Uses ENV var: BURSTABLE_REQUEST_FRACTION
+const DefaultBurstableRequestFraction = 0.25
+
+// The minimum TLS version of the gatekeeper, one of tlsv1.0, tlsv1.1, tlsv1.2
+// and tlsv1.3. Uses ENV var: GATEKEEPER_TLS_MIN_VERSION
+const DefaultGatekeeperTLSMinVersion = "tlsv1.2"
+
+// The URI pattern protected by the gatekeeper, and the comma-separated roles,
+// as <client>:<role>, a user needs to reach it.
+// Uses ENV var: GATEKEEPER_RESOURCES, GATEKEEPER_ROLES
+const DefaultGatekeeperResources = "/*"
+const DefaultGatekeeperRoles = "notebook-gatekeeper:notebook-gatekeeper-manager"
+
+// The image of the snapshot sidecar, it must provide rclone.
+// Uses ENV var: SNAPSHOT_IMAGE
+const DefaultSnapshotImage = "docker.io/rclone/rclone:1.57"
+
+// The working directory of the notebook container, unless it sets its own.
+// Jupyter serves it, and the snapshot sidecar syncs it.
+// Uses ENV var: DEFAULT_WORKING_DIR
+const DefaultWorkingDir = "/home/jovyan"
+
+// The scratch volume is mounted there, unless the Notebook sets
+// AnnotationScratchPath. Uses ENV var: SCRATCH_PATH
+const DefaultScratchPath = "/scratch"
+
+// The lifetime in seconds of the projected service account tokens, the kubelet
+// rotates them before they expire. Uses ENV var: PROJECTED_TOKEN_EXPIRATION
+const DefaultProjectedTokenExpiration = int64(3600)
+
+// The projected token replaces the default service account token at its usual
+// path, so the Kubernetes clients in the notebook pick it up unchanged.
+const ProjectedTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// A Notebook waiting for its TLS secret to be issued is checked again after
+// this delay, as the secrets aren't watched.
+const TLSSecretRequeueDelay = 5 * time.Second
+
+// The maintenance ConfigMap is read this often, as it isn't watched.
+const MaintenancePollInterval = 30 * time.Second
+
+// The termination message policy of the notebook container, "File" only
+// reports what the notebook writes to its termination message path.
+// Uses ENV var: TERMINATION_MESSAGE_POLICY
+const DefaultTerminationMessagePolicy = corev1.TerminationMessageFallbackToLogsOnError
+
 // The default fsGroup of PodSecurityContext.
 // https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.11/#podsecuritycontext-v1-core
 const DefaultFSGroup = int64(100)
@@ -80,17 +375,103 @@ type NotebookReconciler struct {
 	Scheme        *runtime.Scheme
 	Metrics       *metrics.Metrics
 	EventRecorder record.EventRecorder
+	// APIReader reads the objects that aren't worth caching cluster-wide,
+	// e.g. Secrets, from the API server. The Client is used if it is nil.
+	APIReader client.Reader
+	// CleanupSteps are run in order when a Notebook is deleted. The cleanup
+	// of the Notebook features is run if it is nil.
+	CleanupSteps []CleanupStep
+
+	// Set when the cert-manager Certificate CRD isn't installed, so the
+	// Certificates are skipped instead of failing every reconcile.
+	noCertManager bool
+	// Set when istio is enabled but its VirtualService CRD isn't installed.
+	noIstio bool
+
+	backoffOnce sync.Once
+	backoff     workqueue.RateLimiter
+
+	eventsOnce sync.Once
+	events     *eventCache
+
+	// Unix nanoseconds of the reconciles, for ReconcileHealthCheck.
+	firstReconcile int64
+	lastSuccess    int64
+	lastFailure    int64
 }
 
-// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;delete
+// +kubebuilder:rbac:groups=core,resources=pods/log,verbs=get
+// +kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
+// +kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
 // +kubebuilder:rbac:groups=core,resources=events,verbs=get;list;watch;create
 // +kubebuilder:rbac:groups=core,resources=services,verbs="*"
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;update;delete
+// +kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get
+// +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=storage.k8s.io,resources=storageclasses,verbs=get;list;watch
+// +kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;list;watch;create;update;delete
 // +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs="*"
 // +kubebuilder:rbac:groups=kubeflow.org,resources=notebooks;notebooks/status;notebooks/finalizers,verbs="*"
+// +kubebuilder:rbac:groups=kubeflow.tmax.io,resources=notebooktemplates,verbs=get;list;watch
 // +kubebuilder:rbac:groups="networking.istio.io",resources=virtualservices,verbs="*"
 
 func (r *NotebookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	log := r.Log.WithValues("notebook", req.NamespacedName)
+	result, err := r.doReconcile(ctx, req)
+	if err != nil && isTransientError(err) {
+		delay := wait.Jitter(r.conflictBackoff().When(req.NamespacedName), 0.5)
+		r.Log.WithValues("notebook", req.NamespacedName).Info("Transient error, requeuing",
+			"error", err.Error(), "requeueAfter", delay)
+		return ctrl.Result{RequeueAfter: delay}, nil
+	}
+	if err == nil {
+		r.conflictBackoff().Forget(req.NamespacedName)
+	}
+	r.recordReconcile(err, time.Now())
+	return result, err
+}
+
+// isTransientError returns true for errors that resolve themselves once the
+// cache catches up, so retrying right away only adds load on the API server.
+func isTransientError(err error) bool {
+	return apierrs.IsConflict(err) || apierrs.IsAlreadyExists(err)
+}
+
+// isQuotaExceededError returns true if a create was rejected by a ResourceQuota.
+func isQuotaExceededError(err error) bool {
+	return apierrs.IsForbidden(err) && strings.Contains(err.Error(), "exceeded quota")
+}
+
+// conflictBackoff tracks the transient failures per Notebook.
+func (r *NotebookReconciler) conflictBackoff() workqueue.RateLimiter {
+	r.backoffOnce.Do(func() {
+		r.backoff = workqueue.NewItemExponentialFailureRateLimiter(
+			DefaultConflictBaseDelay, DefaultConflictMaxDelay)
+	})
+	return r.backoff
+}
+
+// eventCache tracks the events re-emitted on Notebooks.
+func (r *NotebookReconciler) eventCache() *eventCache {
+	r.eventsOnce.Do(func() {
+		r.events = newEventCache(DefaultEventCacheSize)
+	})
+	return r.events
+}
+
+// apiReader returns the reader of the uncached objects.
+func (r *NotebookReconciler) apiReader() client.Reader {
+	if r.APIReader != nil {
+		return r.APIReader
+	}
+	return r.Client
+}
+
+func (r *NotebookReconciler) doReconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	// The reconcile ID tells apart the logs of a pass from those of its retries.
+	log := r.Log.WithValues("notebook", req.NamespacedName, "reconcileID", uuid.NewUUID())
 
 	// TODO(yanniszark): Can we avoid reconciling Events and Notebook in the same queue?
 	event := &corev1.Event{}
@@ -112,7 +493,11 @@ func (r *NotebookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 			return ctrl.Result{}, ignoreNotFound(err)
 		}
 
-		// re-emit the event in the Notebook CR
+		// re-emit the event in the Notebook CR, unless it was just re-emitted
+		if r.eventCache().Seen(eventKey(involvedNotebookKey, event), time.Now(), getEventDedupWindow()) {
+			log.Info("Skipping duplicate Notebook Event.", "Event", event.Name)
+			return ctrl.Result{}, nil
+		}
 		log.Info("Emitting Notebook Event.", "Event", event)
 		r.EventRecorder.Eventf(involvedNotebook, event.Type, event.Reason,
 			"Reissued from %s/%s: %s", strings.ToLower(event.InvolvedObject.Kind), event.InvolvedObject.Name, event.Message)
@@ -127,53 +512,197 @@ func (r *NotebookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 	instance := &v1.Notebook{}
 	if err := r.Get(ctx, req.NamespacedName, instance); err != nil {
 		log.Error(err, "unable to fetch Notebook")
+		if apierrs.IsNotFound(err) {
+			r.Metrics.DeleteNotebookState(req.Namespace, req.Name)
+		}
 		return ctrl.Result{}, ignoreNotFound(err)
 	}
+	log = log.WithValues("uid", instance.UID)
 
-	pvc := generatePersistentVolumeClaim(instance)
-
-	// Check if the PersistentVolumeClaim already exists
-	foundPvc := &corev1.PersistentVolumeClaim{}
-	justCreated := false
-	err := r.Get(ctx, types.NamespacedName{Name: pvc.Name, Namespace: pvc.Namespace}, foundPvc)
-	if err != nil && apierrs.IsNotFound(err) {
-		log.Info("Creating PersistentVolumeClaim", "namespace", pvc.Namespace, "name", pvc.Name)
-		err = r.Create(ctx, pvc)
-		justCreated = true
+	if deleted, err := r.reconcileCleanup(ctx, instance, log); err != nil || deleted {
 		if err != nil {
-			log.Error(err, "unable to create PersistentVolumeClaim")
+			log.Error(err, "unable to clean up Notebook")
+		}
+		return ctrl.Result{}, err
+	}
+
+	if instance.Annotations[AnnotationReconcile] == ReconcilePaused {
+		log.Info("Reconciliation is paused, skipping")
+		return ctrl.Result{}, nil
+	}
+
+	if hostLabelRewritten(instance) &&
+		!r.eventCache().Seen(req.NamespacedName.String()+"|"+EventReasonNameTruncated, time.Now(), getEventDedupWindow()) {
+		r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonNameTruncated,
+			"The Notebook name is too long or not a valid DNS label, its host starts with %s",
+			hostLabel(instance))
+	}
+
+	// The pod of a Notebook pinned to a missing node stays pending.
+	if nodeName := instance.Annotations[AnnotationNodeName]; nodeName != "" {
+		err := r.Get(ctx, types.NamespacedName{Name: nodeName}, &corev1.Node{})
+		if err != nil && !apierrs.IsNotFound(err) {
+			log.Error(err, "unable to fetch the pinned Node")
 			return ctrl.Result{}, err
 		}
-	} else if err != nil {
-		log.Error(err, "error getting PersistentVolumeClaim")
+		if apierrs.IsNotFound(err) &&
+			!r.eventCache().Seen(req.NamespacedName.String()+"|"+EventReasonNodeNotFound, time.Now(), getEventDedupWindow()) {
+			r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonNodeNotFound,
+				"The Notebook is pinned to node %s, which doesn't exist", nodeName)
+		}
+	}
+
+	// Stop the notebook while in maintenance mode, and start it again after.
+	maintenance, err := r.maintenanceModeEnabled(ctx)
+	if err != nil {
+		log.Error(err, "unable to read the maintenance mode")
+		return ctrl.Result{}, err
+	}
+	if setMaintenanceStop(instance, maintenance) {
+		log.Info("Updating maintenance stop annotation", "maintenance", maintenance)
+		if err := r.Update(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+		if maintenance {
+			if err := r.recordCull(ctx, instance, CullReasonMaintenance); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	// Stop the notebook once it is older than its maximum lifetime, even if
+	// it is in use. Unlike culling, this doesn't depend on its activity.
+	if lifetime := getMaxLifetime(instance); lifetime > 0 && !culler.StopAnnotationIsSet(instance.ObjectMeta) &&
+		time.Since(instance.CreationTimestamp.Time) > lifetime {
+		log.Info("Notebook exceeded its maximum lifetime. Setting annotations", "maxLifetime", lifetime)
+		culler.SetStopAnnotation(&instance.ObjectMeta, nil)
+		if err := r.Update(ctx, instance); err != nil {
+			return ctrl.Result{}, err
+		}
+		r.EventRecorder.Eventf(instance, corev1.EventTypeNormal, EventReasonLifetimeExceeded,
+			"Stopping the Notebook after its maximum lifetime of %s", lifetime)
+		if err := r.recordCull(ctx, instance, CullReasonLifetime); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// The stops of the controller are recorded as they happen, so any other
+	// was requested by the user, e.g. from the dashboard.
+	if err := r.recordCull(ctx, instance, CullReasonManual); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	for _, claim := range instance.Spec.VolumeClaim {
+		if err := r.reconcilePersistentVolumeClaim(ctx, instance, generatePersistentVolumeClaim(instance, claim)); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if err := r.reconcileVolumeBoundCondition(ctx, instance, log); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.checkExistingVolumeClaims(ctx, instance, log); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// The TLS secret is created by cert-manager from the Certificate, once it
+	// exists only its owners are reconciled. A shared secret is never owned.
+	secretMissing := false
+	if useCertificate(instance) {
+		// Read uncached, a Secret informer would cache every Secret in the cluster.
+		foundSecret := &corev1.Secret{}
+		err := r.apiReader().Get(ctx, types.NamespacedName{Name: tlsSecretName(instance), Namespace: instance.Namespace}, foundSecret)
+		if err == nil {
+			if err := r.reconcileOwnerReference(ctx, instance, foundSecret, reclaimCertSecret()); err != nil {
+				log.Error(err, "unable to update Secret owners")
+				return ctrl.Result{}, err
+			}
+		} else if !apierrs.IsNotFound(err) {
+			log.Error(err, "error getting Secret")
+			return ctrl.Result{}, err
+		} else {
+			secretMissing = true
+		}
+	}
+
+	// Merge the NotebookTemplate the Notebook references, if any.
+	resolved, err := r.resolveNotebookTemplate(ctx, instance)
+	if err != nil {
+		if apierrs.IsNotFound(err) &&
+			!r.eventCache().Seen(req.NamespacedName.String()+"|"+EventReasonTemplateNotFound, time.Now(), getEventDedupWindow()) {
+			r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonTemplateNotFound,
+				"NotebookTemplate %s doesn't exist", instance.Spec.TemplateRef)
+		}
+		log.Error(err, "unable to resolve the NotebookTemplate", "template", instance.Spec.TemplateRef)
+		return ctrl.Result{}, err
+	}
+
+	// Hold a starting notebook back while its namespace runs too many.
+	queued, err := r.reconcileConcurrencyLimit(ctx, instance, log)
+	if err != nil {
 		return ctrl.Result{}, err
 	}
 
 	// Reconcile StatefulSet
-	ss := generateStatefulSet(instance)
+	ss := generateStatefulSet(resolved)
+	if queued {
+		ss.Spec.Replicas = pointer.Int32(0)
+	}
+	injected := istioSidecarInjected(instance, false)
+	if useIstio() {
+		namespaceInjected, err := r.istioInjectionEnabled(ctx, instance.Namespace)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		injected = istioSidecarInjected(instance, namespaceInjected)
+		setIstioSidecarInjection(&ss.Spec.Template, injected)
+	}
 	if err := ctrl.SetControllerReference(instance, ss, r.Scheme); err != nil {
 		return ctrl.Result{}, err
 	}
 	// Check if the StatefulSet already exists
 	foundStateful := &appsv1.StatefulSet{}
-	justCreated = false
+	justCreated := false
+	waitingForSecret := false
 	err = r.Get(ctx, types.NamespacedName{Name: ss.Name, Namespace: ss.Namespace}, foundStateful)
-	if err != nil && apierrs.IsNotFound(err) {
+	if err != nil && apierrs.IsNotFound(err) && secretMissing && waitForTLSSecret() {
+		// The pod would be stuck in ContainerCreating until the Certificate
+		// is issued, so the StatefulSet is only created once it is.
+		log.Info("Waiting for the TLS Secret before creating the StatefulSet", "secret", tlsSecretName(instance))
+		waitingForSecret = true
+	} else if err != nil && apierrs.IsNotFound(err) {
 		log.Info("Creating StatefulSet", "namespace", ss.Namespace, "name", ss.Name)
-		r.Metrics.NotebookCreation.WithLabelValues(ss.Namespace).Inc()
+		r.Metrics.NotebookCreation.WithLabelValues(ss.Namespace, metrics.GPULabel(usesGPU(&ss.Spec.Template.Spec))).Inc()
 		err = r.Create(ctx, ss)
 		justCreated = true
 		if err != nil {
 			log.Error(err, "unable to create Statefulset")
 			r.Metrics.NotebookFailCreation.WithLabelValues(ss.Namespace).Inc()
+			// The create is retried with a backoff, warn once per window.
+			reason := EventReasonNotebookCreateFailed
+			if isQuotaExceededError(err) {
+				reason = EventReasonQuotaExceeded
+			}
+			if (reason == EventReasonQuotaExceeded || !isTransientError(err)) &&
+				!r.eventCache().Seen(req.NamespacedName.String()+"|"+reason, time.Now(), getEventDedupWindow()) {
+				r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, reason,
+					"Unable to create StatefulSet: %v", err)
+			}
 			return ctrl.Result{}, err
 		}
+		r.EventRecorder.Eventf(instance, corev1.EventTypeNormal, EventReasonNotebookCreated,
+			"Created StatefulSet %s", ss.Name)
 	} else if err != nil {
 		log.Error(err, "error getting Statefulset")
 		return ctrl.Result{}, err
 	}
+	if !justCreated && !waitingForSecret && foundStateful.Spec.Replicas != nil && *foundStateful.Spec.Replicas > MaxReplicas {
+		log.Info("Reverting the manual scale of the StatefulSet", "replicas", *foundStateful.Spec.Replicas)
+		r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonScaleReverted,
+			"StatefulSet %s was scaled to %d replicas, it is scaled back to %d as the notebook volumes can't be shared",
+			foundStateful.Name, *foundStateful.Spec.Replicas, *ss.Spec.Replicas)
+	}
 	// Update the foundStateful object and write the result back if there are any changes
-	if !justCreated && reconcilehelper.CopyStatefulSetFields(ss, foundStateful) {
+	if !justCreated && !waitingForSecret && reconcilehelper.CopyStatefulSetFields(ss, foundStateful) {
 		log.Info("Updating StatefulSet", "namespace", ss.Namespace, "name", ss.Name)
 		err = r.Update(ctx, foundStateful)
 		if err != nil {
@@ -181,9 +710,16 @@ func (r *NotebookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 			return ctrl.Result{}, err
 		}
 	}
+	if !justCreated && !waitingForSecret {
+		if err := r.recreateOutdatedPods(ctx, foundStateful, log); err != nil {
+			log.Error(err, "unable to recreate the outdated pods")
+			return ctrl.Result{}, err
+		}
+	}
 
 	// Reconcile service
 	service := generateService(instance)
+	setIstioServicePort(service, injected)
 	if err := ctrl.SetControllerReference(instance, service, r.Scheme); err != nil {
 		return ctrl.Result{}, err
 	}
@@ -212,25 +748,85 @@ func (r *NotebookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 			return ctrl.Result{}, err
 		}
 	}
+	if useHeadlessService(instance) {
+		if err := r.reconcileHeadlessService(ctx, instance, log); err != nil {
+			log.Error(err, "unable to reconcile the headless Service")
+			return ctrl.Result{}, err
+		}
+	} else if err := r.deleteOwnedObject(ctx, instance, &corev1.Service{}, headlessServiceName(instance)); err != nil {
+		return ctrl.Result{}, err
+	}
 
-	// Reconcile Ingress.
-	err = r.reconcileIngress(instance)
+	customDomain := ""
+	if useIngress() || useIstio() {
+		customDomain, err = r.getCustomDomain(ctx, instance.Namespace)
 		if err != nil {
 			return ctrl.Result{}, err
 		}
+	}
 
-	// Reconcile Certificate.
-	err = r.reconcileCertificate(instance)
-	if err != nil {
-		return ctrl.Result{}, err
-	}	
-
-	// Reconcile virtual service if we use ISTIO.
-	if os.Getenv("USE_ISTIO") == "true" {
-		err = r.reconcileVirtualService(instance)
+	if useIngress() {
+		// Reconcile Ingress.
+		err = r.reconcileIngress(ctx, instance, customDomain, log)
 		if err != nil {
 			return ctrl.Result{}, err
 		}
+
+		// Reconcile Certificate, unless the notebooks share a TLS secret.
+		if r.noCertManager {
+			// Without cert-manager there is no Certificate to reconcile.
+		} else if useCertificate(instance) {
+			err = r.reconcileCertificate(ctx, instance, customDomain, log)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+		} else if err := r.deleteOwnedObject(ctx, instance, newCertificateObject(),
+			certificateName(instance.Name, instance.Namespace)); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else {
+		// Ingress is disabled, delete the objects left from a previous mode.
+		if err := r.deleteOwnedObject(ctx, instance, &netv1.Ingress{},
+			ingressName(instance.Name, instance.Namespace)); err != nil {
+			return ctrl.Result{}, err
+		}
+		if !r.noCertManager {
+			if err := r.deleteOwnedObject(ctx, instance, newCertificateObject(),
+				certificateName(instance.Name, instance.Namespace)); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	// Reconcile virtual service if we use ISTIO.
+	if useIstio() {
+		// Without the CRD, as warned at startup, there is nothing to reconcile.
+		if !r.noIstio {
+			err = r.reconcileVirtualService(ctx, instance, customDomain, log)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	} else if err := r.deleteOwnedObject(ctx, instance, newVirtualServiceObject(),
+		virtualServiceName(instance.Name, instance.Namespace)); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if waitingForSecret {
+		return ctrl.Result{RequeueAfter: TLSSecretRequeueDelay}, nil
+	}
+
+	// Observe how long the notebook took to become ready, from its creation
+	// or else from when it was first seen starting.
+	stopped := culler.StopAnnotationIsSet(instance.ObjectMeta) && foundStateful.Status.Replicas == 0
+	if foundStateful.Status.ReadyReplicas == 0 && !culler.StopAnnotationIsSet(instance.ObjectMeta) && !queued {
+		since := time.Now()
+		if instance.Status.ReadyReplicas == 0 && len(instance.Status.Conditions) == 0 && !instance.CreationTimestamp.IsZero() {
+			since = instance.CreationTimestamp.Time
+		}
+		r.Metrics.SetNotebookStarting(instance.Namespace, instance.Name, since)
+	} else if foundStateful.Status.ReadyReplicas > 0 && instance.Status.ReadyReplicas == 0 {
+		r.Metrics.ObserveNotebookStarted(instance.Namespace, instance.Name, time.Now())
 	}
 
 	// Update the readyReplicas if the status is changed
@@ -242,71 +838,154 @@ func (r *NotebookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 			return ctrl.Result{}, err
 		}
 	}
+	r.Metrics.SetNotebookState(instance.Namespace, instance.Name,
+		foundStateful.Status.ReadyReplicas > 0, stopped, usesGPU(&ss.Spec.Template.Spec))
 
 	// Check the pod status
-	pod := &corev1.Pod{}
-	podFound := false
-	err = r.Get(ctx, types.NamespacedName{Name: ss.Name + "-0", Namespace: ss.Namespace}, pod)
-	if err != nil && apierrs.IsNotFound(err) {
+	pod, podFound, err := r.getStatusPod(ctx, ss)
+	if err != nil {
+		return ctrl.Result{}, err
+	} else if !podFound {
 		// This should be reconciled by the StatefulSet
 		log.Info("Pod not found...")
-	} else if err != nil {
-		return ctrl.Result{}, err
 	} else {
 		// Got the pod
-		podFound = true
+		notebookStatus, hasNotebookStatus := notebookContainerStatus(instance, pod)
 
-		if len(pod.Status.ContainerStatuses) > 0 &&
-			pod.Status.ContainerStatuses[0].State != instance.Status.ContainerState {
+		if hasNotebookStatus &&
+			notebookStatus.State != instance.Status.ContainerState {
 			log.Info("Updating container state: ", "namespace", instance.Namespace, "name", instance.Name)
-			cs := pod.Status.ContainerStatuses[0].State
+			cs := notebookStatus.State
 			instance.Status.ContainerState = cs
 			oldConditions := instance.Status.Conditions
+			lastCondition := latestContainerCondition(oldConditions)
 			newCondition := getNextCondition(cs)
+			if containerCreatingIsTransient(pod, cs) {
+				newCondition.Type = "Pending"
+			} else if cs.Waiting != nil && cs.Waiting.Reason == "ContainerCreating" &&
+				lastCondition != nil && lastCondition.Type == "Pending" {
+				r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonContainerCreatingTimeout,
+					"Container is still creating after %s", getContainerCreatingGracePeriod())
+			}
 			// Append new condition
-			if len(oldConditions) == 0 || oldConditions[0].Type != newCondition.Type ||
-				oldConditions[0].Reason != newCondition.Reason ||
-				oldConditions[0].Message != newCondition.Message {
+			if lastCondition == nil || lastCondition.Type != newCondition.Type ||
+				lastCondition.Reason != newCondition.Reason ||
+				lastCondition.Message != newCondition.Message {
 				log.Info("Appending to conditions: ", "namespace", instance.Namespace, "name", instance.Name, "type", newCondition.Type, "reason", newCondition.Reason, "message", newCondition.Message)
 				instance.Status.Conditions = append([]v1.NotebookCondition{newCondition}, oldConditions...)
-
+				if useConditionCompaction() {
+					instance.Status.Conditions = compactConditions(instance.Status.Conditions)
+				}
 			}
 			err = r.Status().Update(ctx, instance)
 			if err != nil {
 				return ctrl.Result{}, err			
 			}
 		}
+
+		if hasNotebookStatus &&
+			setRestartStatus(&instance.Status, notebookStatus) {
+			log.Info("Updating restart status", "namespace", instance.Namespace, "name", instance.Name,
+				"restartCount", instance.Status.RestartCount)
+			err = r.Status().Update(ctx, instance)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
+
+	if setCondition(&instance.Status, getEndpointReadyCondition(instance, pod, podFound)) {
+		err = r.Status().Update(ctx, instance)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Renew the activity Lease while the notebook runs, and drop it otherwise.
+	if useActivityLease() {
+		if podFound && pod.Status.Phase == corev1.PodRunning && !culler.StopAnnotationIsSet(instance.ObjectMeta) {
+			err = r.reconcileActivityLease(ctx, instance, log)
+		} else {
+			err = r.deleteOwnedObject(ctx, instance, &coordinationv1.Lease{}, activityLeaseName(instance.Name))
+		}
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Surface the impending cull in the status, for the dashboard to poll.
+	var cullWarning *metav1.Time
+	if podFound {
+		cullWarning = culler.GetCullWarningTime(instance.ObjectMeta)
+	}
+	if !cullWarning.Equal(instance.Status.CullWarning) {
+		log.Info("Updating cull warning", "namespace", instance.Namespace, "name", instance.Name,
+			"cullWarning", cullWarning)
+		instance.Status.CullWarning = cullWarning
+		err = r.Status().Update(ctx, instance)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
 	}
 
 	if !podFound {
-		// Delete LAST_ACTIVITY_ANNOTATION annotations for CR objects
-		// that do not have a pod.
+		notRunning := ctrl.Result{}
+		if queued {
+			notRunning.RequeueAfter = ConcurrencyLimitRequeueDelay
+		}
+		// Delete LAST_ACTIVITY_ANNOTATION and LAST_EXECUTION_ANNOTATION
+		// annotations for CR objects that do not have a pod.
 		log.Info("Notebook has not Pod running. Will remove last-activity annotation")
 		meta := instance.ObjectMeta
 		if meta.GetAnnotations() == nil {
 			log.Info("No annotations found")
-			return ctrl.Result{}, nil
+			return notRunning, nil
 		}
 
-		if _, ok := meta.GetAnnotations()[culler.LAST_ACTIVITY_ANNOTATION]; !ok {
+		found := false
+		for _, key := range []string{culler.LastActivityAnnotation(), culler.LastExecutionAnnotation()} {
+			if _, ok := meta.GetAnnotations()[key]; ok {
+				delete(meta.GetAnnotations(), key)
+				found = true
+			}
+		}
+		if !found {
 			log.Info("No last-activity annotations found")
-			return ctrl.Result{}, nil
+			return notRunning, nil
 		}
 
 		log.Info("Removing last-activity annotation")
-		delete(meta.GetAnnotations(), culler.LAST_ACTIVITY_ANNOTATION)
 		err = r.Update(ctx, instance)
 		if err != nil {
 			return ctrl.Result{}, err
 		}
-		return ctrl.Result{}, nil
+		return notRunning, nil
 
 	}
 
 	// Pod is found
-	// Check if the Notebook needs to be stopped
-	// Update the LAST_ACTIVIiANNOTATION
-	
+	// Update the LAST_ACTIVITY_ANNOTATION from the kernels of the notebook
+	if culler.CullByKernelActivity() && pod.Status.Phase == corev1.PodRunning &&
+		!culler.StopAnnotationIsSet(instance.ObjectMeta) {
+		if baseURL := jupyterAPIURL(instance, pod); baseURL != "" &&
+			culler.UpdateNotebookLastActivityAnnotation(&instance.ObjectMeta, baseURL) {
+			err = r.Update(ctx, instance)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
+	// Update the LAST_EXECUTION_ANNOTATION while a kernel of the notebook executes
+	if culler.CullByKernelExecution() && pod.Status.Phase == corev1.PodRunning &&
+		!culler.StopAnnotationIsSet(instance.ObjectMeta) {
+		if baseURL := jupyterAPIURL(instance, pod); baseURL != "" &&
+			culler.UpdateNotebookLastExecutionAnnotation(&instance.ObjectMeta, baseURL) {
+			err = r.Update(ctx, instance)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
 
 	// Check if the Notebook needs to be stopped
 	if culler.NotebookNeedsCulling(instance.ObjectMeta) {
@@ -321,6 +1000,11 @@ func (r *NotebookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		if err != nil {
 			return ctrl.Result{}, err
 		}
+		r.EventRecorder.Eventf(instance, corev1.EventTypeNormal, EventReasonCullingNotebook,
+			"Stopping the idle Notebook")
+		if err := r.recordCull(ctx, instance, CullReasonIdle); err != nil {
+			return ctrl.Result{}, err
+		}
 	} else if !culler.StopAnnotationIsSet(instance.ObjectMeta) {
 		// The Pod is either too fresh, or the idle time has passed and it has
 		// received traffic. In this case we will be periodically checking if
@@ -330,100 +1014,1910 @@ func (r *NotebookReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 	return ctrl.Result{RequeueAfter: culler.GetRequeueTime()}, nil
 }
 
-func getNextCondition(cs corev1.ContainerState) v1.NotebookCondition {
-	var nbtype = ""
-	var nbreason = ""
-	var nbmsg = ""
-
-	if cs.Running != nil {
-		nbtype = "Running"
-	} else if cs.Waiting != nil {
-		nbtype = "Waiting"
-		nbreason = cs.Waiting.Reason
-		nbmsg = cs.Waiting.Message
-	} else {
-		nbtype = "Terminated"
-		nbreason = cs.Terminated.Reason
-		nbmsg = cs.Terminated.Reason
+// jupyterAPIURL returns the URL the Jupyter API of the notebook pod is
+// reached at, under the NB_PREFIX it serves with. Without the gatekeeper it
+// goes through the Service. The gatekeeper only lets authenticated users
+// through, so with it enabled the notebook port of the pod is used directly.
+// It returns an empty string if the pod has no IP yet.
+func jupyterAPIURL(instance *v1.Notebook, pod *corev1.Pod) string {
+	prefix := notebookPrefix(instance)
+	for _, container := range pod.Spec.Containers {
+		if container.Name != notebookContainerName(instance) {
+			continue
+		}
+		for _, envVar := range container.Env {
+			if envVar.Name == PrefixEnvVar {
+				prefix = envVar.Value
+			}
+		}
 	}
+	prefix = strings.TrimSuffix(prefix, "/")
 
+	if useGatekeeper() {
+		if pod.Status.PodIP == "" {
+			return ""
+		}
+		return fmt.Sprintf("http://%s%s", net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(int(notebookPort(instance)))), prefix)
+	}
+	clusterDomain := "cluster.local"
+	if clusterDomainFromEnv, ok := os.LookupEnv("CLUSTER_DOMAIN"); ok {
+		clusterDomain = clusterDomainFromEnv
+	}
+	return fmt.Sprintf("http://%s.%s.svc.%s:%d%s", serviceName(instance), instance.Namespace, clusterDomain, HttpsServingPort, prefix)
+}
+
+// getPodStatusAggregation returns how the status is read when the StatefulSet
+// runs several pods. Uses ENV var: POD_STATUS_AGGREGATION
+func getPodStatusAggregation() string {
+	if os.Getenv("POD_STATUS_AGGREGATION") == PodStatusAggregationFirst {
+		return PodStatusAggregationFirst
+	}
+	return PodStatusAggregationWorst
+}
+
+// getStatusPod returns the pod the Notebook status is read from: the pod in
+// the worst state among the pods of the StatefulSet, or pod-0 with
+// PodStatusAggregationFirst. The returned pod is empty if none was found.
+func (r *NotebookReconciler) getStatusPod(ctx context.Context, ss *appsv1.StatefulSet) (*corev1.Pod, bool, error) {
+	pod := &corev1.Pod{}
+	if getPodStatusAggregation() == PodStatusAggregationFirst {
+		err := r.Get(ctx, types.NamespacedName{Name: ss.Name + "-0", Namespace: ss.Namespace}, pod)
+		if apierrs.IsNotFound(err) {
+			return pod, false, nil
+		}
+		return pod, err == nil, err
+	}
+
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(ss.Namespace),
+		client.MatchingLabels(ss.Spec.Selector.MatchLabels)); err != nil {
+		return pod, false, err
+	}
+	if len(pods.Items) == 0 {
+		return pod, false, nil
+	}
+	// Ties go to the lowest ordinal, so a healthy StatefulSet reports pod-0.
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[i].Name < pods.Items[j].Name
+	})
+	worst := &pods.Items[0]
+	for i := range pods.Items[1:] {
+		if podSeverity(&pods.Items[i+1]) > podSeverity(worst) {
+			worst = &pods.Items[i+1]
+		}
+	}
+	return worst, true, nil
+}
+
+// podSeverity ranks a pod by the state of its worst container, from 0 for
+// ready containers to 4 for a terminated one. The container statuses are
+// sorted by name, so the notebook container can be anywhere among them.
+func podSeverity(pod *corev1.Pod) int {
+	if len(pod.Status.ContainerStatuses) == 0 {
+		return 1
+	}
+	severity := 0
+	for _, cs := range pod.Status.ContainerStatuses {
+		if s := containerSeverity(cs); s > severity {
+			severity = s
+		}
+	}
+	return severity
+}
+
+func containerSeverity(cs corev1.ContainerStatus) int {
+	switch {
+	case cs.State.Terminated != nil:
+		return 4
+	case cs.State.Waiting != nil && cs.State.Waiting.Reason != "ContainerCreating" &&
+		cs.State.Waiting.Reason != "PodInitializing":
+		return 3
+	case cs.State.Waiting != nil:
+		return 2
+	case !cs.Ready:
+		return 1
+	}
+	return 0
+}
+
+// notebookContainerStatus returns the status of the notebook container in the
+// pod, if it has one yet.
+func notebookContainerStatus(instance *v1.Notebook, pod *corev1.Pod) (corev1.ContainerStatus, bool) {
+	name := notebookContainerName(instance)
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.Name == name {
+			return cs, true
+		}
+	}
+	return corev1.ContainerStatus{}, false
+}
+
+// recreateOutdatedPods deletes the pods of the StatefulSet running another
+// image than its template, so the StatefulSet recreates them with the new
+// one. With OnDelete all of them are, while a rolling update only leaves the
+// pods that aren't ready, as it waits on them forever, e.g. for a bad image.
+func (r *NotebookReconciler) recreateOutdatedPods(ctx context.Context, ss *appsv1.StatefulSet, log logr.Logger) error {
+	if ss.Spec.Selector == nil || len(ss.Spec.Template.Spec.Containers) == 0 {
+		return nil
+	}
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(ss.Namespace),
+		client.MatchingLabels(ss.Spec.Selector.MatchLabels)); err != nil {
+		return err
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !pod.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if ss.Spec.UpdateStrategy.Type != appsv1.OnDeleteStatefulSetStrategyType && podSeverity(pod) == 0 {
+			continue
+		}
+		for _, c := range pod.Spec.Containers {
+			container := findContainerByName(ss.Spec.Template.Spec.Containers, c.Name)
+			if container == nil || c.Image == container.Image {
+				continue
+			}
+			log.Info("Deleting outdated pod", "pod", pod.Name, "image", c.Image, "desiredImage", container.Image)
+			if err := r.Delete(ctx, pod); err != nil && !apierrs.IsNotFound(err) {
+				return err
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// maintenanceConfigMap returns the key of the ConfigMap that toggles the
+// maintenance mode, read from MAINTENANCE_CONFIGMAP as <namespace>/<name>.
+func maintenanceConfigMap() (types.NamespacedName, bool) {
+	parts := strings.SplitN(os.Getenv("MAINTENANCE_CONFIGMAP"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return types.NamespacedName{}, false
+	}
+	return types.NamespacedName{Namespace: parts[0], Name: parts[1]}, true
+}
+
+// maintenanceModeEnabled returns true if the maintenance ConfigMap exists and
+// its "enabled" key is "true". Operators set it before e.g. a cluster upgrade
+// to stop every notebook at once.
+func (r *NotebookReconciler) maintenanceModeEnabled(ctx context.Context) (bool, error) {
+	key, ok := maintenanceConfigMap()
+	if !ok {
+		return false, nil
+	}
+	cm := &corev1.ConfigMap{}
+	if err := r.apiReader().Get(ctx, key, cm); err != nil {
+		return false, ignoreNotFound(err)
+	}
+	return cm.Data["enabled"] == "true", nil
+}
+
+// pollMaintenanceMode reads the maintenance mode every interval, and sends an
+// event to reconcile every Notebook when it changes. The ConfigMap is polled
+// rather than watched, as a ConfigMap informer caches every ConfigMap in the
+// cluster.
+func (r *NotebookReconciler) pollMaintenanceMode(ctx context.Context, interval time.Duration,
+	events chan<- event.GenericEvent) error {
+	key, _ := maintenanceConfigMap()
+	// Every Notebook is reconciled at startup, with the current mode.
+	enabled, err := r.maintenanceModeEnabled(ctx)
+	if err != nil {
+		r.Log.Error(err, "unable to read the maintenance mode")
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		current, err := r.maintenanceModeEnabled(ctx)
+		if err != nil {
+			r.Log.Error(err, "unable to read the maintenance mode")
+			continue
+		}
+		if current == enabled {
+			continue
+		}
+		enabled = current
+		r.Log.Info("Maintenance mode changed", "enabled", enabled)
+		cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}
+		select {
+		case events <- event.GenericEvent{Object: cm}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// setMaintenanceStop stops the Notebook during maintenance, also if a user
+// tries to start it, and starts it again afterwards if it was stopped by the
+// maintenance mode. Returns true if the annotations changed.
+func setMaintenanceStop(instance *v1.Notebook, maintenance bool) bool {
+	_, stoppedByMaintenance := instance.ObjectMeta.Annotations[AnnotationMaintenanceStopped]
+	if maintenance {
+		if culler.StopAnnotationIsSet(instance.ObjectMeta) {
+			return false
+		}
+		culler.SetStopAnnotation(&instance.ObjectMeta, nil)
+		instance.ObjectMeta.Annotations[AnnotationMaintenanceStopped] = "true"
+		return true
+	}
+	if !stoppedByMaintenance {
+		return false
+	}
+	delete(instance.ObjectMeta.Annotations, culler.StopAnnotation())
+	delete(instance.ObjectMeta.Annotations, AnnotationMaintenanceStopped)
+	return true
+}
+
+// getMaxLifetime returns how long a Notebook may exist before it is stopped,
+// from AnnotationMaxLifetime or else MAX_NOTEBOOK_LIFETIME. It returns 0, for
+// no limit, if neither is a valid duration.
+func getMaxLifetime(instance *v1.Notebook) time.Duration {
+	value, ok := instance.ObjectMeta.Annotations[AnnotationMaxLifetime]
+	if !ok {
+		value = os.Getenv("MAX_NOTEBOOK_LIFETIME")
+	}
+	if lifetime, err := time.ParseDuration(value); err == nil && lifetime > 0 {
+		return lifetime
+	}
+	return 0
+}
+
+// The reasons of the entries of the Notebook status CullHistory.
+const (
+	CullReasonIdle        = "Idle"
+	CullReasonLifetime    = "Lifetime"
+	CullReasonMaintenance = "Maintenance"
+	CullReasonManual      = "Manual"
+)
+
+// The stops kept in the Notebook status CullHistory.
+// Uses ENV var: CULL_HISTORY_LIMIT
+const DefaultCullHistoryLimit = 10
+
+func getCullHistoryLimit() int {
+	if limit, err := strconv.Atoi(os.Getenv("CULL_HISTORY_LIMIT")); err == nil && limit >= 0 {
+		return limit
+	}
+	return DefaultCullHistoryLimit
+}
+
+// appendCullHistory records the stop of the Notebook in its status, at the
+// time of its stop annotation, unless it is already recorded. The oldest
+// entries are dropped past CULL_HISTORY_LIMIT. Returns true if the status
+// changed.
+func appendCullHistory(instance *v1.Notebook, reason string) bool {
+	if !culler.StopAnnotationIsSet(instance.ObjectMeta) {
+		return false
+	}
+	stopped, err := time.Parse(time.RFC3339, instance.ObjectMeta.Annotations[culler.StopAnnotation()])
+	if err != nil {
+		// Record a stop annotation that isn't a timestamp once.
+		if len(instance.Status.CullHistory) > 0 {
+			return false
+		}
+		stopped = time.Now().Truncate(time.Second)
+	}
+	history := instance.Status.CullHistory
+	if len(history) > 0 && !history[len(history)-1].Time.Time.Before(stopped) {
+		return false
+	}
+
+	history = append(history, v1.NotebookCullRecord{Time: metav1.NewTime(stopped), Reason: reason})
+	if limit := getCullHistoryLimit(); len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	if len(history) == 0 {
+		history = nil
+	}
+	instance.Status.CullHistory = history
+	return true
+}
+
+// recordCull records the stop of the Notebook in its status CullHistory.
+func (r *NotebookReconciler) recordCull(ctx context.Context, instance *v1.Notebook, reason string) error {
+	if !appendCullHistory(instance, reason) {
+		return nil
+	}
+	return r.Status().Update(ctx, instance)
+}
+
+// recreatePVC returns true if a PVC deleted while its Notebook exists is
+// recreated empty, so that the notebook can start again. Otherwise the
+// notebook waits for the PVC to be restored. Uses ENV var: RECREATE_PVC
+func recreatePVC() bool {
+	return os.Getenv("RECREATE_PVC") == "true"
+}
+
+// reclaimPVC returns true if the PVC is owned by the Notebook, and so deleted
+// with it. Otherwise it is orphaned to keep the data. Uses ENV var:
+// DELETE_PVC_ON_NOTEBOOK_DELETE, or its former name RECLAIM_PVC if unset.
+func reclaimPVC() bool {
+	if value, ok := os.LookupEnv("DELETE_PVC_ON_NOTEBOOK_DELETE"); ok {
+		return value == "true"
+	}
+	return os.Getenv("RECLAIM_PVC") == "true"
+}
+
+// waitForTLSSecret returns true if the StatefulSet of a Notebook is only
+// created once the TLS secret is issued from its Certificate. The Certificate
+// is only created with the Ingress. Uses ENV var: WAIT_FOR_TLS_SECRET
+func waitForTLSSecret() bool {
+	return useIngress() && os.Getenv("WAIT_FOR_TLS_SECRET") == "true"
+}
+
+// reclaimCertSecret returns true if the TLS secret issued for the Notebook is
+// owned by it, and so deleted with it. Uses ENV var: RECLAIM_CERT_SECRET
+func reclaimCertSecret() bool {
+	return os.Getenv("RECLAIM_CERT_SECRET") == "true"
+}
+
+// hasDefaultStorageClass returns true if a StorageClass is marked as the
+// cluster default, which PVCs without a storage class are bound with.
+func (r *NotebookReconciler) hasDefaultStorageClass(ctx context.Context) (bool, error) {
+	storageClasses := &storagev1.StorageClassList{}
+	if err := r.List(ctx, storageClasses); err != nil {
+		return false, err
+	}
+	for _, sc := range storageClasses.Items {
+		if sc.Annotations["storageclass.kubernetes.io/is-default-class"] == "true" ||
+			sc.Annotations["storageclass.beta.kubernetes.io/is-default-class"] == "true" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// useActivityLease returns true if a Lease is renewed for every running
+// Notebook, so other systems can watch it for liveness without scraping the
+// notebook. Uses ENV var: ENABLE_ACTIVITY_LEASE
+func useActivityLease() bool {
+	return os.Getenv("ENABLE_ACTIVITY_LEASE") == "true"
+}
+
+func activityLeaseName(kfName string) string {
+	return fmt.Sprintf("%s-activity", kfName)
+}
+
+// reconcileActivityLease creates or renews the activity Lease of the Notebook.
+// It expires if it isn't renewed for two reconcile periods.
+func (r *NotebookReconciler) reconcileActivityLease(ctx context.Context, instance *v1.Notebook, log logr.Logger) error {
+	holder := "notebook-controller"
+	duration := int32(2 * culler.GetRequeuePeriod() / time.Second)
+	now := metav1.NewMicroTime(time.Now())
+
+	lease := &coordinationv1.Lease{}
+	err := r.Get(ctx, types.NamespacedName{Name: activityLeaseName(instance.Name), Namespace: instance.Namespace}, lease)
+	if err != nil && apierrs.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      activityLeaseName(instance.Name),
+				Namespace: instance.Namespace,
+				Labels:    controllerLabels(instance),
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &holder,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		if err := ctrl.SetControllerReference(instance, lease, r.Scheme); err != nil {
+			return err
+		}
+		log.Info("Creating activity Lease", "namespace", lease.Namespace, "name", lease.Name)
+		return r.Create(ctx, lease)
+	} else if err != nil {
+		log.Error(err, "error getting activity Lease")
+		return err
+	}
+
+	lease.Spec.HolderIdentity = &holder
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &now
+	return r.Update(ctx, lease)
+}
+
+// reconcilePersistentVolumeClaim creates the PVC if it doesn't exist, and
+// recreates it if it was deleted while the Notebook exists. An existing PVC is
+// only updated to expand it, apart from its owners.
+func (r *NotebookReconciler) reconcilePersistentVolumeClaim(ctx context.Context, instance *v1.Notebook, pvc *corev1.PersistentVolumeClaim) error {
+	log := r.Log.WithValues("notebook", types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+	foundPvc := &corev1.PersistentVolumeClaim{}
+	err := r.Get(ctx, types.NamespacedName{Name: pvc.Name, Namespace: pvc.Namespace}, foundPvc)
+	if err != nil && apierrs.IsNotFound(err) {
+		// The PVCs are created before the StatefulSet, so if its pods already
+		// mount the PVC it was deleted afterwards. A claim added to an
+		// existing Notebook isn't mounted yet, and is just created.
+		foundStateful := &appsv1.StatefulSet{}
+		err = r.Get(ctx, types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}, foundStateful)
+		if err != nil && !apierrs.IsNotFound(err) {
+			log.Error(err, "error getting Statefulset")
+			return err
+		}
+		if err == nil && mountsClaim(&foundStateful.Spec.Template.Spec, pvc.Name) {
+			if !recreatePVC() {
+				key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}.String() + "|" +
+					EventReasonVolumeMissing + "|" + pvc.Name
+				if !r.eventCache().Seen(key, time.Now(), getEventDedupWindow()) {
+					r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonVolumeMissing,
+						"PersistentVolumeClaim %s was deleted, set RECREATE_PVC to recreate it", pvc.Name)
+				}
+				return nil
+			}
+			log.Info("Recreating deleted PersistentVolumeClaim", "namespace", pvc.Namespace, "name", pvc.Name)
+			r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonVolumeRecreated,
+				"PersistentVolumeClaim %s was deleted and is recreated empty, its data may be lost", pvc.Name)
+		}
+		log.Info("Creating PersistentVolumeClaim", "namespace", pvc.Namespace, "name", pvc.Name)
+		if pvc.Spec.StorageClassName == nil {
+			found, err := r.hasDefaultStorageClass(ctx)
+			if err != nil {
+				log.Error(err, "unable to list StorageClasses")
+			} else if !found {
+				r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonNoStorageClass,
+					"PersistentVolumeClaim %s has no storage class and the cluster has no default one, set DEFAULT_STORAGE_CLASS", pvc.Name)
+			}
+		} else if err := r.checkStorageClass(ctx, instance, pvc, log); err != nil {
+			return err
+		}
+		if reclaimPVC() {
+			if err := controllerutil.SetOwnerReference(instance, pvc, r.Scheme); err != nil {
+				return err
+			}
+		}
+		if err := r.Create(ctx, pvc); err != nil {
+			log.Error(err, "unable to create PersistentVolumeClaim")
+			return err
+		}
+		return nil
+	} else if err != nil {
+		log.Error(err, "error getting PersistentVolumeClaim")
+		return err
+	}
+
+	if err := r.reconcileOwnerReference(ctx, instance, foundPvc, reclaimPVC()); err != nil {
+		log.Error(err, "unable to update PersistentVolumeClaim owners")
+		return err
+	}
+	if foundPvc.Status.Phase == corev1.ClaimPending && foundPvc.Spec.StorageClassName != nil {
+		if err := r.checkStorageClass(ctx, instance, foundPvc, log); err != nil {
+			return err
+		}
+	}
+	return r.reconcilePersistentVolumeClaimSize(ctx, instance, pvc, foundPvc, log)
+}
+
+func getVolumePendingGracePeriod() time.Duration {
+	period := DefaultVolumePendingGracePeriod
+	if value, ok := os.LookupEnv("VOLUME_PENDING_GRACE_PERIOD"); ok {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			period = seconds
+		}
+	}
+	return time.Duration(period) * time.Second
+}
+
+// reconcileVolumeBoundCondition reflects the phase of the notebook PVCs in
+// the VolumeBound condition, and warns when one stays Pending past
+// VOLUME_PENDING_GRACE_PERIOD. PVCs without a phase yet are left out.
+func (r *NotebookReconciler) reconcileVolumeBoundCondition(ctx context.Context, instance *v1.Notebook, log logr.Logger) error {
+	condition := v1.NotebookCondition{
+		Type:          NotebookConditionVolumeBound,
+		LastProbeTime: metav1.Now(),
+		Status:        corev1.ConditionTrue,
+	}
+	known := false
+	var pending []string
+	for _, claim := range instance.Spec.VolumeClaim {
+		pvc := &corev1.PersistentVolumeClaim{}
+		err := r.Get(ctx, types.NamespacedName{Name: claim.Name, Namespace: instance.Namespace}, pvc)
+		if apierrs.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			log.Error(err, "error getting PersistentVolumeClaim")
+			return err
+		}
+		switch pvc.Status.Phase {
+		case corev1.ClaimBound:
+			known = true
+		case corev1.ClaimPending, corev1.ClaimLost:
+			known = true
+			pending = append(pending, fmt.Sprintf("%s is %s", pvc.Name, pvc.Status.Phase))
+			key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}.String() + "|" +
+				EventReasonVolumePending + "|" + pvc.Name
+			if !pvc.CreationTimestamp.IsZero() && time.Since(pvc.CreationTimestamp.Time) > getVolumePendingGracePeriod() &&
+				!r.eventCache().Seen(key, time.Now(), getEventDedupWindow()) {
+				r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonVolumePending,
+					"PersistentVolumeClaim %s is still %s after %s", pvc.Name, pvc.Status.Phase,
+					time.Since(pvc.CreationTimestamp.Time).Round(time.Second))
+			}
+		}
+	}
+	if !known {
+		return nil
+	}
+	if len(pending) > 0 {
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "VolumePending"
+		condition.Message = "persistent volume claims not bound: " + strings.Join(pending, ", ")
+	}
+	if setCondition(&instance.Status, condition) {
+		log.Info("Updating the VolumeBound condition", "status", condition.Status)
+		return r.Status().Update(ctx, instance)
+	}
+	return nil
+}
+
+// checkStorageClass emits a warning on the Notebook when the storage class of
+// the PVC doesn't exist, as the PVC then stays Pending without a clear reason.
+// The PVC is still created, so it binds once the class is added.
+func (r *NotebookReconciler) checkStorageClass(ctx context.Context, instance *v1.Notebook,
+	pvc *corev1.PersistentVolumeClaim, log logr.Logger) error {
+	name := *pvc.Spec.StorageClassName
+	if name == "" {
+		// Binds to a pre-provisioned volume without a class.
+		return nil
+	}
+	err := r.Get(ctx, types.NamespacedName{Name: name}, &storagev1.StorageClass{})
+	if err == nil {
+		return nil
+	} else if !apierrs.IsNotFound(err) {
+		log.Error(err, "error getting StorageClass")
+		return err
+	}
+	key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}.String() + "|" +
+		EventReasonStorageClassNotFound + "|" + pvc.Name
+	if !r.eventCache().Seen(key, time.Now(), getEventDedupWindow()) {
+		r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonStorageClassNotFound,
+			"StorageClass %s of PersistentVolumeClaim %s not found", name, pvc.Name)
+	}
+	return nil
+}
+
+// checkExistingVolumeClaims emits an event for each existing PVC of the
+// Notebook that isn't found, as the notebook pod then stays Pending. The PVCs
+// are never created nor owned, their lifecycle is managed by their users.
+func (r *NotebookReconciler) checkExistingVolumeClaims(ctx context.Context, instance *v1.Notebook, log logr.Logger) error {
+	for _, claim := range instance.Spec.ExistingVolumeClaims {
+		if claim.ClaimName == "" {
+			continue
+		}
+		err := r.Get(ctx, types.NamespacedName{Name: claim.ClaimName, Namespace: instance.Namespace}, &corev1.PersistentVolumeClaim{})
+		if err == nil {
+			continue
+		} else if !apierrs.IsNotFound(err) {
+			log.Error(err, "error getting PersistentVolumeClaim")
+			return err
+		}
+		key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}.String() + "|" +
+			EventReasonExistingVolumeNotFound + "|" + claim.ClaimName
+		if !r.eventCache().Seen(key, time.Now(), getEventDedupWindow()) {
+			r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonExistingVolumeNotFound,
+				"Existing PersistentVolumeClaim %s mounted at %s not found", claim.ClaimName, claim.MountPath)
+		}
+	}
+	return nil
+}
+
+// reconcilePersistentVolumeClaimSize expands an existing PVC when the Notebook
+// requests more storage and its storage class allows it. Volumes can't shrink,
+// so a smaller request is only reported with an event.
+func (r *NotebookReconciler) reconcilePersistentVolumeClaimSize(ctx context.Context, instance *v1.Notebook,
+	pvc *corev1.PersistentVolumeClaim, foundPvc *corev1.PersistentVolumeClaim, log logr.Logger) error {
+	requested := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	current := foundPvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	// The warnings repeat on every reconcile until the request changes.
+	warningSeen := func(reason string) bool {
+		key := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}.String() + "|" +
+			reason + "|" + foundPvc.Name
+		return r.eventCache().Seen(key, time.Now(), getEventDedupWindow())
+	}
+	switch requested.Cmp(current) {
+	case 0:
+		return nil
+	case -1:
+		if !warningSeen(EventReasonVolumeShrinkRejected) {
+			r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonVolumeShrinkRejected,
+				"PersistentVolumeClaim %s can't shrink from %s to %s", foundPvc.Name, current.String(), requested.String())
+		}
+		return nil
+	}
+
+	expandable := false
+	if foundPvc.Spec.StorageClassName != nil {
+		sc := &storagev1.StorageClass{}
+		if err := r.Get(ctx, types.NamespacedName{Name: *foundPvc.Spec.StorageClassName}, sc); err != nil {
+			if !apierrs.IsNotFound(err) {
+				log.Error(err, "error getting StorageClass")
+				return err
+			}
+		} else {
+			expandable = sc.AllowVolumeExpansion != nil && *sc.AllowVolumeExpansion
+		}
+	}
+	if !expandable {
+		if !warningSeen(EventReasonVolumeExpansionFailed) {
+			r.EventRecorder.Eventf(instance, corev1.EventTypeWarning, EventReasonVolumeExpansionFailed,
+				"PersistentVolumeClaim %s can't expand to %s, its storage class doesn't allow volume expansion",
+				foundPvc.Name, requested.String())
+		}
+		return nil
+	}
+
+	log.Info("Expanding PersistentVolumeClaim", "namespace", foundPvc.Namespace, "name", foundPvc.Name,
+		"from", current.String(), "to", requested.String())
+	patch := client.MergeFrom(foundPvc.DeepCopy())
+	foundPvc.Spec.Resources.Requests[corev1.ResourceStorage] = requested
+	if err := r.Patch(ctx, foundPvc, patch); err != nil {
+		log.Error(err, "unable to expand PersistentVolumeClaim")
+		return err
+	}
+	r.EventRecorder.Eventf(instance, corev1.EventTypeNormal, EventReasonVolumeExpanded,
+		"Expanded PersistentVolumeClaim %s from %s to %s", foundPvc.Name, current.String(), requested.String())
+	return nil
+}
+
+// reconcileOwnerReference adds the Notebook to the owners of obj if owned is
+// true, and removes it otherwise. The reference isn't a controller reference,
+// since the object may already be controlled by someone else (e.g. the
+// Certificate for the TLS secret).
+func (r *NotebookReconciler) reconcileOwnerReference(ctx context.Context, instance *v1.Notebook, obj client.Object, owned bool) error {
+	isOwner := false
+	refs := []metav1.OwnerReference{}
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.UID == instance.UID {
+			isOwner = true
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	if owned == isOwner {
+		return nil
+	}
+
+	if owned {
+		if err := controllerutil.SetOwnerReference(instance, obj, r.Scheme); err != nil {
+			return err
+		}
+	} else {
+		obj.SetOwnerReferences(refs)
+	}
+	r.Log.Info("Updating owners", "namespace", obj.GetNamespace(), "name", obj.GetName(), "owned", owned)
+	return r.Update(ctx, obj)
+}
+
+// useCertificate returns true if a cert-manager Certificate is issued for the
+// Notebook. Uses ENV var: SHARED_TLS_SECRET, the name of an existing wildcard
+// TLS secret used by all notebooks instead.
+func useCertificate(instance *v1.Notebook) bool {
+	return os.Getenv("SHARED_TLS_SECRET") == "" &&
+		instance.ObjectMeta.Annotations[AnnotationDisableCertificate] != "true"
+}
+
+// tlsSecretName returns the name of the TLS secret mounted into the notebook
+// pod: the one issued from the Certificate, the shared secret, or an empty
+// string if there is none.
+func tlsSecretName(instance *v1.Notebook) string {
+	if shared := os.Getenv("SHARED_TLS_SECRET"); shared != "" {
+		return shared
+	}
+	if !useCertificate(instance) {
+		return ""
+	}
+	if host := externalHostname(instance); host != "" {
+		return strings.ReplaceAll(host, ".", "-") + "-tls"
+	}
+	return fmt.Sprintf("%s-secret", instance.Name)
+}
+
+// externalHostname returns the hostname of AnnotationExternalHostname, or ""
+// if it isn't set or isn't a valid DNS name.
+func externalHostname(instance *v1.Notebook) string {
+	host := strings.ToLower(instance.ObjectMeta.Annotations[AnnotationExternalHostname])
+	if host == "" || len(validation.IsDNS1123Subdomain(host)) > 0 {
+		return ""
+	}
+	return host
+}
+
+// exposeMode returns the networking path selected with EXPOSE_MODE, or an
+// empty string if it isn't set to a known mode.
+func exposeMode() string {
+	switch mode := os.Getenv("EXPOSE_MODE"); mode {
+	case ExposeModeIngress, ExposeModeIstio, ExposeModeNone:
+		return mode
+	default:
+		return ""
+	}
+}
+
+// useIngress returns true if notebooks are exposed through an Ingress and a
+// Certificate. Uses ENV var: EXPOSE_MODE, or USE_INGRESS if EXPOSE_MODE isn't
+// set, enabled unless set to "false".
+func useIngress() bool {
+	if mode := exposeMode(); mode != "" {
+		return mode == ExposeModeIngress
+	}
+	return os.Getenv("USE_INGRESS") != "false"
+}
+
+// useIstio returns true if notebooks are exposed through an istio
+// VirtualService. Uses ENV var: EXPOSE_MODE, or USE_ISTIO if EXPOSE_MODE isn't
+// set.
+func useIstio() bool {
+	if mode := exposeMode(); mode != "" {
+		return mode == ExposeModeIstio
+	}
+	return os.Getenv("USE_ISTIO") == "true"
+}
+
+// useGatekeeper returns true if the gatekeeper sidecar fronts the notebooks.
+// Without it, the Service exposes the notebook port directly.
+// Uses ENV var: ENABLE_GATEKEEPER
+func useGatekeeper() bool {
+	return os.Getenv("ENABLE_GATEKEEPER") != "false"
+}
+
+// deleteOwnedObject deletes the named object if it exists and is controlled by
+// the Notebook, so that objects created by the Notebook in a previously enabled
+// networking mode don't linger.
+func (r *NotebookReconciler) deleteOwnedObject(ctx context.Context, instance *v1.Notebook, obj client.Object, name string) error {
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: instance.Namespace}, obj)
+	if meta.IsNoMatchError(err) {
+		// The CRD isn't installed, so there is nothing to clean up
+		return nil
+	} else if err != nil {
+		return ignoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(obj, instance) {
+		return nil
+	}
+	r.Log.Info("Deleting stale object", "namespace", instance.Namespace, "name", name,
+		"kind", obj.GetObjectKind().GroupVersionKind().Kind)
+	return ignoreNotFound(r.Delete(ctx, obj))
+}
+
+func getNextCondition(cs corev1.ContainerState) v1.NotebookCondition {
+	var nbtype = ""
+	var nbreason = ""
+	var nbmsg = ""
+
+	if cs.Running != nil {
+		nbtype = "Running"
+	} else if cs.Waiting != nil {
+		nbtype = "Waiting"
+		nbreason = cs.Waiting.Reason
+		nbmsg = cs.Waiting.Message
+	} else if cs.Terminated != nil {
+		nbtype = "Terminated"
+		nbreason = cs.Terminated.Reason
+		nbmsg = fmt.Sprintf("exit code %d", cs.Terminated.ExitCode)
+		if cs.Terminated.Message != "" {
+			nbmsg = fmt.Sprintf("%s (exit code %d)", cs.Terminated.Message, cs.Terminated.ExitCode)
+		}
+	} else {
+		// No state is reported yet, the kubelet defaults such containers to
+		// waiting.
+		nbtype = "Waiting"
+	}
+
+	maxLength := getConditionMessageMaxLength()
 	newCondition := v1.NotebookCondition{
 		Type:          nbtype,
 		LastProbeTime: metav1.Now(),
-		Reason:        nbreason,
-		Message:       nbmsg,
+		Reason:        truncateMessage(nbreason, maxLength),
+		Message:       truncateMessage(nbmsg, maxLength),
+	}
+	return newCondition
+}
+
+// setRestartStatus copies the restart count and the last termination of the
+// container into the status, so crash-looping kernels can be debugged from the
+// Notebook. Returns true if the status changed.
+func setRestartStatus(status *v1.NotebookStatus, cs corev1.ContainerStatus) bool {
+	reason, exitCode := "", int32(0)
+	if terminated := cs.LastTerminationState.Terminated; terminated != nil {
+		reason, exitCode = terminated.Reason, terminated.ExitCode
+	}
+	if status.RestartCount == cs.RestartCount && status.LastTerminationReason == reason &&
+		status.LastTerminationExitCode == exitCode {
+		return false
+	}
+	status.RestartCount = cs.RestartCount
+	status.LastTerminationReason = reason
+	status.LastTerminationExitCode = exitCode
+	return true
+}
+
+// latestContainerCondition returns the most recent container state condition,
+// or nil if there is none.
+func latestContainerCondition(conditions []v1.NotebookCondition) *v1.NotebookCondition {
+	for i := range conditions {
+		if conditions[i].Status == "" {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
+
+// useConditionCompaction returns true if runs of container state conditions
+// of the same type are compacted. Uses ENV var: CONDITION_COMPACTION
+func useConditionCompaction() bool {
+	return os.Getenv("CONDITION_COMPACTION") == "true"
+}
+
+// compactConditions collapses each run of consecutive container state
+// conditions of the same type, e.g. a pod flapping between ErrImagePull and
+// ImagePullBackOff, into its newest entry. The entry counts the conditions of
+// the run, and keeps the probe time of the oldest as FirstProbeTime.
+func compactConditions(conditions []v1.NotebookCondition) []v1.NotebookCondition {
+	compacted := make([]v1.NotebookCondition, 0, len(conditions))
+	for _, condition := range conditions {
+		if condition.Count == 0 {
+			condition.Count = 1
+		}
+		if condition.FirstProbeTime.IsZero() {
+			condition.FirstProbeTime = condition.LastProbeTime
+		}
+		if last := len(compacted) - 1; last >= 0 && condition.Status == "" &&
+			compacted[last].Status == "" && compacted[last].Type == condition.Type {
+			compacted[last].Count += condition.Count
+			compacted[last].FirstProbeTime = condition.FirstProbeTime
+			continue
+		}
+		compacted = append(compacted, condition)
+	}
+	return compacted
+}
+
+// setCondition updates the condition of the same type in place, or appends it.
+// Returns true if the status changed.
+func setCondition(status *v1.NotebookStatus, condition v1.NotebookCondition) bool {
+	for i := range status.Conditions {
+		existing := &status.Conditions[i]
+		if existing.Type != condition.Type {
+			continue
+		}
+		if existing.Status == condition.Status && existing.Reason == condition.Reason &&
+			existing.Message == condition.Message {
+			return false
+		}
+		*existing = condition
+		return true
+	}
+	status.Conditions = append(status.Conditions, condition)
+	return true
+}
+
+// getEndpointReadyCondition returns the EndpointReady condition of the pod.
+// The notebook container can pass its probe before the gatekeeper finished the
+// OIDC discovery, so the gatekeeper has to be Ready as well.
+func getEndpointReadyCondition(instance *v1.Notebook, pod *corev1.Pod, podFound bool) v1.NotebookCondition {
+	condition := v1.NotebookCondition{
+		Type:          NotebookConditionEndpointReady,
+		LastProbeTime: metav1.Now(),
+		Status:        corev1.ConditionFalse,
+	}
+	if !podFound {
+		condition.Reason = "PodNotFound"
+		return condition
+	}
+
+	required := []string{notebookContainerName(instance)}
+	if useGatekeeper() {
+		required = append(required, "gatekeeper")
+	}
+	var notReady []string
+	for _, name := range required {
+		ready := false
+		for _, cs := range pod.Status.ContainerStatuses {
+			if cs.Name == name {
+				ready = cs.Ready
+				break
+			}
+		}
+		if !ready {
+			notReady = append(notReady, name)
+		}
+	}
+	if len(notReady) > 0 {
+		condition.Reason = "ContainersNotReady"
+		condition.Message = fmt.Sprintf("containers not ready: %s", strings.Join(notReady, ", "))
+		return condition
+	}
+	condition.Status = corev1.ConditionTrue
+	return condition
+}
+
+func getConditionMessageMaxLength() int {
+	if value, ok := os.LookupEnv("CONDITION_MESSAGE_MAX_LENGTH"); ok {
+		if length, err := strconv.Atoi(value); err == nil && length > 0 {
+			return length
+		}
+	}
+	return DefaultConditionMessageMaxLength
+}
+
+// truncateMessage shortens msg to at most maxLength characters, replacing the
+// end with an ellipsis.
+func truncateMessage(msg string, maxLength int) string {
+	const ellipsis = "..."
+	runes := []rune(msg)
+	if len(runes) <= maxLength {
+		return msg
+	}
+	if maxLength <= len(ellipsis) {
+		return string(runes[:maxLength])
+	}
+	return string(runes[:maxLength-len(ellipsis)]) + ellipsis
+}
+
+func getContainerCreatingGracePeriod() time.Duration {
+	period := DefaultContainerCreatingGracePeriod
+	if value, ok := os.LookupEnv("CONTAINER_CREATING_GRACE_PERIOD"); ok {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			period = seconds
+		}
+	}
+	return time.Duration(period) * time.Second
+}
+
+// getTerminationGracePeriod returns NOTEBOOK_TERMINATION_GRACE_PERIOD, or
+// DefaultTerminationGracePeriod if it isn't valid.
+func getTerminationGracePeriod() int64 {
+	period := int64(DefaultTerminationGracePeriod)
+	if value, ok := os.LookupEnv("NOTEBOOK_TERMINATION_GRACE_PERIOD"); ok {
+		if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds >= 0 {
+			period = seconds
+		}
+	}
+	return period
+}
+
+// containerCreatingIsTransient returns true if the container is waiting in
+// ContainerCreating and the pod is still within the grace period, so the
+// state is part of a normal startup rather than something to warn about.
+func containerCreatingIsTransient(pod *corev1.Pod, cs corev1.ContainerState) bool {
+	if cs.Waiting == nil || cs.Waiting.Reason != "ContainerCreating" {
+		return false
+	}
+	return time.Since(pod.CreationTimestamp.Time) < getContainerCreatingGracePeriod()
+}
+
+// notebookPrefix returns the path the notebook is served under with path
+// routing.
+func notebookPrefix(instance *v1.Notebook) string {
+	return "/notebook/" + instance.Namespace + "/" + instance.Name
+}
+
+// routingMode returns the routing mode selected with AnnotationRoutingMode, or
+// an empty string if it isn't set to a known mode.
+func routingMode(instance *v1.Notebook) string {
+	switch mode := instance.ObjectMeta.Annotations[AnnotationRoutingMode]; mode {
+	case RoutingModeSubdomain, RoutingModePath:
+		return mode
+	}
+	return ""
+}
+
+// setRoutingPrefix sets the NB_PREFIX the notebook is served under to match
+// the routing mode: the root of its own host, or its path on the shared host.
+func setRoutingPrefix(instance *v1.Notebook, container *corev1.Container) {
+	var prefix string
+	switch routingMode(instance) {
+	case RoutingModeSubdomain:
+		prefix = "/"
+	case RoutingModePath:
+		prefix = notebookPrefix(instance)
+	default:
+		return
+	}
+
+	for i := range container.Env {
+		if container.Env[i].Name == PrefixEnvVar {
+			container.Env[i].Value = prefix
+			return
+		}
+	}
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name:  PrefixEnvVar,
+		Value: prefix,
+	})
+}
+
+func setPrefixEnvVar(instance *v1.Notebook, container *corev1.Container) {
+	prefix := notebookPrefix(instance)
+
+	for _, envVar := range container.Env {
+		if envVar.Name == PrefixEnvVar {
+			envVar.Value = prefix
+			return
+		}
+	}
+
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name:  PrefixEnvVar,
+		Value: prefix,
+	})
+}
+
+// setMOTDEnvVars passes the message of the day of NOTEBOOK_MOTD, and the env
+// vars of the JSON object NOTEBOOK_BANNER_ENV, e.g. {"JUPYTER_ENABLE_LAB":"yes"},
+// to the notebook container. The env vars of the Notebook take precedence.
+func setMOTDEnvVars(container *corev1.Container) {
+	env := make(map[string]string)
+	_ = json.Unmarshal([]byte(os.Getenv("NOTEBOOK_BANNER_ENV")), &env)
+	if motd := os.Getenv("NOTEBOOK_MOTD"); motd != "" {
+		env[MOTDEnvVar] = motd
+	}
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mergeEnvVar(container, corev1.EnvVar{Name: name, Value: env[name]})
+	}
+}
+
+// mergeEnvVar appends the env var to the container, unless it is already set.
+func mergeEnvVar(container *corev1.Container, envVar corev1.EnvVar) {
+	for _, e := range container.Env {
+		if e.Name == envVar.Name {
+			return
+		}
+	}
+	container.Env = append(container.Env, envVar)
+}
+
+// setNodePool makes the pod tolerate the taint of the dedicated node pool and
+// selects the nodes of that pool. The pool is read from NOTEBOOK_NODE_POOL and
+// can be overridden per Notebook with AnnotationNodePool (an empty value opts
+// the Notebook out).
+func setNodePool(instance *v1.Notebook, podSpec *corev1.PodSpec) {
+	pool := os.Getenv("NOTEBOOK_NODE_POOL")
+	if value, ok := instance.ObjectMeta.Annotations[AnnotationNodePool]; ok {
+		pool = value
+	}
+	if pool == "" {
+		return
+	}
+
+	toleration := corev1.Toleration{
+		Key:      NodePoolKey,
+		Operator: corev1.TolerationOpEqual,
+		Value:    pool,
+		Effect:   corev1.TaintEffectNoSchedule,
+	}
+	found := false
+	for _, t := range podSpec.Tolerations {
+		if t == toleration {
+			found = true
+			break
+		}
+	}
+	if !found {
+		podSpec.Tolerations = append(podSpec.Tolerations, toleration)
+	}
+
+	if podSpec.NodeSelector == nil {
+		podSpec.NodeSelector = map[string]string{}
+	}
+	if _, ok := podSpec.NodeSelector[NodePoolKey]; !ok {
+		podSpec.NodeSelector[NodePoolKey] = pool
+	}
+}
+
+// getSpotTolerations parses SPOT_TOLERATIONS, a comma-separated list of the
+// taints of the spot nodes, each as key[=value][:effect]. A taint without a
+// value is tolerated with the Exists operator, and one without an effect
+// whatever its effect.
+func getSpotTolerations() []corev1.Toleration {
+	var tolerations []corev1.Toleration
+	for _, taint := range splitList(os.Getenv("SPOT_TOLERATIONS")) {
+		toleration := corev1.Toleration{Operator: corev1.TolerationOpExists}
+		if i := strings.LastIndex(taint, ":"); i >= 0 {
+			toleration.Effect = corev1.TaintEffect(taint[i+1:])
+			taint = taint[:i]
+		}
+		if i := strings.Index(taint, "="); i >= 0 {
+			toleration.Operator = corev1.TolerationOpEqual
+			toleration.Value = taint[i+1:]
+			taint = taint[:i]
+		}
+		if taint == "" {
+			continue
+		}
+		toleration.Key = taint
+		tolerations = append(tolerations, toleration)
+	}
+	return tolerations
+}
+
+// getSpotNodeLabel returns the label of the spot nodes, read from
+// SPOT_NODE_LABEL as key[=value]. It defaults to the first spot taint, as the
+// spot nodes are usually labeled and tainted alike.
+func getSpotNodeLabel(tolerations []corev1.Toleration) (string, string) {
+	label := os.Getenv("SPOT_NODE_LABEL")
+	if label == "" {
+		return tolerations[0].Key, tolerations[0].Value
+	}
+	if i := strings.Index(label, "="); i >= 0 {
+		return label[:i], label[i+1:]
+	}
+	return label, ""
+}
+
+// setSpotScheduling lets the Notebooks annotated with AnnotationSpot tolerate
+// SPOT_TOLERATIONS, and keeps the other Notebooks off the spot nodes with a
+// node affinity, so that a preemption never takes down a notebook that didn't
+// opt in.
+func setSpotScheduling(instance *v1.Notebook, podSpec *corev1.PodSpec) {
+	tolerations := getSpotTolerations()
+	if len(tolerations) == 0 {
+		return
+	}
+
+	if instance.ObjectMeta.Annotations[AnnotationSpot] == "true" {
+		for _, toleration := range tolerations {
+			found := false
+			for _, t := range podSpec.Tolerations {
+				if t == toleration {
+					found = true
+					break
+				}
+			}
+			if !found {
+				podSpec.Tolerations = append(podSpec.Tolerations, toleration)
+			}
+		}
+		return
+	}
+
+	key, value := getSpotNodeLabel(tolerations)
+	requirement := corev1.NodeSelectorRequirement{
+		Key:      key,
+		Operator: corev1.NodeSelectorOpDoesNotExist,
+	}
+	if value != "" {
+		requirement.Operator = corev1.NodeSelectorOpNotIn
+		requirement.Values = []string{value}
+	}
+	if podSpec.Affinity == nil {
+		podSpec.Affinity = &corev1.Affinity{}
+	}
+	if podSpec.Affinity.NodeAffinity == nil {
+		podSpec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	nodeAffinity := podSpec.Affinity.NodeAffinity
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+	}
+	selector := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if len(selector.NodeSelectorTerms) == 0 {
+		selector.NodeSelectorTerms = []corev1.NodeSelectorTerm{{}}
+	}
+	// The terms are ORed, so each of them must exclude the spot nodes.
+	for i := range selector.NodeSelectorTerms {
+		term := &selector.NodeSelectorTerms[i]
+		term.MatchExpressions = append(term.MatchExpressions, requirement)
+	}
+}
+
+// setNodeName pins the pod to the node of AnnotationNodeName with a node
+// affinity on its name. Unlike spec.nodeName, the pod still goes through the
+// scheduler, so it waits for the resources of the node instead of failing.
+func setNodeName(instance *v1.Notebook, podSpec *corev1.PodSpec) {
+	nodeName := instance.ObjectMeta.Annotations[AnnotationNodeName]
+	if nodeName == "" {
+		return
+	}
+
+	requirement := corev1.NodeSelectorRequirement{
+		Key:      "metadata.name",
+		Operator: corev1.NodeSelectorOpIn,
+		Values:   []string{nodeName},
+	}
+	if podSpec.Affinity == nil {
+		podSpec.Affinity = &corev1.Affinity{}
+	}
+	if podSpec.Affinity.NodeAffinity == nil {
+		podSpec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	nodeAffinity := podSpec.Affinity.NodeAffinity
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+	}
+	selector := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if len(selector.NodeSelectorTerms) == 0 {
+		selector.NodeSelectorTerms = []corev1.NodeSelectorTerm{{}}
+	}
+	// The terms are ORed, so each of them must select the node.
+	for i := range selector.NodeSelectorTerms {
+		term := &selector.NodeSelectorTerms[i]
+		term.MatchFields = append(term.MatchFields, requirement)
+	}
+}
+
+// getProjectedTokenExpiration returns PROJECTED_TOKEN_EXPIRATION, or
+// DefaultProjectedTokenExpiration if it isn't valid. The API server rejects
+// tokens shorter than 10 minutes.
+func getProjectedTokenExpiration() int64 {
+	if expiration, err := strconv.ParseInt(os.Getenv("PROJECTED_TOKEN_EXPIRATION"), 10, 64); err == nil && expiration >= 600 {
+		return expiration
+	}
+	return DefaultProjectedTokenExpiration
+}
+
+// setProjectedToken mounts a projected service account token, bound to
+// PROJECTED_TOKEN_AUDIENCE (the API server when empty) and rotated every
+// PROJECTED_TOKEN_EXPIRATION seconds, instead of the default long-lived token
+// of the service account.
+func setProjectedToken(instance *v1.Notebook, podSpec *corev1.PodSpec) {
+	if os.Getenv("ENABLE_PROJECTED_TOKEN") != "true" || instance.ObjectMeta.Annotations[AnnotationProjectedToken] != "true" {
+		return
+	}
+	container := notebookContainer(instance, podSpec)
+	for _, mount := range container.VolumeMounts {
+		if strings.TrimSuffix(mount.MountPath, "/") == ProjectedTokenPath {
+			return
+		}
+	}
+
+	podSpec.AutomountServiceAccountToken = pointer.Bool(false)
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: "projected-token",
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{
+					{
+						ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+							Audience:          os.Getenv("PROJECTED_TOKEN_AUDIENCE"),
+							ExpirationSeconds: pointer.Int64(getProjectedTokenExpiration()),
+							Path:              "token",
+						},
+					},
+					{
+						ConfigMap: &corev1.ConfigMapProjection{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "kube-root-ca.crt"},
+							Items:                []corev1.KeyToPath{{Key: "ca.crt", Path: "ca.crt"}},
+						},
+					},
+					{
+						DownwardAPI: &corev1.DownwardAPIProjection{
+							Items: []corev1.DownwardAPIVolumeFile{{
+								Path:     "namespace",
+								FieldRef: &corev1.ObjectFieldSelector{APIVersion: "v1", FieldPath: "metadata.namespace"},
+							}},
+						},
+					},
+				},
+			},
+		},
+	})
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      "projected-token",
+		MountPath: ProjectedTokenPath,
+		ReadOnly:  true,
+	})
+}
+
+// setServiceAccount runs the pod as the AnnotationServiceAccount of the
+// Notebook, or DEFAULT_SERVICE_ACCOUNT, and mounts its token as
+// AUTOMOUNT_SA_TOKEN says, e.g. "false" so that notebook users can't reach the
+// API server with it. Unset, the namespace default service account and its
+// automount setting are used. The settings of the Notebook are kept.
+func setServiceAccount(instance *v1.Notebook, podSpec *corev1.PodSpec) {
+	if name := strings.TrimSpace(instance.ObjectMeta.Annotations[AnnotationServiceAccount]); name != "" &&
+		len(validation.IsDNS1123Subdomain(name)) == 0 {
+		podSpec.ServiceAccountName = name
+	} else if podSpec.ServiceAccountName == "" {
+		podSpec.ServiceAccountName = os.Getenv("DEFAULT_SERVICE_ACCOUNT")
+	}
+	if podSpec.AutomountServiceAccountToken != nil {
+		return
+	}
+	if automount, err := strconv.ParseBool(os.Getenv("AUTOMOUNT_SA_TOKEN")); err == nil {
+		podSpec.AutomountServiceAccountToken = pointer.Bool(automount)
+	}
+}
+
+// setDefaultInitContainers prepends the init containers of
+// DEFAULT_INIT_CONTAINERS, a JSON list of containers, e.g. to git-sync a
+// repository before the notebook starts. They mount the same PVCs as the
+// notebook container, so they can fill the workspace. The init containers of
+// the Notebook run after them, and one with the same name replaces a default.
+func setDefaultInitContainers(instance *v1.Notebook, podSpec *corev1.PodSpec) {
+	var defaults []corev1.Container
+	if err := json.Unmarshal([]byte(os.Getenv("DEFAULT_INIT_CONTAINERS")), &defaults); err != nil {
+		return
+	}
+
+	claimVolumes := make(map[string]bool)
+	for _, volume := range podSpec.Volumes {
+		if volume.PersistentVolumeClaim != nil {
+			claimVolumes[volume.Name] = true
+		}
+	}
+	var workspaceMounts []corev1.VolumeMount
+	for _, mount := range notebookContainer(instance, podSpec).VolumeMounts {
+		if claimVolumes[mount.Name] {
+			workspaceMounts = append(workspaceMounts, mount)
+		}
+	}
+
+	existing := make(map[string]bool)
+	for _, c := range podSpec.InitContainers {
+		existing[c.Name] = true
+	}
+	var initContainers []corev1.Container
+	for _, c := range defaults {
+		if c.Name == "" || existing[c.Name] {
+			continue
+		}
+		for _, mount := range workspaceMounts {
+			mounted := false
+			for _, m := range c.VolumeMounts {
+				mounted = mounted || m.Name == mount.Name || m.MountPath == mount.MountPath
+			}
+			if !mounted {
+				c.VolumeMounts = append(c.VolumeMounts, mount)
+			}
+		}
+		initContainers = append(initContainers, c)
+	}
+	podSpec.InitContainers = append(initContainers, podSpec.InitContainers...)
+}
+
+// runUpdateCACerts returns true if the notebook runs update-ca-certificates
+// before jupyter, which only Debian based images provide.
+// Uses ENV var: RUN_UPDATE_CA_CERTS
+func runUpdateCACerts() bool {
+	return os.Getenv("RUN_UPDATE_CA_CERTS") != "false"
+}
+
+// caBundleVolume returns the volume of the CA certificates trusted by the
+// notebooks, from the CA_BUNDLE_CONFIGMAP ConfigMap or else the
+// CA_BUNDLE_SECRET Secret, or nil if neither is set.
+func caBundleVolume() *corev1.Volume {
+	volume := &corev1.Volume{Name: "ca-bundle"}
+	if name := os.Getenv("CA_BUNDLE_CONFIGMAP"); name != "" {
+		volume.ConfigMap = &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name},
+		}
+	} else if name := os.Getenv("CA_BUNDLE_SECRET"); name != "" {
+		volume.Secret = &corev1.SecretVolumeSource{SecretName: name}
+	} else {
+		return nil
+	}
+	return volume
+}
+
+// getDefaultWorkingDir returns DEFAULT_WORKING_DIR if it is an absolute path,
+// or else DefaultWorkingDir.
+func getDefaultWorkingDir() string {
+	if dir := os.Getenv("DEFAULT_WORKING_DIR"); path.IsAbs(dir) {
+		return dir
+	}
+	return DefaultWorkingDir
+}
+
+// getJupyterTokenPolicy returns the token policy of the Notebook, from
+// AnnotationJupyterToken or else JUPYTER_TOKEN_POLICY. Without the gatekeeper
+// nothing else authenticates the users, so a token is required by default.
+func getJupyterTokenPolicy(instance *v1.Notebook) string {
+	for _, policy := range []string{instance.ObjectMeta.Annotations[AnnotationJupyterToken], os.Getenv("JUPYTER_TOKEN_POLICY")} {
+		if policy == JupyterTokenPolicyNone || policy == JupyterTokenPolicyRequired {
+			return policy
+		}
+	}
+	if useGatekeeper() {
+		return JupyterTokenPolicyNone
+	}
+	return JupyterTokenPolicyRequired
+}
+
+// jupyterAuthArgs returns the token and origin arguments of the jupyter
+// command. The allowed origin is AnnotationJupyterAllowOrigin, or else
+// JUPYTER_ALLOW_ORIGIN, "*" if unset. An empty one only allows the origin
+// Jupyter is served on.
+func jupyterAuthArgs(instance *v1.Notebook) string {
+	var args string
+	if getJupyterTokenPolicy(instance) == JupyterTokenPolicyNone {
+		args += " --NotebookApp.token='' --NotebookApp.password=''"
+	}
+
+	origin, ok := instance.ObjectMeta.Annotations[AnnotationJupyterAllowOrigin]
+	if !ok {
+		if origin, ok = os.LookupEnv("JUPYTER_ALLOW_ORIGIN"); !ok {
+			origin = "*"
+		}
+	}
+	if origin != "" {
+		args += " --NotebookApp.allow_origin=" + shellQuote(origin)
+	}
+	return args
+}
+
+// shellQuote quotes a value for sh, so it is passed as a single argument.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// setJupyterTokenEnvVar passes the "token" key of JUPYTER_TOKEN_SECRET to
+// Jupyter, when it requires a token. The Secret is read from the namespace of
+// the Notebook, and Jupyter generates a token if it doesn't exist.
+func setJupyterTokenEnvVar(instance *v1.Notebook, container *corev1.Container) {
+	secretName := os.Getenv("JUPYTER_TOKEN_SECRET")
+	if secretName == "" || getJupyterTokenPolicy(instance) != JupyterTokenPolicyRequired {
+		return
+	}
+	mergeEnvVar(container, corev1.EnvVar{
+		Name: "JUPYTER_TOKEN",
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+				Key:                  "token",
+				Optional:             pointer.Bool(true),
+			},
+		},
+	})
+}
+
+// getScratchPath returns the absolute path the scratch volume is mounted at.
+func getScratchPath(instance *v1.Notebook) string {
+	if dir := instance.ObjectMeta.Annotations[AnnotationScratchPath]; path.IsAbs(dir) {
+		return path.Clean(dir)
+	}
+	if dir := os.Getenv("SCRATCH_PATH"); path.IsAbs(dir) {
+		return path.Clean(dir)
+	}
+	return DefaultScratchPath
+}
+
+// setScratchVolume mounts an emptyDir limited to AnnotationScratchSize in the
+// notebook container. An invalid size, or a path the Notebook already mounts
+// a volume at, is skipped.
+func setScratchVolume(instance *v1.Notebook, podSpec *corev1.PodSpec) {
+	value, ok := instance.ObjectMeta.Annotations[AnnotationScratchSize]
+	if !ok {
+		return
+	}
+	sizeLimit, err := resource.ParseQuantity(value)
+	if err != nil || sizeLimit.Sign() <= 0 {
+		return
+	}
+
+	container := notebookContainer(instance, podSpec)
+	mountPath := getScratchPath(instance)
+	for _, m := range container.VolumeMounts {
+		if path.Clean(m.MountPath) == mountPath {
+			return
+		}
+	}
+	if hasVolume(podSpec, "scratch") {
+		return
+	}
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: "scratch",
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{SizeLimit: &sizeLimit},
+		},
+	})
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      "scratch",
+		MountPath: mountPath,
+	})
+}
+
+// setExistingVolumeClaims mounts the existing PVCs of the Notebook into the
+// notebook container. The volumes are named by their position, as the claim
+// names aren't always valid volume names. A claim mounted where the template
+// already mounts a volume is skipped.
+func setExistingVolumeClaims(instance *v1.Notebook, podSpec *corev1.PodSpec) {
+	container := notebookContainer(instance, podSpec)
+	for i, claim := range instance.Spec.ExistingVolumeClaims {
+		if claim.ClaimName == "" || claim.MountPath == "" {
+			continue
+		}
+		mounted := false
+		for _, m := range container.VolumeMounts {
+			if path.Clean(m.MountPath) == path.Clean(claim.MountPath) {
+				mounted = true
+			}
+		}
+		name := fmt.Sprintf("existing-claim-%d", i)
+		if mounted || hasVolume(podSpec, name) {
+			continue
+		}
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: claim.ClaimName,
+					ReadOnly:  claim.ReadOnly,
+				},
+			},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      name,
+			MountPath: claim.MountPath,
+			ReadOnly:  claim.ReadOnly,
+		})
+	}
+}
+
+// useSnapshot returns true if the snapshot sidecar is injected into the
+// Notebook. Uses ENV vars: ENABLE_SNAPSHOT, SNAPSHOT_DESTINATION
+func useSnapshot(instance *v1.Notebook) bool {
+	return os.Getenv("ENABLE_SNAPSHOT") == "true" && os.Getenv("SNAPSHOT_DESTINATION") != "" &&
+		instance.ObjectMeta.Annotations[AnnotationSnapshot] == "true"
+}
+
+// setSnapshotSidecar injects a sidecar that syncs the working directory to
+// SNAPSHOT_DESTINATION (an rclone remote path, e.g. ":s3:bucket/notebooks") from
+// its preStop hook, so the work of ephemeral notebooks survives a shutdown. The
+// rclone credentials are read from the SNAPSHOT_CREDENTIALS_SECRET Secret.
+// The working directory is backed by an emptyDir if nothing is mounted there.
+func setSnapshotSidecar(instance *v1.Notebook, podSpec *corev1.PodSpec) {
+	if !useSnapshot(instance) {
+		return
+	}
+	destination := os.Getenv("SNAPSHOT_DESTINATION")
+	image := os.Getenv("SNAPSHOT_IMAGE")
+	if image == "" {
+		image = DefaultSnapshotImage
+	}
+
+	container := notebookContainer(instance, podSpec)
+	homePath := strings.TrimSuffix(container.WorkingDir, "/")
+	volumeName := ""
+	for _, mount := range container.VolumeMounts {
+		if strings.TrimSuffix(mount.MountPath, "/") == homePath {
+			volumeName = mount.Name
+			break
+		}
 	}
-	return newCondition
+	if volumeName == "" {
+		volumeName = "snapshot-home"
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name:         volumeName,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      volumeName,
+			MountPath: homePath,
+		})
+	}
+
+	sidecar := corev1.Container{
+		Name:    "snapshot",
+		Image:   image,
+		Command: []string{"sh", "-c", "trap 'exit 0' TERM; sleep infinity & wait"},
+		Lifecycle: &corev1.Lifecycle{
+			PreStop: &corev1.LifecycleHandler{
+				Exec: &corev1.ExecAction{
+					Command: []string{"rclone", "sync", homePath,
+						strings.TrimSuffix(destination, "/") + "/" + instance.Namespace + "/" + instance.Name},
+				},
+			},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      volumeName,
+				MountPath: homePath,
+				ReadOnly:  true,
+			},
+		},
+	}
+	if secret := os.Getenv("SNAPSHOT_CREDENTIALS_SECRET"); secret != "" {
+		sidecar.EnvFrom = []corev1.EnvFromSource{
+			{
+				SecretRef: &corev1.SecretEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: secret},
+				},
+			},
+		}
+	}
+	podSpec.Containers = append(podSpec.Containers, sidecar)
 }
 
-func setPrefixEnvVar(instance *v1.Notebook, container *corev1.Container) {
-	prefix := "/notebook/" + instance.Namespace + "/" + instance.Name
+// setSecurityHardening runs the notebook and gatekeeper containers with a
+// read-only root filesystem, without capabilities and privilege escalation
+// when HARDEN_SECURITY is "true". The settings of the Notebook are kept. The
+// directories the notebook writes to are backed by emptyDirs unless something
+// is mounted there, and are owned by the fsGroup like any other volume.
+func setSecurityHardening(instance *v1.Notebook, podSpec *corev1.PodSpec) {
+	if os.Getenv("HARDEN_SECURITY") != "true" {
+		return
+	}
+	notebook := notebookContainer(instance, podSpec)
+	for i := range podSpec.Containers {
+		container := &podSpec.Containers[i]
+		if container != notebook && container.Name != "gatekeeper" {
+			continue
+		}
+		if container.SecurityContext == nil {
+			container.SecurityContext = &corev1.SecurityContext{}
+		}
+		sc := container.SecurityContext
+		if sc.ReadOnlyRootFilesystem == nil {
+			sc.ReadOnlyRootFilesystem = pointer.Bool(true)
+		}
+		if sc.AllowPrivilegeEscalation == nil {
+			sc.AllowPrivilegeEscalation = pointer.Bool(false)
+		}
+		if sc.Capabilities == nil {
+			sc.Capabilities = &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}}
+		}
+		if !*sc.ReadOnlyRootFilesystem {
+			continue
+		}
 
-	for _, envVar := range container.Env {
-		if envVar.Name == PrefixEnvVar {
-			envVar.Value = prefix
-			return
+		writable := []corev1.VolumeMount{{Name: "hardening-tmp", MountPath: "/tmp"}}
+		if container == notebook {
+			writable = append(writable,
+				corev1.VolumeMount{Name: "hardening-home", MountPath: strings.TrimSuffix(container.WorkingDir, "/")})
+			// update-ca-certificates rewrites the bundle on startup.
+			if runUpdateCACerts() {
+				writable = append(writable, corev1.VolumeMount{Name: "hardening-certs", MountPath: "/etc/ssl/certs"})
+			}
+		}
+		for _, mount := range writable {
+			mounted := false
+			for _, m := range container.VolumeMounts {
+				mounted = mounted || strings.TrimSuffix(m.MountPath, "/") == mount.MountPath
+			}
+			if mounted {
+				continue
+			}
+			container.VolumeMounts = append(container.VolumeMounts, mount)
+			if !hasVolume(podSpec, mount.Name) {
+				podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+					Name:         mount.Name,
+					VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+				})
+			}
 		}
 	}
+}
 
-	container.Env = append(container.Env, corev1.EnvVar{
-		Name:  PrefixEnvVar,
-		Value: prefix,
-	})
+// mountsClaim returns true if the pod has a volume of the named PVC.
+func mountsClaim(podSpec *corev1.PodSpec, claimName string) bool {
+	for _, volume := range podSpec.Volumes {
+		if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == claimName {
+			return true
+		}
+	}
+	return false
 }
 
-func generatePersistentVolumeClaim(instance *v1.Notebook) *corev1.PersistentVolumeClaim {
-	storageclass := instance.Spec.VolumeClaim[0].StorageClass
-	pvc := &corev1.PersistentVolumeClaim{}
+func hasVolume(podSpec *corev1.PodSpec, name string) bool {
+	for _, volume := range podSpec.Volumes {
+		if volume.Name == name {
+			return true
+		}
+	}
+	return false
+}
 
-	if storageclass != "" {
-		pvc = &corev1.PersistentVolumeClaim{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      instance.Spec.VolumeClaim[0].Name,
-				Namespace: instance.Namespace,
-				Labels: map[string]string{
-					"notebook": instance.Name,
-				},
-			},
-			Spec: corev1.PersistentVolumeClaimSpec{
-				AccessModes: []corev1.PersistentVolumeAccessMode{
-					corev1.ReadWriteMany,
-				},
-				Resources: corev1.ResourceRequirements{
-					Requests: corev1.ResourceList{
-						corev1.ResourceName(corev1.ResourceStorage): resource.MustParse(instance.Spec.VolumeClaim[0].Size),
-					},
+// getBurstableRequestFraction returns the fraction of the limits a burstable
+// Notebook requests, or 0 if it isn't burstable.
+func getBurstableRequestFraction(instance *v1.Notebook) float64 {
+	value, ok := instance.ObjectMeta.Annotations[AnnotationBurstable]
+	if !ok || value == "false" {
+		return 0
+	}
+	if value == "true" {
+		value = os.Getenv("BURSTABLE_REQUEST_FRACTION")
+	}
+	if fraction, err := strconv.ParseFloat(value, 64); err == nil && fraction > 0 && fraction <= 1 {
+		return fraction
+	}
+	return DefaultBurstableRequestFraction
+}
+
+// setBurstableRequests sets the CPU and memory requests of a burstable
+// Notebook to a fraction of the limits. Other resources, e.g. GPUs, can't be
+// overcommitted and are left alone.
+func setBurstableRequests(instance *v1.Notebook, container *corev1.Container) {
+	fraction := getBurstableRequestFraction(instance)
+	if fraction == 0 {
+		return
+	}
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		limit, ok := container.Resources.Limits[name]
+		if !ok {
+			continue
+		}
+		var request *resource.Quantity
+		if name == corev1.ResourceCPU {
+			request = resource.NewMilliQuantity(int64(float64(limit.MilliValue())*fraction), limit.Format)
+		} else {
+			request = resource.NewQuantity(int64(float64(limit.Value())*fraction), limit.Format)
+		}
+		if container.Resources.Requests == nil {
+			container.Resources.Requests = corev1.ResourceList{}
+		}
+		container.Resources.Requests[name] = *request
+	}
+}
+
+// setTTY allocates stdin and a TTY to the notebook container of a Notebook
+// with AnnotationTTY.
+func setTTY(instance *v1.Notebook, container *corev1.Container) {
+	if instance.ObjectMeta.Annotations[AnnotationTTY] != "true" {
+		return
+	}
+	container.Stdin = true
+	container.TTY = true
+}
+
+// setTerminationMessagePolicy defaults the termination message policy of the
+// notebook container to TERMINATION_MESSAGE_POLICY, so that the last lines of
+// the logs of a crashed notebook end up in its Terminated condition.
+func setTerminationMessagePolicy(container *corev1.Container) {
+	if container.TerminationMessagePolicy != "" {
+		return
+	}
+	container.TerminationMessagePolicy = DefaultTerminationMessagePolicy
+	if policy := corev1.TerminationMessagePolicy(os.Getenv("TERMINATION_MESSAGE_POLICY")); policy == corev1.TerminationMessageReadFile {
+		container.TerminationMessagePolicy = policy
+	}
+}
+
+// setDefaultEnvFrom loads the environment of the container from the
+// ConfigMaps of DEFAULT_ENV_FROM_CONFIGMAPS and the Secrets of
+// DEFAULT_ENV_FROM_SECRETS, comma-separated names in the notebook namespace,
+// e.g. to share the object storage settings. They are optional, so a
+// namespace without them still starts. The envFrom of the Notebook comes
+// after them, so its keys win, and a source it already lists isn't repeated.
+func setDefaultEnvFrom(container *corev1.Container) {
+	configMaps := make(map[string]bool)
+	secrets := make(map[string]bool)
+	for _, source := range container.EnvFrom {
+		if source.ConfigMapRef != nil {
+			configMaps[source.ConfigMapRef.Name] = true
+		}
+		if source.SecretRef != nil {
+			secrets[source.SecretRef.Name] = true
+		}
+	}
+
+	var defaults []corev1.EnvFromSource
+	for _, name := range splitList(os.Getenv("DEFAULT_ENV_FROM_CONFIGMAPS")) {
+		if !configMaps[name] {
+			configMaps[name] = true
+			defaults = append(defaults, corev1.EnvFromSource{
+				ConfigMapRef: &corev1.ConfigMapEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: name},
+					Optional:             pointer.Bool(true),
 				},
-				StorageClassName: &storageclass,
-			},
+			})
 		}
-	} else {
-		pvc = &corev1.PersistentVolumeClaim{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      instance.Spec.VolumeClaim[0].Name,
-				Namespace: instance.Namespace,
-				Labels: map[string]string{
-					"notebook": instance.Name,
+	}
+	for _, name := range splitList(os.Getenv("DEFAULT_ENV_FROM_SECRETS")) {
+		if !secrets[name] {
+			secrets[name] = true
+			defaults = append(defaults, corev1.EnvFromSource{
+				SecretRef: &corev1.SecretEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: name},
+					Optional:             pointer.Bool(true),
 				},
+			})
+		}
+	}
+	if len(defaults) > 0 {
+		container.EnvFrom = append(defaults, container.EnvFrom...)
+	}
+}
+
+// setImagePullPolicy sets the DEFAULT_IMAGE_PULL_POLICY of the container if
+// it is a valid policy. Otherwise the image is pulled on every start if its
+// tag is mutable, and only when missing from the node otherwise, e.g. for a
+// pinned digest. An explicit policy of the Notebook is kept.
+func setImagePullPolicy(container *corev1.Container) {
+	if container.ImagePullPolicy != "" {
+		return
+	}
+	switch policy := corev1.PullPolicy(os.Getenv("DEFAULT_IMAGE_PULL_POLICY")); policy {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+		container.ImagePullPolicy = policy
+		return
+	}
+	container.ImagePullPolicy = corev1.PullIfNotPresent
+	if isMutableImageTag(container.Image) {
+		container.ImagePullPolicy = corev1.PullAlways
+	}
+}
+
+// isMutableImageTag returns true if the image has no digest and its tag, or
+// latest if it has none, is latest or one of the comma-separated tags of
+// MUTABLE_IMAGE_TAGS, e.g. "nightly,dev".
+func isMutableImageTag(image string) bool {
+	if strings.Contains(image, "@") {
+		return false
+	}
+	tag := "latest"
+	// The registry host may contain a port, so only look at the last part.
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		tag = name[i+1:]
+	}
+	for _, mutable := range append(splitList(os.Getenv("MUTABLE_IMAGE_TAGS")), "latest") {
+		if tag == mutable {
+			return true
+		}
+	}
+	return false
+}
+
+// getPVCAccessMode returns the access mode of a claim, falling back to
+// PVC_ACCESS_MODE and then ReadWriteMany.
+func getPVCAccessMode(claim v1.NotebookVolumeClaim) corev1.PersistentVolumeAccessMode {
+	if claim.AccessMode != "" {
+		return claim.AccessMode
+	}
+	if accessMode := os.Getenv("PVC_ACCESS_MODE"); accessMode != "" {
+		return corev1.PersistentVolumeAccessMode(accessMode)
+	}
+	return corev1.ReadWriteMany
+}
+
+func generatePersistentVolumeClaim(instance *v1.Notebook, claim v1.NotebookVolumeClaim) *corev1.PersistentVolumeClaim {
+	storageclass := claim.StorageClass
+	if storageclass == "" {
+		storageclass = os.Getenv("DEFAULT_STORAGE_CLASS")
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      claim.Name,
+			Namespace: instance.Namespace,
+			Labels: map[string]string{
+				"notebook": instance.Name,
 			},
-			Spec: corev1.PersistentVolumeClaimSpec{
-				AccessModes: []corev1.PersistentVolumeAccessMode{
-					corev1.ReadWriteMany,
-				},
-				Resources: corev1.ResourceRequirements{
-					Requests: corev1.ResourceList{
-						corev1.ResourceName(corev1.ResourceStorage): resource.MustParse(instance.Spec.VolumeClaim[0].Size),
-					},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{
+				getPVCAccessMode(claim),
+			},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceName(corev1.ResourceStorage): resource.MustParse(claim.Size),
 				},
 			},
-		}
+		},
+	}
+	if storageclass != "" {
+		pvc.Spec.StorageClassName = &storageclass
 	}
+	setCommonMetadata(pvc)
 
 	return pvc
 }
 
+// getUpdateStrategy returns the update strategy of the notebook StatefulSet,
+// from STATEFULSET_UPDATE_STRATEGY: RollingUpdate (default), or OnDelete to
+// let the controller recreate the pods whose image changed.
+func getUpdateStrategy() appsv1.StatefulSetUpdateStrategy {
+	if appsv1.StatefulSetUpdateStrategyType(os.Getenv("STATEFULSET_UPDATE_STRATEGY")) == appsv1.OnDeleteStatefulSetStrategyType {
+		return appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType}
+	}
+	return appsv1.StatefulSetUpdateStrategy{
+		Type: appsv1.RollingUpdateStatefulSetStrategyType,
+		RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{
+			Partition: pointer.Int32(0),
+		},
+	}
+}
+
 func generateStatefulSet(instance *v1.Notebook) *appsv1.StatefulSet {
-	replicas := int32(1)
+	replicas := int32(MaxReplicas)
 	if culler.StopAnnotationIsSet(instance.ObjectMeta) {
 		replicas = 0
 	}
@@ -434,7 +2928,8 @@ func generateStatefulSet(instance *v1.Notebook) *appsv1.StatefulSet {
 			Namespace: instance.Namespace,
 		},
 		Spec: appsv1.StatefulSetSpec{
-			Replicas: &replicas,
+			Replicas:       &replicas,
+			UpdateStrategy: getUpdateStrategy(),
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{
 					"statefulset": instance.Name,
@@ -457,28 +2952,53 @@ func generateStatefulSet(instance *v1.Notebook) *appsv1.StatefulSet {
 	for k, v := range instance.ObjectMeta.Labels {
 		(*l)[k] = v
 	}
+	// and the annotations of the pod template, e.g. prometheus.io/scrape
+	a := &ss.Spec.Template.ObjectMeta.Annotations
+	for k, v := range instance.Spec.Template.Annotations {
+		(*a)[k] = v
+	}
 
 	podSpec := &ss.Spec.Template.Spec
-	container := &podSpec.Containers[0]
+	container := notebookContainer(instance, podSpec)
 	if container.WorkingDir == "" {
-		container.WorkingDir = "/home/jovyan"
+		container.WorkingDir = getDefaultWorkingDir()
 	}
+	port := notebookPort(instance)
 	if container.Ports == nil {
 		container.Ports = []corev1.ContainerPort{
 			{
-				ContainerPort: DefaultContainerPort,
+				ContainerPort: port,
 				Name:          "notebook-port",
 				Protocol:      "TCP",
 			},
 		}
 	}
-	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
-		Name: "secret",
-		MountPath: "/usr/local/share/ca-certificates",
-	})	
+	secretName := tlsSecretName(instance)
+	caBundle := caBundleVolume()
+	if runUpdateCACerts() {
+		// The CA bundle is trusted if configured, and else the TLS secret.
+		if caBundle != nil {
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+				Name:      caBundle.Name,
+				MountPath: "/usr/local/share/ca-certificates",
+			})
+		} else if secretName != "" {
+			container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+				Name:      "secret",
+				MountPath: "/usr/local/share/ca-certificates",
+			})
+		}
+	}
 	
+	// Only the default command is known to serve the Jupyter API.
+	servesJupyter := container.Args == nil
 	if container.Args == nil {
-		container.Args = []string{"sh","-c", "update-ca-certificates && jupyter lab --notebook-dir=/home/${NB_USER} --ip=0.0.0.0 --no-browser --allow-root --port=8888 --NotebookApp.token='' --NotebookApp.password='' --NotebookApp.allow_origin='*' --NotebookApp.base_url=${NB_PREFIX}"}
+		command := "jupyter lab --notebook-dir=" + container.WorkingDir + " --ip=0.0.0.0 --no-browser --allow-root --port=" + strconv.Itoa(int(port)) + jupyterAuthArgs(instance) + " --NotebookApp.base_url=${NB_PREFIX}"
+		setJupyterTokenEnvVar(instance, container)
+		if runUpdateCACerts() {
+			command = "update-ca-certificates && " + command
+		}
+		container.Args = []string{"sh","-c", command}
 	}
 
 	
@@ -495,106 +3015,26 @@ func generateStatefulSet(instance *v1.Notebook) *appsv1.StatefulSet {
 		MountPath: "/home/jovyan/bin",
 	})		
 */
-	clientsecret := os.Getenv("CLIENT_SECRET")
-	discoveryurl := os.Getenv("DISCOVERY_URL")
-	gatekeeperVersion := os.Getenv("GATEKEEPER_VERSION")		
-	logLevel := os.Getenv("LOG_LEVEL")
-	isClosed := os.Getenv("IS_CLOSED")
-	registryName := os.Getenv("REGISTRY_NAME")
-	
-	imageOpened := "docker.io/tmaxcloudck/gatekeeper:" + gatekeeperVersion
-	imageClosed := registryName + "docker.io/tmaxcloudck/gatekeeper:" + gatekeeperVersion
-	
-	
-	if isClosed == "true" {
-		podSpec.Containers = append(podSpec.Containers, corev1.Container{
-			Name:  "gatekeeper",		
-			Image: imageClosed,
-			Args: []string{
-				"--client-id=notebook-gatekeeper",
-				"--client-secret=" + clientsecret,
-				"--listen=:3000",
-				"--upstream-url=http://127.0.0.1:8888",
-				"--discovery-url=" + discoveryurl,
-				"--secure-cookie=false",
-				"--upstream-keepalives=false",
-				"--skip-openid-provider-tls-verify=true",
-				"--skip-upstream-tls-verify=true",
-				"--tls-cert=/etc/secrets/tls.crt",
-				"--tls-private-key=/etc/secrets/tls.key",
-				"--tls-ca-certificate=/etc/secrets/ca.crt",
-				"--enable-self-signed-tls=false",
-				"--enable-refresh-tokens=true",
-				"--enable-default-deny=true",
-				"--enable-metrics=true",
-				"--encryption-key=AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j",
-				"--resources=uri=/*|roles=notebook-gatekeeper:notebook-gatekeeper-manager",
-				"--log-level=" + logLevel,
-			},
-			Ports: []corev1.ContainerPort{
-				{
-					Name:          "service",
-					ContainerPort: 3000,
-				},
-			},			
-			VolumeMounts: []corev1.VolumeMount{
-				{
-					Name:      "secret",
-					MountPath: "/etc/secrets",
-				},
-			},
-		})				
-	} else {
-		podSpec.Containers = append(podSpec.Containers, corev1.Container{
-			Name:  "gatekeeper",		
-			Image: imageOpened,
-			Args: []string{
-				"--client-id=notebook-gatekeeper",
-				"--client-secret=" + clientsecret,
-				"--listen=:3000",
-				"--upstream-url=http://127.0.0.1:8888",
-				"--discovery-url=" + discoveryurl,
-				"--secure-cookie=false",
-				"--upstream-keepalives=false",
-				"--skip-openid-provider-tls-verify=true",
-				"--skip-upstream-tls-verify=true",
-				"--tls-cert=/etc/secrets/tls.crt",
-				"--tls-private-key=/etc/secrets/tls.key",
-				"--tls-ca-certificate=/etc/secrets/ca.crt",
-				"--enable-self-signed-tls=false",
-				"--enable-refresh-tokens=true",
-				"--enable-default-deny=true",
-				"--enable-metrics=true",
-				"--encryption-key=AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j",
-				"--resources=uri=/*|roles=notebook-gatekeeper:notebook-gatekeeper-manager",
-				"--log-level=" + logLevel,
-			},
-			Ports: []corev1.ContainerPort{
-				{
-					Name:          "service",
-					ContainerPort: 3000,
-				},
-			},			
-			VolumeMounts: []corev1.VolumeMount{
-				{
-					Name:      "secret",
-					MountPath: "/etc/secrets",
-				},
-			},
-		})
+	if useGatekeeper() {
+		podSpec.Containers = append(podSpec.Containers, generateGatekeeperContainer(instance))
 	}
 
 	
 
-	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
-		Name: "secret",
-		VolumeSource: corev1.VolumeSource{
-			Secret: &corev1.SecretVolumeSource{
-				SecretName: instance.Name + "-secret",
-				DefaultMode: pointer.Int32(0777),
+	if secretName != "" {
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: "secret",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName:  secretName,
+					DefaultMode: pointer.Int32(0777),
+				},
 			},
-		},
-	})
+		})
+	}
+	if caBundle != nil && runUpdateCACerts() {
+		podSpec.Volumes = append(podSpec.Volumes, *caBundle)
+	}
 
 /*	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
 		Name: "secret-self",
@@ -616,21 +3056,384 @@ func generateStatefulSet(instance *v1.Notebook) *appsv1.StatefulSet {
 		},
 	})*/
 
-	setPrefixEnvVar(instance, container)
+	// Appending the gatekeeper may have moved the notebook container.
+	container = notebookContainer(instance, podSpec)
+	setPrefixEnvVar(instance, container)
+	setMOTDEnvVars(container)
+	setRoutingPrefix(instance, container)
+	if servesJupyter {
+		setReadinessProbe(instance, container)
+	}
+	setStartupProbe(container)
+	setBurstableRequests(instance, container)
+	setIstioSidecarInjection(&ss.Spec.Template, istioSidecarInjected(instance, false))
+	setNotebookImageMirror(instance, container)
+	setImagePullPolicy(container)
+	setDefaultEnvFrom(container)
+	setTTY(instance, container)
+	setTerminationMessagePolicy(container)
+	setNodePool(instance, podSpec)
+	setSpotScheduling(instance, podSpec)
+	setNodeName(instance, podSpec)
+	setScratchVolume(instance, podSpec)
+	setExistingVolumeClaims(instance, podSpec)
+	setSnapshotSidecar(instance, podSpec)
+	setSecurityHardening(instance, podSpec)
+	setDefaultInitContainers(instance, podSpec)
+
+	// The StatefulSet controller honors the grace period when culling scales
+	// it to zero, as well as when the Notebook is deleted.
+	if podSpec.TerminationGracePeriodSeconds == nil {
+		podSpec.TerminationGracePeriodSeconds = pointer.Int64(getTerminationGracePeriod())
+	}
+	setProjectedToken(instance, podSpec)
+	setServiceAccount(instance, podSpec)
+
+	// The StatefulSet governs the pod DNS names through the notebook Service,
+	// e.g. <name>-0.<name>.<namespace>.svc. The field is immutable, so it is
+	// only set on new StatefulSets.
+	if value, exists := os.LookupEnv("SET_STATEFULSET_SERVICE_NAME"); !exists || value == "true" {
+		ss.Spec.ServiceName = serviceName(instance)
+		if useHeadlessService(instance) {
+			ss.Spec.ServiceName = headlessServiceName(instance)
+		}
+	}
+
+	// For some platforms (like OpenShift), adding fsGroup: 100 is troublesome.
+	// This allows for those platforms to bypass the automatic addition of the fsGroup
+	// and will allow for the Pod Security Policy controller to make an appropriate choice
+	// https://github.com/kubernetes-sigs/controller-runtime/issues/4617
+	if value, exists := os.LookupEnv("ADD_FSGROUP"); !exists || value == "true" {
+		if podSpec.SecurityContext == nil {
+			fsGroup := DefaultFSGroup
+			podSpec.SecurityContext = &corev1.PodSecurityContext{
+				FSGroup: &fsGroup,
+			}
+		}
+	}
+
+	// Applied after the fsGroup, which is only defaulted without a context.
+	if profile := getSeccompProfile(); profile != nil {
+		if podSpec.SecurityContext == nil {
+			podSpec.SecurityContext = &corev1.PodSecurityContext{}
+		}
+		if podSpec.SecurityContext.SeccompProfile == nil {
+			podSpec.SecurityContext.SeccompProfile = profile
+		}
+	}
+	setCommonMetadata(ss)
+	return ss
+}
+
+// getSeccompProfile returns the seccomp profile of the notebook pods from
+// SECCOMP_PROFILE: RuntimeDefault, Unconfined or Localhost/<profile path>.
+// It defaults to RuntimeDefault when HARDEN_SECURITY is "true", and to none
+// otherwise.
+func getSeccompProfile() *corev1.SeccompProfile {
+	value, ok := os.LookupEnv("SECCOMP_PROFILE")
+	if !ok && os.Getenv("HARDEN_SECURITY") == "true" {
+		value = string(corev1.SeccompProfileTypeRuntimeDefault)
+	}
+	parts := strings.SplitN(value, "/", 2)
+	switch profileType := corev1.SeccompProfileType(parts[0]); profileType {
+	case corev1.SeccompProfileTypeRuntimeDefault, corev1.SeccompProfileTypeUnconfined:
+		return &corev1.SeccompProfile{Type: profileType}
+	case corev1.SeccompProfileTypeLocalhost:
+		if len(parts) == 2 && parts[1] != "" {
+			return &corev1.SeccompProfile{Type: profileType, LocalhostProfile: &parts[1]}
+		}
+	}
+	return nil
+}
+
+// mirroredImage returns the image pulled through REGISTRY_NAME when IS_CLOSED
+// is "true", e.g. registry.local:5000/docker.io/jupyter/base-notebook for the
+// prefix "registry.local:5000/". Images without a registry are from docker.io.
+// An image already under the prefix is kept.
+func mirroredImage(image string) string {
+	registryName := os.Getenv("REGISTRY_NAME")
+	if os.Getenv("IS_CLOSED") != "true" || strings.HasPrefix(image, registryName) {
+		return image
+	}
+	return registryName + fullImageName(image)
+}
+
+// fullImageName returns the image with its registry, docker.io for the images
+// without one, e.g. docker.io/library/python:3.9 for python:3.9.
+func fullImageName(image string) string {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return "docker.io/library/" + image
+	}
+	if host := image[:i]; !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return "docker.io/" + image
+	}
+	return image
+}
+
+// setNotebookImageMirror pulls the notebook image through the registry mirror
+// when MIRROR_NOTEBOOK_IMAGE is "true", unless the Notebook opts out with
+// AnnotationRegistryMirror, e.g. for an image of an internal registry.
+func setNotebookImageMirror(instance *v1.Notebook, container *corev1.Container) {
+	if os.Getenv("MIRROR_NOTEBOOK_IMAGE") != "true" || instance.ObjectMeta.Annotations[AnnotationRegistryMirror] == "false" {
+		return
+	}
+	container.Image = mirroredImage(container.Image)
+}
+
+// generateGatekeeperContainer returns the gatekeeper sidecar, which terminates
+// TLS and authenticates the users with OIDC before proxying to the notebook.
+func generateGatekeeperContainer(instance *v1.Notebook) corev1.Container {
+	clientsecret := os.Getenv("CLIENT_SECRET")
+	discoveryurl := os.Getenv("DISCOVERY_URL")
+	gatekeeperVersion := os.Getenv("GATEKEEPER_VERSION")
+
+	image := mirroredImage("docker.io/tmaxcloudck/gatekeeper:" + gatekeeperVersion)
+
+	args := []string{
+		"--client-id=notebook-gatekeeper",
+		"--client-secret=" + clientsecret,
+		"--listen=:" + strconv.Itoa(GatekeeperPort),
+		"--upstream-url=http://127.0.0.1:" + strconv.Itoa(int(notebookPort(instance))),
+		"--discovery-url=" + discoveryurl,
+		"--secure-cookie=false",
+		"--upstream-keepalives=false",
+		"--skip-openid-provider-tls-verify=true",
+		"--skip-upstream-tls-verify=true",
+	}
+	args = append(args, "--tls-min-version="+getGatekeeperTLSMinVersion())
+	if cipherSuites := getGatekeeperTLSCipherSuites(); len(cipherSuites) > 0 {
+		args = append(args, "--tls-cipher-suites="+strings.Join(cipherSuites, ","))
+	}
+	var volumeMounts []corev1.VolumeMount
+	if tlsSecretName(instance) == "" {
+		args = append(args, "--enable-self-signed-tls=true")
+	} else {
+		args = append(args,
+			"--tls-cert=/etc/secrets/tls.crt",
+			"--tls-private-key=/etc/secrets/tls.key",
+			"--tls-ca-certificate=/etc/secrets/ca.crt",
+			"--enable-self-signed-tls=false",
+		)
+		volumeMounts = []corev1.VolumeMount{
+			{
+				Name:      "secret",
+				MountPath: "/etc/secrets",
+			},
+		}
+	}
+	args = append(args,
+		"--enable-refresh-tokens=true",
+		"--enable-default-deny=true",
+		"--enable-metrics=true",
+		"--encryption-key=AgXa7xRcoClDEU0ZDSH4X0XhL5Qy2Z2j",
+		"--resources=uri="+getGatekeeperResources()+"|roles="+strings.Join(getGatekeeperRoles(instance), ","),
+		"--log-level="+getGatekeeperLogLevel(instance),
+	)
+
+	container := corev1.Container{
+		Name:  "gatekeeper",
+		Image: image,
+		Args:  args,
+		Ports: []corev1.ContainerPort{
+			{
+				Name:          "service",
+				ContainerPort: GatekeeperPort,
+			},
+		},
+		VolumeMounts: volumeMounts,
+	}
+	setImagePullPolicy(&container)
+	return container
+}
+
+// getGatekeeperLogLevel returns the log level of the gatekeeper, from
+// AnnotationGatekeeperLogLevel if it is a known level and else LOG_LEVEL.
+func getGatekeeperLogLevel(instance *v1.Notebook) string {
+	switch level := instance.ObjectMeta.Annotations[AnnotationGatekeeperLogLevel]; level {
+	case "debug", "info", "warn", "error":
+		return level
+	}
+	return os.Getenv("LOG_LEVEL")
+}
+
+// getGatekeeperTLSMinVersion returns the minimum TLS version the gatekeeper
+// accepts. Uses ENV var: GATEKEEPER_TLS_MIN_VERSION
+func getGatekeeperTLSMinVersion() string {
+	switch version := os.Getenv("GATEKEEPER_TLS_MIN_VERSION"); version {
+	case "tlsv1.0", "tlsv1.1", "tlsv1.2", "tlsv1.3":
+		return version
+	}
+	return DefaultGatekeeperTLSMinVersion
+}
+
+// getGatekeeperTLSCipherSuites returns the cipher suites the gatekeeper is
+// restricted to, from the comma-separated GATEKEEPER_TLS_CIPHER_SUITES. Only
+// the secure suites of crypto/tls are accepted, others are dropped.
+func getGatekeeperTLSCipherSuites() []string {
+	secure := make(map[string]bool)
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = true
+	}
+	var cipherSuites []string
+	for _, name := range splitList(os.Getenv("GATEKEEPER_TLS_CIPHER_SUITES")) {
+		if secure[name] {
+			cipherSuites = append(cipherSuites, name)
+		}
+	}
+	return cipherSuites
+}
+
+// getGatekeeperResources returns GATEKEEPER_RESOURCES, or
+// DefaultGatekeeperResources if it isn't a valid URI pattern.
+func getGatekeeperResources() string {
+	uri := os.Getenv("GATEKEEPER_RESOURCES")
+	if !strings.HasPrefix(uri, "/") || strings.ContainsAny(uri, "| \t") {
+		return DefaultGatekeeperResources
+	}
+	return uri
+}
+
+// getGatekeeperRoles returns the roles from AnnotationGatekeeperRoles or
+// GATEKEEPER_ROLES, or DefaultGatekeeperRoles. A list with an invalid role is
+// ignored as a whole, rather than granting access without that role.
+func getGatekeeperRoles(instance *v1.Notebook) []string {
+	for _, value := range []string{instance.ObjectMeta.Annotations[AnnotationGatekeeperRoles], os.Getenv("GATEKEEPER_ROLES")} {
+		roles := splitList(value)
+		valid := len(roles) > 0
+		for _, role := range roles {
+			valid = valid && !strings.ContainsAny(role, "|= \t")
+		}
+		if valid {
+			return roles
+		}
+	}
+	return splitList(DefaultGatekeeperRoles)
+}
+
+// notebookContainerName returns the name of the notebook container: the
+// container of AnnotationPrimaryContainer, the container named after the
+// Notebook, as the Kubeflow spawner names it, or else the first container of
+// its template.
+func notebookContainerName(instance *v1.Notebook) string {
+	containers := instance.Spec.Template.Spec.Containers
+	if c := findContainerByName(containers, instance.ObjectMeta.Annotations[AnnotationPrimaryContainer]); c != nil {
+		return c.Name
+	}
+	if c := findContainerByName(containers, instance.Name); c != nil {
+		return c.Name
+	}
+	if len(containers) > 0 {
+		return containers[0].Name
+	}
+	return ""
+}
+
+// usesGPU returns true if a container of the pod requests a GPU resource, e.g.
+// nvidia.com/gpu. Extended resources may only set the limits.
+func usesGPU(podSpec *corev1.PodSpec) bool {
+	for _, c := range podSpec.Containers {
+		for _, list := range []corev1.ResourceList{c.Resources.Requests, c.Resources.Limits} {
+			for name, quantity := range list {
+				if strings.HasSuffix(string(name), "/gpu") && !quantity.IsZero() {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// findContainerByName returns the container with the name, or nil.
+func findContainerByName(containers []corev1.Container, name string) *corev1.Container {
+	for i := range containers {
+		if containers[i].Name == name {
+			return &containers[i]
+		}
+	}
+	return nil
+}
+
+// notebookContainer returns the notebook container of a pod spec generated
+// for the Notebook, wherever the sidecars were added.
+func notebookContainer(instance *v1.Notebook, podSpec *corev1.PodSpec) *corev1.Container {
+	if c := findContainerByName(podSpec.Containers, notebookContainerName(instance)); c != nil {
+		return c
+	}
+	return &podSpec.Containers[0]
+}
+
+// notebookPort returns the port the notebook container serves on, from
+// AnnotationContainerPort or the first port of the container. The Service,
+// the gatekeeper upstream and the probes all target it.
+func notebookPort(instance *v1.Notebook) int32 {
+	if value, ok := instance.ObjectMeta.Annotations[AnnotationContainerPort]; ok {
+		if port, err := strconv.ParseInt(value, 10, 32); err == nil && port > 0 && port <= 65535 {
+			return int32(port)
+		}
+	}
+	containerPorts := notebookContainer(instance, &instance.Spec.Template.Spec).Ports
+	if len(containerPorts) > 0 {
+		return containerPorts[0].ContainerPort
+	}
+	return DefaultContainerPort
+}
 
-	// For some platforms (like OpenShift), adding fsGroup: 100 is troublesome.
-	// This allows for those platforms to bypass the automatic addition of the fsGroup
-	// and will allow for the Pod Security Policy controller to make an appropriate choice
-	// https://github.com/kubernetes-sigs/controller-runtime/issues/4617
-	if value, exists := os.LookupEnv("ADD_FSGROUP"); !exists || value == "true" {
-		if podSpec.SecurityContext == nil {
-			fsGroup := DefaultFSGroup
-			podSpec.SecurityContext = &corev1.PodSecurityContext{
-				FSGroup: &fsGroup,
-			}
+// setReadinessProbe probes the notebook API under the NB_PREFIX the container
+// serves with, unless the Notebook defines its own probe. It is only set when
+// the controller runs jupyter lab, as other images (e.g. code-server or
+// RStudio) don't serve <NB_PREFIX>/api and would never become ready.
+func setReadinessProbe(instance *v1.Notebook, container *corev1.Container) {
+	if container.ReadinessProbe != nil {
+		return
+	}
+	prefix := ""
+	for _, envVar := range container.Env {
+		if envVar.Name == PrefixEnvVar {
+			prefix = strings.TrimSuffix(envVar.Value, "/")
 		}
 	}
-	return ss
+	port := notebookPort(instance)
+	container.ReadinessProbe = &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path:   prefix + "/api",
+				Port:   intstr.FromInt(int(port)),
+				Scheme: corev1.URISchemeHTTP,
+			},
+		},
+		InitialDelaySeconds: 5,
+		PeriodSeconds:       10,
+		FailureThreshold:    3,
+	}
+}
+
+// getStartupProbeTimeout returns STARTUP_PROBE_TIMEOUT, or
+// DefaultStartupProbeTimeout if it isn't a valid number of seconds.
+func getStartupProbeTimeout() int32 {
+	if value, ok := os.LookupEnv("STARTUP_PROBE_TIMEOUT"); ok {
+		if seconds, err := strconv.ParseInt(value, 10, 32); err == nil && seconds >= 0 {
+			return int32(seconds)
+		}
+	}
+	return DefaultStartupProbeTimeout
+}
+
+// setStartupProbe holds the liveness and readiness probes of the notebook
+// container back for up to STARTUP_PROBE_TIMEOUT seconds, so a slow image
+// isn't restarted before it serves. It probes like the readiness probe, which
+// may be the Notebook's own. A startup probe of the Notebook is kept.
+func setStartupProbe(container *corev1.Container) {
+	timeout := getStartupProbeTimeout()
+	if container.StartupProbe != nil || container.ReadinessProbe == nil || timeout == 0 {
+		return
+	}
+	const period = 10
+	container.StartupProbe = &corev1.Probe{
+		ProbeHandler:     *container.ReadinessProbe.ProbeHandler.DeepCopy(),
+		PeriodSeconds:    period,
+		FailureThreshold: (timeout + period - 1) / period,
+	}
 }
 
 func generateService(instance *v1.Notebook) *corev1.Service {
@@ -641,57 +3444,401 @@ func generateService(instance *v1.Notebook) *corev1.Service {
 		port = int(containerPorts[0].ContainerPort)
 	}*/
 	serverstransport := os.Getenv("SERVERSTRANSPORT")
+	targetPort := intstr.FromInt(GatekeeperPort)
+	if !useGatekeeper() {
+		targetPort = intstr.FromInt(int(notebookPort(instance)))
+	}
+	serviceType := corev1.ServiceType(os.Getenv("SERVICE_TYPE"))
+	switch serviceType {
+	case corev1.ServiceTypeNodePort, corev1.ServiceTypeLoadBalancer:
+	default:
+		serviceType = corev1.ServiceTypeClusterIP
+	}
 
 	
 	svc := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      instance.Name,
+			Name:      serviceName(instance),
 			Namespace: instance.Namespace,
 			Annotations: map[string]string{
 				"traefik.ingress.kubernetes.io/service.serverstransport": serverstransport,				
 			},
 		},
 		Spec: corev1.ServiceSpec{
-			Type:     "ClusterIP",
+			Type:     serviceType,
 			Selector: map[string]string{"statefulset": instance.Name},
 			Ports: []corev1.ServicePort{
 				{
 					// Make port name follow Istio pattern so it can be managed by istio rbac
 					Name:       "https-" + instance.Name,
 					Port:       int32(HttpsServingPort),
-					TargetPort: intstr.FromInt(3000),
+					TargetPort: targetPort,
+					Protocol:   "TCP",
+				},
+			},
+		},
+	}
+	for _, port := range extraPorts(instance) {
+		svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{
+			Name:       port.Name,
+			Port:       port.Port,
+			TargetPort: intstr.FromInt(int(port.Port)),
+			Protocol:   "TCP",
+		})
+	}
+
+	// Cloud load balancers are configured through Service annotations, e.g.
+	// service.beta.kubernetes.io/aws-load-balancer-internal: "true".
+	if serviceType == corev1.ServiceTypeLoadBalancer {
+		lbAnnotations := make(map[string]string)
+		if err := json.Unmarshal([]byte(os.Getenv("SERVICE_LB_ANNOTATIONS")), &lbAnnotations); err == nil {
+			for k, v := range lbAnnotations {
+				svc.Annotations[k] = v
+			}
+		}
+	}
+	setCommonMetadata(svc)
+	return svc
+}
+
+// extraPorts returns the valid ports of spec.ports. Ports without a DNS label
+// name, out of range, or clashing with the notebook Service port or an earlier
+// port are skipped, so one bad entry doesn't break the Service.
+func extraPorts(instance *v1.Notebook) []v1.NotebookPort {
+	names := map[string]bool{"https-" + instance.Name: true, "http-" + instance.Name: true}
+	numbers := map[int32]bool{HttpsServingPort: true}
+	var ports []v1.NotebookPort
+	for _, port := range instance.Spec.Ports {
+		if len(validation.IsDNS1123Label(port.Name)) > 0 || port.Port < 1 || port.Port > 65535 {
+			continue
+		}
+		if names[port.Name] || numbers[port.Port] {
+			continue
+		}
+		names[port.Name] = true
+		numbers[port.Port] = true
+		port.Path = strings.Trim(port.Path, "/")
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+// serviceName returns the name of the notebook Service.
+func serviceName(instance *v1.Notebook) string {
+	return instance.Name
+}
+
+// headlessServiceName returns the name of the headless Service of a Notebook.
+func headlessServiceName(instance *v1.Notebook) string {
+	return rfc1123Name(instance.Name + "-headless")
+}
+
+// useHeadlessService returns true if the Notebook gets a headless Service.
+// Uses ENV var: HEADLESS_SERVICE
+func useHeadlessService(instance *v1.Notebook) bool {
+	if value, ok := instance.ObjectMeta.Annotations[AnnotationHeadlessService]; ok {
+		return value == "true"
+	}
+	return os.Getenv("HEADLESS_SERVICE") == "true"
+}
+
+// generateHeadlessService returns the headless Service of a Notebook. Its
+// ports go straight to the notebook container, as the clients address the
+// pods without the gatekeeper in front. The addresses are published before
+// the pods are ready, so the workers can find each other while starting.
+func generateHeadlessService(instance *v1.Notebook) *corev1.Service {
+	port := notebookPort(instance)
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      headlessServiceName(instance),
+			Namespace: instance.Namespace,
+			Labels:    controllerLabels(instance),
+		},
+		Spec: corev1.ServiceSpec{
+			Type:                     corev1.ServiceTypeClusterIP,
+			ClusterIP:                corev1.ClusterIPNone,
+			PublishNotReadyAddresses: true,
+			Selector:                 map[string]string{"statefulset": instance.Name},
+			Ports: []corev1.ServicePort{
+				{
+					Name:       "http-" + instance.Name,
+					Port:       port,
+					TargetPort: intstr.FromInt(int(port)),
 					Protocol:   "TCP",
 				},
 			},
 		},
 	}
+	for _, extra := range extraPorts(instance) {
+		if extra.Port == port {
+			continue
+		}
+		svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{
+			Name:       extra.Name,
+			Port:       extra.Port,
+			TargetPort: intstr.FromInt(int(extra.Port)),
+			Protocol:   "TCP",
+		})
+	}
+	setCommonMetadata(svc)
 	return svc
 }
 
+// reconcileHeadlessService creates or updates the headless Service of a
+// Notebook.
+func (r *NotebookReconciler) reconcileHeadlessService(ctx context.Context, instance *v1.Notebook, log logr.Logger) error {
+	service := generateHeadlessService(instance)
+	if err := ctrl.SetControllerReference(instance, service, r.Scheme); err != nil {
+		return err
+	}
+	foundService := &corev1.Service{}
+	err := r.Get(ctx, types.NamespacedName{Name: service.Name, Namespace: service.Namespace}, foundService)
+	if err != nil && apierrs.IsNotFound(err) {
+		log.Info("Creating headless Service", "namespace", service.Namespace, "name", service.Name)
+		return r.Create(ctx, service)
+	} else if err != nil {
+		return err
+	}
+	if reconcilehelper.CopyServiceFields(service, foundService) {
+		log.Info("Updating headless Service", "namespace", service.Namespace, "name", service.Name)
+		return r.Update(ctx, foundService)
+	}
+	return nil
+}
+
+// controllerLabels are the labels set on the generated resources that aren't
+// selected by the StatefulSet, so they can be found and cleaned up per Notebook.
+func controllerLabels(instance *v1.Notebook) map[string]string {
+	return map[string]string{
+		"notebook-name":                instance.Name,
+		"app.kubernetes.io/managed-by": "notebook-controller",
+	}
+}
+
+// commonMetadata returns the labels of COMMON_LABELS and the annotations of
+// COMMON_ANNOTATIONS, JSON objects set on every generated resource, e.g.
+// {"team": "ml", "cost-center": "1234"} for cost allocation.
+func commonMetadata() (map[string]string, map[string]string) {
+	labels := make(map[string]string)
+	if err := json.Unmarshal([]byte(os.Getenv("COMMON_LABELS")), &labels); err != nil {
+		labels = nil
+	}
+	annotations := make(map[string]string)
+	if err := json.Unmarshal([]byte(os.Getenv("COMMON_ANNOTATIONS")), &annotations); err != nil {
+		annotations = nil
+	}
+	return labels, annotations
+}
+
+// setCommonMetadata adds the common labels and annotations to a generated
+// resource. The ones the controller sets itself take precedence.
+func setCommonMetadata(obj metav1.Object) {
+	labels, annotations := commonMetadata()
+	if len(labels) > 0 {
+		merged := obj.GetLabels()
+		if merged == nil {
+			merged = make(map[string]string)
+		}
+		for k, v := range labels {
+			if _, ok := merged[k]; !ok {
+				merged[k] = v
+			}
+		}
+		obj.SetLabels(merged)
+	}
+	if len(annotations) > 0 {
+		merged := obj.GetAnnotations()
+		if merged == nil {
+			merged = make(map[string]string)
+		}
+		for k, v := range annotations {
+			if _, ok := merged[k]; !ok {
+				merged[k] = v
+			}
+		}
+		obj.SetAnnotations(merged)
+	}
+}
+
 func ingressName(kfName string, namespace string) string {
 	return fmt.Sprintf("%s-%s", kfName, namespace)
 }
 
-func generateIngress(instance *v1.Notebook) (*netv1.Ingress, error) {
+// rfc1123Name returns name if it is a valid RFC 1123 label. Otherwise the
+// invalid characters are replaced and it is shortened to fit in a label, with
+// a hash of the original name appended to keep it unique. Only what has to be
+// a label goes through it, e.g. the host of the notebook: the Ingress,
+// Certificate and VirtualService names are DNS subdomains, and renaming them
+// would leave the previously named objects behind.
+func rfc1123Name(name string) string {
+	if len(validation.IsDNS1123Label(name)) == 0 {
+		return name
+	}
+	sanitized := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, name)
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	suffix := fmt.Sprintf("-%08x", h.Sum32())
+	if max := validation.DNS1123LabelMaxLength - len(suffix); len(sanitized) > max {
+		sanitized = sanitized[:max]
+	}
+	return strings.Trim(sanitized, "-") + suffix
+}
+
+// hostLabel returns the first label of the notebook host, the Ingress name
+// made a valid RFC 1123 label.
+func hostLabel(instance *v1.Notebook) string {
+	return rfc1123Name(ingressName(instance.Name, instance.Namespace))
+}
+
+// hostLabelRewritten returns true if rfc1123Name had to rewrite the host label
+// of the Notebook.
+func hostLabelRewritten(instance *v1.Notebook) bool {
+	return hostLabel(instance) != ingressName(instance.Name, instance.Namespace)
+}
+
+// ingressHost returns the host the notebook is served on. With path routing
+// the notebooks share the domain itself.
+func ingressHost(instance *v1.Notebook, customDomain string) string {
+	if host := externalHostname(instance); host != "" {
+		return host
+	}
+	if routingMode(instance) == RoutingModePath {
+		return customDomain
+	}
+	return hostLabel(instance) + "." + customDomain
+}
+
+// ingressPath returns the path the notebook is served under on its host.
+func ingressPath(instance *v1.Notebook) string {
+	if routingMode(instance) == RoutingModePath {
+		return notebookPrefix(instance)
+	}
+	return "/"
+}
+
+// istioInjectionEnabled returns true if the namespace is labeled for istio
+// sidecar injection.
+func (r *NotebookReconciler) istioInjectionEnabled(ctx context.Context, namespace string) (bool, error) {
+	ns := &corev1.Namespace{}
+	if err := r.Get(ctx, types.NamespacedName{Name: namespace}, ns); err != nil && !apierrs.IsNotFound(err) {
+		return false, err
+	}
+	return ns.Labels[IstioInjectionLabel] == "enabled", nil
+}
+
+// istioSidecarInjected returns AnnotationIstioInject if the Notebook sets it,
+// then the sidecar.istio.io/inject annotation of its pod template, or else
+// whether its namespace is labeled for injection.
+func istioSidecarInjected(instance *v1.Notebook, namespaceInjected bool) bool {
+	if injected, err := strconv.ParseBool(instance.Annotations[AnnotationIstioInject]); err == nil {
+		return injected
+	}
+	if injected, err := strconv.ParseBool(instance.Spec.Template.Annotations["sidecar.istio.io/inject"]); err == nil {
+		return injected
+	}
+	return namespaceInjected
+}
+
+// setIstioSidecarInjection lets the notebook pod get the istio sidecar when
+// it is opted in, so that it joins the mesh behind its VirtualService. It is
+// opted out otherwise.
+func setIstioSidecarInjection(template *corev1.PodTemplateSpec, injected bool) {
+	template.ObjectMeta.Annotations["sidecar.istio.io/inject"] = strconv.FormatBool(injected)
+}
+
+// setIstioServicePort names the Service port after the protocol the sidecar
+// proxies. Without the gatekeeper the notebook serves plain HTTP, which istio
+// only routes and secures with mTLS on an http- port.
+func setIstioServicePort(svc *corev1.Service, injected bool) {
+	if injected && !useGatekeeper() {
+		svc.Spec.Ports[0].Name = "http-" + svc.Name
+	}
+}
+
+// getCustomDomain returns the domain of the notebook hosts in the namespace,
+// from AnnotationCustomDomain on the Namespace or else CUSTOM_DOMAIN.
+func (r *NotebookReconciler) getCustomDomain(ctx context.Context, namespace string) (string, error) {
+	ns := &corev1.Namespace{}
+	if err := r.Get(ctx, types.NamespacedName{Name: namespace}, ns); err != nil && !apierrs.IsNotFound(err) {
+		return "", err
+	}
+	if domain := ns.Annotations[AnnotationCustomDomain]; domain != "" {
+		return domain, nil
+	}
+	return os.Getenv("CUSTOM_DOMAIN"), nil
+}
+
+// getIngressClassName returns INGRESS_CLASS_NAME, or DefaultIngressClassName
+// if it isn't set.
+func getIngressClassName() *string {
+	if className := os.Getenv("INGRESS_CLASS_NAME"); className != "" {
+		return &className
+	}
+	return pointer.String(DefaultIngressClassName)
+}
+
+func generateIngress(instance *v1.Notebook, customDomain string) (*netv1.Ingress, error) {
 	name := instance.Name
 	namespace := instance.Namespace
 	var tls []netv1.IngressTLS
-	var ingressclassname = new(string)
-	*ingressclassname = "tmax-cloud"
+	ingressclassname := getIngressClassName()
 /*	if redirect.Expose != nil && redirect.Expose.TLS.Enabled() {
 		tls = []netv1.IngressTLS{{
 			SecretName: redirect.Expose.TLS.CertificateRef,
 			Hosts:      []string{redirect.Expose.Ingress.Host},
 		}}
 	}*/
-	customDomain := os.Getenv("CUSTOM_DOMAIN")
-
-	tls = []netv1.IngressTLS{{		
-		Hosts:      []string{ingressName(name, namespace) + "." + customDomain},
+	tls = []netv1.IngressTLS{{
+		Hosts:      []string{ingressHost(instance, customDomain)},
+		SecretName: os.Getenv("SHARED_TLS_SECRET"),
 	}}
+	// The Certificate of an external hostname is issued for the Ingress too.
+	if externalHostname(instance) != "" {
+		tls[0].SecretName = tlsSecretName(instance)
+	}
 	
 	pathTypePrefix := netv1.PathTypePrefix
-	
+	paths := []netv1.HTTPIngressPath{
+		{
+			Path:     ingressPath(instance),
+			PathType: &pathTypePrefix,
+			Backend: netv1.IngressBackend{
+				Service: &netv1.IngressServiceBackend{
+					Name: instance.Name,
+					Port: netv1.ServiceBackendPort{
+						Number: int32(443),
+					},
+				},
+			},
+		},
+	}
+	// The extra ports with a path are routed under the notebook path.
+	for _, port := range extraPorts(instance) {
+		if port.Path == "" {
+			continue
+		}
+		paths = append(paths, netv1.HTTPIngressPath{
+			Path:     strings.TrimSuffix(ingressPath(instance), "/") + "/" + port.Path,
+			PathType: &pathTypePrefix,
+			Backend: netv1.IngressBackend{
+				Service: &netv1.IngressServiceBackend{
+					Name: instance.Name,
+					Port: netv1.ServiceBackendPort{
+						Number: port.Port,
+					},
+				},
+			},
+		})
+	}
+
 	ingress := &netv1.Ingress{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Ingress",
@@ -705,7 +3852,7 @@ func generateIngress(instance *v1.Notebook) (*netv1.Ingress, error) {
 				"cert-manager.io/cluster-issuer": "tmaxcloud-issuer",
 			},
 			Labels: map[string]string{
-				"ingress.tmaxcloud.org/name":   ingressName(name, namespace),				
+				"ingress.tmaxcloud.org/name":   hostLabel(instance),				
 			},
 		},
 		Spec: netv1.IngressSpec{
@@ -713,46 +3860,33 @@ func generateIngress(instance *v1.Notebook) (*netv1.Ingress, error) {
 			IngressClassName: ingressclassname,
 			Rules: []netv1.IngressRule{
 				{
-					Host: ingressName(name, namespace) + "." + customDomain,
+					Host: ingressHost(instance, customDomain),
 					IngressRuleValue: netv1.IngressRuleValue{
 						HTTP: &netv1.HTTPIngressRuleValue{
-							Paths: []netv1.HTTPIngressPath{
-								{
-									Path:     "/",
-									PathType: &pathTypePrefix,
-									Backend: netv1.IngressBackend{
-										Service: &netv1.IngressServiceBackend{
-											Name: instance.Name,
-											Port: netv1.ServiceBackendPort{
-												Number: int32(443),
-											},
-										},
-									},
-								},
-							},
+							Paths: paths,
 						},
 					},
 				},
 			},
 		},
 	}
+	setCommonMetadata(ingress)
 	return ingress, nil
 }
 
-func (r *NotebookReconciler) reconcileIngress(instance *v1.Notebook) error {	
-	log := r.Log.WithValues("notebook", instance.Namespace)
-	ingress, err := generateIngress(instance)
+func (r *NotebookReconciler) reconcileIngress(ctx context.Context, instance *v1.Notebook, customDomain string, log logr.Logger) error {
+	ingress, err := generateIngress(instance, customDomain)
 	if err := ctrl.SetControllerReference(instance, ingress, r.Scheme); err != nil {
 		return err
 	}
 	// ingress 존재 체크
 	foundIngress := &netv1.Ingress{}
 	justCreated := false	
-	err = r.Get(context.TODO(), types.NamespacedName{Name: ingressName(instance.Name,
+	err = r.Get(ctx, types.NamespacedName{Name: ingressName(instance.Name,
 		instance.Namespace), Namespace: instance.Namespace}, foundIngress)
 	if err != nil && apierrs.IsNotFound(err) {
 		log.Info("Creating Ingress", "namespace", ingress.Namespace, "name", ingressName(instance.Name, instance.Namespace))
-		err = r.Create(context.TODO(), ingress)
+		err = r.Create(ctx, ingress)
 		justCreated = true
 		if err != nil {
 			return err
@@ -763,7 +3897,7 @@ func (r *NotebookReconciler) reconcileIngress(instance *v1.Notebook) error {
 
 	if !justCreated && reconcilehelper.CopyIngress(ingress, foundIngress) {
 		log.Info("Updating Ingress\n", "namespace", ingress.Namespace, "name", ingressName(instance.Name, instance.Namespace))
-		err = r.Update(context.TODO(), foundIngress)
+		err = r.Update(ctx, foundIngress)
 		if err != nil {
 			return err
 		}
@@ -776,7 +3910,7 @@ func certificateName(kfName string, namespace string) string {
 	return fmt.Sprintf("cert-%s-%s", namespace, kfName)
 }
 
-func generateCertificate(instance *v1.Notebook) (*unstructured.Unstructured, error) {
+func generateCertificate(instance *v1.Notebook, customDomain string) (*unstructured.Unstructured, error) {
 	name := instance.Name
 	namespace := instance.Namespace
 	cert := &unstructured.Unstructured{}
@@ -784,8 +3918,9 @@ func generateCertificate(instance *v1.Notebook) (*unstructured.Unstructured, err
 	cert.SetKind("Certificate")
 	cert.SetName(certificateName(name, namespace))
 	cert.SetNamespace(namespace)
+	cert.SetLabels(controllerLabels(instance))
 	
-	secretname := fmt.Sprintf("%s-secret", name)
+	secretname := tlsSecretName(instance)
 	if err := unstructured.SetNestedField(cert.Object, secretname, "spec", "secretName"); err != nil {
 		return nil, fmt.Errorf("Set .spec.secretName error: %v", err)
 	}
@@ -796,6 +3931,14 @@ func generateCertificate(instance *v1.Notebook) (*unstructured.Unstructured, err
 	dnsnames := []string{
 		"tmax-cloud",
 	}
+	if host := externalHostname(instance); host != "" {
+		dnsnames = append(dnsnames, host)
+		if err := unstructured.SetNestedField(cert.Object, host, "spec", "commonName"); err != nil {
+			return nil, fmt.Errorf("Set .spec.commonName error: %v", err)
+		}
+	} else if customDomain != "" {
+		dnsnames = append(dnsnames, ingressHost(instance, customDomain))
+	}
 	if err := unstructured.SetNestedStringSlice(cert.Object, dnsnames, "spec", "dnsNames"); err != nil {
 		return nil, fmt.Errorf("Set .spec.dnsNames error: %v", err)
 	}
@@ -818,26 +3961,43 @@ func generateCertificate(instance *v1.Notebook) (*unstructured.Unstructured, err
 	if err := unstructured.SetNestedStringMap(cert.Object, issuerref, "spec", "issuerRef"); err != nil {
 		return nil, fmt.Errorf("Set .spec.issuerref error: %v", err)
 	}	
+	setCommonMetadata(cert)
 
 	return cert, nil
 }
 
-func (r *NotebookReconciler) reconcileCertificate(instance *v1.Notebook) error {	
-	log := r.Log.WithValues("notebook", instance.Namespace)
-	certificate, err := generateCertificate(instance)
+// kindInstalled returns true if the API server serves the kind of obj, e.g.
+// false for a cert-manager Certificate when its CRD isn't installed.
+func kindInstalled(mapper meta.RESTMapper, obj runtime.Object) (bool, error) {
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	_, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// newCertificateObject returns an empty cert-manager Certificate to read into.
+func newCertificateObject() *unstructured.Unstructured {
+	certificate := &unstructured.Unstructured{}
+	certificate.SetAPIVersion("cert-manager.io/v1")
+	certificate.SetKind("Certificate")
+	return certificate
+}
+
+func (r *NotebookReconciler) reconcileCertificate(ctx context.Context, instance *v1.Notebook, customDomain string, log logr.Logger) error {
+	certificate, err := generateCertificate(instance, customDomain)
 	if err := ctrl.SetControllerReference(instance, certificate, r.Scheme); err != nil {
 		return err
 	}
 	// certificate 존재 체크
-	foundCertificate := &unstructured.Unstructured{}
+	foundCertificate := newCertificateObject()
 	justCreated := false
-	foundCertificate.SetAPIVersion("cert-manager.io/v1")
-	foundCertificate.SetKind("Certificate")	
-	err = r.Get(context.TODO(), types.NamespacedName{Name: certificateName(instance.Name,
+	err = r.Get(ctx, types.NamespacedName{Name: certificateName(instance.Name,
 		instance.Namespace), Namespace: instance.Namespace}, foundCertificate)
 	if err != nil && apierrs.IsNotFound(err) {
 		log.Info("Creating Certificate", "namespace", instance.Namespace, "name", certificateName(instance.Name, instance.Namespace))
-		err = r.Create(context.TODO(), certificate)
+		err = r.Create(ctx, certificate)
 		justCreated = true
 		if err != nil {
 			return err
@@ -848,7 +4008,7 @@ func (r *NotebookReconciler) reconcileCertificate(instance *v1.Notebook) error {
 
 	if !justCreated && reconcilehelper.CopyCertificate(certificate, foundCertificate) {
 		log.Info("Updating Certificate\n", "namespace", instance.Namespace, "name", certificateName(instance.Name, instance.Namespace))
-		err = r.Update(context.TODO(), foundCertificate)
+		err = r.Update(ctx, foundCertificate)
 		if err != nil {
 			return err
 		}
@@ -857,15 +4017,30 @@ func (r *NotebookReconciler) reconcileCertificate(instance *v1.Notebook) error {
 	return nil
 }
 
+// splitList splits a comma-separated list, dropping blank items.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func virtualServiceName(kfName string, namespace string) string {
 	return fmt.Sprintf("notebook-%s-%s", namespace, kfName)
 }
 
-func generateVirtualService(instance *v1.Notebook) (*unstructured.Unstructured, error) {
+func generateVirtualService(instance *v1.Notebook, customDomain string) (*unstructured.Unstructured, error) {
 	name := instance.Name
 	namespace := instance.Namespace
 	clusterDomain := "cluster.local"
 	prefix := fmt.Sprintf("/notebook/%s/%s/", namespace, name)
+	mode := routingMode(instance)
+	if mode == RoutingModeSubdomain {
+		prefix = "/"
+	}
 
 	// unpack annotations from Notebook resource
 	annotations := make(map[string]string)
@@ -873,7 +4048,7 @@ func generateVirtualService(instance *v1.Notebook) (*unstructured.Unstructured,
 		annotations[k] = v
 	}
 
-	rewrite := fmt.Sprintf("/notebook/%s/%s/", namespace, name)
+	rewrite := prefix
 	// If AnnotationRewriteURI is present, use this value for "rewrite"
 	if _, ok := annotations[AnnotationRewriteURI]; ok && len(annotations[AnnotationRewriteURI]) > 0 {
 		rewrite = annotations[AnnotationRewriteURI]
@@ -889,15 +4064,32 @@ func generateVirtualService(instance *v1.Notebook) (*unstructured.Unstructured,
 	vsvc.SetKind("VirtualService")
 	vsvc.SetName(virtualServiceName(name, namespace))
 	vsvc.SetNamespace(namespace)
-	if err := unstructured.SetNestedStringSlice(vsvc.Object, []string{"*"}, "spec", "hosts"); err != nil {
+	vsvc.SetLabels(controllerLabels(instance))
+	// If AnnotationIstioHost is present, use its comma-separated hosts instead of the wildcard
+	hosts := []string{"*"}
+	if mode == RoutingModeSubdomain {
+		hosts = []string{ingressHost(instance, customDomain)}
+	}
+	if value, ok := annotations[AnnotationIstioHost]; ok && len(splitList(value)) > 0 {
+		hosts = splitList(value)
+	}
+	// The external hostname wins, so the route always matches the Certificate.
+	if host := externalHostname(instance); host != "" {
+		hosts = []string{host}
+	}
+	if err := unstructured.SetNestedStringSlice(vsvc.Object, hosts, "spec", "hosts"); err != nil {
 		return nil, fmt.Errorf("Set .spec.hosts error: %v", err)
 	}
 
-	istioGateway := os.Getenv("ISTIO_GATEWAY")
-	if len(istioGateway) == 0 {
-		istioGateway = "kubeflow/kubeflow-gateway"
+	// If AnnotationIstioGateway is present, use its comma-separated gateways instead of ISTIO_GATEWAY
+	istioGateways := splitList(os.Getenv("ISTIO_GATEWAY"))
+	if value, ok := annotations[AnnotationIstioGateway]; ok && len(splitList(value)) > 0 {
+		istioGateways = splitList(value)
 	}
-	if err := unstructured.SetNestedStringSlice(vsvc.Object, []string{istioGateway},
+	if len(istioGateways) == 0 {
+		istioGateways = []string{"kubeflow/kubeflow-gateway"}
+	}
+	if err := unstructured.SetNestedStringSlice(vsvc.Object, istioGateways,
 		"spec", "gateways"); err != nil {
 		return nil, fmt.Errorf("Set .spec.gateways error: %v", err)
 	}
@@ -917,63 +4109,170 @@ func generateVirtualService(instance *v1.Notebook) (*unstructured.Unstructured,
 		headersRequestSetInterface[key] = element
 	}
 
+	// If AnnotationHTTPTimeout is present and a valid duration, use it as the route timeout
+	timeout := DefaultHTTPTimeout
+	if value, ok := annotations[AnnotationHTTPTimeout]; ok && len(value) > 0 {
+		if _, err := time.ParseDuration(value); err == nil {
+			timeout = value
+		}
+	}
+
 	// the http section of the istio VirtualService spec
-	http := []interface{}{
-		map[string]interface{}{
-			"headers": map[string]interface{}{
-				"request": map[string]interface{}{
-					"set": headersRequestSetInterface,
+	route := map[string]interface{}{
+		"headers": map[string]interface{}{
+			"request": map[string]interface{}{
+				"set": headersRequestSetInterface,
+			},
+		},
+		"match": []interface{}{
+			map[string]interface{}{
+				"uri": map[string]interface{}{
+					"prefix": prefix,
+				},
+			},
+		},
+		"rewrite": map[string]interface{}{
+			"uri": rewrite,
+		},
+		"route": []interface{}{
+			map[string]interface{}{
+				"destination": map[string]interface{}{
+					"host": service,
+					"port": map[string]interface{}{
+						"number": int64(DefaultServingPort),
+					},
 				},
 			},
+		},
+		"timeout": timeout,
+	}
+
+	// If AnnotationHTTPRetries is present and a non-negative number, use it as the retry attempts
+	if value, ok := annotations[AnnotationHTTPRetries]; ok && len(value) > 0 {
+		if attempts, err := strconv.Atoi(value); err == nil && attempts >= 0 {
+			route["retries"] = map[string]interface{}{
+				"attempts": int64(attempts),
+			}
+		}
+	}
+	// If AnnotationHTTPCorsPolicy is present and valid, use it as the route "corsPolicy"
+	if value, ok := annotations[AnnotationHTTPCorsPolicy]; ok && len(value) > 0 {
+		if policy, err := parseCorsPolicy(value); err == nil {
+			route["corsPolicy"] = policy
+		}
+	}
+	http := []interface{}{route}
+
+	// The extra ports with a path are routed under the notebook prefix. istio
+	// matches the routes in order, so they go before the notebook route.
+	var portRoutes []interface{}
+	for _, port := range extraPorts(instance) {
+		if port.Path == "" {
+			continue
+		}
+		portRoutes = append(portRoutes, map[string]interface{}{
 			"match": []interface{}{
 				map[string]interface{}{
 					"uri": map[string]interface{}{
-						"prefix": prefix,
+						"prefix": prefix + port.Path + "/",
 					},
 				},
 			},
-			"rewrite": map[string]interface{}{
-				"uri": rewrite,
-			},
 			"route": []interface{}{
 				map[string]interface{}{
 					"destination": map[string]interface{}{
 						"host": service,
 						"port": map[string]interface{}{
-							"number": int64(DefaultServingPort),
+							"number": int64(port.Port),
 						},
 					},
 				},
 			},
-		},
+			"timeout": timeout,
+		})
 	}
+	http = append(portRoutes, http...)
 
 	// add http section to istio VirtualService spec
 	if err := unstructured.SetNestedSlice(vsvc.Object, http, "spec", "http"); err != nil {
 		return nil, fmt.Errorf("Set .spec.http error: %v", err)
 	}
+	setCommonMetadata(vsvc)
 
 	return vsvc, nil
 
 }
 
-func (r *NotebookReconciler) reconcileVirtualService(instance *v1.Notebook) error {
-	log := r.Log.WithValues("notebook", instance.Namespace)
-	virtualService, err := generateVirtualService(instance)
+// corsPolicy is the subset of the istio CorsPolicy accepted in
+// AnnotationHTTPCorsPolicy.
+type corsPolicy struct {
+	AllowOrigins     []map[string]string `json:"allowOrigins"`
+	AllowMethods     []string            `json:"allowMethods,omitempty"`
+	AllowHeaders     []string            `json:"allowHeaders,omitempty"`
+	ExposeHeaders    []string            `json:"exposeHeaders,omitempty"`
+	MaxAge           string              `json:"maxAge,omitempty"`
+	AllowCredentials *bool               `json:"allowCredentials,omitempty"`
+}
+
+// parseCorsPolicy validates the JSON of AnnotationHTTPCorsPolicy and returns
+// it in the unstructured form of the VirtualService "corsPolicy".
+func parseCorsPolicy(value string) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	policy := corsPolicy{}
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, err
+	}
+	if len(policy.AllowOrigins) == 0 {
+		return nil, fmt.Errorf("corsPolicy must set allowOrigins")
+	}
+	for _, origin := range policy.AllowOrigins {
+		for match := range origin {
+			if match != "exact" && match != "prefix" && match != "regex" {
+				return nil, fmt.Errorf("unknown allowOrigins match %q", match)
+			}
+		}
+	}
+	if policy.MaxAge != "" {
+		if _, err := time.ParseDuration(policy.MaxAge); err != nil {
+			return nil, err
+		}
+	}
+
+	// Round trip through JSON to get the unstructured representation
+	policyBytes, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+	unstructuredPolicy := make(map[string]interface{})
+	if err := json.Unmarshal(policyBytes, &unstructuredPolicy); err != nil {
+		return nil, err
+	}
+	return unstructuredPolicy, nil
+}
+
+// newVirtualServiceObject returns an empty istio VirtualService to read into.
+func newVirtualServiceObject() *unstructured.Unstructured {
+	virtualService := &unstructured.Unstructured{}
+	virtualService.SetAPIVersion("networking.istio.io/v1alpha3")
+	virtualService.SetKind("VirtualService")
+	return virtualService
+}
+
+func (r *NotebookReconciler) reconcileVirtualService(ctx context.Context, instance *v1.Notebook, customDomain string, log logr.Logger) error {
+	virtualService, err := generateVirtualService(instance, customDomain)
 	if err := ctrl.SetControllerReference(instance, virtualService, r.Scheme); err != nil {
 		return err
 	}
 	// Check if the virtual service already exists.
-	foundVirtual := &unstructured.Unstructured{}
+	foundVirtual := newVirtualServiceObject()
 	justCreated := false
-	foundVirtual.SetAPIVersion("networking.istio.io/v1alpha3")
-	foundVirtual.SetKind("VirtualService")
-	err = r.Get(context.TODO(), types.NamespacedName{Name: virtualServiceName(instance.Name,
+	err = r.Get(ctx, types.NamespacedName{Name: virtualServiceName(instance.Name,
 		instance.Namespace), Namespace: instance.Namespace}, foundVirtual)
 	if err != nil && apierrs.IsNotFound(err) {
 		log.Info("Creating virtual service", "namespace", instance.Namespace, "name",
 			virtualServiceName(instance.Name, instance.Namespace))
-		err = r.Create(context.TODO(), virtualService)
+		err = r.Create(ctx, virtualService)
 		justCreated = true
 		if err != nil {
 			return err
@@ -985,7 +4284,7 @@ func (r *NotebookReconciler) reconcileVirtualService(instance *v1.Notebook) erro
 	if !justCreated && reconcilehelper.CopyVirtualService(virtualService, foundVirtual) {
 		log.Info("Updating virtual service", "namespace", instance.Namespace, "name",
 			virtualServiceName(instance.Name, instance.Namespace))
-		err = r.Update(context.TODO(), foundVirtual)
+		err = r.Update(ctx, foundVirtual)
 		if err != nil {
 			return err
 		}
@@ -1046,6 +4345,38 @@ func predNBPodIsLabeled() predicate.Funcs {
 	return predicate.NewPredicateFuncs(checkNBLabel())
 }
 
+// predIstioInjectionChanged selects the namespaces whose istio-injection
+// label changed.
+func predIstioInjectionChanged() predicate.Funcs {
+	return predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return false },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return false },
+		GenericFunc: func(e event.GenericEvent) bool { return false },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return e.ObjectOld.GetLabels()[IstioInjectionLabel] != e.ObjectNew.GetLabels()[IstioInjectionLabel]
+		},
+	}
+}
+
+// predNBPVCChanged selects the phase changes of the PVCs created for
+// Notebooks, and their deletions if they are recreated.
+func predNBPVCChanged(recreate bool) predicate.Funcs {
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool { return false },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			_, labelExists := e.ObjectNew.GetLabels()["notebook"]
+			oldPvc, okOld := e.ObjectOld.(*corev1.PersistentVolumeClaim)
+			newPvc, okNew := e.ObjectNew.(*corev1.PersistentVolumeClaim)
+			return labelExists && okOld && okNew && oldPvc.Status.Phase != newPvc.Status.Phase
+		},
+		GenericFunc: func(e event.GenericEvent) bool { return false },
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			_, labelExists := e.Object.GetLabels()["notebook"]
+			return recreate && labelExists
+		},
+	}
+}
+
 // predNBEvents filters events not coming from Pod or STS, and coming from
 // unknown NBs
 func predNBEvents(r *NotebookReconciler) predicate.Funcs {
@@ -1093,19 +4424,88 @@ func (r *NotebookReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		}
 	}
 
-	
-	// watch Certificate
-	certificate := &unstructured.Unstructured{}
-	certificate.SetAPIVersion("cert-manager.io/v1")
-	certificate.SetKind("Certificate")
-	
+	// Map function to convert maintenance ConfigMap events to reconciliation
+	// requests for every Notebook
+	mapMaintenanceToRequests := func(object client.Object) []reconcile.Request {
+		notebooks := &v1.NotebookList{}
+		if err := r.List(context.Background(), notebooks); err != nil {
+			r.Log.Error(err, "unable to list Notebooks for the maintenance mode")
+			return nil
+		}
+		requests := make([]reconcile.Request, 0, len(notebooks.Items))
+		for _, nb := range notebooks.Items {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace},
+			})
+		}
+		return requests
+	}
+
+	// Map function to convert namespace events to reconciliation requests for
+	// the Notebooks in it
+	mapNamespaceToRequests := func(object client.Object) []reconcile.Request {
+		notebooks := &v1.NotebookList{}
+		if err := r.List(context.Background(), notebooks, client.InNamespace(object.GetName())); err != nil {
+			r.Log.Error(err, "unable to list Notebooks for the namespace", "namespace", object.GetName())
+			return nil
+		}
+		requests := make([]reconcile.Request, 0, len(notebooks.Items))
+		for _, nb := range notebooks.Items {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace},
+			})
+		}
+		return requests
+	}
+
+	// Map function to convert NotebookTemplate events to reconciliation
+	// requests for the Notebooks referencing it
+	mapTemplateToRequests := func(object client.Object) []reconcile.Request {
+		notebooks := &v1.NotebookList{}
+		if err := r.List(context.Background(), notebooks); err != nil {
+			r.Log.Error(err, "unable to list Notebooks for the template", "template", object.GetName())
+			return nil
+		}
+		var requests []reconcile.Request
+		for _, nb := range notebooks.Items {
+			if nb.Spec.TemplateRef == object.GetName() {
+				requests = append(requests, reconcile.Request{
+					NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace},
+				})
+			}
+		}
+		return requests
+	}
+
+	// Map function to convert PVC events to reconciliation requests
+	mapPVCToRequest := func(object client.Object) []reconcile.Request {
+		return []reconcile.Request{
+			{NamespacedName: types.NamespacedName{
+				Name:      object.GetLabels()["notebook"],
+				Namespace: object.GetNamespace(),
+			}},
+		}
+	}
+
+	// watch Certificate, if cert-manager is installed
+	certificate := newCertificateObject()
+	certManagerInstalled, err := kindInstalled(mgr.GetRESTMapper(), certificate)
+	if err != nil {
+		return err
+	}
+	if !certManagerInstalled {
+		r.Log.Info("The cert-manager Certificate CRD is not installed, skipping the Certificates. " +
+			"Set SHARED_TLS_SECRET or the disable-certificate annotation for the notebooks to get TLS secrets.")
+		r.noCertManager = true
+	}
+	pvcPredicates := builder.WithPredicates(predNBPVCChanged(recreatePVC()))
+	namespacePredicates := builder.WithPredicates(predIstioInjectionChanged())
 
 	builder := ctrl.NewControllerManagedBy(mgr).
 		For(&v1.Notebook{}).
 		Owns(&appsv1.StatefulSet{}).
 		Owns(&corev1.Service{}).
 		Owns(&netv1.Ingress{}).
-		Owns(certificate).
 		Watches(
 			&source.Kind{Type: &corev1.Pod{}},
 			handler.EnqueueRequestsFromMapFunc(mapPodToRequest),
@@ -1113,18 +4513,53 @@ func (r *NotebookReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		Watches(
 			&source.Kind{Type: &corev1.Event{}},
 			handler.EnqueueRequestsFromMapFunc(mapEventToRequest),
-			builder.WithPredicates(predNBEvents(r)))
-	// watch Istio virtual service
-	if os.Getenv("USE_ISTIO") == "true" {
-		virtualService := &unstructured.Unstructured{}
-		virtualService.SetAPIVersion("networking.istio.io/v1alpha3")
-		virtualService.SetKind("VirtualService")
-		builder.Owns(virtualService)
+			builder.WithPredicates(predNBEvents(r))).
+		Watches(
+			&source.Kind{Type: &v1.NotebookTemplate{}},
+			handler.EnqueueRequestsFromMapFunc(mapTemplateToRequests))
+	// watch the maintenance ConfigMap, if configured
+	if _, ok := maintenanceConfigMap(); ok {
+		maintenanceEvents := make(chan event.GenericEvent)
+		if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			return r.pollMaintenanceMode(ctx, MaintenancePollInterval, maintenanceEvents)
+		})); err != nil {
+			return err
+		}
+		builder.Watches(
+			&source.Channel{Source: maintenanceEvents},
+			handler.EnqueueRequestsFromMapFunc(mapMaintenanceToRequests))
+	}
+	if certManagerInstalled {
+		builder.Owns(certificate)
+	}
+	// watch the PVCs binding, and the deleted ones to recreate them
+	builder.Watches(
+		&source.Kind{Type: &corev1.PersistentVolumeClaim{}},
+		handler.EnqueueRequestsFromMapFunc(mapPVCToRequest),
+		pvcPredicates)
+	// watch Istio virtual service, and the namespaces for the sidecar injection
+	if useIstio() {
+		istioInstalled, err := kindInstalled(mgr.GetRESTMapper(), newVirtualServiceObject())
+		if err != nil {
+			return err
+		}
+		if istioInstalled {
+			builder.Owns(newVirtualServiceObject())
+		} else {
+			r.Log.Info("WARNING: istio is enabled but the VirtualService CRD is not installed, "+
+				"the notebooks get no VirtualService until it is and the controller restarts",
+				"crd", "virtualservices.networking.istio.io")
+			r.noIstio = true
+		}
+		builder.Watches(
+			&source.Kind{Type: &corev1.Namespace{}},
+			handler.EnqueueRequestsFromMapFunc(mapNamespaceToRequests),
+			namespacePredicates)
 	}
 	
 	
 
-	err := builder.Complete(r)
+	err = builder.Complete(r)
 	if err != nil {
 		return err
 	}
@@ -26,7 +26,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 
-	nbv1beta1 "github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	nbv1 "github.com/tmax-cloud/notebook-controller-go/api/v1"
 )
 
 var _ = Describe("Notebook controller", func() {
@@ -43,13 +43,13 @@ var _ = Describe("Notebook controller", func() {
 		It("Should create replicas", func() {
 			By("By creating a new Notebook")
 			ctx := context.Background()
-			notebook := &nbv1beta1.Notebook{
+			notebook := &nbv1.Notebook{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      Name,
 					Namespace: Namespace,
 				},
-				Spec: nbv1beta1.NotebookSpec{
-					Template: nbv1beta1.NotebookTemplateSpec{
+				Spec: nbv1.NotebookSpec{
+					Template: nbv1.NotebookTemplateSpec{
 						Spec: v1.PodSpec{Containers: []v1.Container{{
 							Name:  "busybox",
 							Image: "busybox",
@@ -58,7 +58,7 @@ var _ = Describe("Notebook controller", func() {
 			Expect(k8sClient.Create(ctx, notebook)).Should(Succeed())
 
 			notebookLookupKey := types.NamespacedName{Name: Name, Namespace: Namespace}
-			createdNotebook := &nbv1beta1.Notebook{}
+			createdNotebook := &nbv1.Notebook{}
 
 			Eventually(func() bool {
 				err := k8sClient.Get(ctx, notebookLookupKey, createdNotebook)
@@ -1,16 +1,58 @@
 package controllers
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	crmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
 
+	nbv1 "github.com/tmax-cloud/notebook-controller-go/api/v1"
+	"github.com/tmax-cloud/notebook-controller-go/pkg/culler"
+	"github.com/tmax-cloud/notebook-controller-go/pkg/metrics"
+	reconcilehelper "github.com/tmax-cloud/notebook-controller-go/pkg/reconcilehelper"
 	appsv1 "k8s.io/api/apps/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
 	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 )
 
 func TestNbNameFromInvolvedObject(t *testing.T) {
@@ -73,7 +115,7 @@ func TestNbNameFromInvolvedObject(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			c := fake.NewFakeClientWithScheme(scheme.Scheme, objects...)
+			c := fake.NewFakeClientWithScheme(clientgoscheme.Scheme, objects...)
 			nbName, err := nbNameFromInvolvedObject(c, &test.event.InvolvedObject)
 			if err != nil {
 				t.Fatalf("Unexpected error: %v", err)
@@ -84,3 +126,5696 @@ func TestNbNameFromInvolvedObject(t *testing.T) {
 		})
 	}
 }
+
+func newTestNotebook(annotations map[string]string) *nbv1.Notebook {
+	return &nbv1.Notebook{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "test-notebook",
+			Namespace:   "test-namespace",
+			UID:         "test-notebook-uid",
+			Annotations: annotations,
+		},
+		Spec: nbv1.NotebookSpec{
+			VolumeClaim: []nbv1.NotebookVolumeClaim{{
+				Name: "test-notebook-pvc",
+				Size: "10Gi",
+			}},
+			Template: nbv1.NotebookTemplateSpec{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{
+					Name:  "notebook",
+					Image: "jupyter/minimal-notebook",
+				}}},
+			},
+		},
+	}
+}
+
+func TestGenerateStatefulSetNodePool(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         string
+		annotations map[string]string
+		pool        string
+	}{
+		{
+			name: "no node pool",
+			pool: "",
+		},
+		{
+			name: "node pool from env",
+			env:  "notebooks",
+			pool: "notebooks",
+		},
+		{
+			name:        "node pool from annotation",
+			env:         "notebooks",
+			annotations: map[string]string{AnnotationNodePool: "gpu-notebooks"},
+			pool:        "gpu-notebooks",
+		},
+		{
+			name:        "opt out with an empty annotation",
+			env:         "notebooks",
+			annotations: map[string]string{AnnotationNodePool: ""},
+			pool:        "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("NOTEBOOK_NODE_POOL", test.env)
+			podSpec := generateStatefulSet(newTestNotebook(test.annotations)).Spec.Template.Spec
+
+			if test.pool == "" {
+				if len(podSpec.Tolerations) != 0 || len(podSpec.NodeSelector) != 0 {
+					t.Fatalf("Expected no toleration and node selector, got %v and %v", podSpec.Tolerations, podSpec.NodeSelector)
+				}
+				return
+			}
+			expected := corev1.Toleration{
+				Key:      NodePoolKey,
+				Operator: corev1.TolerationOpEqual,
+				Value:    test.pool,
+				Effect:   corev1.TaintEffectNoSchedule,
+			}
+			if len(podSpec.Tolerations) != 1 || podSpec.Tolerations[0] != expected {
+				t.Fatalf("Got tolerations %v, Expected %v", podSpec.Tolerations, expected)
+			}
+			if podSpec.NodeSelector[NodePoolKey] != test.pool {
+				t.Fatalf("Got node selector %v, Expected %v=%v", podSpec.NodeSelector, NodePoolKey, test.pool)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetSpotScheduling(t *testing.T) {
+	t.Setenv("SPOT_TOLERATIONS", "cloud.google.com/gke-spot=true:NoSchedule, kubernetes.azure.com/scalesetpriority")
+	spotTolerations := []corev1.Toleration{
+		{
+			Key:      "cloud.google.com/gke-spot",
+			Operator: corev1.TolerationOpEqual,
+			Value:    "true",
+			Effect:   corev1.TaintEffectNoSchedule,
+		},
+		{
+			Key:      "kubernetes.azure.com/scalesetpriority",
+			Operator: corev1.TolerationOpExists,
+		},
+	}
+	expectedAffinity := corev1.NodeSelectorRequirement{
+		Key:      "cloud.google.com/gke-spot",
+		Operator: corev1.NodeSelectorOpNotIn,
+		Values:   []string{"true"},
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		spot        bool
+	}{
+		{
+			name:        "spot eligible",
+			annotations: map[string]string{AnnotationSpot: "true"},
+			spot:        true,
+		},
+		{
+			name: "not annotated",
+			spot: false,
+		},
+		{
+			name:        "not eligible",
+			annotations: map[string]string{AnnotationSpot: "false"},
+			spot:        false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			podSpec := generateStatefulSet(newTestNotebook(test.annotations)).Spec.Template.Spec
+
+			if test.spot {
+				if !reflect.DeepEqual(podSpec.Tolerations, spotTolerations) {
+					t.Fatalf("Got tolerations %v, Expected %v", podSpec.Tolerations, spotTolerations)
+				}
+				if podSpec.Affinity != nil {
+					t.Fatalf("Got affinity %v, Expected none", podSpec.Affinity)
+				}
+				return
+			}
+			if len(podSpec.Tolerations) != 0 {
+				t.Fatalf("Got tolerations %v, Expected none", podSpec.Tolerations)
+			}
+			if podSpec.Affinity == nil || podSpec.Affinity.NodeAffinity == nil ||
+				podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+				t.Fatalf("Expected a node affinity avoiding the spot nodes, got %v", podSpec.Affinity)
+			}
+			terms := podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+			if len(terms) != 1 || !reflect.DeepEqual(terms[0].MatchExpressions, []corev1.NodeSelectorRequirement{expectedAffinity}) {
+				t.Fatalf("Got node selector terms %v, Expected %v", terms, expectedAffinity)
+			}
+		})
+	}
+
+	t.Run("spot node label", func(t *testing.T) {
+		t.Setenv("SPOT_NODE_LABEL", "node.tmaxcloud.org/spot")
+		podSpec := generateStatefulSet(newTestNotebook(nil)).Spec.Template.Spec
+		expected := []corev1.NodeSelectorRequirement{{
+			Key:      "node.tmaxcloud.org/spot",
+			Operator: corev1.NodeSelectorOpDoesNotExist,
+		}}
+		terms := podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+		if !reflect.DeepEqual(terms[0].MatchExpressions, expected) {
+			t.Fatalf("Got node selector terms %v, Expected %v", terms, expected)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("SPOT_TOLERATIONS", "")
+		podSpec := generateStatefulSet(newTestNotebook(map[string]string{AnnotationSpot: "true"})).Spec.Template.Spec
+		if len(podSpec.Tolerations) != 0 || podSpec.Affinity != nil {
+			t.Fatalf("Got tolerations %v and affinity %v, Expected none", podSpec.Tolerations, podSpec.Affinity)
+		}
+	})
+}
+
+func TestReconcileNodeName(t *testing.T) {
+	expected := []corev1.NodeSelectorRequirement{{
+		Key:      "metadata.name",
+		Operator: corev1.NodeSelectorOpIn,
+		Values:   []string{"worker-1"},
+	}}
+
+	t.Run("pinned", func(t *testing.T) {
+		nb := newTestNotebook(map[string]string{AnnotationNodeName: "worker-1"})
+		node := &corev1.Node{ObjectMeta: v1.ObjectMeta{Name: "worker-1"}}
+		r := newTestReconciler(nb, node)
+		reconcileNotebook(t, r, nb)
+
+		ss := &appsv1.StatefulSet{}
+		objectExists(t, r, nb, ss, nb.Name)
+		affinity := ss.Spec.Template.Spec.Affinity
+		if affinity == nil || affinity.NodeAffinity == nil ||
+			affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+			t.Fatalf("Expected a node affinity to worker-1, got %v", affinity)
+		}
+		terms := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+		if len(terms) != 1 || !reflect.DeepEqual(terms[0].MatchFields, expected) {
+			t.Fatalf("Got node selector terms %v, Expected %v", terms, expected)
+		}
+		for _, reason := range eventReasons(r) {
+			if reason == EventReasonNodeNotFound {
+				t.Fatalf("Got a %s event for an existing node", reason)
+			}
+		}
+	})
+
+	t.Run("pinned with the spot affinity", func(t *testing.T) {
+		t.Setenv("SPOT_TOLERATIONS", "cloud.google.com/gke-spot=true:NoSchedule")
+		podSpec := generateStatefulSet(newTestNotebook(map[string]string{AnnotationNodeName: "worker-1"})).Spec.Template.Spec
+		terms := podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+		if len(terms) != 1 || len(terms[0].MatchExpressions) != 1 || !reflect.DeepEqual(terms[0].MatchFields, expected) {
+			t.Fatalf("Got node selector terms %v, Expected the node and the spot requirements", terms)
+		}
+	})
+
+	t.Run("missing node", func(t *testing.T) {
+		nb := newTestNotebook(map[string]string{AnnotationNodeName: "worker-1"})
+		r := newTestReconciler(nb)
+		reconcileNotebook(t, r, nb)
+
+		objectExists(t, r, nb, &appsv1.StatefulSet{}, nb.Name)
+		reasons := eventReasons(r)
+		found := false
+		for _, reason := range reasons {
+			found = found || reason == EventReasonNodeNotFound
+		}
+		if !found {
+			t.Fatalf("Got events %v, Expected %s", reasons, EventReasonNodeNotFound)
+		}
+	})
+
+	t.Run("not pinned", func(t *testing.T) {
+		podSpec := generateStatefulSet(newTestNotebook(nil)).Spec.Template.Spec
+		if podSpec.Affinity != nil {
+			t.Fatalf("Got affinity %v, Expected none", podSpec.Affinity)
+		}
+	})
+}
+
+func TestReconcileImageUpdate(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		ready    bool
+		deleted  bool
+	}{
+		{
+			name:    "rolling update of a ready pod",
+			ready:   true,
+			deleted: false,
+		},
+		{
+			name:    "rolling update stuck on a pod that isn't ready",
+			ready:   false,
+			deleted: true,
+		},
+		{
+			name:     "on delete",
+			strategy: "OnDelete",
+			ready:    true,
+			deleted:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("STATEFULSET_UPDATE_STRATEGY", test.strategy)
+			nb := newTestNotebook(nil)
+			pod := &corev1.Pod{
+				ObjectMeta: testPodMeta(nb, 0),
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "notebook", Image: "jupyter/minimal-notebook"}},
+				},
+				Status: corev1.PodStatus{
+					ContainerStatuses: []corev1.ContainerStatus{{
+						Name:  "notebook",
+						Ready: test.ready,
+						State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+					}},
+				},
+			}
+			r := newTestReconciler(nb, pod)
+			reconcileNotebook(t, r, nb)
+			objectExists(t, r, nb, &corev1.Pod{}, pod.Name)
+
+			if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			nb.Spec.Template.Spec.Containers[0].Image = "jupyter/scipy-notebook"
+			if err := r.Update(context.Background(), nb); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			reconcileNotebook(t, r, nb)
+
+			ss := &appsv1.StatefulSet{}
+			objectExists(t, r, nb, ss, nb.Name)
+			if image := ss.Spec.Template.Spec.Containers[0].Image; image != "jupyter/scipy-notebook" {
+				t.Fatalf("Got image %v, Expected jupyter/scipy-notebook", image)
+			}
+			expected := appsv1.RollingUpdateStatefulSetStrategyType
+			if test.strategy != "" {
+				expected = appsv1.StatefulSetUpdateStrategyType(test.strategy)
+			}
+			if ss.Spec.UpdateStrategy.Type != expected {
+				t.Fatalf("Got update strategy %v, Expected %v", ss.Spec.UpdateStrategy.Type, expected)
+			}
+			err := r.Get(context.Background(), client.ObjectKeyFromObject(pod), &corev1.Pod{})
+			if deleted := apierrs.IsNotFound(err); deleted != test.deleted {
+				t.Fatalf("Got pod deleted %v, Expected %v", deleted, test.deleted)
+			}
+		})
+	}
+}
+
+func TestJupyterAPIURL(t *testing.T) {
+	nb := newTestNotebook(nil)
+	pod := &corev1.Pod{
+		ObjectMeta: testPodMeta(nb, 0),
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name: "notebook",
+				Env:  []corev1.EnvVar{{Name: PrefixEnvVar, Value: "/notebook/test-namespace/test-notebook/"}},
+			}},
+		},
+		Status: corev1.PodStatus{PodIP: "10.0.0.5"},
+	}
+
+	t.Setenv("ENABLE_GATEKEEPER", "true")
+	if url, expected := jupyterAPIURL(nb, pod), "http://10.0.0.5:8888/notebook/test-namespace/test-notebook"; url != expected {
+		t.Fatalf("Got %v, Expected %v", url, expected)
+	}
+	pod.Status.PodIP = ""
+	if url := jupyterAPIURL(nb, pod); url != "" {
+		t.Fatalf("Got %v, Expected no URL for a pod without an IP", url)
+	}
+
+	t.Setenv("ENABLE_GATEKEEPER", "false")
+	expected := "http://test-notebook.test-namespace.svc.cluster.local:443/notebook/test-namespace/test-notebook"
+	if url := jupyterAPIURL(nb, pod); url != expected {
+		t.Fatalf("Got %v, Expected %v", url, expected)
+	}
+}
+
+// testTLSSecret returns the TLS secret issued from the Notebook's Certificate.
+func testTLSSecret(nb *nbv1.Notebook) *corev1.Secret {
+	return &corev1.Secret{ObjectMeta: v1.ObjectMeta{
+		Name:      tlsSecretName(nb),
+		Namespace: nb.Namespace,
+	}}
+}
+
+// testPodMeta returns the metadata of a pod of the Notebook's StatefulSet.
+func testPodMeta(nb *nbv1.Notebook, ordinal int) v1.ObjectMeta {
+	return v1.ObjectMeta{
+		Name:      fmt.Sprintf("%s-%d", nb.Name, ordinal),
+		Namespace: nb.Namespace,
+		Labels:    map[string]string{"statefulset": nb.Name, "notebook-name": nb.Name},
+	}
+}
+
+// newTestReconciler returns a NotebookReconciler backed by a fake client
+// seeded with the given objects.
+func newTestReconciler(objects ...runtime.Object) *NotebookReconciler {
+	s := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(s)
+	_ = nbv1.AddToScheme(s)
+	c := fake.NewFakeClientWithScheme(s, objects...)
+
+	// Every reconciler gets its own metrics, so keep them out of the global
+	// registry.
+	m := metrics.NewMetrics(c)
+	crmetrics.Registry.Unregister(m)
+
+	return &NotebookReconciler{
+		Client:        c,
+		Log:           logr.Discard(),
+		Scheme:        s,
+		Metrics:       m,
+		EventRecorder: record.NewFakeRecorder(100),
+	}
+}
+
+func reconcileNotebook(t *testing.T, r *NotebookReconciler, nb *nbv1.Notebook) ctrl.Result {
+	t.Helper()
+	result, err := r.Reconcile(context.Background(), ctrl.Request{
+		NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return result
+}
+
+func TestReconcileNotebookStateGauges(t *testing.T) {
+	replicas := int32(0)
+	nb := newTestNotebook(map[string]string{culler.STOP_ANNOTATION: "2021-08-30T15:37:36Z"})
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: v1.ObjectMeta{Name: nb.Name, Namespace: nb.Namespace},
+		Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+	}
+	r := newTestReconciler(nb, sts)
+
+	reconcileNotebook(t, r, nb)
+	if got := testutil.ToFloat64(r.Metrics.NotebookStopped.WithLabelValues(nb.Namespace)); got != 1 {
+		t.Fatalf("Got %v stopped notebooks, Expected 1", got)
+	}
+	if got := testutil.ToFloat64(r.Metrics.NotebookRunning.WithLabelValues(nb.Namespace, "false")); got != 0 {
+		t.Fatalf("Got %v running notebooks, Expected 0", got)
+	}
+
+	// Restart the notebook and observe a ready replica.
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	delete(nb.Annotations, culler.STOP_ANNOTATION)
+	if err := r.Update(context.Background(), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(sts), sts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sts.Status.Replicas = 1
+	sts.Status.ReadyReplicas = 1
+	if err := r.Update(context.Background(), sts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	reconcileNotebook(t, r, nb)
+	if got := testutil.ToFloat64(r.Metrics.NotebookStopped.WithLabelValues(nb.Namespace)); got != 0 {
+		t.Fatalf("Got %v stopped notebooks, Expected 0", got)
+	}
+	if got := testutil.ToFloat64(r.Metrics.NotebookRunning.WithLabelValues(nb.Namespace, "false")); got != 1 {
+		t.Fatalf("Got %v running notebooks, Expected 1", got)
+	}
+
+	// Deleting the notebook decrements the gauge.
+	if err := r.Delete(context.Background(), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reconcileNotebook(t, r, nb)
+	if got := testutil.ToFloat64(r.Metrics.NotebookRunning.WithLabelValues(nb.Namespace, "false")); got != 0 {
+		t.Fatalf("Got %v running notebooks, Expected 0", got)
+	}
+}
+
+func TestReconcileGPUMetrics(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits corev1.ResourceList
+		gpu    string
+	}{
+		{
+			name:   "gpu notebook",
+			limits: corev1.ResourceList{"nvidia.com/gpu": resource.MustParse("1")},
+			gpu:    "true",
+		},
+		{
+			name:   "cpu-only notebook",
+			limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+			gpu:    "false",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nb := newTestNotebook(nil)
+			nb.Spec.Template.Spec.Containers[0].Resources.Limits = test.limits
+			r := newTestReconciler(nb)
+
+			reconcileNotebook(t, r, nb)
+			if got := testutil.ToFloat64(r.Metrics.NotebookCreation.WithLabelValues(nb.Namespace, test.gpu)); got != 1 {
+				t.Fatalf("Got %v created notebooks with gpu=%v, Expected 1", got, test.gpu)
+			}
+
+			sts := &appsv1.StatefulSet{}
+			if !objectExists(t, r, nb, sts, nb.Name) {
+				t.Fatalf("StatefulSet not found")
+			}
+			sts.Status.Replicas = 1
+			sts.Status.ReadyReplicas = 1
+			if err := r.Update(context.Background(), sts); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			reconcileNotebook(t, r, nb)
+			for _, gpu := range []string{"true", "false"} {
+				expected := 0.0
+				if gpu == test.gpu {
+					expected = 1
+				}
+				if got := testutil.ToFloat64(r.Metrics.NotebookRunning.WithLabelValues(nb.Namespace, gpu)); got != expected {
+					t.Fatalf("Got %v running notebooks with gpu=%v, Expected %v", got, gpu, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileNotebookStartupLatency(t *testing.T) {
+	nb := newTestNotebook(nil)
+	nb.CreationTimestamp = v1.NewTime(time.Now().Add(-30 * time.Second))
+	r := newTestReconciler(nb)
+
+	samples := func() (uint64, float64) {
+		m := &dto.Metric{}
+		if err := r.Metrics.NotebookStartupSeconds.WithLabelValues(nb.Namespace).(prometheus.Histogram).Write(m); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return m.Histogram.GetSampleCount(), m.Histogram.GetSampleSum()
+	}
+
+	reconcileNotebook(t, r, nb)
+	if count, _ := samples(); count != 0 {
+		t.Fatalf("Got %v observations, Expected none before the notebook is ready", count)
+	}
+
+	// The notebook becomes ready.
+	sts := &appsv1.StatefulSet{}
+	objectExists(t, r, nb, sts, nb.Name)
+	sts.Status.Replicas = 1
+	sts.Status.ReadyReplicas = 1
+	if err := r.Update(context.Background(), sts); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reconcileNotebook(t, r, nb)
+	reconcileNotebook(t, r, nb)
+	count, sum := samples()
+	if count != 1 {
+		t.Fatalf("Got %v observations, Expected 1", count)
+	}
+	if sum < 30 || sum > 60 {
+		t.Fatalf("Got a startup of %vs, Expected it measured from the creation 30s ago", sum)
+	}
+}
+
+func TestReconcileCleanupSteps(t *testing.T) {
+	t.Setenv("DISABLED_CLEANUP_STEPS", "disabled")
+	nb := newTestNotebook(nil)
+	r := newTestReconciler(nb)
+	var ran []string
+	for _, name := range []string{"first", "disabled", "second"} {
+		name := name
+		r.CleanupSteps = append(r.CleanupSteps, CleanupStep{
+			Name: name,
+			Run: func(ctx context.Context, instance *nbv1.Notebook) error {
+				ran = append(ran, name)
+				return nil
+			},
+		})
+	}
+
+	reconcileNotebook(t, r, nb)
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !controllerutil.ContainsFinalizer(nb, CleanupFinalizer) {
+		t.Fatalf("Got finalizers %v, Expected %v", nb.Finalizers, CleanupFinalizer)
+	}
+	if len(ran) != 0 {
+		t.Fatalf("Got cleanup steps %v, Expected none before the deletion", ran)
+	}
+
+	if err := r.Delete(context.Background(), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reconcileNotebook(t, r, nb)
+	if expected := []string{"first", "second"}; !reflect.DeepEqual(ran, expected) {
+		t.Fatalf("Got cleanup steps %v, Expected %v", ran, expected)
+	}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); !apierrs.IsNotFound(err) {
+		t.Fatalf("Got %v, Expected the Notebook to be deleted once its finalizer is removed", err)
+	}
+}
+
+func TestReconcileDefaultCleanupSteps(t *testing.T) {
+	t.Setenv("RECLAIM_PVC", "true")
+	t.Setenv("RECLAIM_CERT_SECRET", "true")
+	t.Setenv("ENABLE_ACTIVITY_LEASE", "true")
+	t.Setenv("ENABLE_SNAPSHOT", "true")
+	t.Setenv("SNAPSHOT_DESTINATION", ":s3:bucket/notebooks")
+	nb := newTestNotebook(map[string]string{AnnotationSnapshot: "true"})
+	owned := []v1.OwnerReference{{APIVersion: "kubeflow.tmax.io/v1", Kind: "Notebook", Name: nb.Name, UID: nb.UID}}
+	lease := &coordinationv1.Lease{ObjectMeta: v1.ObjectMeta{
+		Name: activityLeaseName(nb.Name), Namespace: nb.Namespace, OwnerReferences: owned,
+	}}
+	pod := &corev1.Pod{ObjectMeta: testPodMeta(nb, 0)}
+	r := newTestReconciler(nb, testTLSSecret(nb), lease, pod)
+
+	reconcileNotebook(t, r, nb)
+	if !objectExists(t, r, nb, &appsv1.StatefulSet{}, nb.Name) || !objectExists(t, r, nb, &corev1.PersistentVolumeClaim{}, "test-notebook-pvc") {
+		t.Fatalf("Expected the StatefulSet and the PVC to be created")
+	}
+	if err := r.Delete(context.Background(), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The pod holds the Notebook back until its snapshot is synced.
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(nb)}); err == nil {
+		t.Fatalf("Expected an error while the pod syncs its snapshot")
+	}
+	if !objectExists(t, r, nb, &corev1.PersistentVolumeClaim{}, "test-notebook-pvc") {
+		t.Fatalf("Expected the PVC to be kept until the snapshot is synced")
+	}
+	if err := r.Delete(context.Background(), pod); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	reconcileNotebook(t, r, nb)
+	for name, obj := range map[string]client.Object{
+		nb.Name:                    &appsv1.StatefulSet{},
+		"test-notebook-pvc":        &corev1.PersistentVolumeClaim{},
+		tlsSecretName(nb):          &corev1.Secret{},
+		activityLeaseName(nb.Name): &coordinationv1.Lease{},
+	} {
+		if objectExists(t, r, nb, obj, name) {
+			t.Fatalf("Expected %T %s to be deleted with the Notebook", obj, name)
+		}
+	}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); !apierrs.IsNotFound(err) {
+		t.Fatalf("Got %v, Expected the Notebook to be deleted once its finalizer is removed", err)
+	}
+}
+
+func virtualServiceRoute(t *testing.T, vsvc *unstructured.Unstructured) map[string]interface{} {
+	t.Helper()
+	http, _, err := unstructured.NestedSlice(vsvc.Object, "spec", "http")
+	if err != nil || len(http) != 1 {
+		t.Fatalf("Unexpected .spec.http %v: %v", http, err)
+	}
+	return http[0].(map[string]interface{})
+}
+
+func TestGenerateVirtualServiceTimeoutAndRetries(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		timeout     string
+		retries     interface{}
+	}{
+		{
+			name:    "defaults",
+			timeout: DefaultHTTPTimeout,
+		},
+		{
+			name: "timeout and retries from annotations",
+			annotations: map[string]string{
+				AnnotationHTTPTimeout: "600s",
+				AnnotationHTTPRetries: "3",
+			},
+			timeout: "600s",
+			retries: map[string]interface{}{"attempts": int64(3)},
+		},
+		{
+			name: "invalid annotations are ignored",
+			annotations: map[string]string{
+				AnnotationHTTPTimeout: "forever",
+				AnnotationHTTPRetries: "-1",
+			},
+			timeout: DefaultHTTPTimeout,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vsvc, err := generateVirtualService(newTestNotebook(test.annotations), "")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			route := virtualServiceRoute(t, vsvc)
+			if route["timeout"] != test.timeout {
+				t.Fatalf("Got timeout %v, Expected %v", route["timeout"], test.timeout)
+			}
+			if !reflect.DeepEqual(route["retries"], test.retries) {
+				t.Fatalf("Got retries %v, Expected %v", route["retries"], test.retries)
+			}
+		})
+	}
+
+	t.Run("changes are detected", func(t *testing.T) {
+		found, _ := generateVirtualService(newTestNotebook(nil), "")
+		desired, _ := generateVirtualService(newTestNotebook(map[string]string{AnnotationHTTPTimeout: "60s"}), "")
+		if !reconcilehelper.CopyVirtualService(desired, found) {
+			t.Fatalf("Expected the timeout change to require an update")
+		}
+		if route := virtualServiceRoute(t, found); route["timeout"] != "60s" {
+			t.Fatalf("Got timeout %v, Expected 60s", route["timeout"])
+		}
+	})
+}
+
+func TestGenerateControllerLabels(t *testing.T) {
+	nb := newTestNotebook(nil)
+	cert, err := generateCertificate(nb, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	vsvc, err := generateVirtualService(nb, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"notebook-name":                nb.Name,
+		"app.kubernetes.io/managed-by": "notebook-controller",
+	}
+	for _, obj := range []*unstructured.Unstructured{cert, vsvc} {
+		if !reflect.DeepEqual(obj.GetLabels(), expected) {
+			t.Fatalf("%s: got labels %v, Expected %v", obj.GetKind(), obj.GetLabels(), expected)
+		}
+	}
+}
+
+// containerConditions returns the container state conditions of the Notebook.
+func containerConditions(nb *nbv1.Notebook) []nbv1.NotebookCondition {
+	var conditions []nbv1.NotebookCondition
+	for _, condition := range nb.Status.Conditions {
+		if condition.Status == "" {
+			conditions = append(conditions, condition)
+		}
+	}
+	return conditions
+}
+
+func TestReconcileContainerCreatingGracePeriod(t *testing.T) {
+	t.Setenv("CONTAINER_CREATING_GRACE_PERIOD", "60")
+	t.Setenv("DEFAULT_STORAGE_CLASS", "standard")
+	nb := newTestNotebook(nil)
+	pod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:              nb.Name + "-0",
+			Namespace:         nb.Namespace,
+			Labels:            map[string]string{"statefulset": nb.Name},
+			CreationTimestamp: v1.Now(),
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name: "notebook",
+				State: corev1.ContainerState{
+					Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"},
+				},
+			}},
+		},
+	}
+	r := newTestReconciler(nb, pod, &storagev1.StorageClass{ObjectMeta: v1.ObjectMeta{Name: "standard"}})
+
+	// A brief ContainerCreating phase is reported once as Pending.
+	reconcileNotebook(t, r, nb)
+	reconcileNotebook(t, r, nb)
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if conditions := containerConditions(nb); len(conditions) != 1 || conditions[0].Type != "Pending" {
+		t.Fatalf("Got conditions %v, Expected a single Pending condition", nb.Status.Conditions)
+	}
+
+	// Past the grace period the condition escalates to Waiting with a warning.
+	pod.CreationTimestamp = v1.NewTime(time.Now().Add(-2 * time.Minute))
+	if err := r.Update(context.Background(), pod); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reconcileNotebook(t, r, nb)
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if conditions := containerConditions(nb); len(conditions) != 2 || conditions[0].Type != "Waiting" {
+		t.Fatalf("Got conditions %v, Expected a Waiting condition on top of Pending", nb.Status.Conditions)
+	}
+	expected := []string{EventReasonNotebookCreated, EventReasonContainerCreatingTimeout}
+	if reasons := eventReasons(r); !reflect.DeepEqual(reasons, expected) {
+		t.Fatalf("Got reasons %v, Expected %v", reasons, expected)
+	}
+}
+
+func TestReconcileTerminationMessage(t *testing.T) {
+	for _, policy := range []corev1.TerminationMessagePolicy{"", corev1.TerminationMessageReadFile} {
+		t.Run(string(policy), func(t *testing.T) {
+			t.Setenv("TERMINATION_MESSAGE_POLICY", string(policy))
+			expected := DefaultTerminationMessagePolicy
+			if policy != "" {
+				expected = policy
+			}
+			notebook := findContainer(generateStatefulSet(newTestNotebook(nil)).Spec.Template.Spec, "notebook")
+			if notebook.TerminationMessagePolicy != expected {
+				t.Fatalf("Got %v, Expected %v", notebook.TerminationMessagePolicy, expected)
+			}
+		})
+	}
+
+	// The logs the kubelet falls back to end up in the Terminated condition.
+	nb := newTestNotebook(nil)
+	pod := &corev1.Pod{
+		ObjectMeta: testPodMeta(nb, 0),
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name: "notebook",
+				State: corev1.ContainerState{
+					Terminated: &corev1.ContainerStateTerminated{
+						Reason:   "Error",
+						ExitCode: 1,
+						Message:  "ModuleNotFoundError: No module named 'jupyterlab'",
+					},
+				},
+			}},
+		},
+	}
+	r := newTestReconciler(nb, pod)
+	reconcileNotebook(t, r, nb)
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	conditions := containerConditions(nb)
+	expected := "ModuleNotFoundError: No module named 'jupyterlab' (exit code 1)"
+	if len(conditions) != 1 || conditions[0].Type != "Terminated" || conditions[0].Message != expected {
+		t.Fatalf("Got conditions %v, Expected a Terminated condition with %q", conditions, expected)
+	}
+}
+
+func TestReconcileWaitForTLSSecret(t *testing.T) {
+	t.Setenv("WAIT_FOR_TLS_SECRET", "true")
+	nb := newTestNotebook(nil)
+	r := newTestReconciler(nb)
+
+	// Until the Certificate is issued only the StatefulSet is held back.
+	result := reconcileNotebook(t, r, nb)
+	if result.RequeueAfter != TLSSecretRequeueDelay {
+		t.Fatalf("Got RequeueAfter %v, Expected %v", result.RequeueAfter, TLSSecretRequeueDelay)
+	}
+	if objectExists(t, r, nb, &appsv1.StatefulSet{}, nb.Name) {
+		t.Fatalf("Expected no StatefulSet before the TLS secret exists")
+	}
+	if !objectExists(t, r, nb, &corev1.Service{}, nb.Name) ||
+		!objectExists(t, r, nb, newCertificateObject(), certificateName(nb.Name, nb.Namespace)) {
+		t.Fatalf("Expected the Service and the Certificate to be created")
+	}
+
+	if err := r.Create(context.Background(), testTLSSecret(nb)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result := reconcileNotebook(t, r, nb); result.RequeueAfter == TLSSecretRequeueDelay {
+		t.Fatalf("Got RequeueAfter %v, Expected the TLS secret to be found", result.RequeueAfter)
+	}
+	if !objectExists(t, r, nb, &appsv1.StatefulSet{}, nb.Name) {
+		t.Fatalf("Expected the StatefulSet to be created once the TLS secret exists")
+	}
+}
+
+func TestReconcileConditionCompaction(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(strconv.FormatBool(enabled), func(t *testing.T) {
+			t.Setenv("CONDITION_COMPACTION", strconv.FormatBool(enabled))
+			t.Setenv("DEFAULT_STORAGE_CLASS", "standard")
+			nb := newTestNotebook(nil)
+			pod := &corev1.Pod{
+				ObjectMeta: testPodMeta(nb, 0),
+				Status: corev1.PodStatus{
+					ContainerStatuses: []corev1.ContainerStatus{{Name: "notebook"}},
+				},
+			}
+			r := newTestReconciler(nb, pod)
+
+			// The pod flaps between ErrImagePull and ImagePullBackOff.
+			var firstProbeTime v1.Time
+			for i, reason := range []string{"ErrImagePull", "ImagePullBackOff", "ErrImagePull", "ImagePullBackOff"} {
+				pod.Status.ContainerStatuses[0].State.Waiting = &corev1.ContainerStateWaiting{Reason: reason}
+				if err := r.Update(context.Background(), pod); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				reconcileNotebook(t, r, nb)
+				if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if i == 0 {
+					firstProbeTime = containerConditions(nb)[0].LastProbeTime
+				}
+			}
+
+			conditions := containerConditions(nb)
+			if !enabled {
+				if len(conditions) != 4 {
+					t.Fatalf("Got conditions %v, Expected all 4 conditions", conditions)
+				}
+				return
+			}
+			if len(conditions) != 1 {
+				t.Fatalf("Got conditions %v, Expected a single compacted condition", conditions)
+			}
+			condition := conditions[0]
+			if condition.Type != "Waiting" || condition.Reason != "ImagePullBackOff" || condition.Count != 4 {
+				t.Fatalf("Got %v, Expected the latest Waiting condition with a count of 4", condition)
+			}
+			if !condition.FirstProbeTime.Equal(&firstProbeTime) || condition.LastProbeTime.Before(&condition.FirstProbeTime) {
+				t.Fatalf("Got probe times %v to %v, Expected to start at %v", condition.FirstProbeTime, condition.LastProbeTime, firstProbeTime)
+			}
+		})
+	}
+}
+
+func TestGenerateVirtualServiceCorsPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		corsPolicy  interface{}
+	}{
+		{
+			name: "no cors policy",
+		},
+		{
+			name: "cors policy from annotation",
+			annotations: map[string]string{
+				AnnotationHTTPCorsPolicy: `{"allowOrigins":[{"exact":"https://dashboard.example.com"}],"allowMethods":["GET","POST"],"allowHeaders":["authorization"]}`,
+			},
+			corsPolicy: map[string]interface{}{
+				"allowOrigins": []interface{}{map[string]interface{}{"exact": "https://dashboard.example.com"}},
+				"allowMethods": []interface{}{"GET", "POST"},
+				"allowHeaders": []interface{}{"authorization"},
+			},
+		},
+		{
+			name: "invalid json",
+			annotations: map[string]string{
+				AnnotationHTTPCorsPolicy: `{"allowOrigins":`,
+			},
+		},
+		{
+			name: "unknown field",
+			annotations: map[string]string{
+				AnnotationHTTPCorsPolicy: `{"allowOrigins":[{"exact":"*"}],"allowEverything":true}`,
+			},
+		},
+		{
+			name: "missing origins",
+			annotations: map[string]string{
+				AnnotationHTTPCorsPolicy: `{"allowMethods":["GET"]}`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vsvc, err := generateVirtualService(newTestNotebook(test.annotations), "")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			route := virtualServiceRoute(t, vsvc)
+			if !reflect.DeepEqual(route["corsPolicy"], test.corsPolicy) {
+				t.Fatalf("Got corsPolicy %v, Expected %v", route["corsPolicy"], test.corsPolicy)
+			}
+		})
+	}
+}
+
+func TestGenerateVirtualServiceGatewaysAndHosts(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         string
+		annotations map[string]string
+		gateways    []string
+		hosts       []string
+	}{
+		{
+			name:     "defaults",
+			gateways: []string{"kubeflow/kubeflow-gateway"},
+			hosts:    []string{"*"},
+		},
+		{
+			name:     "gateway from env",
+			env:      "istio-system/notebook-gateway",
+			gateways: []string{"istio-system/notebook-gateway"},
+			hosts:    []string{"*"},
+		},
+		{
+			name: "overrides from annotations",
+			env:  "istio-system/notebook-gateway",
+			annotations: map[string]string{
+				AnnotationIstioGateway: "team-a/gateway, istio-system/mesh",
+				AnnotationIstioHost:    "team-a.example.com",
+			},
+			gateways: []string{"team-a/gateway", "istio-system/mesh"},
+			hosts:    []string{"team-a.example.com"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("ISTIO_GATEWAY", test.env)
+			vsvc, err := generateVirtualService(newTestNotebook(test.annotations), "")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			gateways, _, _ := unstructured.NestedStringSlice(vsvc.Object, "spec", "gateways")
+			if !reflect.DeepEqual(gateways, test.gateways) {
+				t.Fatalf("Got gateways %v, Expected %v", gateways, test.gateways)
+			}
+			hosts, _, _ := unstructured.NestedStringSlice(vsvc.Object, "spec", "hosts")
+			if !reflect.DeepEqual(hosts, test.hosts) {
+				t.Fatalf("Got hosts %v, Expected %v", hosts, test.hosts)
+			}
+		})
+	}
+}
+
+func TestGetNextCondition(t *testing.T) {
+	tests := []struct {
+		name     string
+		cs       corev1.ContainerState
+		expected nbv1.NotebookCondition
+	}{
+		{
+			name: "running",
+			cs:   corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+			expected: nbv1.NotebookCondition{
+				Type: "Running",
+			},
+		},
+		{
+			name: "terminated with a message",
+			cs: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+				Reason:   "Error",
+				Message:  "kernel died unexpectedly",
+				ExitCode: 1,
+			}},
+			expected: nbv1.NotebookCondition{
+				Type:    "Terminated",
+				Reason:  "Error",
+				Message: "kernel died unexpectedly (exit code 1)",
+			},
+		},
+		{
+			name: "terminated without a message",
+			cs: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+				Reason:   "OOMKilled",
+				ExitCode: 137,
+			}},
+			expected: nbv1.NotebookCondition{
+				Type:    "Terminated",
+				Reason:  "OOMKilled",
+				Message: "exit code 137",
+			},
+		},
+		{
+			name: "no state",
+			cs:   corev1.ContainerState{},
+			expected: nbv1.NotebookCondition{
+				Type: "Waiting",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			condition := getNextCondition(test.cs)
+			condition.LastProbeTime = v1.Time{}
+			if !reflect.DeepEqual(condition, test.expected) {
+				t.Fatalf("Got %v, Expected %v", condition, test.expected)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetWorkingDir(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        string
+		workingDir string
+		expected   string
+	}{
+		{
+			name:     "jovyan by default",
+			expected: "/home/jovyan",
+		},
+		{
+			name:     "default from env",
+			env:      "/home/rstudio",
+			expected: "/home/rstudio",
+		},
+		{
+			name:     "relative default from env",
+			env:      "rstudio",
+			expected: "/home/jovyan",
+		},
+		{
+			name:       "custom working dir",
+			env:        "/home/rstudio",
+			workingDir: "/workspace",
+			expected:   "/workspace",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("DEFAULT_WORKING_DIR", test.env)
+			t.Setenv("ENABLE_SNAPSHOT", "true")
+			t.Setenv("SNAPSHOT_DESTINATION", ":s3:notebooks/")
+			nb := newTestNotebook(map[string]string{AnnotationSnapshot: "true"})
+			nb.Spec.Template.Spec.Containers[0].WorkingDir = test.workingDir
+			podSpec := generateStatefulSet(nb).Spec.Template.Spec
+
+			notebook := findContainer(podSpec, "notebook")
+			if notebook.WorkingDir != test.expected {
+				t.Fatalf("Got working dir %v, Expected %v", notebook.WorkingDir, test.expected)
+			}
+			if args := strings.Join(notebook.Args, " "); !strings.Contains(args, "--notebook-dir="+test.expected+" ") {
+				t.Fatalf("Got args %v, Expected jupyter to serve %v", args, test.expected)
+			}
+			sidecar := findContainer(podSpec, "snapshot")
+			if len(sidecar.VolumeMounts) != 1 || sidecar.VolumeMounts[0].MountPath != test.expected {
+				t.Fatalf("Got snapshot mounts %v, Expected %v", sidecar.VolumeMounts, test.expected)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetImagePullPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		image    string
+		policy   corev1.PullPolicy
+		expected corev1.PullPolicy
+	}{
+		{
+			name:     "latest tag",
+			image:    "jupyter/minimal-notebook:latest",
+			expected: corev1.PullAlways,
+		},
+		{
+			name:     "no tag",
+			image:    "registry.example.com:5000/jupyter/minimal-notebook",
+			expected: corev1.PullAlways,
+		},
+		{
+			name:     "configured mutable tag",
+			image:    "jupyter/minimal-notebook:nightly",
+			expected: corev1.PullAlways,
+		},
+		{
+			name:     "pinned tag",
+			image:    "registry.example.com:5000/jupyter/minimal-notebook:2022-03-01",
+			expected: corev1.PullIfNotPresent,
+		},
+		{
+			name:     "pinned digest",
+			image:    "jupyter/minimal-notebook@sha256:8e2ea7d3c2e6bba7d8d2e9b0cb7f4e5d3c2b1a09f8e7d6c5b4a3928170f6e5d4",
+			expected: corev1.PullIfNotPresent,
+		},
+		{
+			name:     "explicit policy",
+			image:    "jupyter/minimal-notebook:latest",
+			policy:   corev1.PullNever,
+			expected: corev1.PullNever,
+		},
+	}
+
+	t.Setenv("MUTABLE_IMAGE_TAGS", "nightly, dev")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nb := newTestNotebook(nil)
+			nb.Spec.Template.Spec.Containers[0].Image = test.image
+			nb.Spec.Template.Spec.Containers[0].ImagePullPolicy = test.policy
+
+			ss := generateStatefulSet(nb)
+			if policy := ss.Spec.Template.Spec.Containers[0].ImagePullPolicy; policy != test.expected {
+				t.Fatalf("Got %v, Expected %v", policy, test.expected)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetRegistryMirror(t *testing.T) {
+	const registry = "registry.local:5000/"
+	tests := []struct {
+		name        string
+		isClosed    string
+		mirror      string
+		annotations map[string]string
+		image       string
+		expected    string
+	}{
+		{
+			name:     "docker hub image",
+			isClosed: "true",
+			mirror:   "true",
+			image:    "jupyter/base-notebook:v1",
+			expected: registry + "docker.io/jupyter/base-notebook:v1",
+		},
+		{
+			name:     "official image",
+			isClosed: "true",
+			mirror:   "true",
+			image:    "python:3.9",
+			expected: registry + "docker.io/library/python:3.9",
+		},
+		{
+			name:     "image with a registry",
+			isClosed: "true",
+			mirror:   "true",
+			image:    "quay.io/jupyter/base-notebook:v1",
+			expected: registry + "quay.io/jupyter/base-notebook:v1",
+		},
+		{
+			name:     "already mirrored",
+			isClosed: "true",
+			mirror:   "true",
+			image:    registry + "docker.io/jupyter/base-notebook:v1",
+			expected: registry + "docker.io/jupyter/base-notebook:v1",
+		},
+		{
+			name:        "opted out",
+			isClosed:    "true",
+			mirror:      "true",
+			annotations: map[string]string{AnnotationRegistryMirror: "false"},
+			image:       "harbor.internal/team/notebook:v1",
+			expected:    "harbor.internal/team/notebook:v1",
+		},
+		{
+			name:     "notebook image not mirrored",
+			isClosed: "true",
+			image:    "jupyter/base-notebook:v1",
+			expected: "jupyter/base-notebook:v1",
+		},
+		{
+			name:     "open cluster",
+			mirror:   "true",
+			image:    "jupyter/base-notebook:v1",
+			expected: "jupyter/base-notebook:v1",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("IS_CLOSED", test.isClosed)
+			t.Setenv("REGISTRY_NAME", registry)
+			t.Setenv("MIRROR_NOTEBOOK_IMAGE", test.mirror)
+			t.Setenv("GATEKEEPER_VERSION", "v1.0.0")
+			nb := newTestNotebook(test.annotations)
+			nb.Spec.Template.Spec.Containers[0].Image = test.image
+			podSpec := generateStatefulSet(nb).Spec.Template.Spec
+
+			if image := findContainer(podSpec, "notebook").Image; image != test.expected {
+				t.Fatalf("Got image %q, Expected %q", image, test.expected)
+			}
+			expectedGatekeeper := "docker.io/tmaxcloudck/gatekeeper:v1.0.0"
+			if test.isClosed == "true" {
+				expectedGatekeeper = registry + expectedGatekeeper
+			}
+			if image := findContainer(podSpec, "gatekeeper").Image; image != expectedGatekeeper {
+				t.Fatalf("Got gatekeeper image %q, Expected %q", image, expectedGatekeeper)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetDefaultImagePullPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        string
+		policy     corev1.PullPolicy
+		notebook   corev1.PullPolicy
+		gatekeeper corev1.PullPolicy
+	}{
+		{
+			name:       "default policy",
+			env:        "Always",
+			notebook:   corev1.PullAlways,
+			gatekeeper: corev1.PullAlways,
+		},
+		{
+			name:       "overridden by the notebook",
+			env:        "Always",
+			policy:     corev1.PullNever,
+			notebook:   corev1.PullNever,
+			gatekeeper: corev1.PullAlways,
+		},
+		{
+			name:       "invalid default",
+			env:        "Sometimes",
+			notebook:   corev1.PullIfNotPresent,
+			gatekeeper: corev1.PullIfNotPresent,
+		},
+	}
+
+	t.Setenv("GATEKEEPER_VERSION", "v1.0.0")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("DEFAULT_IMAGE_PULL_POLICY", test.env)
+			nb := newTestNotebook(nil)
+			nb.Spec.Template.Spec.Containers[0].Image = "jupyter/minimal-notebook:2022-03-01"
+			nb.Spec.Template.Spec.Containers[0].ImagePullPolicy = test.policy
+
+			podSpec := generateStatefulSet(nb).Spec.Template.Spec
+			if policy := findContainer(podSpec, "notebook").ImagePullPolicy; policy != test.notebook {
+				t.Fatalf("Got notebook policy %v, Expected %v", policy, test.notebook)
+			}
+			if policy := findContainer(podSpec, "gatekeeper").ImagePullPolicy; policy != test.gatekeeper {
+				t.Fatalf("Got gatekeeper policy %v, Expected %v", policy, test.gatekeeper)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetTTY(t *testing.T) {
+	for _, tty := range []bool{false, true} {
+		t.Run(strconv.FormatBool(tty), func(t *testing.T) {
+			nb := newTestNotebook(map[string]string{AnnotationTTY: strconv.FormatBool(tty)})
+			notebook := findContainer(generateStatefulSet(nb).Spec.Template.Spec, "notebook")
+			if notebook.Stdin != tty || notebook.TTY != tty {
+				t.Fatalf("Got stdin %v and tty %v, Expected %v", notebook.Stdin, notebook.TTY, tty)
+			}
+		})
+	}
+}
+
+func TestGenerateCommonMetadata(t *testing.T) {
+	t.Setenv("COMMON_LABELS", `{"team": "ml", "notebook-name": "other"}`)
+	t.Setenv("COMMON_ANNOTATIONS", `{"cost-center": "1234"}`)
+	nb := newTestNotebook(nil)
+
+	ingress, err := generateIngress(nb, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cert, err := generateCertificate(nb, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	vsvc, err := generateVirtualService(nb, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	objects := map[string]v1.Object{
+		"PersistentVolumeClaim": generatePersistentVolumeClaim(nb, nbv1.NotebookVolumeClaim{Name: "home", Size: "1Gi"}),
+		"StatefulSet":           generateStatefulSet(nb),
+		"Service":               generateService(nb),
+		"Ingress":               ingress,
+		"Certificate":           cert,
+		"VirtualService":        vsvc,
+	}
+	for kind, obj := range objects {
+		if team := obj.GetLabels()["team"]; team != "ml" {
+			t.Fatalf("%s: Got team label %q, Expected %q", kind, team, "ml")
+		}
+		if costCenter := obj.GetAnnotations()["cost-center"]; costCenter != "1234" {
+			t.Fatalf("%s: Got cost-center annotation %q, Expected %q", kind, costCenter, "1234")
+		}
+	}
+	// The labels set by the controller take precedence.
+	if name := cert.GetLabels()["notebook-name"]; name != nb.Name {
+		t.Fatalf("Got notebook-name label %q, Expected %q", name, nb.Name)
+	}
+}
+
+func TestGenerateStatefulSetPodAnnotations(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		inject      string
+	}{
+		{
+			name:        "user annotations",
+			annotations: map[string]string{"prometheus.io/scrape": "true", "vault.hashicorp.com/agent-inject": "true"},
+			inject:      "false",
+		},
+		{
+			name:        "istio injection overridden",
+			annotations: map[string]string{"prometheus.io/scrape": "true", "sidecar.istio.io/inject": "true"},
+			inject:      "true",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nb := newTestNotebook(nil)
+			nb.Spec.Template.Annotations = test.annotations
+			podAnnotations := generateStatefulSet(nb).Spec.Template.Annotations
+			for k, v := range test.annotations {
+				if k != "sidecar.istio.io/inject" && podAnnotations[k] != v {
+					t.Fatalf("Got pod annotations %v, Expected %v=%v", podAnnotations, k, v)
+				}
+			}
+			if inject := podAnnotations["sidecar.istio.io/inject"]; inject != test.inject {
+				t.Fatalf("Got sidecar.istio.io/inject %v, Expected %v", inject, test.inject)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetScratchVolume(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         string
+		annotations map[string]string
+		sizeLimit   string
+		mountPath   string
+	}{
+		{
+			name: "no scratch volume",
+		},
+		{
+			name:        "default path",
+			annotations: map[string]string{AnnotationScratchSize: "20Gi"},
+			sizeLimit:   "20Gi",
+			mountPath:   DefaultScratchPath,
+		},
+		{
+			name:        "path from env",
+			env:         "/mnt/scratch/",
+			annotations: map[string]string{AnnotationScratchSize: "500Mi"},
+			sizeLimit:   "500Mi",
+			mountPath:   "/mnt/scratch",
+		},
+		{
+			name:        "path from annotation",
+			env:         "/mnt/scratch",
+			annotations: map[string]string{AnnotationScratchSize: "1Gi", AnnotationScratchPath: "/data/tmp"},
+			sizeLimit:   "1Gi",
+			mountPath:   "/data/tmp",
+		},
+		{
+			name:        "invalid size",
+			annotations: map[string]string{AnnotationScratchSize: "lots"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("SCRATCH_PATH", test.env)
+			podSpec := generateStatefulSet(newTestNotebook(test.annotations)).Spec.Template.Spec
+
+			var volume *corev1.Volume
+			for i := range podSpec.Volumes {
+				if podSpec.Volumes[i].Name == "scratch" {
+					volume = &podSpec.Volumes[i]
+				}
+			}
+			var mountPath string
+			for _, m := range findContainer(podSpec, "notebook").VolumeMounts {
+				if m.Name == "scratch" {
+					mountPath = m.MountPath
+				}
+			}
+			if test.sizeLimit == "" {
+				if volume != nil || mountPath != "" {
+					t.Fatalf("Got volume %v mounted at %q, Expected none", volume, mountPath)
+				}
+				return
+			}
+			if volume == nil || volume.EmptyDir == nil || volume.EmptyDir.SizeLimit.String() != test.sizeLimit {
+				t.Fatalf("Got volume %v, Expected an emptyDir limited to %v", volume, test.sizeLimit)
+			}
+			if mountPath != test.mountPath {
+				t.Fatalf("Got mount path %v, Expected %v", mountPath, test.mountPath)
+			}
+		})
+	}
+}
+
+func TestGenerateJupyterAuthArgs(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		annotations map[string]string
+		contains    []string
+		excludes    []string
+		tokenEnv    bool
+	}{
+		{
+			name:     "behind the gatekeeper",
+			contains: []string{"--NotebookApp.token=''", "--NotebookApp.allow_origin='*'"},
+		},
+		{
+			name:     "without the gatekeeper",
+			env:      map[string]string{"ENABLE_GATEKEEPER": "false"},
+			contains: []string{"--NotebookApp.allow_origin='*'"},
+			excludes: []string{"--NotebookApp.token"},
+		},
+		{
+			name:     "token required",
+			env:      map[string]string{"JUPYTER_TOKEN_POLICY": "required", "JUPYTER_TOKEN_SECRET": "jupyter-token"},
+			excludes: []string{"--NotebookApp.token"},
+			tokenEnv: true,
+		},
+		{
+			name:        "token opted out without the gatekeeper",
+			env:         map[string]string{"ENABLE_GATEKEEPER": "false", "JUPYTER_TOKEN_SECRET": "jupyter-token"},
+			annotations: map[string]string{AnnotationJupyterToken: "none"},
+			contains:    []string{"--NotebookApp.token=''"},
+		},
+		{
+			name:     "restricted origin",
+			env:      map[string]string{"JUPYTER_ALLOW_ORIGIN": "https://console.example.com"},
+			contains: []string{"--NotebookApp.allow_origin='https://console.example.com'"},
+		},
+		{
+			name:     "same origin only",
+			env:      map[string]string{"JUPYTER_ALLOW_ORIGIN": ""},
+			excludes: []string{"--NotebookApp.allow_origin"},
+		},
+		{
+			name:        "origin from annotation",
+			env:         map[string]string{"JUPYTER_ALLOW_ORIGIN": "https://console.example.com"},
+			annotations: map[string]string{AnnotationJupyterAllowOrigin: "https://it's.example.com"},
+			contains:    []string{`--NotebookApp.allow_origin='https://it'\''s.example.com'`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for k, v := range test.env {
+				t.Setenv(k, v)
+			}
+			notebook := findContainer(generateStatefulSet(newTestNotebook(test.annotations)).Spec.Template.Spec, "notebook")
+			command := notebook.Args[len(notebook.Args)-1]
+			for _, arg := range test.contains {
+				if !strings.Contains(command, arg) {
+					t.Fatalf("Got %v, Expected it to contain %v", command, arg)
+				}
+			}
+			for _, arg := range test.excludes {
+				if strings.Contains(command, arg) {
+					t.Fatalf("Got %v, Expected it not to contain %v", command, arg)
+				}
+			}
+			tokenEnv := false
+			for _, envVar := range notebook.Env {
+				if envVar.Name == "JUPYTER_TOKEN" && envVar.ValueFrom.SecretKeyRef.Name == "jupyter-token" {
+					tokenEnv = true
+				}
+			}
+			if tokenEnv != test.tokenEnv {
+				t.Fatalf("Got JUPYTER_TOKEN from the secret %v, Expected %v", tokenEnv, test.tokenEnv)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetServiceName(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      string
+		expected string
+	}{
+		{
+			name:     "notebook service by default",
+			expected: "test-notebook",
+		},
+		{
+			name:     "enabled",
+			env:      "true",
+			expected: "test-notebook",
+		},
+		{
+			name: "disabled",
+			env:  "false",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.env != "" {
+				t.Setenv("SET_STATEFULSET_SERVICE_NAME", test.env)
+			}
+			nb := newTestNotebook(nil)
+			if name := generateStatefulSet(nb).Spec.ServiceName; name != test.expected {
+				t.Fatalf("Got %v, Expected %v", name, test.expected)
+			}
+			if test.expected != "" && generateService(nb).Name != test.expected {
+				t.Fatalf("Got service %v, Expected %v", generateService(nb).Name, test.expected)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetSecurityHardening(t *testing.T) {
+	for _, harden := range []bool{false, true} {
+		t.Run(strconv.FormatBool(harden), func(t *testing.T) {
+			t.Setenv("HARDEN_SECURITY", strconv.FormatBool(harden))
+			podSpec := generateStatefulSet(newTestNotebook(nil)).Spec.Template.Spec
+
+			for name, paths := range map[string][]string{
+				"notebook":   {"/tmp", "/home/jovyan", "/etc/ssl/certs"},
+				"gatekeeper": {"/tmp"},
+			} {
+				container := findContainer(podSpec, name)
+				if !harden {
+					if container.SecurityContext != nil {
+						t.Fatalf("Got %v security context %v, Expected none", name, container.SecurityContext)
+					}
+					continue
+				}
+				expected := &corev1.SecurityContext{
+					ReadOnlyRootFilesystem:   pointer.Bool(true),
+					AllowPrivilegeEscalation: pointer.Bool(false),
+					Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+				}
+				if !reflect.DeepEqual(container.SecurityContext, expected) {
+					t.Fatalf("Got %v security context %v, Expected %v", name, container.SecurityContext, expected)
+				}
+				for _, path := range paths {
+					found := false
+					for _, mount := range container.VolumeMounts {
+						found = found || mount.MountPath == path
+					}
+					if !found {
+						t.Fatalf("Got %v mounts %v, Expected a writable %v", name, container.VolumeMounts, path)
+					}
+				}
+			}
+			if podSpec.SecurityContext == nil || *podSpec.SecurityContext.FSGroup != DefaultFSGroup {
+				t.Fatalf("Got pod security context %v, Expected fsGroup %v", podSpec.SecurityContext, DefaultFSGroup)
+			}
+		})
+	}
+
+	// The settings of the Notebook are kept.
+	t.Setenv("HARDEN_SECURITY", "true")
+	nb := newTestNotebook(nil)
+	nb.Spec.Template.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{ReadOnlyRootFilesystem: pointer.Bool(false)}
+	notebook := findContainer(generateStatefulSet(nb).Spec.Template.Spec, "notebook")
+	if *notebook.SecurityContext.ReadOnlyRootFilesystem {
+		t.Fatalf("Got %v, Expected a writable root filesystem", notebook.SecurityContext)
+	}
+	for _, mount := range notebook.VolumeMounts {
+		if strings.HasPrefix(mount.Name, "hardening-") {
+			t.Fatalf("Got mounts %v, Expected no emptyDirs on a writable root filesystem", notebook.VolumeMounts)
+		}
+	}
+
+	// The notebook container is hardened wherever it is listed.
+	nb = newTestNotebook(nil)
+	nb.Spec.Template.Spec.Containers = []corev1.Container{
+		{Name: "proxy", Image: "envoyproxy/envoy"},
+		{Name: nb.Name, Image: "jupyter/minimal-notebook"},
+	}
+	assertHardenedContainer(t, generateStatefulSet(nb).Spec.Template.Spec, nb.Name, "proxy")
+}
+
+// assertHardenedContainer checks that the named notebook container has the
+// hardened security context and the writable home, and the sidecar neither.
+func assertHardenedContainer(t *testing.T, podSpec corev1.PodSpec, name, sidecar string) {
+	t.Helper()
+	notebook := findContainer(podSpec, name)
+	if notebook.SecurityContext == nil || !*notebook.SecurityContext.ReadOnlyRootFilesystem {
+		t.Fatalf("Got %v security context %v, Expected a read-only root filesystem", name, notebook.SecurityContext)
+	}
+	home := false
+	for _, mount := range notebook.VolumeMounts {
+		home = home || mount.Name == "hardening-home"
+	}
+	if !home {
+		t.Fatalf("Got %v mounts %v, Expected a writable home", name, notebook.VolumeMounts)
+	}
+	if other := findContainer(podSpec, sidecar); other.SecurityContext != nil || len(other.VolumeMounts) != 0 {
+		t.Fatalf("Got %v security context %v and mounts %v, Expected none", sidecar, other.SecurityContext, other.VolumeMounts)
+	}
+}
+
+func TestGenerateStatefulSetNotebookContainerByName(t *testing.T) {
+	nb := newTestNotebook(nil)
+	nb.Spec.Template.Spec.Containers = []corev1.Container{
+		{Name: "proxy", Image: "envoyproxy/envoy:v1.22.0"},
+		{
+			Name:  nb.Name,
+			Image: "jupyter/minimal-notebook",
+			Ports: []corev1.ContainerPort{{Name: "notebook-port", ContainerPort: 8889}},
+		},
+	}
+	if name := notebookContainerName(nb); name != nb.Name {
+		t.Fatalf("Got notebook container %v, Expected %v", name, nb.Name)
+	}
+	if port := notebookPort(nb); port != 8889 {
+		t.Fatalf("Got port %v, Expected %v", port, 8889)
+	}
+
+	podSpec := generateStatefulSet(nb).Spec.Template.Spec
+	notebook := findContainer(podSpec, nb.Name)
+	if notebook.WorkingDir == "" || notebook.Args == nil {
+		t.Fatalf("Got notebook container %v, Expected the working dir and args defaulted", notebook)
+	}
+	prefix := ""
+	for _, envVar := range notebook.Env {
+		if envVar.Name == PrefixEnvVar {
+			prefix = envVar.Value
+		}
+	}
+	if prefix != notebookPrefix(nb) {
+		t.Fatalf("Got %v %v, Expected %v", PrefixEnvVar, prefix, notebookPrefix(nb))
+	}
+
+	proxy := findContainer(podSpec, "proxy")
+	if proxy.WorkingDir != "" || proxy.Args != nil || proxy.Env != nil || proxy.Ports != nil {
+		t.Fatalf("Got proxy container %v, Expected it untouched", proxy)
+	}
+
+	// Without a container named after the Notebook, the first one is used.
+	nb.Spec.Template.Spec.Containers[1].Name = "notebook"
+	if name := notebookContainerName(nb); name != "proxy" {
+		t.Fatalf("Got notebook container %v, Expected %v", name, "proxy")
+	}
+}
+
+func TestGenerateStatefulSetMOTD(t *testing.T) {
+	t.Setenv("NOTEBOOK_MOTD", "Idle notebooks are stopped after 1h")
+	t.Setenv("NOTEBOOK_BANNER_ENV", `{"JUPYTER_ENABLE_LAB":"yes","USAGE_POLICY":"https://example.com/policy"}`)
+	nb := newTestNotebook(nil)
+	nb.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "JUPYTER_ENABLE_LAB", Value: "no"}}
+
+	notebook := findContainer(generateStatefulSet(nb).Spec.Template.Spec, "notebook")
+	env := make(map[string]string)
+	for _, envVar := range notebook.Env {
+		env[envVar.Name] = envVar.Value
+	}
+	expected := map[string]string{
+		"JUPYTER_ENABLE_LAB": "no",
+		"USAGE_POLICY":       "https://example.com/policy",
+		MOTDEnvVar:           "Idle notebooks are stopped after 1h",
+		PrefixEnvVar:         notebookPrefix(nb),
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("Got env %v, Expected %v", env, expected)
+	}
+}
+
+func TestGenerateStatefulSetCABundle(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		volume    string
+		configMap string
+		secret    string
+		update    bool
+	}{
+		{
+			name:   "tls secret by default",
+			volume: "secret",
+			update: true,
+		},
+		{
+			name:      "ca bundle configmap",
+			env:       map[string]string{"CA_BUNDLE_CONFIGMAP": "corporate-ca"},
+			volume:    "ca-bundle",
+			configMap: "corporate-ca",
+			update:    true,
+		},
+		{
+			name:   "ca bundle secret",
+			env:    map[string]string{"CA_BUNDLE_SECRET": "corporate-ca"},
+			volume: "ca-bundle",
+			secret: "corporate-ca",
+			update: true,
+		},
+		{
+			name: "update disabled",
+			env:  map[string]string{"RUN_UPDATE_CA_CERTS": "false", "CA_BUNDLE_CONFIGMAP": "corporate-ca"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for k, v := range test.env {
+				t.Setenv(k, v)
+			}
+			podSpec := generateStatefulSet(newTestNotebook(nil)).Spec.Template.Spec
+
+			notebook := findContainer(podSpec, "notebook")
+			if update := strings.Contains(notebook.Args[2], "update-ca-certificates"); update != test.update {
+				t.Fatalf("Got args %v, Expected update-ca-certificates %v", notebook.Args, test.update)
+			}
+			volume := ""
+			for _, mount := range notebook.VolumeMounts {
+				if mount.MountPath == "/usr/local/share/ca-certificates" {
+					volume = mount.Name
+				}
+			}
+			if volume != test.volume {
+				t.Fatalf("Got CA certificates from %q, Expected %q", volume, test.volume)
+			}
+
+			var caBundle *corev1.Volume
+			for i := range podSpec.Volumes {
+				if podSpec.Volumes[i].Name == "ca-bundle" {
+					caBundle = &podSpec.Volumes[i]
+				}
+			}
+			if test.configMap == "" && test.secret == "" {
+				if caBundle != nil {
+					t.Fatalf("Got %v, Expected no ca-bundle volume", caBundle)
+				}
+				return
+			}
+			if test.configMap != "" && (caBundle.ConfigMap == nil || caBundle.ConfigMap.Name != test.configMap) {
+				t.Fatalf("Got %v, Expected the %v ConfigMap", caBundle, test.configMap)
+			}
+			if test.secret != "" && (caBundle.Secret == nil || caBundle.Secret.SecretName != test.secret) {
+				t.Fatalf("Got %v, Expected the %v Secret", caBundle, test.secret)
+			}
+		})
+	}
+}
+
+func TestGenerateGatekeeperLogLevel(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name:     "default from env",
+			expected: "--log-level=info",
+		},
+		{
+			name:        "override",
+			annotations: map[string]string{AnnotationGatekeeperLogLevel: "debug"},
+			expected:    "--log-level=debug",
+		},
+		{
+			name:        "unknown level",
+			annotations: map[string]string{AnnotationGatekeeperLogLevel: "verbose"},
+			expected:    "--log-level=info",
+		},
+	}
+
+	t.Setenv("LOG_LEVEL", "info")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gatekeeper := generateGatekeeperContainer(newTestNotebook(test.annotations))
+			found := false
+			for _, arg := range gatekeeper.Args {
+				found = found || arg == test.expected
+			}
+			if !found {
+				t.Fatalf("Got args %v, Expected %v", gatekeeper.Args, test.expected)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetGatekeeper(t *testing.T) {
+	tests := []struct {
+		name       string
+		gatekeeper string
+		enabled    bool
+		targetPort int
+	}{
+		{
+			name:       "enabled by default",
+			enabled:    true,
+			targetPort: GatekeeperPort,
+		},
+		{
+			name:       "disabled",
+			gatekeeper: "false",
+			targetPort: DefaultContainerPort,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("ENABLE_GATEKEEPER", test.gatekeeper)
+			nb := newTestNotebook(nil)
+			podSpec := generateStatefulSet(nb).Spec.Template.Spec
+
+			gatekeeper := findContainer(podSpec, "gatekeeper")
+			if got := gatekeeper != nil; got != test.enabled {
+				t.Fatalf("Got gatekeeper %v, Expected %v", got, test.enabled)
+			}
+			if test.enabled {
+				expected := []corev1.ContainerPort{{Name: "service", ContainerPort: GatekeeperPort}}
+				if !reflect.DeepEqual(gatekeeper.Ports, expected) {
+					t.Fatalf("Got ports %v, Expected %v", gatekeeper.Ports, expected)
+				}
+				listen, upstream := false, false
+				for _, arg := range gatekeeper.Args {
+					listen = listen || arg == "--listen=:3000"
+					upstream = upstream || arg == "--upstream-url=http://127.0.0.1:8888"
+				}
+				if !listen || !upstream {
+					t.Fatalf("Got args %v, Expected to listen on 3000 and proxy to 8888", gatekeeper.Args)
+				}
+			}
+			if got := generateService(nb).Spec.Ports[0].TargetPort; got != intstr.FromInt(test.targetPort) {
+				t.Fatalf("Got target port %v, Expected %v", got.String(), test.targetPort)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetSeccompProfile(t *testing.T) {
+	localhostProfile := "profiles/notebook.json"
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expected *corev1.SeccompProfile
+	}{
+		{
+			name: "unset by default",
+		},
+		{
+			name:     "runtime default when hardened",
+			env:      map[string]string{"HARDEN_SECURITY": "true"},
+			expected: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+		},
+		{
+			name:     "configured",
+			env:      map[string]string{"SECCOMP_PROFILE": "RuntimeDefault"},
+			expected: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+		},
+		{
+			name:     "localhost profile",
+			env:      map[string]string{"SECCOMP_PROFILE": "Localhost/profiles/notebook.json"},
+			expected: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeLocalhost, LocalhostProfile: &localhostProfile},
+		},
+		{
+			name: "disabled when hardened",
+			env:  map[string]string{"HARDEN_SECURITY": "true", "SECCOMP_PROFILE": ""},
+		},
+		{
+			name: "invalid",
+			env:  map[string]string{"SECCOMP_PROFILE": "Localhost"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for k, v := range test.env {
+				t.Setenv(k, v)
+			}
+			sc := generateStatefulSet(newTestNotebook(nil)).Spec.Template.Spec.SecurityContext
+			if sc == nil || sc.FSGroup == nil || *sc.FSGroup != DefaultFSGroup {
+				t.Fatalf("Got %v, Expected fsGroup %v", sc, DefaultFSGroup)
+			}
+			if !reflect.DeepEqual(sc.SeccompProfile, test.expected) {
+				t.Fatalf("Got %v, Expected %v", sc.SeccompProfile, test.expected)
+			}
+		})
+	}
+}
+
+func TestGetNextConditionTruncatesMessage(t *testing.T) {
+	t.Setenv("CONDITION_MESSAGE_MAX_LENGTH", "20")
+	cs := corev1.ContainerState{
+		Waiting: &corev1.ContainerStateWaiting{
+			Reason:  "CrashLoopBackOff",
+			Message: strings.Repeat("Traceback (most recent call last) ", 100),
+		},
+	}
+
+	condition := getNextCondition(cs)
+	if condition.Reason != "CrashLoopBackOff" {
+		t.Fatalf("Got reason %q, Expected it untouched", condition.Reason)
+	}
+	if condition.Message != "Traceback (most r..." {
+		t.Fatalf("Got message %q, Expected it truncated to 20 characters", condition.Message)
+	}
+}
+
+func TestGenerateServiceLoadBalancerAnnotations(t *testing.T) {
+	lbAnnotations := `{"service.beta.kubernetes.io/aws-load-balancer-internal":"true"}`
+	tests := []struct {
+		name        string
+		serviceType string
+		serviceSpec corev1.ServiceType
+		internal    bool
+	}{
+		{
+			name:        "cluster ip by default",
+			serviceSpec: corev1.ServiceTypeClusterIP,
+		},
+		{
+			name:        "node port",
+			serviceType: "NodePort",
+			serviceSpec: corev1.ServiceTypeNodePort,
+		},
+		{
+			name:        "internal load balancer",
+			serviceType: "LoadBalancer",
+			serviceSpec: corev1.ServiceTypeLoadBalancer,
+			internal:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("SERVICE_TYPE", test.serviceType)
+			t.Setenv("SERVICE_LB_ANNOTATIONS", lbAnnotations)
+			svc := generateService(newTestNotebook(nil))
+			if svc.Spec.Type != test.serviceSpec {
+				t.Fatalf("Got type %v, Expected %v", svc.Spec.Type, test.serviceSpec)
+			}
+			_, internal := svc.Annotations["service.beta.kubernetes.io/aws-load-balancer-internal"]
+			if internal != test.internal {
+				t.Fatalf("Got annotations %v, Expected internal load balancer: %v", svc.Annotations, test.internal)
+			}
+		})
+	}
+}
+
+func TestGenerateHeadlessService(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         string
+		annotations map[string]string
+		headless    bool
+	}{
+		{
+			name: "disabled by default",
+		},
+		{
+			name:     "enabled by env",
+			env:      "true",
+			headless: true,
+		},
+		{
+			name:        "enabled by annotation",
+			annotations: map[string]string{AnnotationHeadlessService: "true"},
+			headless:    true,
+		},
+		{
+			name:        "disabled by annotation",
+			env:         "true",
+			annotations: map[string]string{AnnotationHeadlessService: "false"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("HEADLESS_SERVICE", test.env)
+			nb := newTestNotebook(test.annotations)
+			if got := useHeadlessService(nb); got != test.headless {
+				t.Fatalf("Got headless %v, Expected %v", got, test.headless)
+			}
+			expectedServiceName := serviceName(nb)
+			if test.headless {
+				expectedServiceName = headlessServiceName(nb)
+			}
+			if ss := generateStatefulSet(nb); ss.Spec.ServiceName != expectedServiceName {
+				t.Fatalf("Got StatefulSet service name %q, Expected %q", ss.Spec.ServiceName, expectedServiceName)
+			}
+		})
+	}
+
+	nb := newTestNotebook(nil)
+	nb.Spec.Ports = []nbv1.NotebookPort{{Name: "dask-scheduler", Port: 8786}}
+	svc := generateHeadlessService(nb)
+	if svc.Name != "test-notebook-headless" || svc.Spec.ClusterIP != corev1.ClusterIPNone {
+		t.Fatalf("Got %s with cluster ip %q, Expected a headless test-notebook-headless", svc.Name, svc.Spec.ClusterIP)
+	}
+	if !svc.Spec.PublishNotReadyAddresses {
+		t.Fatalf("Expected the addresses to be published before the pods are ready")
+	}
+	expectedPorts := []corev1.ServicePort{
+		{Name: "http-test-notebook", Port: DefaultContainerPort, TargetPort: intstr.FromInt(DefaultContainerPort), Protocol: "TCP"},
+		{Name: "dask-scheduler", Port: 8786, TargetPort: intstr.FromInt(8786), Protocol: "TCP"},
+	}
+	if !reflect.DeepEqual(svc.Spec.Ports, expectedPorts) {
+		t.Fatalf("Got ports %v, Expected %v", svc.Spec.Ports, expectedPorts)
+	}
+}
+
+func TestReconcileHeadlessService(t *testing.T) {
+	nb := newTestNotebook(nil)
+	r := newTestReconciler(nb)
+	name := headlessServiceName(nb)
+
+	t.Setenv("HEADLESS_SERVICE", "true")
+	reconcileNotebook(t, r, nb)
+	svc := &corev1.Service{}
+	if !objectExists(t, r, nb, svc, name) {
+		t.Fatalf("Expected the headless Service to be created")
+	}
+	if svc.Spec.ClusterIP != corev1.ClusterIPNone {
+		t.Fatalf("Got cluster ip %q, Expected %q", svc.Spec.ClusterIP, corev1.ClusterIPNone)
+	}
+	if !objectExists(t, r, nb, &corev1.Service{}, serviceName(nb)) {
+		t.Fatalf("Expected the notebook Service to be kept")
+	}
+
+	// Reconciling again leaves the headless Service alone.
+	resourceVersion := svc.ResourceVersion
+	reconcileNotebook(t, r, nb)
+	if !objectExists(t, r, nb, svc, name) || svc.ResourceVersion != resourceVersion {
+		t.Fatalf("Got resource version %q, Expected the headless Service unchanged at %q", svc.ResourceVersion, resourceVersion)
+	}
+
+	t.Setenv("HEADLESS_SERVICE", "false")
+	reconcileNotebook(t, r, nb)
+	if objectExists(t, r, nb, &corev1.Service{}, name) {
+		t.Fatalf("Expected the headless Service to be deleted")
+	}
+}
+
+// objectExists returns true if the named object exists in the namespace of nb.
+func objectExists(t *testing.T, r *NotebookReconciler, nb *nbv1.Notebook, obj client.Object, name string) bool {
+	t.Helper()
+	err := r.Get(context.Background(), types.NamespacedName{Name: name, Namespace: nb.Namespace}, obj)
+	if err != nil && !apierrs.IsNotFound(err) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return err == nil
+}
+
+func TestReconcileCleansUpDisabledNetworking(t *testing.T) {
+	nb := newTestNotebook(nil)
+	r := newTestReconciler(nb)
+	vsvcName := virtualServiceName(nb.Name, nb.Namespace)
+	ingName := ingressName(nb.Name, nb.Namespace)
+	certName := certificateName(nb.Name, nb.Namespace)
+
+	t.Setenv("USE_ISTIO", "true")
+	reconcileNotebook(t, r, nb)
+	if !objectExists(t, r, nb, newVirtualServiceObject(), vsvcName) ||
+		!objectExists(t, r, nb, &netv1.Ingress{}, ingName) ||
+		!objectExists(t, r, nb, newCertificateObject(), certName) {
+		t.Fatalf("Expected the VirtualService, Ingress and Certificate to be created")
+	}
+
+	// Disabling istio removes the VirtualService.
+	t.Setenv("USE_ISTIO", "false")
+	reconcileNotebook(t, r, nb)
+	if objectExists(t, r, nb, newVirtualServiceObject(), vsvcName) {
+		t.Fatalf("Expected the stale VirtualService to be deleted")
+	}
+
+	// Disabling ingress in favor of istio removes the Ingress and Certificate.
+	t.Setenv("USE_ISTIO", "true")
+	t.Setenv("USE_INGRESS", "false")
+	reconcileNotebook(t, r, nb)
+	if !objectExists(t, r, nb, newVirtualServiceObject(), vsvcName) {
+		t.Fatalf("Expected the VirtualService to be recreated")
+	}
+	if objectExists(t, r, nb, &netv1.Ingress{}, ingName) || objectExists(t, r, nb, newCertificateObject(), certName) {
+		t.Fatalf("Expected the stale Ingress and Certificate to be deleted")
+	}
+}
+
+func TestReconcileExposeMode(t *testing.T) {
+	tests := []struct {
+		mode    string
+		ingress bool
+		istio   bool
+	}{
+		{mode: ExposeModeIngress, ingress: true},
+		{mode: ExposeModeIstio, istio: true},
+		{mode: ExposeModeNone},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			t.Setenv("EXPOSE_MODE", test.mode)
+			// EXPOSE_MODE takes precedence over the legacy toggles.
+			t.Setenv("USE_ISTIO", "true")
+			nb := newTestNotebook(nil)
+			r := newTestReconciler(nb)
+			reconcileNotebook(t, r, nb)
+
+			if got := objectExists(t, r, nb, &netv1.Ingress{}, ingressName(nb.Name, nb.Namespace)); got != test.ingress {
+				t.Fatalf("Got Ingress %v, Expected %v", got, test.ingress)
+			}
+			if got := objectExists(t, r, nb, newCertificateObject(), certificateName(nb.Name, nb.Namespace)); got != test.ingress {
+				t.Fatalf("Got Certificate %v, Expected %v", got, test.ingress)
+			}
+			if got := objectExists(t, r, nb, newVirtualServiceObject(), virtualServiceName(nb.Name, nb.Namespace)); got != test.istio {
+				t.Fatalf("Got VirtualService %v, Expected %v", got, test.istio)
+			}
+		})
+	}
+}
+
+func TestReconcileIngressClassName(t *testing.T) {
+	t.Setenv("EXPOSE_MODE", ExposeModeIngress)
+	nb := newTestNotebook(nil)
+	r := newTestReconciler(nb)
+	reconcileNotebook(t, r, nb)
+
+	ingress := &netv1.Ingress{}
+	objectExists(t, r, nb, ingress, ingressName(nb.Name, nb.Namespace))
+	if *ingress.Spec.IngressClassName != DefaultIngressClassName {
+		t.Fatalf("Got ingress class %v, Expected %v", *ingress.Spec.IngressClassName, DefaultIngressClassName)
+	}
+
+	// Changing INGRESS_CLASS_NAME on an upgrade moves the existing Ingresses.
+	t.Setenv("INGRESS_CLASS_NAME", "nginx")
+	reconcileNotebook(t, r, nb)
+	objectExists(t, r, nb, ingress, ingressName(nb.Name, nb.Namespace))
+	if *ingress.Spec.IngressClassName != "nginx" {
+		t.Fatalf("Got ingress class %v, Expected nginx", *ingress.Spec.IngressClassName)
+	}
+}
+
+func isOwnedBy(obj client.Object, nb *nbv1.Notebook) bool {
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.UID == nb.UID {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReconcileReclaimOwnerReferences(t *testing.T) {
+	tests := []struct {
+		name        string
+		reclaimPVC  string
+		reclaimCert string
+		pvcOwned    bool
+		secretOwned bool
+	}{
+		{name: "nothing owned"},
+		{name: "pvc owned", reclaimPVC: "true", pvcOwned: true},
+		{name: "secret owned", reclaimCert: "true", secretOwned: true},
+		{name: "both owned", reclaimPVC: "true", reclaimCert: "true", pvcOwned: true, secretOwned: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("RECLAIM_PVC", test.reclaimPVC)
+			t.Setenv("RECLAIM_CERT_SECRET", test.reclaimCert)
+			nb := newTestNotebook(nil)
+			secret := &corev1.Secret{ObjectMeta: v1.ObjectMeta{
+				Name:      nb.Name + "-secret",
+				Namespace: nb.Namespace,
+				OwnerReferences: []v1.OwnerReference{{
+					APIVersion: "cert-manager.io/v1",
+					Kind:       "Certificate",
+					Name:       certificateName(nb.Name, nb.Namespace),
+					UID:        "certificate-uid",
+				}},
+			}}
+			r := newTestReconciler(nb, secret)
+			reconcileNotebook(t, r, nb)
+
+			pvc := &corev1.PersistentVolumeClaim{}
+			if !objectExists(t, r, nb, pvc, nb.Spec.VolumeClaim[0].Name) {
+				t.Fatalf("Expected the PVC to be created")
+			}
+			if got := isOwnedBy(pvc, nb); got != test.pvcOwned {
+				t.Fatalf("Got PVC owned %v, Expected %v", got, test.pvcOwned)
+			}
+			objectExists(t, r, nb, secret, secret.Name)
+			if got := isOwnedBy(secret, nb); got != test.secretOwned {
+				t.Fatalf("Got Secret owned %v, Expected %v", got, test.secretOwned)
+			}
+			if len(secret.OwnerReferences) == 0 || secret.OwnerReferences[0].UID != "certificate-uid" {
+				t.Fatalf("Expected the Certificate owner to be kept, got %v", secret.OwnerReferences)
+			}
+
+			// Turning reclaiming off again releases both.
+			t.Setenv("RECLAIM_PVC", "false")
+			t.Setenv("RECLAIM_CERT_SECRET", "false")
+			reconcileNotebook(t, r, nb)
+			objectExists(t, r, nb, pvc, pvc.Name)
+			objectExists(t, r, nb, secret, secret.Name)
+			if isOwnedBy(pvc, nb) || isOwnedBy(secret, nb) {
+				t.Fatalf("Expected the PVC and Secret to be released")
+			}
+		})
+	}
+}
+
+// uncachedKindsClient fails the reads of the kinds the manager doesn't cache,
+// which have to go through the APIReader.
+type uncachedKindsClient struct {
+	client.Client
+}
+
+func (c *uncachedKindsClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	switch obj.(type) {
+	case *corev1.Secret, *corev1.ConfigMap:
+		return fmt.Errorf("%T %s read through the cache", obj, key)
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func TestReconcileReadsSecretUncached(t *testing.T) {
+	t.Setenv("RECLAIM_CERT_SECRET", "true")
+	nb := newTestNotebook(nil)
+	r := newTestReconciler(nb, testTLSSecret(nb))
+	r.APIReader = r.Client
+	r.Client = &uncachedKindsClient{Client: r.Client}
+	reconcileNotebook(t, r, nb)
+
+	secret := &corev1.Secret{}
+	if err := r.APIReader.Get(context.Background(), client.ObjectKeyFromObject(testTLSSecret(nb)), secret); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !isOwnedBy(secret, nb) {
+		t.Fatalf("Got owners %v, Expected the Notebook", secret.OwnerReferences)
+	}
+}
+
+func TestReconcilePersistentVolumeClaimAccessModes(t *testing.T) {
+	t.Setenv("PVC_ACCESS_MODE", "ReadWriteOnce")
+	nb := newTestNotebook(nil)
+	nb.Spec.VolumeClaim = []nbv1.NotebookVolumeClaim{
+		{Name: "home", Size: "10Gi"},
+		{Name: "shared", Size: "100Gi", StorageClass: "nfs", AccessMode: corev1.ReadWriteMany},
+	}
+	r := newTestReconciler(nb)
+	reconcileNotebook(t, r, nb)
+
+	expected := map[string]corev1.PersistentVolumeAccessMode{
+		"home":   corev1.ReadWriteOnce,
+		"shared": corev1.ReadWriteMany,
+	}
+	for name, accessMode := range expected {
+		pvc := &corev1.PersistentVolumeClaim{}
+		if !objectExists(t, r, nb, pvc, name) {
+			t.Fatalf("Expected PVC %s to be created", name)
+		}
+		if len(pvc.Spec.AccessModes) != 1 || pvc.Spec.AccessModes[0] != accessMode {
+			t.Fatalf("Got access modes %v for PVC %s, Expected %v", pvc.Spec.AccessModes, name, accessMode)
+		}
+	}
+}
+
+func TestReconcileCustomDomain(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace *corev1.Namespace
+		domain    string
+	}{
+		{
+			name:   "global default",
+			domain: "example.com",
+		},
+		{
+			name: "namespace override",
+			namespace: &corev1.Namespace{ObjectMeta: v1.ObjectMeta{
+				Name:        "test-namespace",
+				Annotations: map[string]string{AnnotationCustomDomain: "team-a.example.com"},
+			}},
+			domain: "team-a.example.com",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("CUSTOM_DOMAIN", "example.com")
+			nb := newTestNotebook(nil)
+			objects := []runtime.Object{nb}
+			if test.namespace != nil {
+				objects = append(objects, test.namespace)
+			}
+			r := newTestReconciler(objects...)
+			reconcileNotebook(t, r, nb)
+
+			host := ingressName(nb.Name, nb.Namespace) + "." + test.domain
+			ingress := &netv1.Ingress{}
+			if !objectExists(t, r, nb, ingress, ingressName(nb.Name, nb.Namespace)) {
+				t.Fatalf("Expected the Ingress to be created")
+			}
+			if ingress.Spec.Rules[0].Host != host || ingress.Spec.TLS[0].Hosts[0] != host {
+				t.Fatalf("Got Ingress rules %v and TLS %v, Expected host %s", ingress.Spec.Rules, ingress.Spec.TLS, host)
+			}
+			cert := newCertificateObject()
+			objectExists(t, r, nb, cert, certificateName(nb.Name, nb.Namespace))
+			dnsNames, _, _ := unstructured.NestedStringSlice(cert.Object, "spec", "dnsNames")
+			if !reflect.DeepEqual(dnsNames, []string{"tmax-cloud", host}) {
+				t.Fatalf("Got dnsNames %v, Expected %s", dnsNames, host)
+			}
+		})
+	}
+}
+
+func TestReconcileSharedTLSSecret(t *testing.T) {
+	tests := []struct {
+		name        string
+		shared      string
+		certificate bool
+		secretName  string
+	}{
+		{
+			name:        "per-notebook certificate",
+			certificate: true,
+			secretName:  "test-notebook-secret",
+		},
+		{
+			name:       "shared wildcard secret",
+			shared:     "wildcard-tls",
+			secretName: "wildcard-tls",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("SHARED_TLS_SECRET", test.shared)
+			t.Setenv("CUSTOM_DOMAIN", "example.com")
+			nb := newTestNotebook(nil)
+			r := newTestReconciler(nb)
+			reconcileNotebook(t, r, nb)
+
+			if got := objectExists(t, r, nb, newCertificateObject(), certificateName(nb.Name, nb.Namespace)); got != test.certificate {
+				t.Fatalf("Got Certificate %v, Expected %v", got, test.certificate)
+			}
+			ingress := &netv1.Ingress{}
+			objectExists(t, r, nb, ingress, ingressName(nb.Name, nb.Namespace))
+			expectedTLS := []netv1.IngressTLS{{
+				Hosts:      []string{ingressName(nb.Name, nb.Namespace) + ".example.com"},
+				SecretName: test.shared,
+			}}
+			if !reflect.DeepEqual(ingress.Spec.TLS, expectedTLS) {
+				t.Fatalf("Got TLS %v, Expected %v", ingress.Spec.TLS, expectedTLS)
+			}
+			sts := &appsv1.StatefulSet{}
+			objectExists(t, r, nb, sts, nb.Name)
+			for _, volume := range sts.Spec.Template.Spec.Volumes {
+				if volume.Name == "secret" && volume.Secret.SecretName != test.secretName {
+					t.Fatalf("Got secret volume %v, Expected %v", volume.Secret.SecretName, test.secretName)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileCullingRetainsPVC(t *testing.T) {
+	nb := newTestNotebook(nil)
+	replicas := int32(1)
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: v1.ObjectMeta{Name: nb.Name, Namespace: nb.Namespace},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &replicas,
+		},
+	}
+	r := newTestReconciler(nb, sts)
+	reconcileNotebook(t, r, nb)
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	if !objectExists(t, r, nb, pvc, nb.Spec.VolumeClaim[0].Name) {
+		t.Fatalf("Expected the PVC to be created")
+	}
+	pvcUID := pvc.UID
+
+	for _, stop := range []bool{true, false} {
+		if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if stop {
+			culler.SetStopAnnotation(&nb.ObjectMeta, nil)
+		} else {
+			delete(nb.Annotations, culler.STOP_ANNOTATION)
+		}
+		if err := r.Update(context.Background(), nb); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		reconcileNotebook(t, r, nb)
+
+		objectExists(t, r, nb, sts, sts.Name)
+		if expected := map[bool]int32{true: 0, false: 1}[stop]; *sts.Spec.Replicas != expected {
+			t.Fatalf("Got %v replicas, Expected %v", *sts.Spec.Replicas, expected)
+		}
+		if !objectExists(t, r, nb, pvc, pvc.Name) || pvc.UID != pvcUID {
+			t.Fatalf("Expected the PVC to be preserved")
+		}
+	}
+}
+
+func TestReconcileRevertsManualScale(t *testing.T) {
+	tests := []struct {
+		name     string
+		stopped  bool
+		scaled   int32
+		expected int32
+		reverted bool
+	}{
+		{
+			name:     "scaled up",
+			scaled:   3,
+			expected: 1,
+			reverted: true,
+		},
+		{
+			name:     "scaled up while stopped",
+			stopped:  true,
+			scaled:   2,
+			expected: 0,
+			reverted: true,
+		},
+		{
+			name:     "not scaled",
+			scaled:   1,
+			expected: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var annotations map[string]string
+			if test.stopped {
+				annotations = map[string]string{culler.STOP_ANNOTATION: "2021-08-30T15:37:36Z"}
+			}
+			nb := newTestNotebook(annotations)
+			r := newTestReconciler(nb)
+			reconcileNotebook(t, r, nb)
+			eventReasons(r)
+
+			sts := &appsv1.StatefulSet{}
+			objectExists(t, r, nb, sts, nb.Name)
+			sts.Spec.Replicas = pointer.Int32(test.scaled)
+			if err := r.Update(context.Background(), sts); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			reconcileNotebook(t, r, nb)
+
+			objectExists(t, r, nb, sts, nb.Name)
+			if *sts.Spec.Replicas != test.expected {
+				t.Fatalf("Got %v replicas, Expected %v", *sts.Spec.Replicas, test.expected)
+			}
+			reverted := false
+			for _, reason := range eventReasons(r) {
+				reverted = reverted || reason == EventReasonScaleReverted
+			}
+			if reverted != test.reverted {
+				t.Fatalf("Got reverted %v, Expected %v", reverted, test.reverted)
+			}
+		})
+	}
+}
+
+// runningNotebookStatefulSet returns the StatefulSet of another notebook of
+// the test namespace, scaled to the replicas.
+func runningNotebookStatefulSet(name string, replicas int32) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      name,
+			Namespace: "test-namespace",
+			OwnerReferences: []v1.OwnerReference{{
+				APIVersion: nbv1.GroupVersion.String(),
+				Kind:       "Notebook",
+				Name:       name,
+				Controller: pointer.Bool(true),
+			}},
+		},
+		Spec: appsv1.StatefulSetSpec{Replicas: pointer.Int32(replicas)},
+	}
+}
+
+func TestReconcileConcurrencyLimit(t *testing.T) {
+	t.Setenv("MAX_RUNNING_NOTEBOOKS_PER_NAMESPACE", "2")
+	limitCondition := func(r *NotebookReconciler, nb *nbv1.Notebook) *nbv1.NotebookCondition {
+		if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for i := range nb.Status.Conditions {
+			if nb.Status.Conditions[i].Type == NotebookConditionConcurrencyLimited {
+				return &nb.Status.Conditions[i]
+			}
+		}
+		return nil
+	}
+	replicas := func(r *NotebookReconciler, nb *nbv1.Notebook) int32 {
+		sts := &appsv1.StatefulSet{}
+		if !objectExists(t, r, nb, sts, nb.Name) {
+			t.Fatalf("StatefulSet not found")
+		}
+		return *sts.Spec.Replicas
+	}
+
+	t.Run("under the limit", func(t *testing.T) {
+		nb := newTestNotebook(nil)
+		r := newTestReconciler(nb, runningNotebookStatefulSet("other", 1), runningNotebookStatefulSet("stopped", 0))
+		reconcileNotebook(t, r, nb)
+		if got := replicas(r, nb); got != 1 {
+			t.Fatalf("Got %v replicas, Expected 1", got)
+		}
+		if condition := limitCondition(r, nb); condition != nil {
+			t.Fatalf("Got condition %v, Expected none", condition)
+		}
+	})
+
+	t.Run("over the limit", func(t *testing.T) {
+		nb := newTestNotebook(nil)
+		first := runningNotebookStatefulSet("first", 1)
+		r := newTestReconciler(nb, first, runningNotebookStatefulSet("second", 1))
+		result := reconcileNotebook(t, r, nb)
+		if got := replicas(r, nb); got != 0 {
+			t.Fatalf("Got %v replicas, Expected the Notebook queued at 0", got)
+		}
+		if result.RequeueAfter != ConcurrencyLimitRequeueDelay {
+			t.Fatalf("Got requeue after %v, Expected %v", result.RequeueAfter, ConcurrencyLimitRequeueDelay)
+		}
+		condition := limitCondition(r, nb)
+		if condition == nil || condition.Status != corev1.ConditionTrue {
+			t.Fatalf("Got condition %v, Expected ConcurrencyLimited to be True", condition)
+		}
+		found := false
+		for _, reason := range eventReasons(r) {
+			found = found || reason == EventReasonConcurrencyLimited
+		}
+		if !found {
+			t.Fatalf("Expected a %s event", EventReasonConcurrencyLimited)
+		}
+
+		// The notebook starts once another one stops.
+		first.Spec.Replicas = pointer.Int32(0)
+		if err := r.Update(context.Background(), first); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		reconcileNotebook(t, r, nb)
+		if got := replicas(r, nb); got != 1 {
+			t.Fatalf("Got %v replicas, Expected 1", got)
+		}
+		if condition := limitCondition(r, nb); condition == nil || condition.Status != corev1.ConditionFalse {
+			t.Fatalf("Got condition %v, Expected ConcurrencyLimited to be False", condition)
+		}
+	})
+
+	t.Run("already running", func(t *testing.T) {
+		nb := newTestNotebook(nil)
+		r := newTestReconciler(nb)
+		reconcileNotebook(t, r, nb)
+
+		// Notebooks started by hand past the limit don't stop a running one.
+		for _, name := range []string{"first", "second"} {
+			if err := r.Create(context.Background(), runningNotebookStatefulSet(name, 1)); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		reconcileNotebook(t, r, nb)
+		if got := replicas(r, nb); got != 1 {
+			t.Fatalf("Got %v replicas, Expected the running Notebook kept at 1", got)
+		}
+	})
+}
+
+// failingClient fails every StatefulSet create with err.
+type failingClient struct {
+	client.Client
+	err error
+}
+
+func (c *failingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if _, ok := obj.(*appsv1.StatefulSet); ok {
+		return c.err
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+// writeCountingClient counts the writes to the API server.
+type writeCountingClient struct {
+	client.Client
+	writes int
+}
+
+func (c *writeCountingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	c.writes++
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c *writeCountingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	c.writes++
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func (c *writeCountingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	c.writes++
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func (c *writeCountingClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	c.writes++
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+func TestReconcilePaused(t *testing.T) {
+	nb := newTestNotebook(map[string]string{AnnotationReconcile: ReconcilePaused})
+	r := newTestReconciler(nb)
+	counting := &writeCountingClient{Client: r.Client}
+	r.Client = counting
+
+	result := reconcileNotebook(t, r, nb)
+	if !reflect.DeepEqual(result, ctrl.Result{}) {
+		t.Fatalf("Got result %v, Expected no requeue", result)
+	}
+	if counting.writes != 0 {
+		t.Fatalf("Got %v writes, Expected 0", counting.writes)
+	}
+	if objectExists(t, r, nb, &appsv1.StatefulSet{}, nb.Name) {
+		t.Fatalf("Got a StatefulSet, Expected none while paused")
+	}
+
+	// Resuming reconciles the Notebook again.
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	delete(nb.Annotations, AnnotationReconcile)
+	if err := r.Update(context.Background(), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reconcileNotebook(t, r, nb)
+	if !objectExists(t, r, nb, &appsv1.StatefulSet{}, nb.Name) {
+		t.Fatalf("StatefulSet not found after resuming")
+	}
+}
+
+// missingCRDClient fails the requests for the kinds of a group like an API
+// server without its CRDs, e.g. cert-manager.io.
+type missingCRDClient struct {
+	client.Client
+	group string
+}
+
+func (c *missingCRDClient) noMatch(obj runtime.Object) error {
+	if gvk := obj.GetObjectKind().GroupVersionKind(); gvk.Group == c.group {
+		return &meta.NoKindMatchError{GroupKind: gvk.GroupKind(), SearchedVersions: []string{gvk.Version}}
+	}
+	return nil
+}
+
+func (c *missingCRDClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if err := c.noMatch(obj); err != nil {
+		return err
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func (c *missingCRDClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if err := c.noMatch(obj); err != nil {
+		return err
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestReconcileWithoutCertManager(t *testing.T) {
+	certificateGVK := newCertificateObject().GroupVersionKind()
+	for _, installed := range []bool{true, false} {
+		t.Run(fmt.Sprintf("installed=%v", installed), func(t *testing.T) {
+			mapper := meta.NewDefaultRESTMapper(nil)
+			if installed {
+				mapper.Add(certificateGVK, meta.RESTScopeNamespace)
+			}
+			got, err := kindInstalled(mapper, newCertificateObject())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != installed {
+				t.Fatalf("Got installed %v, Expected %v", got, installed)
+			}
+
+			nb := newTestNotebook(nil)
+			r := newTestReconciler(nb)
+			if !installed {
+				r.Client = &missingCRDClient{Client: r.Client, group: certificateGVK.Group}
+				r.noCertManager = true
+			}
+			reconcileNotebook(t, r, nb)
+			if !objectExists(t, r, nb, &netv1.Ingress{}, ingressName(nb.Name, nb.Namespace)) {
+				t.Fatalf("Ingress not found")
+			}
+			if installed && !objectExists(t, r, nb, newCertificateObject(), certificateName(nb.Name, nb.Namespace)) {
+				t.Fatalf("Certificate not found")
+			}
+		})
+	}
+}
+
+func TestReconcileWithoutIstio(t *testing.T) {
+	t.Setenv("EXPOSE_MODE", ExposeModeIstio)
+	virtualServiceGVK := newVirtualServiceObject().GroupVersionKind()
+	for _, installed := range []bool{true, false} {
+		t.Run(fmt.Sprintf("installed=%v", installed), func(t *testing.T) {
+			mapper := meta.NewDefaultRESTMapper(nil)
+			if installed {
+				mapper.Add(virtualServiceGVK, meta.RESTScopeNamespace)
+			}
+			got, err := kindInstalled(mapper, newVirtualServiceObject())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != installed {
+				t.Fatalf("Got installed %v, Expected %v", got, installed)
+			}
+
+			nb := newTestNotebook(nil)
+			r := newTestReconciler(nb)
+			if !installed {
+				r.Client = &missingCRDClient{Client: r.Client, group: virtualServiceGVK.Group}
+				r.noIstio = true
+			}
+			reconcileNotebook(t, r, nb)
+			if !objectExists(t, r, nb, &appsv1.StatefulSet{}, nb.Name) {
+				t.Fatalf("StatefulSet not found")
+			}
+			if installed && !objectExists(t, r, nb, newVirtualServiceObject(), virtualServiceName(nb.Name, nb.Namespace)) {
+				t.Fatalf("VirtualService not found")
+			}
+		})
+	}
+}
+
+func TestReconcileTransientErrorBackoff(t *testing.T) {
+	nb := newTestNotebook(nil)
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+	gr := schema.GroupResource{Group: "apps", Resource: "statefulsets"}
+
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "conflict", err: apierrs.NewConflict(gr, nb.Name, errors.New("object was modified"))},
+		{name: "already exists", err: apierrs.NewAlreadyExists(gr, nb.Name)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestReconciler(nb)
+			r.Client = &failingClient{Client: r.Client, err: test.err}
+
+			var previous time.Duration
+			for i := 0; i < 3; i++ {
+				result, err := r.Reconcile(context.Background(), req)
+				if err != nil {
+					t.Fatalf("Got error %v, Expected a requeue", err)
+				}
+				if result.RequeueAfter <= previous {
+					t.Fatalf("Got RequeueAfter %v, Expected more than %v", result.RequeueAfter, previous)
+				}
+				previous = result.RequeueAfter
+			}
+		})
+	}
+
+	t.Run("hard error", func(t *testing.T) {
+		r := newTestReconciler(nb)
+		r.Client = &failingClient{Client: r.Client, err: apierrs.NewInternalError(errors.New("etcd is down"))}
+		if _, err := r.Reconcile(context.Background(), req); err == nil {
+			t.Fatalf("Expected the error to be returned")
+		}
+	})
+}
+
+func findContainer(podSpec corev1.PodSpec, name string) *corev1.Container {
+	for i := range podSpec.Containers {
+		if podSpec.Containers[i].Name == name {
+			return &podSpec.Containers[i]
+		}
+	}
+	return nil
+}
+
+func TestGenerateStatefulSetSnapshotSidecar(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         string
+		annotations map[string]string
+		injected    bool
+	}{
+		{
+			name:        "disabled",
+			annotations: map[string]string{AnnotationSnapshot: "true"},
+		},
+		{
+			name: "not opted in",
+			env:  "true",
+		},
+		{
+			name:        "enabled and opted in",
+			env:         "true",
+			annotations: map[string]string{AnnotationSnapshot: "true"},
+			injected:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("ENABLE_SNAPSHOT", test.env)
+			t.Setenv("SNAPSHOT_DESTINATION", ":s3:notebooks/")
+			t.Setenv("SNAPSHOT_CREDENTIALS_SECRET", "snapshot-credentials")
+			podSpec := generateStatefulSet(newTestNotebook(test.annotations)).Spec.Template.Spec
+
+			sidecar := findContainer(podSpec, "snapshot")
+			if !test.injected {
+				if sidecar != nil {
+					t.Fatalf("Expected no snapshot sidecar, got %v", sidecar)
+				}
+				return
+			}
+			if sidecar == nil {
+				t.Fatalf("Expected the snapshot sidecar to be injected")
+			}
+			if sidecar.Image != DefaultSnapshotImage {
+				t.Fatalf("Got image %v, Expected %v", sidecar.Image, DefaultSnapshotImage)
+			}
+			expectedCommand := []string{"rclone", "sync", DefaultWorkingDir, ":s3:notebooks/test-namespace/test-notebook"}
+			if sidecar.Lifecycle == nil || sidecar.Lifecycle.PreStop == nil || sidecar.Lifecycle.PreStop.Exec == nil ||
+				!reflect.DeepEqual(sidecar.Lifecycle.PreStop.Exec.Command, expectedCommand) {
+				t.Fatalf("Got preStop %v, Expected %v", sidecar.Lifecycle, expectedCommand)
+			}
+			if len(sidecar.EnvFrom) != 1 || sidecar.EnvFrom[0].SecretRef.Name != "snapshot-credentials" {
+				t.Fatalf("Got envFrom %v, Expected the snapshot-credentials Secret", sidecar.EnvFrom)
+			}
+
+			// The notebook and the sidecar share the home directory.
+			notebook := findContainer(podSpec, "notebook")
+			expectedMount := corev1.VolumeMount{Name: "snapshot-home", MountPath: DefaultWorkingDir}
+			found := false
+			for _, mount := range notebook.VolumeMounts {
+				found = found || mount == expectedMount
+			}
+			if !found {
+				t.Fatalf("Got mounts %v, Expected %v", notebook.VolumeMounts, expectedMount)
+			}
+			if len(sidecar.VolumeMounts) != 1 || sidecar.VolumeMounts[0].Name != "snapshot-home" {
+				t.Fatalf("Got sidecar mounts %v, Expected snapshot-home", sidecar.VolumeMounts)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetProjectedToken(t *testing.T) {
+	tests := []struct {
+		name        string
+		enabled     string
+		annotations map[string]string
+		projected   bool
+	}{
+		{
+			name:        "enabled and opted in",
+			enabled:     "true",
+			annotations: map[string]string{AnnotationProjectedToken: "true"},
+			projected:   true,
+		},
+		{
+			name:    "not opted in",
+			enabled: "true",
+		},
+		{
+			name:        "disabled",
+			annotations: map[string]string{AnnotationProjectedToken: "true"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("ENABLE_PROJECTED_TOKEN", test.enabled)
+			t.Setenv("PROJECTED_TOKEN_AUDIENCE", "notebooks.tmaxcloud.org")
+			t.Setenv("PROJECTED_TOKEN_EXPIRATION", "1800")
+			podSpec := generateStatefulSet(newTestNotebook(test.annotations)).Spec.Template.Spec
+
+			var volume *corev1.Volume
+			for i := range podSpec.Volumes {
+				if podSpec.Volumes[i].Name == "projected-token" {
+					volume = &podSpec.Volumes[i]
+				}
+			}
+			var mount *corev1.VolumeMount
+			for i, m := range podSpec.Containers[0].VolumeMounts {
+				if m.MountPath == ProjectedTokenPath {
+					mount = &podSpec.Containers[0].VolumeMounts[i]
+				}
+			}
+			if !test.projected {
+				if volume != nil || mount != nil || podSpec.AutomountServiceAccountToken != nil {
+					t.Fatalf("Got volume %v and mount %v, Expected the default token", volume, mount)
+				}
+				return
+			}
+
+			if volume == nil || mount == nil || mount.Name != volume.Name || !mount.ReadOnly {
+				t.Fatalf("Got volume %v and mount %v, Expected a projected token mounted read-only", volume, mount)
+			}
+			expected := &corev1.ServiceAccountTokenProjection{
+				Audience:          "notebooks.tmaxcloud.org",
+				ExpirationSeconds: pointer.Int64(1800),
+				Path:              "token",
+			}
+			if got := volume.Projected.Sources[0].ServiceAccountToken; !reflect.DeepEqual(got, expected) {
+				t.Fatalf("Got token projection %v, Expected %v", got, expected)
+			}
+			if podSpec.AutomountServiceAccountToken == nil || *podSpec.AutomountServiceAccountToken {
+				t.Fatalf("Expected the default token not to be mounted")
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetServiceAccount(t *testing.T) {
+	tests := []struct {
+		name              string
+		automount         string
+		serviceAccount    string
+		notebookAutomount *bool
+		notebookAccount   string
+		annotation        string
+		expectedAutomount *bool
+		expectedAccount   string
+	}{
+		{
+			name: "namespace default",
+		},
+		{
+			name:              "automount disabled",
+			automount:         "false",
+			serviceAccount:    "notebook",
+			expectedAutomount: pointer.Bool(false),
+			expectedAccount:   "notebook",
+		},
+		{
+			name:              "invalid automount ignored",
+			automount:         "no",
+			expectedAutomount: nil,
+		},
+		{
+			name:              "notebook settings kept",
+			automount:         "false",
+			serviceAccount:    "notebook",
+			notebookAutomount: pointer.Bool(true),
+			notebookAccount:   "training",
+			expectedAutomount: pointer.Bool(true),
+			expectedAccount:   "training",
+		},
+		{
+			name:            "annotation",
+			serviceAccount:  "notebook",
+			notebookAccount: "training",
+			annotation:      "team-a-irsa",
+			expectedAccount: "team-a-irsa",
+		},
+		{
+			name:            "empty annotation ignored",
+			serviceAccount:  "notebook",
+			annotation:      " ",
+			expectedAccount: "notebook",
+		},
+		{
+			name:            "invalid annotation ignored",
+			notebookAccount: "training",
+			annotation:      "Team_A",
+			expectedAccount: "training",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("AUTOMOUNT_SA_TOKEN", test.automount)
+			t.Setenv("DEFAULT_SERVICE_ACCOUNT", test.serviceAccount)
+			var annotations map[string]string
+			if test.annotation != "" {
+				annotations = map[string]string{AnnotationServiceAccount: test.annotation}
+			}
+			nb := newTestNotebook(annotations)
+			nb.Spec.Template.Spec.AutomountServiceAccountToken = test.notebookAutomount
+			nb.Spec.Template.Spec.ServiceAccountName = test.notebookAccount
+			podSpec := generateStatefulSet(nb).Spec.Template.Spec
+
+			if !reflect.DeepEqual(podSpec.AutomountServiceAccountToken, test.expectedAutomount) {
+				t.Fatalf("Got automount %v, Expected %v", podSpec.AutomountServiceAccountToken, test.expectedAutomount)
+			}
+			if podSpec.ServiceAccountName != test.expectedAccount {
+				t.Fatalf("Got service account %q, Expected %q", podSpec.ServiceAccountName, test.expectedAccount)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetDefaultEnvFrom(t *testing.T) {
+	t.Setenv("DEFAULT_ENV_FROM_CONFIGMAPS", "s3-config, proxy")
+	t.Setenv("DEFAULT_ENV_FROM_SECRETS", "s3-credentials")
+	nb := newTestNotebook(nil)
+	nb.Spec.Template.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{
+		{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "proxy"}}},
+		{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "team-token"}}},
+	}
+	podSpec := generateStatefulSet(nb).Spec.Template.Spec
+
+	// The defaults come first, so the keys of the Notebook sources win.
+	expected := []corev1.EnvFromSource{
+		{ConfigMapRef: &corev1.ConfigMapEnvSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "s3-config"},
+			Optional:             pointer.Bool(true),
+		}},
+		{SecretRef: &corev1.SecretEnvSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "s3-credentials"},
+			Optional:             pointer.Bool(true),
+		}},
+		{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "proxy"}}},
+		{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "team-token"}}},
+	}
+	if envFrom := findContainer(podSpec, "notebook").EnvFrom; !reflect.DeepEqual(envFrom, expected) {
+		t.Fatalf("Got envFrom %v, Expected %v", envFrom, expected)
+	}
+	for _, container := range podSpec.Containers {
+		if container.Name != "notebook" && len(container.EnvFrom) > 0 {
+			t.Fatalf("Got envFrom %v on container %s, Expected only the notebook container", container.EnvFrom, container.Name)
+		}
+	}
+}
+
+func TestGenerateStatefulSetPrimaryContainer(t *testing.T) {
+	tests := []struct {
+		name    string
+		primary string
+		serving string
+	}{
+		{
+			name:    "designated primary",
+			primary: "jupyter",
+			serving: "jupyter",
+		},
+		{
+			name:    "first container by default",
+			serving: "code-server",
+		},
+		{
+			name:    "unknown primary ignored",
+			primary: "lab",
+			serving: "code-server",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var annotations map[string]string
+			if test.primary != "" {
+				annotations = map[string]string{AnnotationPrimaryContainer: test.primary}
+			}
+			nb := newTestNotebook(annotations)
+			nb.Spec.Template.Spec.Containers = []corev1.Container{
+				{Name: "code-server", Image: "codercom/code-server"},
+				{Name: "jupyter", Image: "jupyter/minimal-notebook"},
+			}
+			if got := notebookContainerName(nb); got != test.serving {
+				t.Fatalf("Got notebook container %q, Expected %q", got, test.serving)
+			}
+			podSpec := generateStatefulSet(nb).Spec.Template.Spec
+
+			for _, name := range []string{"code-server", "jupyter"} {
+				container := findContainer(podSpec, name)
+				if container == nil {
+					t.Fatalf("Container %s not found", name)
+				}
+				prefixed := false
+				for _, envVar := range container.Env {
+					prefixed = prefixed || envVar.Name == PrefixEnvVar
+				}
+				defaulted := container.WorkingDir == DefaultWorkingDir && len(container.Ports) == 1 &&
+					container.Ports[0].ContainerPort == DefaultContainerPort && container.ReadinessProbe != nil
+				if serving := name == test.serving; prefixed != serving || defaulted != serving {
+					t.Fatalf("Got %s with NB_PREFIX %v and defaults %v, Expected both %v: %v",
+						name, prefixed, defaulted, serving, container)
+				}
+			}
+		})
+	}
+
+	// A primary container listed after a sidecar is the one hardened.
+	t.Setenv("HARDEN_SECURITY", "true")
+	nb := newTestNotebook(map[string]string{AnnotationPrimaryContainer: "jupyter"})
+	nb.Spec.Template.Spec.Containers = []corev1.Container{
+		{Name: "code-server", Image: "codercom/code-server"},
+		{Name: "jupyter", Image: "jupyter/minimal-notebook"},
+	}
+	assertHardenedContainer(t, generateStatefulSet(nb).Spec.Template.Spec, "jupyter", "code-server")
+}
+
+func TestGenerateStatefulSetExistingVolumeClaims(t *testing.T) {
+	nb := newTestNotebook(nil)
+	nb.Spec.Template.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
+		{Name: "home", MountPath: "/home/jovyan"},
+	}
+	nb.Spec.ExistingVolumeClaims = []nbv1.NotebookExistingVolumeClaim{
+		{ClaimName: "team.datasets", MountPath: "/data", ReadOnly: true},
+		{ClaimName: "shared", MountPath: "/home/jovyan/"},
+	}
+	podSpec := generateStatefulSet(nb).Spec.Template.Spec
+
+	var volumes []corev1.Volume
+	for _, volume := range podSpec.Volumes {
+		if volume.PersistentVolumeClaim != nil {
+			volumes = append(volumes, volume)
+		}
+	}
+	if len(volumes) != 1 || volumes[0].Name != "existing-claim-0" ||
+		volumes[0].PersistentVolumeClaim.ClaimName != "team.datasets" || !volumes[0].PersistentVolumeClaim.ReadOnly {
+		t.Fatalf("Got volumes %v, Expected the read-only team.datasets claim", volumes)
+	}
+	// The claim mounted over the template's home volume is skipped.
+	var mounts []corev1.VolumeMount
+	for _, mount := range findContainer(podSpec, "notebook").VolumeMounts {
+		if strings.HasPrefix(mount.Name, "existing-claim-") {
+			mounts = append(mounts, mount)
+		}
+	}
+	expected := []corev1.VolumeMount{
+		{Name: "existing-claim-0", MountPath: "/data", ReadOnly: true},
+	}
+	if !reflect.DeepEqual(mounts, expected) {
+		t.Fatalf("Got %v, Expected %v", mounts, expected)
+	}
+}
+
+func TestGenerateStatefulSetInitContainers(t *testing.T) {
+	gitSync := `[{"name": "git-sync", "image": "k8s.gcr.io/git-sync/git-sync:v3.6.1", "args": ["--one-time"]}]`
+	specInit := corev1.Container{Name: "download", Image: "curlimages/curl"}
+	workspace := corev1.VolumeMount{Name: "workspace", MountPath: "/home/jovyan"}
+	tests := []struct {
+		name     string
+		defaults string
+		spec     []corev1.Container
+		expected []string
+	}{
+		{
+			name:     "from the spec",
+			spec:     []corev1.Container{specInit},
+			expected: []string{"download"},
+		},
+		{
+			name:     "defaults",
+			defaults: gitSync,
+			expected: []string{"git-sync"},
+		},
+		{
+			name:     "defaults before the spec",
+			defaults: gitSync,
+			spec:     []corev1.Container{specInit},
+			expected: []string{"git-sync", "download"},
+		},
+		{
+			name:     "spec replaces a default",
+			defaults: gitSync,
+			spec:     []corev1.Container{{Name: "git-sync", Image: "custom/git-sync"}},
+			expected: []string{"git-sync"},
+		},
+		{
+			name:     "invalid defaults",
+			defaults: `{"name": "git-sync"}`,
+			spec:     []corev1.Container{specInit},
+			expected: []string{"download"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("DEFAULT_INIT_CONTAINERS", test.defaults)
+			nb := newTestNotebook(nil)
+			nb.Spec.Template.Spec.InitContainers = test.spec
+			nb.Spec.Template.Spec.Volumes = []corev1.Volume{{
+				Name: "workspace",
+				VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: "test-notebook-pvc",
+				}},
+			}}
+			nb.Spec.Template.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{workspace}
+			podSpec := generateStatefulSet(nb).Spec.Template.Spec
+
+			var names []string
+			for _, c := range podSpec.InitContainers {
+				names = append(names, c.Name)
+				if c.Name == "git-sync" && c.Image != "custom/git-sync" &&
+					!reflect.DeepEqual(c.VolumeMounts, []corev1.VolumeMount{workspace}) {
+					t.Fatalf("Got mounts %v, Expected the workspace %v", c.VolumeMounts, workspace)
+				}
+				if c.Name == "download" && !reflect.DeepEqual(c, specInit) {
+					t.Fatalf("Got %v, Expected %v", c, specInit)
+				}
+			}
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Fatalf("Got init containers %v, Expected %v", names, test.expected)
+			}
+		})
+	}
+}
+
+func TestGenerateStatefulSetTerminationGracePeriod(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      string
+		user     *int64
+		culled   bool
+		expected int64
+	}{
+		{
+			name:     "default",
+			expected: DefaultTerminationGracePeriod,
+		},
+		{
+			name:     "from env",
+			env:      "120",
+			expected: 120,
+		},
+		{
+			name:     "invalid env",
+			env:      "2m",
+			expected: DefaultTerminationGracePeriod,
+		},
+		{
+			name:     "set by the user",
+			env:      "120",
+			user:     pointer.Int64(5),
+			expected: 5,
+		},
+		{
+			name:     "culled",
+			env:      "120",
+			culled:   true,
+			expected: 120,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.env != "" {
+				t.Setenv("NOTEBOOK_TERMINATION_GRACE_PERIOD", test.env)
+			}
+			nb := newTestNotebook(nil)
+			nb.Spec.Template.Spec.TerminationGracePeriodSeconds = test.user
+			if test.culled {
+				culler.SetStopAnnotation(&nb.ObjectMeta, nil)
+			}
+			ss := generateStatefulSet(nb)
+
+			if got := ss.Spec.Template.Spec.TerminationGracePeriodSeconds; got == nil || *got != test.expected {
+				t.Fatalf("Got grace period %v, Expected %v", got, test.expected)
+			}
+			if test.culled && *ss.Spec.Replicas != 0 {
+				t.Fatalf("Got %v replicas, Expected 0", *ss.Spec.Replicas)
+			}
+		})
+	}
+}
+
+func TestReconcileDeduplicatesEvents(t *testing.T) {
+	nb := newTestNotebook(nil)
+	pod := &corev1.Pod{ObjectMeta: v1.ObjectMeta{
+		Name:      nb.Name + "-0",
+		Namespace: nb.Namespace,
+		Labels:    map[string]string{"statefulset": nb.Name, "notebook-name": nb.Name},
+	}}
+	newEvent := func(name, message string) *corev1.Event {
+		return &corev1.Event{
+			ObjectMeta: v1.ObjectMeta{Name: name, Namespace: nb.Namespace},
+			InvolvedObject: corev1.ObjectReference{
+				Kind:      "Pod",
+				Name:      pod.Name,
+				Namespace: pod.Namespace,
+			},
+			Type:    corev1.EventTypeWarning,
+			Reason:  "BackOff",
+			Message: message,
+		}
+	}
+	events := []*corev1.Event{
+		newEvent("event-1", "Back-off restarting failed container"),
+		newEvent("event-2", "Back-off restarting failed container"),
+		newEvent("event-3", "Back-off restarting failed container"),
+		newEvent("event-4", "Back-off pulling image"),
+	}
+
+	tests := []struct {
+		name     string
+		window   string
+		expected int
+	}{
+		{name: "deduplicated", window: "60", expected: 2},
+		{name: "disabled", window: "0", expected: 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("EVENT_DEDUP_WINDOW", test.window)
+			objects := []runtime.Object{nb, pod}
+			for _, event := range events {
+				objects = append(objects, event)
+			}
+			r := newTestReconciler(objects...)
+			recorder := r.EventRecorder.(*record.FakeRecorder)
+
+			for _, event := range events {
+				_, err := r.Reconcile(context.Background(), ctrl.Request{
+					NamespacedName: types.NamespacedName{Name: event.Name, Namespace: event.Namespace},
+				})
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+			if got := len(recorder.Events); got != test.expected {
+				t.Fatalf("Got %v re-emitted events, Expected %v", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestEventCacheIsBounded(t *testing.T) {
+	c := newEventCache(2)
+	now := time.Now()
+	window := time.Minute
+
+	if c.Seen("a", now, window) || c.Seen("b", now.Add(time.Second), window) {
+		t.Fatalf("Expected new keys to not be seen")
+	}
+	if !c.Seen("a", now.Add(2*time.Second), window) {
+		t.Fatalf("Expected a duplicate key to be seen within the window")
+	}
+	// Adding a third key evicts the one closest to expiring.
+	c.Seen("c", now.Add(3*time.Second), window)
+	if len(c.expires) != 2 {
+		t.Fatalf("Got %v entries, Expected 2", len(c.expires))
+	}
+	if _, ok := c.expires["a"]; ok {
+		t.Fatalf("Expected the oldest key to be evicted")
+	}
+	if c.Seen("b", now.Add(2*window), window) {
+		t.Fatalf("Expected an expired key to not be seen")
+	}
+}
+
+func TestGenerateReadinessProbe(t *testing.T) {
+	tests := []struct {
+		name       string
+		gatekeeper string
+		probePort  int
+		targetPort int
+	}{
+		{
+			name:       "gatekeeper enabled",
+			probePort:  8080,
+			targetPort: GatekeeperPort,
+		},
+		{
+			name:       "gatekeeper disabled",
+			gatekeeper: "false",
+			probePort:  8080,
+			targetPort: 8080,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("ENABLE_GATEKEEPER", test.gatekeeper)
+			nb := newTestNotebook(nil)
+			nb.Spec.Template.Spec.Containers[0].Ports = []corev1.ContainerPort{{ContainerPort: 8080}}
+			nb.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{{
+				Name:  PrefixEnvVar,
+				Value: "/notebook/test-namespace/test-notebook",
+			}}
+			podSpec := generateStatefulSet(nb).Spec.Template.Spec
+
+			if got := findContainer(podSpec, "gatekeeper") != nil; got != (test.gatekeeper != "false") {
+				t.Fatalf("Got gatekeeper %v, Expected %v", got, !got)
+			}
+			probe := findContainer(podSpec, "notebook").ReadinessProbe
+			expected := &corev1.HTTPGetAction{
+				Path:   "/notebook/test-namespace/test-notebook/api",
+				Port:   intstr.FromInt(test.probePort),
+				Scheme: corev1.URISchemeHTTP,
+			}
+			if probe == nil || !reflect.DeepEqual(probe.HTTPGet, expected) {
+				t.Fatalf("Got probe %v, Expected %v", probe, expected)
+			}
+			svc := generateService(nb)
+			if got := svc.Spec.Ports[0].TargetPort; got != intstr.FromInt(test.targetPort) {
+				t.Fatalf("Got target port %v, Expected %v", got.String(), test.targetPort)
+			}
+		})
+	}
+
+	// A probe defined by the Notebook is kept.
+	nb := newTestNotebook(nil)
+	custom := &corev1.Probe{ProbeHandler: corev1.ProbeHandler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(8888)}}}
+	nb.Spec.Template.Spec.Containers[0].ReadinessProbe = custom
+	if got := findContainer(generateStatefulSet(nb).Spec.Template.Spec, "notebook").ReadinessProbe; !reflect.DeepEqual(got, custom) {
+		t.Fatalf("Got probe %v, Expected %v", got, custom)
+	}
+
+	// An image run with its own args, e.g. code-server, isn't probed.
+	nb = newTestNotebook(nil)
+	nb.Spec.Template.Spec.Containers[0].Args = []string{"--bind-addr", "0.0.0.0:8888"}
+	container := findContainer(generateStatefulSet(nb).Spec.Template.Spec, "notebook")
+	if container.ReadinessProbe != nil || container.StartupProbe != nil {
+		t.Fatalf("Got probes %v and %v, Expected none", container.ReadinessProbe, container.StartupProbe)
+	}
+}
+
+func TestGenerateStartupProbe(t *testing.T) {
+	liveness := &corev1.Probe{
+		ProbeHandler:     corev1.ProbeHandler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(8888)}},
+		PeriodSeconds:    10,
+		FailureThreshold: 3,
+	}
+	tests := []struct {
+		name     string
+		timeout  string
+		startup  *corev1.Probe
+		expected *corev1.Probe
+	}{
+		{
+			name: "default timeout",
+			expected: &corev1.Probe{
+				ProbeHandler:     corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{Path: notebookPrefix(newTestNotebook(nil)) + "/api", Port: intstr.FromInt(8888), Scheme: corev1.URISchemeHTTP}},
+				PeriodSeconds:    10,
+				FailureThreshold: 60,
+			},
+		},
+		{
+			name:    "rounded up timeout",
+			timeout: "95",
+			expected: &corev1.Probe{
+				ProbeHandler:     corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{Path: notebookPrefix(newTestNotebook(nil)) + "/api", Port: intstr.FromInt(8888), Scheme: corev1.URISchemeHTTP}},
+				PeriodSeconds:    10,
+				FailureThreshold: 10,
+			},
+		},
+		{
+			name:    "disabled",
+			timeout: "0",
+		},
+		{
+			name:     "defined by the notebook",
+			startup:  &corev1.Probe{ProbeHandler: corev1.ProbeHandler{Exec: &corev1.ExecAction{Command: []string{"true"}}}},
+			expected: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{Exec: &corev1.ExecAction{Command: []string{"true"}}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.timeout != "" {
+				t.Setenv("STARTUP_PROBE_TIMEOUT", test.timeout)
+			}
+			nb := newTestNotebook(nil)
+			nb.Spec.Template.Spec.Containers[0].StartupProbe = test.startup
+			nb.Spec.Template.Spec.Containers[0].LivenessProbe = liveness
+			container := findContainer(generateStatefulSet(nb).Spec.Template.Spec, "notebook")
+
+			if !reflect.DeepEqual(container.StartupProbe, test.expected) {
+				t.Fatalf("Got probe %v, Expected %v", container.StartupProbe, test.expected)
+			}
+			// The liveness probe only runs once the startup probe passed.
+			if !reflect.DeepEqual(container.LivenessProbe, liveness) {
+				t.Fatalf("Got liveness probe %v, Expected %v", container.LivenessProbe, liveness)
+			}
+		})
+	}
+
+	// The startup probe follows a readiness probe defined by the Notebook.
+	nb := newTestNotebook(nil)
+	readiness := corev1.ProbeHandler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(8888)}}
+	nb.Spec.Template.Spec.Containers[0].ReadinessProbe = &corev1.Probe{ProbeHandler: readiness}
+	probe := findContainer(generateStatefulSet(nb).Spec.Template.Spec, "notebook").StartupProbe
+	if probe == nil || !reflect.DeepEqual(probe.ProbeHandler, readiness) {
+		t.Fatalf("Got probe %v, Expected the readiness probe handler %v", probe, readiness)
+	}
+}
+
+func TestGenerateContainerPort(t *testing.T) {
+	for _, gatekeeper := range []string{"true", "false"} {
+		t.Run("gatekeeper "+gatekeeper, func(t *testing.T) {
+			t.Setenv("ENABLE_GATEKEEPER", gatekeeper)
+			nb := newTestNotebook(map[string]string{AnnotationContainerPort: "8080"})
+			podSpec := generateStatefulSet(nb).Spec.Template.Spec
+
+			container := findContainer(podSpec, "notebook")
+			if len(container.Ports) != 1 || container.Ports[0].ContainerPort != 8080 {
+				t.Fatalf("Got ports %v, Expected 8080", container.Ports)
+			}
+			if !strings.Contains(container.Args[2], "--port=8080 ") {
+				t.Fatalf("Got args %v, Expected --port=8080", container.Args)
+			}
+			if got := container.ReadinessProbe.HTTPGet.Port; got != intstr.FromInt(8080) {
+				t.Fatalf("Got probe port %v, Expected 8080", got.String())
+			}
+
+			targetPort := intstr.FromInt(8080)
+			if gatekeeper == "true" {
+				targetPort = intstr.FromInt(GatekeeperPort)
+				args := findContainer(podSpec, "gatekeeper").Args
+				found := false
+				for _, arg := range args {
+					found = found || arg == "--upstream-url=http://127.0.0.1:8080"
+				}
+				if !found {
+					t.Fatalf("Got gatekeeper args %v, Expected the upstream on 8080", args)
+				}
+			}
+			if got := generateService(nb).Spec.Ports[0].TargetPort; got != targetPort {
+				t.Fatalf("Got target port %v, Expected %v", got.String(), targetPort.String())
+			}
+		})
+	}
+
+	// An invalid annotation falls back to the container port.
+	nb := newTestNotebook(map[string]string{AnnotationContainerPort: "http"})
+	if got := notebookPort(nb); got != DefaultContainerPort {
+		t.Fatalf("Got port %v, Expected %v", got, DefaultContainerPort)
+	}
+}
+
+func TestReconcileDisableCertificate(t *testing.T) {
+	tests := []struct {
+		name       string
+		shared     string
+		secretName string
+	}{
+		{
+			name: "no secret",
+		},
+		{
+			name:       "shared secret",
+			shared:     "wildcard-tls",
+			secretName: "wildcard-tls",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("SHARED_TLS_SECRET", test.shared)
+			nb := newTestNotebook(map[string]string{AnnotationDisableCertificate: "true"})
+			r := newTestReconciler(nb)
+			reconcileNotebook(t, r, nb)
+
+			if objectExists(t, r, nb, newCertificateObject(), certificateName(nb.Name, nb.Namespace)) {
+				t.Fatalf("Expected no Certificate to be created")
+			}
+			sts := &appsv1.StatefulSet{}
+			objectExists(t, r, nb, sts, nb.Name)
+			podSpec := sts.Spec.Template.Spec
+
+			secretName := ""
+			volumes := map[string]bool{}
+			for _, volume := range podSpec.Volumes {
+				volumes[volume.Name] = true
+				if volume.Secret != nil {
+					secretName = volume.Secret.SecretName
+				}
+			}
+			if secretName != test.secretName {
+				t.Fatalf("Got secret volume %q, Expected %q", secretName, test.secretName)
+			}
+			for _, container := range podSpec.Containers {
+				for _, mount := range container.VolumeMounts {
+					if !volumes[mount.Name] {
+						t.Fatalf("Container %v mounts the missing volume %v", container.Name, mount.Name)
+					}
+				}
+			}
+			selfSigned := false
+			for _, arg := range findContainer(podSpec, "gatekeeper").Args {
+				selfSigned = selfSigned || arg == "--enable-self-signed-tls=true"
+			}
+			if selfSigned != (test.secretName == "") {
+				t.Fatalf("Got self-signed gatekeeper TLS %v, Expected %v", selfSigned, test.secretName == "")
+			}
+		})
+	}
+}
+
+func TestReconcileEndpointReadyCondition(t *testing.T) {
+	tests := []struct {
+		name       string
+		gatekeeper string
+		notebook   bool
+		keeper     bool
+		expected   corev1.ConditionStatus
+		message    string
+	}{
+		{
+			name:     "both ready",
+			notebook: true,
+			keeper:   true,
+			expected: corev1.ConditionTrue,
+		},
+		{
+			name:     "gatekeeper not ready",
+			notebook: true,
+			expected: corev1.ConditionFalse,
+			message:  "containers not ready: gatekeeper",
+		},
+		{
+			name:     "notebook not ready",
+			keeper:   true,
+			expected: corev1.ConditionFalse,
+			message:  "containers not ready: notebook",
+		},
+		{
+			name:       "gatekeeper disabled",
+			gatekeeper: "false",
+			notebook:   true,
+			expected:   corev1.ConditionTrue,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("ENABLE_GATEKEEPER", test.gatekeeper)
+			nb := newTestNotebook(nil)
+			running := corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+			pod := &corev1.Pod{
+				ObjectMeta: testPodMeta(nb, 0),
+				Status: corev1.PodStatus{
+					ContainerStatuses: []corev1.ContainerStatus{
+						{Name: "notebook", State: running, Ready: test.notebook},
+						{Name: "gatekeeper", State: running, Ready: test.keeper},
+					},
+				},
+			}
+			r := newTestReconciler(nb, pod)
+			reconcileNotebook(t, r, nb)
+			// Reconciling again doesn't duplicate the condition.
+			reconcileNotebook(t, r, nb)
+			if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			var found []nbv1.NotebookCondition
+			for _, condition := range nb.Status.Conditions {
+				if condition.Type == NotebookConditionEndpointReady {
+					found = append(found, condition)
+				}
+			}
+			if len(found) != 1 {
+				t.Fatalf("Got conditions %v, Expected a single EndpointReady condition", nb.Status.Conditions)
+			}
+			if found[0].Status != test.expected || found[0].Message != test.message {
+				t.Fatalf("Got %v %q, Expected %v %q", found[0].Status, found[0].Message, test.expected, test.message)
+			}
+			if conditions := containerConditions(nb); len(conditions) != 1 || conditions[0].Type != "Running" {
+				t.Fatalf("Got conditions %v, Expected a single Running condition", nb.Status.Conditions)
+			}
+		})
+	}
+}
+
+// eventReasons drains the recorded events and returns their reasons.
+func eventReasons(r *NotebookReconciler) []string {
+	var reasons []string
+	events := r.EventRecorder.(*record.FakeRecorder).Events
+	for {
+		select {
+		case e := <-events:
+			reasons = append(reasons, strings.Fields(e)[1])
+		default:
+			return reasons
+		}
+	}
+}
+
+func TestReconcileEventReasons(t *testing.T) {
+	t.Setenv("DEFAULT_STORAGE_CLASS", "standard")
+	nb := newTestNotebook(nil)
+	standardClass := &storagev1.StorageClass{ObjectMeta: v1.ObjectMeta{Name: "standard"}}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: nb.Name, Namespace: nb.Namespace}}
+
+	// Creating the notebook.
+	r := newTestReconciler(nb, standardClass)
+	reconcileNotebook(t, r, nb)
+	if reasons := eventReasons(r); !reflect.DeepEqual(reasons, []string{EventReasonNotebookCreated}) {
+		t.Fatalf("Got reasons %v, Expected %v", reasons, []string{EventReasonNotebookCreated})
+	}
+
+	// Culling an idle notebook.
+	t.Setenv("ENABLE_CULLING", "true")
+	idle := newTestNotebook(map[string]string{
+		culler.LAST_ACTIVITY_ANNOTATION: time.Now().Add(-48 * time.Hour).Format(time.RFC3339),
+	})
+	pod := &corev1.Pod{ObjectMeta: testPodMeta(nb, 0)}
+	r = newTestReconciler(idle, pod, standardClass)
+	reconcileNotebook(t, r, idle)
+	if reasons := eventReasons(r); !reflect.DeepEqual(reasons, []string{EventReasonNotebookCreated, EventReasonCullingNotebook}) {
+		t.Fatalf("Got reasons %v, Expected %v", reasons, []string{EventReasonNotebookCreated, EventReasonCullingNotebook})
+	}
+
+	// Failing to create the notebook.
+	gr := schema.GroupResource{Resource: "statefulsets"}
+	tests := []struct {
+		err    error
+		reason string
+	}{
+		{
+			err:    apierrs.NewForbidden(gr, nb.Name, errors.New("exceeded quota: compute, requested: pods=1")),
+			reason: EventReasonQuotaExceeded,
+		},
+		{
+			err:    apierrs.NewBadRequest("invalid StatefulSet"),
+			reason: EventReasonNotebookCreateFailed,
+		},
+	}
+	for _, test := range tests {
+		r := newTestReconciler(nb, standardClass)
+		r.Client = &failingClient{Client: r.Client, err: test.err}
+		if _, err := r.Reconcile(context.Background(), req); err == nil {
+			t.Fatalf("Expected the error to be returned")
+		}
+		if reasons := eventReasons(r); !reflect.DeepEqual(reasons, []string{test.reason}) {
+			t.Fatalf("Got reasons %v, Expected %v", reasons, []string{test.reason})
+		}
+
+		// The retries don't repeat the warning.
+		if _, err := r.Reconcile(context.Background(), req); err == nil {
+			t.Fatalf("Expected the error to be returned")
+		}
+		if reasons := eventReasons(r); len(reasons) != 0 {
+			t.Fatalf("Got reasons %v, Expected none", reasons)
+		}
+	}
+}
+
+func TestReconcileMaintenanceMode(t *testing.T) {
+	t.Setenv("MAINTENANCE_CONFIGMAP", "kubeflow/notebook-maintenance")
+	running := newTestNotebook(nil)
+	running.Name = "running-notebook"
+	started := newTestNotebook(nil)
+	started.Name = "started-notebook"
+	stopped := newTestNotebook(map[string]string{culler.STOP_ANNOTATION: "2021-08-30T15:37:36Z"})
+	stopped.Name = "stopped-notebook"
+	cm := &corev1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Name: "notebook-maintenance", Namespace: "kubeflow"},
+		Data:       map[string]string{"enabled": "true"},
+	}
+	r := newTestReconciler(running, started, stopped, cm)
+
+	get := func(nb *nbv1.Notebook) *nbv1.Notebook {
+		found := &nbv1.Notebook{}
+		if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), found); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return found
+	}
+	replicas := func(nb *nbv1.Notebook) int32 {
+		sts := &appsv1.StatefulSet{}
+		objectExists(t, r, nb, sts, nb.Name)
+		return *sts.Spec.Replicas
+	}
+	notebooks := []*nbv1.Notebook{running, started, stopped}
+
+	// Every notebook is stopped in maintenance mode.
+	for _, nb := range notebooks {
+		reconcileNotebook(t, r, nb)
+		if !culler.StopAnnotationIsSet(get(nb).ObjectMeta) || replicas(nb) != 0 {
+			t.Fatalf("Expected %v to be stopped in maintenance mode", nb.Name)
+		}
+	}
+
+	// A user can't start a notebook during maintenance.
+	nb := get(started)
+	delete(nb.Annotations, culler.STOP_ANNOTATION)
+	if err := r.Update(context.Background(), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reconcileNotebook(t, r, started)
+	if !culler.StopAnnotationIsSet(get(started).ObjectMeta) || replicas(started) != 0 {
+		t.Fatalf("Expected %v to stay stopped in maintenance mode", started.Name)
+	}
+
+	// Clearing maintenance starts the notebooks it stopped, and only them.
+	cm.Data["enabled"] = "false"
+	if err := r.Update(context.Background(), cm); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, nb := range notebooks {
+		reconcileNotebook(t, r, nb)
+	}
+	for _, nb := range []*nbv1.Notebook{running, started} {
+		found := get(nb)
+		if culler.StopAnnotationIsSet(found.ObjectMeta) || found.Annotations[AnnotationMaintenanceStopped] != "" || replicas(nb) != 1 {
+			t.Fatalf("Expected %v to be started after maintenance, got %v", nb.Name, found.Annotations)
+		}
+	}
+	if !culler.StopAnnotationIsSet(get(stopped).ObjectMeta) || replicas(stopped) != 0 {
+		t.Fatalf("Expected %v to stay stopped after maintenance", stopped.Name)
+	}
+}
+
+func TestPollMaintenanceMode(t *testing.T) {
+	t.Setenv("MAINTENANCE_CONFIGMAP", "kubeflow/notebook-maintenance")
+	cm := &corev1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Name: "notebook-maintenance", Namespace: "kubeflow"},
+		Data:       map[string]string{"enabled": "false"},
+	}
+	r := newTestReconciler(cm)
+	r.APIReader = r.Client
+	r.Client = &uncachedKindsClient{Client: r.Client}
+	events := make(chan event.GenericEvent)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = r.pollMaintenanceMode(ctx, 10*time.Millisecond, events)
+	}()
+
+	// Nothing is sent while the mode is unchanged.
+	select {
+	case e := <-events:
+		t.Fatalf("Got event for %v, Expected none", e.Object.GetName())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cm.Data["enabled"] = "true"
+	if err := r.APIReader.(client.Client).Update(context.Background(), cm); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	select {
+	case e := <-events:
+		if e.Object.GetName() != cm.Name || e.Object.GetNamespace() != cm.Namespace {
+			t.Fatalf("Got event for %s/%s, Expected %s/%s",
+				e.Object.GetNamespace(), e.Object.GetName(), cm.Namespace, cm.Name)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected an event once the maintenance mode is enabled")
+	}
+}
+
+func TestReconcileMaxLifetime(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         string
+		annotations map[string]string
+		age         time.Duration
+		stopped     bool
+	}{
+		{
+			name:    "past its lifetime",
+			env:     "24h",
+			age:     25 * time.Hour,
+			stopped: true,
+		},
+		{
+			name:    "within its lifetime",
+			env:     "24h",
+			age:     23 * time.Hour,
+			stopped: false,
+		},
+		{
+			name:    "no lifetime",
+			age:     1000 * time.Hour,
+			stopped: false,
+		},
+		{
+			name:        "lifetime extended by the annotation",
+			env:         "24h",
+			annotations: map[string]string{AnnotationMaxLifetime: "72h"},
+			age:         25 * time.Hour,
+			stopped:     false,
+		},
+		{
+			name:        "lifetime shortened by the annotation",
+			annotations: map[string]string{AnnotationMaxLifetime: "1h"},
+			age:         2 * time.Hour,
+			stopped:     true,
+		},
+		{
+			name:        "opted out",
+			env:         "24h",
+			annotations: map[string]string{AnnotationMaxLifetime: "0"},
+			age:         25 * time.Hour,
+			stopped:     false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("MAX_NOTEBOOK_LIFETIME", test.env)
+			nb := newTestNotebook(test.annotations)
+			nb.CreationTimestamp = v1.NewTime(time.Now().Add(-test.age))
+			r := newTestReconciler(nb)
+			reconcileNotebook(t, r, nb)
+
+			if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if stopped := culler.StopAnnotationIsSet(nb.ObjectMeta); stopped != test.stopped {
+				t.Fatalf("Got stopped %v, Expected %v", stopped, test.stopped)
+			}
+			if test.stopped && (len(nb.Status.CullHistory) != 1 || nb.Status.CullHistory[0].Reason != CullReasonLifetime) {
+				t.Fatalf("Got cull history %v, Expected a Lifetime entry", nb.Status.CullHistory)
+			}
+			sts := &appsv1.StatefulSet{}
+			objectExists(t, r, nb, sts, nb.Name)
+			if stopped := *sts.Spec.Replicas == 0; stopped != test.stopped {
+				t.Fatalf("Got replicas %d, Expected stopped %v", *sts.Spec.Replicas, test.stopped)
+			}
+			reasons := eventReasons(r)
+			found := false
+			for _, reason := range reasons {
+				found = found || reason == EventReasonLifetimeExceeded
+			}
+			if found != test.stopped {
+				t.Fatalf("Got events %v, Expected a %s event %v", reasons, EventReasonLifetimeExceeded, test.stopped)
+			}
+		})
+	}
+}
+
+func TestReconcileNotebookTemplate(t *testing.T) {
+	template := &nbv1.NotebookTemplate{
+		ObjectMeta: v1.ObjectMeta{Name: "pytorch-small"},
+		Template: nbv1.NotebookTemplateSpec{
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{
+					Name:  "notebook",
+					Image: "pytorch-notebook:latest",
+					Resources: corev1.ResourceRequirements{
+						Limits: corev1.ResourceList{
+							corev1.ResourceCPU:    resource.MustParse("2"),
+							corev1.ResourceMemory: resource.MustParse("4Gi"),
+						},
+					},
+					VolumeMounts: []corev1.VolumeMount{{Name: "datasets", MountPath: "/datasets"}},
+				}},
+				Volumes: []corev1.Volume{{
+					Name: "datasets",
+					VolumeSource: corev1.VolumeSource{
+						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "datasets"},
+					},
+				}},
+			},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		image  string
+		limits corev1.ResourceList
+		cpu    string
+		memory string
+		expect string
+	}{
+		{
+			name:   "from the template",
+			cpu:    "2",
+			memory: "4Gi",
+			expect: "pytorch-notebook:latest",
+		},
+		{
+			name:   "overridden by the notebook",
+			image:  "custom-notebook:latest",
+			limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")},
+			cpu:    "1",
+			memory: "4Gi",
+			expect: "custom-notebook:latest",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nb := newTestNotebook(nil)
+			nb.Spec.TemplateRef = template.Name
+			nb.Spec.Template.Spec.Containers[0].Image = test.image
+			nb.Spec.Template.Spec.Containers[0].Resources.Limits = test.limits
+			r := newTestReconciler(nb, template.DeepCopy())
+			reconcileNotebook(t, r, nb)
+
+			sts := &appsv1.StatefulSet{}
+			if !objectExists(t, r, nb, sts, nb.Name) {
+				t.Fatalf("StatefulSet not found")
+			}
+			podSpec := sts.Spec.Template.Spec
+			container := findContainer(podSpec, "notebook")
+			if container.Image != test.expect {
+				t.Fatalf("Got image %v, Expected %v", container.Image, test.expect)
+			}
+			if cpu := container.Resources.Limits[corev1.ResourceCPU]; cpu.String() != test.cpu {
+				t.Fatalf("Got cpu limit %v, Expected %v", cpu.String(), test.cpu)
+			}
+			if memory := container.Resources.Limits[corev1.ResourceMemory]; memory.String() != test.memory {
+				t.Fatalf("Got memory limit %v, Expected %v", memory.String(), test.memory)
+			}
+			if !hasVolume(&podSpec, "datasets") {
+				t.Fatalf("Got volumes %v, Expected the datasets volume", podSpec.Volumes)
+			}
+
+			// The merged fields are not written back to the Notebook.
+			if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if image := nb.Spec.Template.Spec.Containers[0].Image; image != test.image {
+				t.Fatalf("Got notebook image %v, Expected %v", image, test.image)
+			}
+		})
+	}
+
+	t.Run("missing template", func(t *testing.T) {
+		nb := newTestNotebook(nil)
+		nb.Spec.TemplateRef = "missing"
+		r := newTestReconciler(nb)
+		_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(nb)})
+		if !apierrs.IsNotFound(err) {
+			t.Fatalf("Got error %v, Expected NotFound", err)
+		}
+		reasons := eventReasons(r)
+		found := false
+		for _, reason := range reasons {
+			found = found || reason == EventReasonTemplateNotFound
+		}
+		if !found {
+			t.Fatalf("Got reasons %v, Expected a %s event", reasons, EventReasonTemplateNotFound)
+		}
+		if objectExists(t, r, nb, &appsv1.StatefulSet{}, nb.Name) {
+			t.Fatalf("Got a StatefulSet, Expected none")
+		}
+	})
+}
+
+func TestReconcileRestartStatus(t *testing.T) {
+	nb := newTestNotebook(nil)
+	pod := &corev1.Pod{
+		ObjectMeta: testPodMeta(nb, 0),
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name: "notebook",
+				State: corev1.ContainerState{
+					Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"},
+				},
+				LastTerminationState: corev1.ContainerState{
+					Terminated: &corev1.ContainerStateTerminated{Reason: "OOMKilled", ExitCode: 137},
+				},
+				RestartCount: 3,
+			}},
+		},
+	}
+	r := newTestReconciler(nb, pod)
+	reconcileNotebook(t, r, nb)
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if nb.Status.RestartCount != 3 || nb.Status.LastTerminationReason != "OOMKilled" ||
+		nb.Status.LastTerminationExitCode != 137 {
+		t.Fatalf("Got %v restarts, last termination %q (%v), Expected 3, \"OOMKilled\" (137)",
+			nb.Status.RestartCount, nb.Status.LastTerminationReason, nb.Status.LastTerminationExitCode)
+	}
+
+	// A fresh pod without restarts clears the last termination.
+	pod.Status.ContainerStatuses[0].RestartCount = 0
+	pod.Status.ContainerStatuses[0].LastTerminationState = corev1.ContainerState{}
+	if err := r.Update(context.Background(), pod); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reconcileNotebook(t, r, nb)
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if nb.Status.RestartCount != 0 || nb.Status.LastTerminationReason != "" || nb.Status.LastTerminationExitCode != 0 {
+		t.Fatalf("Got %v restarts, last termination %q (%v), Expected none",
+			nb.Status.RestartCount, nb.Status.LastTerminationReason, nb.Status.LastTerminationExitCode)
+	}
+}
+
+func TestReconcileStatusFollowsNotebookContainer(t *testing.T) {
+	nb := newTestNotebook(nil)
+	pod := &corev1.Pod{
+		ObjectMeta: testPodMeta(nb, 0),
+		Status: corev1.PodStatus{
+			// The statuses are sorted by name, so the gatekeeper comes first.
+			ContainerStatuses: []corev1.ContainerStatus{
+				{
+					Name:  "gatekeeper",
+					State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+					Ready: true,
+				},
+				{
+					Name: "notebook",
+					State: corev1.ContainerState{
+						Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"},
+					},
+					RestartCount: 2,
+				},
+			},
+		},
+	}
+	r := newTestReconciler(nb, pod)
+	reconcileNotebook(t, r, nb)
+
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if nb.Status.ContainerState.Waiting == nil || nb.Status.ContainerState.Waiting.Reason != "CrashLoopBackOff" {
+		t.Fatalf("Got container state %v, Expected the notebook container waiting", nb.Status.ContainerState)
+	}
+	condition := latestContainerCondition(nb.Status.Conditions)
+	if condition == nil || condition.Type != "Waiting" {
+		t.Fatalf("Got condition %v, Expected Waiting", condition)
+	}
+	if nb.Status.RestartCount != 2 {
+		t.Fatalf("Got %v restarts, Expected %v", nb.Status.RestartCount, 2)
+	}
+	if severity := podSeverity(pod); severity != 3 {
+		t.Fatalf("Got pod severity %v, Expected %v", severity, 3)
+	}
+}
+
+func TestGenerateStatefulSetBurstableRequests(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         string
+		annotations map[string]string
+		cpu         string
+		memory      string
+	}{
+		{
+			name:   "not burstable",
+			cpu:    "2",
+			memory: "4Gi",
+		},
+		{
+			name:        "default fraction",
+			annotations: map[string]string{AnnotationBurstable: "true"},
+			cpu:         "1",
+			memory:      "2Gi",
+		},
+		{
+			name:        "fraction from env",
+			env:         "0.1",
+			annotations: map[string]string{AnnotationBurstable: "true"},
+			cpu:         "400m",
+			memory:      "858993459",
+		},
+		{
+			name:        "fraction from annotation",
+			env:         "0.1",
+			annotations: map[string]string{AnnotationBurstable: "0.5"},
+			cpu:         "2",
+			memory:      "4Gi",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("BURSTABLE_REQUEST_FRACTION", test.env)
+			nb := newTestNotebook(test.annotations)
+			nb.Spec.Template.Spec.Containers[0].Resources = corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{
+					corev1.ResourceCPU:                    resource.MustParse("4"),
+					corev1.ResourceMemory:                 resource.MustParse("8Gi"),
+					corev1.ResourceName("nvidia.com/gpu"): resource.MustParse("1"),
+				},
+				Requests: corev1.ResourceList{
+					corev1.ResourceCPU:                    resource.MustParse("2"),
+					corev1.ResourceMemory:                 resource.MustParse("4Gi"),
+					corev1.ResourceName("nvidia.com/gpu"): resource.MustParse("1"),
+				},
+			}
+			requests := findContainer(generateStatefulSet(nb).Spec.Template.Spec, "notebook").Resources.Requests
+
+			if got := requests[corev1.ResourceCPU]; got.Cmp(resource.MustParse(test.cpu)) != 0 {
+				t.Fatalf("Got CPU request %v, Expected %v", got.String(), test.cpu)
+			}
+			if got := requests[corev1.ResourceMemory]; got.Cmp(resource.MustParse(test.memory)) != 0 {
+				t.Fatalf("Got memory request %v, Expected %v", got.String(), test.memory)
+			}
+			if got := requests[corev1.ResourceName("nvidia.com/gpu")]; got.Cmp(resource.MustParse("1")) != 0 {
+				t.Fatalf("Got GPU request %v, Expected it untouched", got.String())
+			}
+		})
+	}
+}
+
+func TestReconcileRoutingMode(t *testing.T) {
+	tests := []struct {
+		mode        string
+		prefix      string
+		host        string
+		path        string
+		vsvcHosts   []string
+		vsvcPrefix  string
+		probePrefix string
+	}{
+		{
+			mode:        RoutingModeSubdomain,
+			prefix:      "/",
+			host:        "test-notebook-test-namespace.example.com",
+			path:        "/",
+			vsvcHosts:   []string{"test-notebook-test-namespace.example.com"},
+			vsvcPrefix:  "/",
+			probePrefix: "",
+		},
+		{
+			mode:        RoutingModePath,
+			prefix:      "/notebook/test-namespace/test-notebook",
+			host:        "example.com",
+			path:        "/notebook/test-namespace/test-notebook",
+			vsvcHosts:   []string{"*"},
+			vsvcPrefix:  "/notebook/test-namespace/test-notebook/",
+			probePrefix: "/notebook/test-namespace/test-notebook",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			t.Setenv("CUSTOM_DOMAIN", "example.com")
+			t.Setenv("USE_ISTIO", "true")
+			nb := newTestNotebook(map[string]string{AnnotationRoutingMode: test.mode})
+			r := newTestReconciler(nb)
+			reconcileNotebook(t, r, nb)
+
+			sts := &appsv1.StatefulSet{}
+			objectExists(t, r, nb, sts, nb.Name)
+			notebook := findContainer(sts.Spec.Template.Spec, "notebook")
+			prefix := ""
+			for _, envVar := range notebook.Env {
+				if envVar.Name == PrefixEnvVar {
+					prefix = envVar.Value
+				}
+			}
+			if prefix != test.prefix {
+				t.Fatalf("Got NB_PREFIX %q, Expected %q", prefix, test.prefix)
+			}
+			if got := notebook.ReadinessProbe.HTTPGet.Path; got != test.probePrefix+"/api" {
+				t.Fatalf("Got probe path %q, Expected %q", got, test.probePrefix+"/api")
+			}
+
+			ingress := &netv1.Ingress{}
+			objectExists(t, r, nb, ingress, ingressName(nb.Name, nb.Namespace))
+			rule := ingress.Spec.Rules[0]
+			if rule.Host != test.host || rule.HTTP.Paths[0].Path != test.path {
+				t.Fatalf("Got Ingress %v%v, Expected %v%v", rule.Host, rule.HTTP.Paths[0].Path, test.host, test.path)
+			}
+			if !reflect.DeepEqual(ingress.Spec.TLS[0].Hosts, []string{test.host}) {
+				t.Fatalf("Got TLS hosts %v, Expected %v", ingress.Spec.TLS[0].Hosts, test.host)
+			}
+
+			vsvc := newVirtualServiceObject()
+			objectExists(t, r, nb, vsvc, virtualServiceName(nb.Name, nb.Namespace))
+			hosts, _, _ := unstructured.NestedStringSlice(vsvc.Object, "spec", "hosts")
+			if !reflect.DeepEqual(hosts, test.vsvcHosts) {
+				t.Fatalf("Got VirtualService hosts %v, Expected %v", hosts, test.vsvcHosts)
+			}
+			route := virtualServiceRoute(t, vsvc)
+			match := route["match"].([]interface{})[0].(map[string]interface{})["uri"].(map[string]interface{})["prefix"]
+			rewrite := route["rewrite"].(map[string]interface{})["uri"]
+			if match != test.vsvcPrefix || rewrite != test.vsvcPrefix {
+				t.Fatalf("Got VirtualService prefix %v and rewrite %v, Expected %v", match, rewrite, test.vsvcPrefix)
+			}
+		})
+	}
+}
+
+func TestReconcileLoggerValues(t *testing.T) {
+	t.Setenv("USE_ISTIO", "true")
+	nb := newTestNotebook(nil)
+	r := newTestReconciler(nb)
+	var lines []string
+	r.Log = funcr.New(func(prefix, args string) {
+		lines = append(lines, args)
+	}, funcr.Options{})
+	reconcileNotebook(t, r, nb)
+
+	reconcileID := regexp.MustCompile(`"reconcileID"="([^"]+)"`)
+	ids := map[string]bool{}
+	for _, msg := range []string{"Creating Ingress", "Creating Certificate", "Creating virtual service"} {
+		found := false
+		for _, line := range lines {
+			if !strings.Contains(line, `"msg"="`+msg+`"`) {
+				continue
+			}
+			found = true
+			if !strings.Contains(line, `"uid"="test-notebook-uid"`) {
+				t.Fatalf("Got %v, Expected the Notebook UID", line)
+			}
+			match := reconcileID.FindStringSubmatch(line)
+			if match == nil {
+				t.Fatalf("Got %v, Expected a reconcile ID", line)
+			}
+			ids[match[1]] = true
+		}
+		if !found {
+			t.Fatalf("Expected a %q log line, got %v", msg, lines)
+		}
+	}
+	if len(ids) != 1 {
+		t.Fatalf("Got reconcile IDs %v, Expected a single one", ids)
+	}
+}
+
+// contextClient fails the requests of a done context, like the API client does.
+type contextClient struct {
+	client.Client
+}
+
+func (c *contextClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func (c *contextClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c *contextClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func TestReconcileHelpersCancelledContext(t *testing.T) {
+	nb := newTestNotebook(nil)
+	r := newTestReconciler(nb)
+	r.Client = &contextClient{Client: r.Client}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	helpers := map[string]func() error{
+		"ingress": func() error {
+			return r.reconcileIngress(ctx, nb, "example.com", r.Log)
+		},
+		"certificate": func() error {
+			return r.reconcileCertificate(ctx, nb, "example.com", r.Log)
+		},
+		"virtual service": func() error {
+			return r.reconcileVirtualService(ctx, nb, "example.com", r.Log)
+		},
+	}
+	for name, helper := range helpers {
+		if err := helper(); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Got %v from the %v helper, Expected %v", err, name, context.Canceled)
+		}
+	}
+	if objectExists(t, r, nb, &netv1.Ingress{}, ingressName(nb.Name, nb.Namespace)) ||
+		objectExists(t, r, nb, newCertificateObject(), certificateName(nb.Name, nb.Namespace)) ||
+		objectExists(t, r, nb, newVirtualServiceObject(), virtualServiceName(nb.Name, nb.Namespace)) {
+		t.Fatalf("Expected nothing to be created with a cancelled context")
+	}
+}
+
+func TestGenerateGatekeeperTLSArgs(t *testing.T) {
+	tests := []struct {
+		name         string
+		minVersion   string
+		cipherSuites string
+		expected     []string
+		unexpected   string
+	}{
+		{
+			name:       "defaults",
+			expected:   []string{"--tls-min-version=tlsv1.2"},
+			unexpected: "--tls-cipher-suites=",
+		},
+		{
+			name:         "overrides",
+			minVersion:   "tlsv1.3",
+			cipherSuites: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			expected: []string{
+				"--tls-min-version=tlsv1.3",
+				"--tls-cipher-suites=TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			},
+		},
+		{
+			name:         "invalid values",
+			minVersion:   "sslv3",
+			cipherSuites: "TLS_RSA_WITH_RC4_128_SHA,TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			expected: []string{
+				"--tls-min-version=tlsv1.2",
+				"--tls-cipher-suites=TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("GATEKEEPER_TLS_MIN_VERSION", test.minVersion)
+			t.Setenv("GATEKEEPER_TLS_CIPHER_SUITES", test.cipherSuites)
+			args := generateGatekeeperContainer(newTestNotebook(nil)).Args
+
+			for _, expected := range test.expected {
+				found := false
+				for _, arg := range args {
+					found = found || arg == expected
+				}
+				if !found {
+					t.Fatalf("Got args %v, Expected %v", args, expected)
+				}
+			}
+			for _, arg := range args {
+				if test.unexpected != "" && strings.HasPrefix(arg, test.unexpected) {
+					t.Fatalf("Got unexpected arg %v", arg)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateGatekeeperResourcesArg(t *testing.T) {
+	tests := []struct {
+		name        string
+		resources   string
+		roles       string
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name:     "defaults",
+			expected: "--resources=uri=/*|roles=notebook-gatekeeper:notebook-gatekeeper-manager",
+		},
+		{
+			name:      "env overrides",
+			resources: "/lab*",
+			roles:     "idp:data-scientist, idp:admin",
+			expected:  "--resources=uri=/lab*|roles=idp:data-scientist,idp:admin",
+		},
+		{
+			name:        "annotation override",
+			roles:       "idp:data-scientist",
+			annotations: map[string]string{AnnotationGatekeeperRoles: "idp:team-a"},
+			expected:    "--resources=uri=/*|roles=idp:team-a",
+		},
+		{
+			name:        "invalid values",
+			resources:   "lab|roles=",
+			roles:       "idp:admin|methods=GET",
+			annotations: map[string]string{AnnotationGatekeeperRoles: "idp:team a"},
+			expected:    "--resources=uri=/*|roles=notebook-gatekeeper:notebook-gatekeeper-manager",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("GATEKEEPER_RESOURCES", test.resources)
+			t.Setenv("GATEKEEPER_ROLES", test.roles)
+			args := generateGatekeeperContainer(newTestNotebook(test.annotations)).Args
+
+			var got string
+			for _, arg := range args {
+				if strings.HasPrefix(arg, "--resources=") {
+					got = arg
+				}
+			}
+			if got != test.expected {
+				t.Fatalf("Got %v, Expected %v", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestReconcileDefaultStorageClass(t *testing.T) {
+	defaultClass := &storagev1.StorageClass{ObjectMeta: v1.ObjectMeta{
+		Name:        "standard",
+		Annotations: map[string]string{"storageclass.kubernetes.io/is-default-class": "true"},
+	}}
+	tests := []struct {
+		name         string
+		claimClass   string
+		env          string
+		objects      []runtime.Object
+		storageClass *string
+		warning      bool
+	}{
+		{
+			name:         "user specified",
+			claimClass:   "fast",
+			env:          "slow",
+			storageClass: pointer.String("fast"),
+		},
+		{
+			name:         "env default",
+			env:          "slow",
+			storageClass: pointer.String("slow"),
+		},
+		{
+			name:    "unset with a cluster default",
+			objects: []runtime.Object{defaultClass},
+		},
+		{
+			name:    "unset without a cluster default",
+			warning: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("DEFAULT_STORAGE_CLASS", test.env)
+			nb := newTestNotebook(nil)
+			nb.Spec.VolumeClaim[0].StorageClass = test.claimClass
+			r := newTestReconciler(append(test.objects, nb)...)
+			reconcileNotebook(t, r, nb)
+
+			pvc := &corev1.PersistentVolumeClaim{}
+			objectExists(t, r, nb, pvc, nb.Spec.VolumeClaim[0].Name)
+			if !reflect.DeepEqual(pvc.Spec.StorageClassName, test.storageClass) {
+				t.Fatalf("Got storage class %v, Expected %v", pvc.Spec.StorageClassName, test.storageClass)
+			}
+			warning := false
+			for _, reason := range eventReasons(r) {
+				warning = warning || reason == EventReasonNoStorageClass
+			}
+			if warning != test.warning {
+				t.Fatalf("Got warning %v, Expected %v", warning, test.warning)
+			}
+		})
+	}
+}
+
+func TestReconcileStorageClassNotFound(t *testing.T) {
+	fastClass := &storagev1.StorageClass{ObjectMeta: v1.ObjectMeta{Name: "fast"}}
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		warning bool
+	}{
+		{
+			name:    "existing storage class",
+			objects: []runtime.Object{fastClass},
+		},
+		{
+			name:    "missing storage class",
+			warning: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nb := newTestNotebook(nil)
+			nb.Spec.VolumeClaim[0].StorageClass = "fast"
+			r := newTestReconciler(append(test.objects, nb)...)
+			reconcileNotebook(t, r, nb)
+
+			// The PVC is created either way, so it binds once the class exists.
+			pvc := &corev1.PersistentVolumeClaim{}
+			if !objectExists(t, r, nb, pvc, nb.Spec.VolumeClaim[0].Name) {
+				t.Fatalf("PersistentVolumeClaim not found")
+			}
+			warnings := 0
+			for _, reason := range eventReasons(r) {
+				if reason == EventReasonStorageClassNotFound {
+					warnings++
+				}
+			}
+			expected := 0
+			if test.warning {
+				expected = 1
+			}
+			if warnings != expected {
+				t.Fatalf("Got %d warnings, Expected %d", warnings, expected)
+			}
+
+			// The PVC stays Pending, the warning isn't repeated.
+			pvc.Status.Phase = corev1.ClaimPending
+			if err := r.Status().Update(context.Background(), pvc); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			reconcileNotebook(t, r, nb)
+			for _, reason := range eventReasons(r) {
+				if reason == EventReasonStorageClassNotFound {
+					t.Fatalf("Got a repeated %s warning", reason)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileExistingVolumeClaims(t *testing.T) {
+	datasets := &corev1.PersistentVolumeClaim{
+		ObjectMeta: v1.ObjectMeta{Name: "datasets", Namespace: "test-namespace"},
+	}
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		warning bool
+	}{
+		{
+			name:    "existing claim",
+			objects: []runtime.Object{datasets},
+		},
+		{
+			name:    "missing claim",
+			warning: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nb := newTestNotebook(nil)
+			nb.Spec.ExistingVolumeClaims = []nbv1.NotebookExistingVolumeClaim{
+				{ClaimName: "datasets", MountPath: "/data"},
+			}
+			r := newTestReconciler(append(test.objects, nb)...)
+			reconcileNotebook(t, r, nb)
+
+			warnings := 0
+			for _, reason := range eventReasons(r) {
+				if reason == EventReasonExistingVolumeNotFound {
+					warnings++
+				}
+			}
+			expected := 0
+			if test.warning {
+				expected = 1
+			}
+			if warnings != expected {
+				t.Fatalf("Got %d warnings, Expected %d", warnings, expected)
+			}
+
+			// The claim is neither created nor owned by the Notebook.
+			pvc := &corev1.PersistentVolumeClaim{}
+			if objectExists(t, r, nb, pvc, "datasets") != !test.warning {
+				t.Fatalf("Got PersistentVolumeClaim existing %v, Expected %v", test.warning, !test.warning)
+			}
+			if len(pvc.OwnerReferences) != 0 {
+				t.Fatalf("Got owners %v, Expected none", pvc.OwnerReferences)
+			}
+			sts := &appsv1.StatefulSet{}
+			if !objectExists(t, r, nb, sts, nb.Name) {
+				t.Fatalf("StatefulSet not found")
+			}
+			if !hasVolume(&sts.Spec.Template.Spec, "existing-claim-0") {
+				t.Fatalf("Got volumes %v, Expected the existing claim", sts.Spec.Template.Spec.Volumes)
+			}
+		})
+	}
+}
+
+func TestReconcileVolumeBoundCondition(t *testing.T) {
+	tests := []struct {
+		name    string
+		phase   corev1.PersistentVolumeClaimPhase
+		age     time.Duration
+		status  corev1.ConditionStatus
+		warning bool
+	}{
+		{
+			name:   "bound",
+			phase:  corev1.ClaimBound,
+			age:    time.Hour,
+			status: corev1.ConditionTrue,
+		},
+		{
+			name:   "briefly pending",
+			phase:  corev1.ClaimPending,
+			age:    time.Second,
+			status: corev1.ConditionFalse,
+		},
+		{
+			name:    "pending past the grace period",
+			phase:   corev1.ClaimPending,
+			age:     time.Hour,
+			status:  corev1.ConditionFalse,
+			warning: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nb := newTestNotebook(nil)
+			pvc := generatePersistentVolumeClaim(nb, nb.Spec.VolumeClaim[0])
+			pvc.CreationTimestamp = v1.NewTime(time.Now().Add(-test.age))
+			pvc.Status.Phase = test.phase
+			r := newTestReconciler(nb, pvc)
+			reconcileNotebook(t, r, nb)
+
+			if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var condition *nbv1.NotebookCondition
+			for i := range nb.Status.Conditions {
+				if nb.Status.Conditions[i].Type == NotebookConditionVolumeBound {
+					condition = &nb.Status.Conditions[i]
+				}
+			}
+			if condition == nil || condition.Status != test.status {
+				t.Fatalf("Got condition %v, Expected VolumeBound to be %v", condition, test.status)
+			}
+			if test.status == corev1.ConditionFalse && condition.Reason != "VolumePending" {
+				t.Fatalf("Got reason %q, Expected VolumePending", condition.Reason)
+			}
+			warning := false
+			for _, reason := range eventReasons(r) {
+				warning = warning || reason == EventReasonVolumePending
+			}
+			if warning != test.warning {
+				t.Fatalf("Got warning %v, Expected %v", warning, test.warning)
+			}
+		})
+	}
+}
+
+func TestPredNBPVCChanged(t *testing.T) {
+	labeled := func(phase corev1.PersistentVolumeClaimPhase) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: v1.ObjectMeta{Labels: map[string]string{"notebook": "test-notebook"}},
+			Status:     corev1.PersistentVolumeClaimStatus{Phase: phase},
+		}
+	}
+	pred := predNBPVCChanged(false)
+	if !pred.Update(event.UpdateEvent{ObjectOld: labeled(corev1.ClaimPending), ObjectNew: labeled(corev1.ClaimBound)}) {
+		t.Fatalf("Expected a phase change to be selected")
+	}
+	if pred.Update(event.UpdateEvent{ObjectOld: labeled(corev1.ClaimBound), ObjectNew: labeled(corev1.ClaimBound)}) {
+		t.Fatalf("Expected an update without a phase change to be skipped")
+	}
+	unlabeled := &corev1.PersistentVolumeClaim{Status: corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimBound}}
+	if pred.Update(event.UpdateEvent{ObjectOld: &corev1.PersistentVolumeClaim{}, ObjectNew: unlabeled}) {
+		t.Fatalf("Expected a PVC of another workload to be skipped")
+	}
+	if pred.Delete(event.DeleteEvent{Object: labeled(corev1.ClaimBound)}) {
+		t.Fatalf("Expected the deletions to be skipped unless the PVCs are recreated")
+	}
+	if !predNBPVCChanged(true).Delete(event.DeleteEvent{Object: labeled(corev1.ClaimBound)}) {
+		t.Fatalf("Expected the deletions to be selected when the PVCs are recreated")
+	}
+}
+
+func TestReconcileActivityLease(t *testing.T) {
+	t.Setenv("ENABLE_ACTIVITY_LEASE", "true")
+	t.Setenv("IDLENESS_CHECK_PERIOD", "5")
+	nb := newTestNotebook(nil)
+	pod := &corev1.Pod{
+		ObjectMeta: testPodMeta(nb, 0),
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	r := newTestReconciler(nb, pod)
+	leaseName := activityLeaseName(nb.Name)
+
+	reconcileNotebook(t, r, nb)
+	lease := &coordinationv1.Lease{}
+	if !objectExists(t, r, nb, lease, leaseName) {
+		t.Fatalf("Expected the activity Lease to be created")
+	}
+	if *lease.Spec.LeaseDurationSeconds != 600 || !isOwnedBy(lease, nb) {
+		t.Fatalf("Got Lease %v, Expected a 600s Lease owned by the Notebook", lease.Spec)
+	}
+
+	// The Lease is renewed on every reconcile.
+	stale := v1.NewMicroTime(time.Now().Add(-time.Hour))
+	lease.Spec.RenewTime = &stale
+	if err := r.Update(context.Background(), lease); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reconcileNotebook(t, r, nb)
+	objectExists(t, r, nb, lease, leaseName)
+	if !lease.Spec.RenewTime.After(stale.Time) {
+		t.Fatalf("Got renew time %v, Expected the Lease to be renewed", lease.Spec.RenewTime)
+	}
+
+	// Culling the notebook drops the Lease.
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	culler.SetStopAnnotation(&nb.ObjectMeta, nil)
+	if err := r.Update(context.Background(), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reconcileNotebook(t, r, nb)
+	if objectExists(t, r, nb, &coordinationv1.Lease{}, leaseName) {
+		t.Fatalf("Expected the activity Lease to be deleted when culled")
+	}
+}
+
+func TestReconcilePersistentVolumeClaimExpansion(t *testing.T) {
+	expandable := &storagev1.StorageClass{
+		ObjectMeta:           v1.ObjectMeta{Name: "expandable"},
+		AllowVolumeExpansion: pointer.Bool(true),
+	}
+	fixed := &storagev1.StorageClass{ObjectMeta: v1.ObjectMeta{Name: "fixed"}}
+	tests := []struct {
+		name         string
+		storageClass string
+		size         string
+		expected     string
+		reason       string
+	}{
+		{
+			name:         "grow",
+			storageClass: "expandable",
+			size:         "20Gi",
+			expected:     "20Gi",
+			reason:       EventReasonVolumeExpanded,
+		},
+		{
+			name:         "grow without expansion",
+			storageClass: "fixed",
+			size:         "20Gi",
+			expected:     "10Gi",
+			reason:       EventReasonVolumeExpansionFailed,
+		},
+		{
+			name:         "shrink",
+			storageClass: "expandable",
+			size:         "5Gi",
+			expected:     "10Gi",
+			reason:       EventReasonVolumeShrinkRejected,
+		},
+		{
+			name:         "unchanged",
+			storageClass: "expandable",
+			size:         "10Gi",
+			expected:     "10Gi",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nb := newTestNotebook(nil)
+			nb.Spec.VolumeClaim[0].StorageClass = test.storageClass
+			r := newTestReconciler(nb, expandable, fixed)
+			reconcileNotebook(t, r, nb)
+			eventReasons(r)
+
+			if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			nb.Spec.VolumeClaim[0].Size = test.size
+			if err := r.Update(context.Background(), nb); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			reconcileNotebook(t, r, nb)
+
+			pvc := &corev1.PersistentVolumeClaim{}
+			objectExists(t, r, nb, pvc, nb.Spec.VolumeClaim[0].Name)
+			size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+			if size.String() != test.expected {
+				t.Fatalf("Got size %v, Expected %v", size.String(), test.expected)
+			}
+			var reasons []string
+			for _, reason := range eventReasons(r) {
+				if strings.HasPrefix(reason, "Volume") {
+					reasons = append(reasons, reason)
+				}
+			}
+			var expected []string
+			if test.reason != "" {
+				expected = []string{test.reason}
+			}
+			if !reflect.DeepEqual(reasons, expected) {
+				t.Fatalf("Got events %v, Expected %v", reasons, expected)
+			}
+
+			// The warnings aren't repeated while the request is unchanged.
+			reconcileNotebook(t, r, nb)
+			for _, reason := range eventReasons(r) {
+				if reason == EventReasonVolumeShrinkRejected || reason == EventReasonVolumeExpansionFailed {
+					t.Fatalf("Got a repeated %s warning", reason)
+				}
+			}
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		mode  string
+		kinds []string
+	}{
+		{
+			mode:  ExposeModeIngress,
+			kinds: []string{"PersistentVolumeClaim", "StatefulSet", "Service", "Ingress", "Certificate"},
+		},
+		{
+			mode:  ExposeModeIstio,
+			kinds: []string{"PersistentVolumeClaim", "StatefulSet", "Service", "VirtualService"},
+		},
+		{
+			mode:  ExposeModeNone,
+			kinds: []string{"PersistentVolumeClaim", "StatefulSet", "Service"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			t.Setenv("EXPOSE_MODE", test.mode)
+			nb := newTestNotebook(nil)
+			resources, err := Render(nb, "example.com")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			var kinds []string
+			for _, obj := range resources.Objects() {
+				kinds = append(kinds, obj.GetKind())
+				if obj.GetAPIVersion() == "" {
+					t.Fatalf("Expected an apiVersion on %v", obj.GetKind())
+				}
+				if obj.GetNamespace() != nb.Namespace {
+					t.Fatalf("Got namespace %v on %v, Expected %v", obj.GetNamespace(), obj.GetKind(), nb.Namespace)
+				}
+			}
+			if !reflect.DeepEqual(kinds, test.kinds) {
+				t.Fatalf("Got kinds %v, Expected %v", kinds, test.kinds)
+			}
+
+			// The rendered objects are the ones the controller applies.
+			ss := &appsv1.StatefulSet{}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(resources.StatefulSet.Object, ss); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(ss.Spec, generateStatefulSet(nb).Spec) {
+				t.Fatalf("Got StatefulSet %v, Expected %v", ss.Spec, generateStatefulSet(nb).Spec)
+			}
+		})
+	}
+}
+
+func TestReconcileAggregatesPodStatus(t *testing.T) {
+	running := corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	crashing := corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}}
+	tests := []struct {
+		aggregation string
+		state       corev1.ContainerState
+	}{
+		{aggregation: "", state: crashing},
+		{aggregation: PodStatusAggregationFirst, state: running},
+	}
+
+	for _, test := range tests {
+		t.Run("aggregation "+test.aggregation, func(t *testing.T) {
+			t.Setenv("POD_STATUS_AGGREGATION", test.aggregation)
+			nb := newTestNotebook(nil)
+			pod0 := &corev1.Pod{
+				ObjectMeta: testPodMeta(nb, 0),
+				Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+					{Name: "notebook", State: running, Ready: true},
+				}},
+			}
+			pod1 := &corev1.Pod{
+				ObjectMeta: testPodMeta(nb, 1),
+				Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+					{Name: "notebook", State: crashing},
+				}},
+			}
+			r := newTestReconciler(nb, pod0, pod1)
+			reconcileNotebook(t, r, nb)
+
+			if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(nb.Status.ContainerState, test.state) {
+				t.Fatalf("Got container state %v, Expected %v", nb.Status.ContainerState, test.state)
+			}
+		})
+	}
+}
+
+func TestReconcileCullWarning(t *testing.T) {
+	t.Setenv("ENABLE_CULLING", "true")
+	t.Setenv("CULL_IDLE_TIME", "60")
+	t.Setenv("CULL_WARNING_PERIOD", "10")
+	lastActivity := time.Now().Add(-55 * time.Minute).Truncate(time.Second)
+	nb := newTestNotebook(map[string]string{culler.LAST_ACTIVITY_ANNOTATION: lastActivity.Format(time.RFC3339)})
+	r := newTestReconciler(nb, &corev1.Pod{ObjectMeta: testPodMeta(nb, 0)})
+	reconcileNotebook(t, r, nb)
+
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := lastActivity.Add(60 * time.Minute)
+	if nb.Status.CullWarning == nil || !nb.Status.CullWarning.Time.Equal(expected) {
+		t.Fatalf("Got cull warning %v, Expected %v", nb.Status.CullWarning, expected)
+	}
+
+	// Activity clears the warning.
+	nb.Annotations[culler.LAST_ACTIVITY_ANNOTATION] = time.Now().Format(time.RFC3339)
+	if err := r.Update(context.Background(), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reconcileNotebook(t, r, nb)
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if nb.Status.CullWarning != nil {
+		t.Fatalf("Got cull warning %v, Expected none", nb.Status.CullWarning)
+	}
+}
+
+func TestReconcileCullHistory(t *testing.T) {
+	t.Setenv("ENABLE_CULLING", "true")
+	t.Setenv("CULL_IDLE_TIME", "60")
+	t.Setenv("CULL_HISTORY_LIMIT", "2")
+	lastActivity := time.Now().Add(-2 * time.Hour)
+	nb := newTestNotebook(map[string]string{culler.LAST_ACTIVITY_ANNOTATION: lastActivity.Format(time.RFC3339)})
+	r := newTestReconciler(nb, &corev1.Pod{ObjectMeta: testPodMeta(nb, 0)})
+	reasons := func() []string {
+		if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var reasons []string
+		for _, record := range nb.Status.CullHistory {
+			reasons = append(reasons, record.Reason)
+		}
+		return reasons
+	}
+
+	// The idle notebook is culled.
+	reconcileNotebook(t, r, nb)
+	if got := reasons(); !reflect.DeepEqual(got, []string{CullReasonIdle}) {
+		t.Fatalf("Got %v, Expected an Idle entry", got)
+	}
+	// The same stop is recorded once.
+	reconcileNotebook(t, r, nb)
+	if got := reasons(); !reflect.DeepEqual(got, []string{CullReasonIdle}) {
+		t.Fatalf("Got %v, Expected a single Idle entry", got)
+	}
+
+	// The user restarts and stops it again, twice.
+	for i, stopped := range []time.Time{time.Now().Add(time.Minute), time.Now().Add(2 * time.Minute)} {
+		nb.Annotations[culler.STOP_ANNOTATION] = stopped.Format(time.RFC3339)
+		if err := r.Update(context.Background(), nb); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		reconcileNotebook(t, r, nb)
+		got := reasons()
+		expected := []string{CullReasonIdle, CullReasonManual}
+		if i == 1 {
+			expected = []string{CullReasonManual, CullReasonManual}
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("Got %v, Expected %v", got, expected)
+		}
+	}
+	last := nb.Status.CullHistory[1].Time.Format(time.RFC3339)
+	if last != nb.Annotations[culler.STOP_ANNOTATION] {
+		t.Fatalf("Got %v, Expected the latest stop at %v", last, nb.Annotations[culler.STOP_ANNOTATION])
+	}
+}
+
+func TestReconcileCustomCullingAnnotationKeys(t *testing.T) {
+	t.Setenv("ENABLE_CULLING", "true")
+	t.Setenv("CULL_IDLE_TIME", "60")
+	t.Setenv("ACTIVITY_ANNOTATION_KEY", "notebooks.example.com/last-activity")
+	t.Setenv("STOP_ANNOTATION_KEY", "notebooks.example.com/stopped")
+	lastActivity := time.Now().Add(-2 * time.Hour).Format(time.RFC3339)
+	nb := newTestNotebook(map[string]string{"notebooks.example.com/last-activity": lastActivity})
+	r := newTestReconciler(nb, &corev1.Pod{ObjectMeta: testPodMeta(nb, 0)})
+
+	// The idle notebook is culled through the configured keys only.
+	reconcileNotebook(t, r, nb)
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := nb.Annotations["notebooks.example.com/stopped"]; !ok {
+		t.Fatalf("Got annotations %v, Expected the configured stop key", nb.Annotations)
+	}
+	if _, ok := nb.Annotations[culler.STOP_ANNOTATION]; ok {
+		t.Fatalf("Got annotations %v, Expected no default stop key", nb.Annotations)
+	}
+	reconcileNotebook(t, r, nb)
+	sts := &appsv1.StatefulSet{}
+	if !objectExists(t, r, nb, sts, nb.Name) || *sts.Spec.Replicas != 0 {
+		t.Fatalf("Got %v, Expected the StatefulSet scaled to 0", sts.Spec.Replicas)
+	}
+
+	// The default stop key, e.g. of the upstream controller, is ignored.
+	delete(nb.Annotations, "notebooks.example.com/stopped")
+	nb.Annotations[culler.STOP_ANNOTATION] = time.Now().Format(time.RFC3339)
+	nb.Annotations["notebooks.example.com/last-activity"] = time.Now().Format(time.RFC3339)
+	if err := r.Update(context.Background(), nb); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reconcileNotebook(t, r, nb)
+	if !objectExists(t, r, nb, sts, nb.Name) || *sts.Spec.Replicas != 1 {
+		t.Fatalf("Got %v, Expected the StatefulSet scaled to 1", sts.Spec.Replicas)
+	}
+}
+
+func TestReconcileRecreatesDeletedPVC(t *testing.T) {
+	tests := []struct {
+		recreate  string
+		recreated bool
+		reason    string
+	}{
+		{recreate: "", recreated: false, reason: EventReasonVolumeMissing},
+		{recreate: "true", recreated: true, reason: EventReasonVolumeRecreated},
+	}
+
+	for _, test := range tests {
+		t.Run("RECREATE_PVC="+test.recreate, func(t *testing.T) {
+			t.Setenv("RECREATE_PVC", test.recreate)
+			t.Setenv("DEFAULT_STORAGE_CLASS", "standard")
+			nb := newTestNotebook(nil)
+			nb.Spec.Template.Spec.Volumes = []corev1.Volume{{
+				Name: "workspace",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: nb.Spec.VolumeClaim[0].Name},
+				},
+			}}
+			r := newTestReconciler(nb)
+			reconcileNotebook(t, r, nb)
+			eventReasons(r)
+
+			pvc := &corev1.PersistentVolumeClaim{}
+			objectExists(t, r, nb, pvc, nb.Spec.VolumeClaim[0].Name)
+			if err := r.Delete(context.Background(), pvc); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			reconcileNotebook(t, r, nb)
+
+			if got := objectExists(t, r, nb, &corev1.PersistentVolumeClaim{}, nb.Spec.VolumeClaim[0].Name); got != test.recreated {
+				t.Fatalf("Got PVC %v, Expected %v", got, test.recreated)
+			}
+			if reasons := eventReasons(r); !reflect.DeepEqual(reasons, []string{test.reason}) {
+				t.Fatalf("Got events %v, Expected %v", reasons, []string{test.reason})
+			}
+
+			// The missing PVC warning isn't repeated.
+			reconcileNotebook(t, r, nb)
+			if reasons := eventReasons(r); len(reasons) != 0 {
+				t.Fatalf("Got events %v, Expected none", reasons)
+			}
+		})
+	}
+}
+
+func TestReconcileCreatesAddedPVC(t *testing.T) {
+	for _, recreate := range []string{"", "true"} {
+		t.Run("RECREATE_PVC="+recreate, func(t *testing.T) {
+			t.Setenv("RECREATE_PVC", recreate)
+			t.Setenv("DEFAULT_STORAGE_CLASS", "standard")
+			nb := newTestNotebook(nil)
+			r := newTestReconciler(nb)
+			reconcileNotebook(t, r, nb)
+			eventReasons(r)
+
+			// A claim added to the running Notebook wasn't deleted, it is new.
+			if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			nb.Spec.VolumeClaim = append(nb.Spec.VolumeClaim, nbv1.NotebookVolumeClaim{Name: "datasets", Size: "1Gi"})
+			if err := r.Update(context.Background(), nb); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			reconcileNotebook(t, r, nb)
+
+			if !objectExists(t, r, nb, &corev1.PersistentVolumeClaim{}, "datasets") {
+				t.Fatalf("Expected the added PVC to be created")
+			}
+			for _, reason := range eventReasons(r) {
+				if reason == EventReasonVolumeRecreated || reason == EventReasonVolumeMissing {
+					t.Fatalf("Got a %s warning for a new PVC", reason)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateExternalHostname(t *testing.T) {
+	const host = "lab.example.com"
+	for _, mode := range []string{"", RoutingModeSubdomain, RoutingModePath} {
+		t.Run("routing mode "+mode, func(t *testing.T) {
+			nb := newTestNotebook(map[string]string{
+				AnnotationExternalHostname: "Lab.Example.com",
+				AnnotationIstioHost:        "other.example.com",
+				AnnotationRoutingMode:      mode,
+			})
+
+			ingress, err := generateIngress(nb, "tmaxcloud.org")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := ingress.Spec.Rules[0].Host; got != host {
+				t.Fatalf("Got Ingress host %v, Expected %v", got, host)
+			}
+			expectedTLS := []netv1.IngressTLS{{Hosts: []string{host}, SecretName: "lab-example-com-tls"}}
+			if !reflect.DeepEqual(ingress.Spec.TLS, expectedTLS) {
+				t.Fatalf("Got Ingress TLS %v, Expected %v", ingress.Spec.TLS, expectedTLS)
+			}
+
+			cert, err := generateCertificate(nb, "tmaxcloud.org")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			dnsNames, _, _ := unstructured.NestedStringSlice(cert.Object, "spec", "dnsNames")
+			commonName, _, _ := unstructured.NestedString(cert.Object, "spec", "commonName")
+			secretName, _, _ := unstructured.NestedString(cert.Object, "spec", "secretName")
+			if !reflect.DeepEqual(dnsNames, []string{"tmax-cloud", host}) || commonName != host ||
+				secretName != "lab-example-com-tls" {
+				t.Fatalf("Got Certificate dnsNames %v, commonName %v and secretName %v, Expected %v",
+					dnsNames, commonName, secretName, host)
+			}
+
+			vsvc, err := generateVirtualService(nb, "tmaxcloud.org")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			hosts, _, _ := unstructured.NestedStringSlice(vsvc.Object, "spec", "hosts")
+			if !reflect.DeepEqual(hosts, []string{host}) {
+				t.Fatalf("Got VirtualService hosts %v, Expected %v", hosts, []string{host})
+			}
+
+			// The gatekeeper serves the same certificate.
+			podSpec := generateStatefulSet(nb).Spec.Template.Spec
+			for _, volume := range podSpec.Volumes {
+				if volume.Name == "secret" && volume.Secret.SecretName != "lab-example-com-tls" {
+					t.Fatalf("Got secret volume %v, Expected lab-example-com-tls", volume.Secret.SecretName)
+				}
+			}
+		})
+	}
+
+	// An invalid hostname is ignored.
+	nb := newTestNotebook(map[string]string{AnnotationExternalHostname: "lab_1.example.com"})
+	if got := ingressHost(nb, "tmaxcloud.org"); got != ingressName(nb.Name, nb.Namespace)+".tmaxcloud.org" {
+		t.Fatalf("Got host %v, Expected the default host", got)
+	}
+}
+
+func TestRFC1123Name(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{name: "test-notebook-test-namespace", expected: "test-notebook-test-namespace"},
+		{name: "my_notebook-test-namespace", expected: "my-notebook-test-namespace-"},
+		{name: "my.Notebook-test-namespace", expected: "my-notebook-test-namespace-"},
+		{name: long, expected: strings.Repeat("a", 54) + "-"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := rfc1123Name(test.name)
+			if errs := validation.IsDNS1123Label(got); len(errs) > 0 {
+				t.Fatalf("Got invalid name %v: %v", got, errs)
+			}
+			if got != test.expected && !(strings.HasPrefix(got, test.expected) && len(got) == len(test.expected)+8) {
+				t.Fatalf("Got %v, Expected %v followed by a hash", got, test.expected)
+			}
+		})
+	}
+
+	// Names that sanitize alike stay unique.
+	if rfc1123Name("a_b") == rfc1123Name("a.b") {
+		t.Fatalf("Expected unique names for a_b and a.b, got %v", rfc1123Name("a_b"))
+	}
+	if rfc1123Name(long+"b") == rfc1123Name(long+"c") {
+		t.Fatalf("Expected unique names for long names, got %v", rfc1123Name(long+"b"))
+	}
+}
+
+func TestReconcileLongNotebookName(t *testing.T) {
+	t.Setenv("EXPOSE_MODE", ExposeModeIngress)
+	t.Setenv("DEFAULT_STORAGE_CLASS", "standard")
+	t.Setenv("CUSTOM_DOMAIN", "tmaxcloud.org")
+	nb := newTestNotebook(nil)
+	nb.Name = "a-notebook-with-a-name-long-enough-to-overflow-its-child-names"
+	r := newTestReconciler(nb)
+	reconcileNotebook(t, r, nb)
+
+	// The objects keep their names, which may be longer than a label, so the
+	// ones created before aren't left behind. Only the host is shortened.
+	ingress := &netv1.Ingress{}
+	if !objectExists(t, r, nb, ingress, nb.Name+"-"+nb.Namespace) {
+		t.Fatalf("Expected the Ingress to be created")
+	}
+	if got := certificateName(nb.Name, nb.Namespace); got != "cert-"+nb.Namespace+"-"+nb.Name {
+		t.Fatalf("Got Certificate name %v, Expected it unchanged", got)
+	}
+	if got := virtualServiceName(nb.Name, nb.Namespace); got != "notebook-"+nb.Namespace+"-"+nb.Name {
+		t.Fatalf("Got VirtualService name %v, Expected it unchanged", got)
+	}
+	host := ingress.Spec.Rules[0].Host
+	label := strings.SplitN(host, ".", 2)[0]
+	if errs := validation.IsDNS1123Label(label); len(errs) > 0 || host != hostLabel(nb)+".tmaxcloud.org" {
+		t.Fatalf("Got host %v, Expected a valid label followed by the domain: %v", host, errs)
+	}
+	if got := ingress.Labels["ingress.tmaxcloud.org/name"]; got != label {
+		t.Fatalf("Got name label %v, Expected %v", got, label)
+	}
+
+	reconcileNotebook(t, r, nb)
+	truncated := 0
+	for _, reason := range eventReasons(r) {
+		if reason == EventReasonNameTruncated {
+			truncated++
+		}
+	}
+	if truncated != 1 {
+		t.Fatalf("Got %d %v events, Expected 1", truncated, EventReasonNameTruncated)
+	}
+}
+
+func TestReconcileDeletePVCOnNotebookDelete(t *testing.T) {
+	tests := []struct {
+		name       string
+		deletePVC  string
+		reclaimPVC string
+		owned      bool
+	}{
+		{name: "unset"},
+		{name: "true", deletePVC: "true", owned: true},
+		{name: "false", deletePVC: "false"},
+		{name: "false overrides RECLAIM_PVC", deletePVC: "false", reclaimPVC: "true"},
+		{name: "RECLAIM_PVC fallback", reclaimPVC: "true", owned: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.deletePVC != "" {
+				t.Setenv("DELETE_PVC_ON_NOTEBOOK_DELETE", test.deletePVC)
+			}
+			t.Setenv("RECLAIM_PVC", test.reclaimPVC)
+			nb := newTestNotebook(nil)
+			r := newTestReconciler(nb)
+			reconcileNotebook(t, r, nb)
+
+			pvc := &corev1.PersistentVolumeClaim{}
+			objectExists(t, r, nb, pvc, nb.Spec.VolumeClaim[0].Name)
+			if got := isOwnedBy(pvc, nb); got != test.owned {
+				t.Fatalf("Got PVC owned %v, Expected %v", got, test.owned)
+			}
+			if test.owned && (pvc.OwnerReferences[0].Controller != nil && *pvc.OwnerReferences[0].Controller) {
+				t.Fatalf("Expected a plain owner reference, got %v", pvc.OwnerReferences)
+			}
+		})
+	}
+}
+
+func TestReconcileIstioInjectionNamespaceLabel(t *testing.T) {
+	t.Setenv("EXPOSE_MODE", ExposeModeIstio)
+	nb := newTestNotebook(nil)
+	ns := &corev1.Namespace{ObjectMeta: v1.ObjectMeta{Name: nb.Namespace}}
+	r := newTestReconciler(nb, ns)
+
+	for _, label := range []string{"", "enabled", "disabled"} {
+		if err := r.Get(context.Background(), client.ObjectKeyFromObject(ns), ns); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		ns.Labels = map[string]string{IstioInjectionLabel: label}
+		if err := r.Update(context.Background(), ns); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		reconcileNotebook(t, r, nb)
+
+		ss := &appsv1.StatefulSet{}
+		objectExists(t, r, nb, ss, nb.Name)
+		expected := strconv.FormatBool(label == "enabled")
+		if got := ss.Spec.Template.Annotations["sidecar.istio.io/inject"]; got != expected {
+			t.Fatalf("Got inject annotation %v with label %q, Expected %v", got, label, expected)
+		}
+	}
+
+	// Only a change of the label reconciles the Notebooks in the namespace.
+	pred := predIstioInjectionChanged()
+	labeled := ns.DeepCopy()
+	labeled.Labels = map[string]string{IstioInjectionLabel: "enabled"}
+	if !pred.Update(event.UpdateEvent{ObjectOld: ns, ObjectNew: labeled}) {
+		t.Fatalf("Expected a label change to be selected")
+	}
+	if pred.Update(event.UpdateEvent{ObjectOld: labeled, ObjectNew: labeled}) {
+		t.Fatalf("Expected an unchanged label not to be selected")
+	}
+}
+
+func TestReconcileIstioInjectOverride(t *testing.T) {
+	tests := []struct {
+		name       string
+		label      string
+		annotation string
+		injected   bool
+		portName   string
+	}{
+		{
+			name:     "namespace not labeled",
+			portName: "https-test-notebook",
+		},
+		{
+			name:     "namespace labeled",
+			label:    "enabled",
+			injected: true,
+			portName: "http-test-notebook",
+		},
+		{
+			name:       "opted in",
+			annotation: "true",
+			injected:   true,
+			portName:   "http-test-notebook",
+		},
+		{
+			name:       "opted out of a labeled namespace",
+			label:      "enabled",
+			annotation: "false",
+			portName:   "https-test-notebook",
+		},
+		{
+			name:       "invalid override",
+			annotation: "yes please",
+			portName:   "https-test-notebook",
+		},
+	}
+
+	t.Setenv("EXPOSE_MODE", ExposeModeIstio)
+	t.Setenv("ENABLE_GATEKEEPER", "false")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nb := newTestNotebook(map[string]string{AnnotationIstioInject: test.annotation})
+			ns := &corev1.Namespace{ObjectMeta: v1.ObjectMeta{
+				Name:   nb.Namespace,
+				Labels: map[string]string{IstioInjectionLabel: test.label},
+			}}
+			r := newTestReconciler(nb, ns)
+			reconcileNotebook(t, r, nb)
+
+			ss := &appsv1.StatefulSet{}
+			objectExists(t, r, nb, ss, nb.Name)
+			expected := strconv.FormatBool(test.injected)
+			if got := ss.Spec.Template.Annotations["sidecar.istio.io/inject"]; got != expected {
+				t.Fatalf("Got inject annotation %v, Expected %v", got, expected)
+			}
+			svc := &corev1.Service{}
+			objectExists(t, r, nb, svc, nb.Name)
+			if name := svc.Spec.Ports[0].Name; name != test.portName {
+				t.Fatalf("Got port name %v, Expected %v", name, test.portName)
+			}
+		})
+	}
+}
+
+func TestReconcileExtraPorts(t *testing.T) {
+	nb := newTestNotebook(nil)
+	nb.Spec.Ports = []nbv1.NotebookPort{
+		{Name: "tensorboard", Port: 6006, Path: "/tensorboard/"},
+		{Name: "dask", Port: 8787},
+		{Name: "Invalid_Name", Port: 9000},
+		{Name: "clash", Port: HttpsServingPort},
+	}
+
+	t.Setenv("EXPOSE_MODE", ExposeModeIngress)
+	r := newTestReconciler(nb)
+	reconcileNotebook(t, r, nb)
+
+	svc := &corev1.Service{}
+	objectExists(t, r, nb, svc, nb.Name)
+	if len(svc.Spec.Ports) != 3 {
+		t.Fatalf("Got %v, Expected the notebook port and 2 extra ports", svc.Spec.Ports)
+	}
+	for i, expected := range []int32{6006, 8787} {
+		if port := svc.Spec.Ports[i+1]; port.Port != expected || port.TargetPort.IntVal != expected {
+			t.Fatalf("Got port %v, Expected %v", port, expected)
+		}
+	}
+
+	ingress := &netv1.Ingress{}
+	objectExists(t, r, nb, ingress, ingressName(nb.Name, nb.Namespace))
+	paths := ingress.Spec.Rules[0].HTTP.Paths
+	if len(paths) != 2 || paths[1].Path != "/tensorboard" || paths[1].Backend.Service.Port.Number != 6006 {
+		t.Fatalf("Got %v, Expected a tensorboard path", paths)
+	}
+
+	vsvc, err := generateVirtualService(nb, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, _, _ := unstructured.NestedSlice(vsvc.Object, "spec", "http")
+	if len(routes) != 2 {
+		t.Fatalf("Got %d routes, Expected 2", len(routes))
+	}
+	prefix, _, _ := unstructured.NestedString(routes[0].(map[string]interface{})["match"].([]interface{})[0].(map[string]interface{}), "uri", "prefix")
+	expected := fmt.Sprintf("/notebook/%s/%s/tensorboard/", nb.Namespace, nb.Name)
+	if prefix != expected {
+		t.Fatalf("Got prefix %v, Expected %v", prefix, expected)
+	}
+
+	// Ports declared later are added to the existing Service.
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(nb), nb); err != nil {
+		t.Fatal(err)
+	}
+	nb.Spec.Ports = append(nb.Spec.Ports, nbv1.NotebookPort{Name: "mlflow", Port: 5000})
+	if err := r.Update(context.Background(), nb); err != nil {
+		t.Fatal(err)
+	}
+	reconcileNotebook(t, r, nb)
+	objectExists(t, r, nb, svc, nb.Name)
+	if len(svc.Spec.Ports) != 4 || svc.Spec.Ports[3].Name != "mlflow" {
+		t.Fatalf("Got %v, Expected the mlflow port to be added", svc.Spec.Ports)
+	}
+}
+
+type fakeLogSource struct {
+	lines string
+	pod   string
+	opts  *corev1.PodLogOptions
+}
+
+func (s *fakeLogSource) Logs(ctx context.Context, namespace, pod string, opts *corev1.PodLogOptions) (io.ReadCloser, error) {
+	s.pod = namespace + "/" + pod
+	s.opts = opts
+	return io.NopCloser(strings.NewReader(s.lines)), nil
+}
+
+func TestLogsHandler(t *testing.T) {
+	nb := newTestNotebook(nil)
+	r := newTestReconciler(nb)
+	clientset := k8sfake.NewSimpleClientset()
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		review.Status.Authenticated = review.Spec.Token != "invalid"
+		review.Status.User.Username = review.Spec.Token
+		return true, review, nil
+	})
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attributes := review.Spec.ResourceAttributes
+		review.Status.Allowed = review.Spec.User == "owner" && attributes.Namespace == nb.Namespace &&
+			attributes.Resource == "pods" && attributes.Subresource == "log"
+		return true, review, nil
+	})
+	source := &fakeLogSource{lines: "[I 10:00:00 LabApp] Jupyter Server is running\n[I 10:00:01 LabApp] Kernel started\n"}
+	handler := &LogsHandler{Client: r.Client, Source: source, Clientset: clientset}
+
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{
+			name:   "no token",
+			path:   LogsPathPrefix + "test-namespace/test-notebook",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "invalid token",
+			path:   LogsPathPrefix + "test-namespace/test-notebook",
+			token:  "invalid",
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "not allowed",
+			path:   LogsPathPrefix + "test-namespace/test-notebook",
+			token:  "someone-else",
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "unknown notebook",
+			path:   LogsPathPrefix + "test-namespace/other-notebook",
+			token:  "owner",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "allowed",
+			path:   LogsPathPrefix + "test-namespace/test-notebook?tailLines=2",
+			token:  "owner",
+			status: http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Fatalf("Got status %v, Expected %v", rec.Code, test.status)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			if body := rec.Body.String(); body != source.lines {
+				t.Fatalf("Got %q, Expected %q", body, source.lines)
+			}
+			if source.pod != "test-namespace/test-notebook-0" || source.opts.Container != "notebook" || *source.opts.TailLines != 2 {
+				t.Fatalf("Got logs of %v with %v, Expected the notebook container of test-notebook-0", source.pod, source.opts)
+			}
+		})
+	}
+}
+
+type fakeCacheSyncer bool
+
+func (s fakeCacheSyncer) WaitForCacheSync(ctx context.Context) bool {
+	if !s {
+		<-ctx.Done()
+	}
+	return bool(s)
+}
+
+func TestCacheSyncCheck(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	if err := NewCacheSyncCheck(fakeCacheSyncer(true))(req); err != nil {
+		t.Fatalf("Got %v, Expected a synced cache to be ready", err)
+	}
+	if err := NewCacheSyncCheck(fakeCacheSyncer(false))(req); err == nil {
+		t.Fatalf("Expected an unsynced cache not to be ready")
+	}
+}
+
+func TestReconcileHealthCheck(t *testing.T) {
+	t.Setenv("RECONCILE_STALENESS", "60")
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	now := time.Now()
+	failure := errors.New("connection refused")
+
+	r := newTestReconciler()
+	if err := r.ReconcileHealthCheck(req); err != nil {
+		t.Fatalf("Got %v, Expected a controller without reconciles to be healthy", err)
+	}
+
+	r.recordReconcile(failure, now.Add(-2*time.Minute))
+	r.recordReconcile(failure, now)
+	if err := r.ReconcileHealthCheck(req); err == nil {
+		t.Fatalf("Expected reconciles failing for 2m to be unhealthy")
+	}
+
+	r.recordReconcile(nil, now)
+	if err := r.ReconcileHealthCheck(req); err != nil {
+		t.Fatalf("Got %v, Expected a successful reconcile to be healthy", err)
+	}
+
+	// Failures within the staleness are tolerated.
+	r.recordReconcile(failure, now.Add(time.Second))
+	if err := r.ReconcileHealthCheck(req); err != nil {
+		t.Fatalf("Got %v, Expected a recent failure to be tolerated", err)
+	}
+
+	// A successful reconcile long ago doesn't matter without failures.
+	r = newTestReconciler()
+	r.recordReconcile(nil, now.Add(-time.Hour))
+	if err := r.ReconcileHealthCheck(req); err != nil {
+		t.Fatalf("Got %v, Expected an idle controller to be healthy", err)
+	}
+}
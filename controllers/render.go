@@ -0,0 +1,114 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/tmax-cloud/notebook-controller-go/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// RenderedResources are the objects the controller would create for a
+// Notebook. The objects of a disabled feature are nil, e.g. the Ingress when
+// EXPOSE_MODE is "istio".
+type RenderedResources struct {
+	PersistentVolumeClaims []*unstructured.Unstructured
+	StatefulSet            *unstructured.Unstructured
+	Service                *unstructured.Unstructured
+	HeadlessService        *unstructured.Unstructured
+	Ingress                *unstructured.Unstructured
+	Certificate            *unstructured.Unstructured
+	VirtualService         *unstructured.Unstructured
+}
+
+// Objects returns the rendered objects in the order the controller creates
+// them, skipping the disabled ones.
+func (rr *RenderedResources) Objects() []*unstructured.Unstructured {
+	objects := append([]*unstructured.Unstructured{}, rr.PersistentVolumeClaims...)
+	for _, obj := range []*unstructured.Unstructured{rr.StatefulSet, rr.Service, rr.HeadlessService, rr.Ingress, rr.Certificate, rr.VirtualService} {
+		if obj != nil {
+			objects = append(objects, obj)
+		}
+	}
+	return objects
+}
+
+// Render generates the objects of a Notebook without a cluster, with the same
+// configuration the controller reads from its environment. The custom domain
+// is passed in, as it is otherwise read from the Notebook's Namespace.
+// Owner references are left out, as they need the Notebook to exist.
+func Render(instance *v1.Notebook, customDomain string) (*RenderedResources, error) {
+	rr := &RenderedResources{}
+	for _, claim := range instance.Spec.VolumeClaim {
+		pvc, err := toUnstructured(generatePersistentVolumeClaim(instance, claim), corev1.SchemeGroupVersion.WithKind("PersistentVolumeClaim"))
+		if err != nil {
+			return nil, err
+		}
+		rr.PersistentVolumeClaims = append(rr.PersistentVolumeClaims, pvc)
+	}
+
+	var err error
+	if rr.StatefulSet, err = toUnstructured(generateStatefulSet(instance), appsv1.SchemeGroupVersion.WithKind("StatefulSet")); err != nil {
+		return nil, err
+	}
+	svc := generateService(instance)
+	setIstioServicePort(svc, istioSidecarInjected(instance, false))
+	if rr.Service, err = toUnstructured(svc, corev1.SchemeGroupVersion.WithKind("Service")); err != nil {
+		return nil, err
+	}
+	if useHeadlessService(instance) {
+		if rr.HeadlessService, err = toUnstructured(generateHeadlessService(instance), corev1.SchemeGroupVersion.WithKind("Service")); err != nil {
+			return nil, err
+		}
+	}
+
+	if useIngress() {
+		ingress, err := generateIngress(instance, customDomain)
+		if err != nil {
+			return nil, err
+		}
+		if rr.Ingress, err = toUnstructured(ingress, netv1.SchemeGroupVersion.WithKind("Ingress")); err != nil {
+			return nil, err
+		}
+		if useCertificate(instance) {
+			if rr.Certificate, err = generateCertificate(instance, customDomain); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if useIstio() {
+		if rr.VirtualService, err = generateVirtualService(instance, customDomain); err != nil {
+			return nil, err
+		}
+	}
+	return rr, nil
+}
+
+func toUnstructured(obj runtime.Object, gvk schema.GroupVersionKind) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, fmt.Errorf("convert %s error: %v", gvk.Kind, err)
+	}
+	u := &unstructured.Unstructured{Object: content}
+	u.SetGroupVersionKind(gvk)
+	return u, nil
+}
@@ -20,7 +20,7 @@ import (
 	"path/filepath"
 	"testing"
 
-	controllermetrics "github.com/kubeflow/kubeflow/components/notebook-controller/pkg/metrics"
+	controllermetrics "github.com/tmax-cloud/notebook-controller-go/pkg/metrics"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -33,7 +33,7 @@ import (
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
-	nbv1beta1 "github.com/kubeflow/kubeflow/components/notebook-controller/api/v1beta1"
+	nbv1 "github.com/tmax-cloud/notebook-controller-go/api/v1"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -63,7 +63,7 @@ var _ = BeforeSuite(func() {
 	Expect(err).NotTo(HaveOccurred())
 	Expect(cfg).NotTo(BeNil())
 
-	err = nbv1beta1.AddToScheme(scheme.Scheme)
+	err = nbv1.AddToScheme(scheme.Scheme)
 	Expect(err).NotTo(HaveOccurred())
 
 	// +kubebuilder:scaffold:scheme
@@ -0,0 +1,165 @@
+/*
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/tmax-cloud/notebook-controller-go/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// resolveNotebookTemplate returns a copy of the Notebook with the
+// NotebookTemplate of its spec.templateRef merged into its template, or the
+// Notebook itself if it doesn't reference one. The merged fields are only used
+// to generate the StatefulSet, and never written back to the Notebook.
+func (r *NotebookReconciler) resolveNotebookTemplate(ctx context.Context, instance *v1.Notebook) (*v1.Notebook, error) {
+	if instance.Spec.TemplateRef == "" {
+		return instance, nil
+	}
+	template := &v1.NotebookTemplate{}
+	if err := r.Get(ctx, types.NamespacedName{Name: instance.Spec.TemplateRef}, template); err != nil {
+		return nil, err
+	}
+	resolved := instance.DeepCopy()
+	for k, v := range template.Template.Annotations {
+		if resolved.Spec.Template.Annotations == nil {
+			resolved.Spec.Template.Annotations = map[string]string{}
+		}
+		if _, ok := resolved.Spec.Template.Annotations[k]; !ok {
+			resolved.Spec.Template.Annotations[k] = v
+		}
+	}
+	mergeNotebookTemplate(&resolved.Spec.Template.Spec, template.Template.Spec.DeepCopy(), notebookContainerName(instance))
+	return resolved, nil
+}
+
+// mergeNotebookTemplate merges the pod spec of a NotebookTemplate into the pod
+// spec of a Notebook. The first container of the template is merged into the
+// notebook container, and its other containers, volumes and scheduling
+// constraints are added. What the Notebook sets takes precedence.
+func mergeNotebookTemplate(podSpec *corev1.PodSpec, template *corev1.PodSpec, containerName string) {
+	if container := findContainerByName(podSpec.Containers, containerName); container != nil && len(template.Containers) > 0 {
+		mergeNotebookContainer(container, &template.Containers[0])
+		for _, c := range template.Containers[1:] {
+			if findContainerByName(podSpec.Containers, c.Name) == nil {
+				podSpec.Containers = append(podSpec.Containers, c)
+			}
+		}
+	}
+	for _, volume := range template.Volumes {
+		if !hasVolume(podSpec, volume.Name) {
+			podSpec.Volumes = append(podSpec.Volumes, volume)
+		}
+	}
+	for k, v := range template.NodeSelector {
+		if podSpec.NodeSelector == nil {
+			podSpec.NodeSelector = map[string]string{}
+		}
+		if _, ok := podSpec.NodeSelector[k]; !ok {
+			podSpec.NodeSelector[k] = v
+		}
+	}
+	for _, toleration := range template.Tolerations {
+		found := false
+		for _, t := range podSpec.Tolerations {
+			found = found || reflect.DeepEqual(t, toleration)
+		}
+		if !found {
+			podSpec.Tolerations = append(podSpec.Tolerations, toleration)
+		}
+	}
+	for _, secret := range template.ImagePullSecrets {
+		found := false
+		for _, s := range podSpec.ImagePullSecrets {
+			found = found || s.Name == secret.Name
+		}
+		if !found {
+			podSpec.ImagePullSecrets = append(podSpec.ImagePullSecrets, secret)
+		}
+	}
+	if podSpec.Affinity == nil {
+		podSpec.Affinity = template.Affinity
+	}
+	if podSpec.SecurityContext == nil {
+		podSpec.SecurityContext = template.SecurityContext
+	}
+	if podSpec.ServiceAccountName == "" {
+		podSpec.ServiceAccountName = template.ServiceAccountName
+	}
+	if podSpec.PriorityClassName == "" {
+		podSpec.PriorityClassName = template.PriorityClassName
+	}
+}
+
+// mergeNotebookContainer merges the notebook container of a NotebookTemplate:
+// its image, resources, env and volume mounts.
+func mergeNotebookContainer(container *corev1.Container, template *corev1.Container) {
+	if container.Image == "" {
+		container.Image = template.Image
+	}
+	if container.ImagePullPolicy == "" {
+		container.ImagePullPolicy = template.ImagePullPolicy
+	}
+	if container.Command == nil && container.Args == nil {
+		container.Command = template.Command
+		container.Args = template.Args
+	}
+	if container.WorkingDir == "" {
+		container.WorkingDir = template.WorkingDir
+	}
+	container.Resources.Limits = mergeResourceList(container.Resources.Limits, template.Resources.Limits)
+	container.Resources.Requests = mergeResourceList(container.Resources.Requests, template.Resources.Requests)
+	for _, envVar := range template.Env {
+		mergeEnvVar(container, envVar)
+	}
+	for _, envFrom := range template.EnvFrom {
+		found := false
+		for _, e := range container.EnvFrom {
+			found = found || reflect.DeepEqual(e, envFrom)
+		}
+		if !found {
+			container.EnvFrom = append(container.EnvFrom, envFrom)
+		}
+	}
+	for _, mount := range template.VolumeMounts {
+		found := false
+		for _, m := range container.VolumeMounts {
+			found = found || m.MountPath == mount.MountPath
+		}
+		if !found {
+			container.VolumeMounts = append(container.VolumeMounts, mount)
+		}
+	}
+	if container.SecurityContext == nil {
+		container.SecurityContext = template.SecurityContext
+	}
+}
+
+// mergeResourceList adds the resources of the template missing from list.
+func mergeResourceList(list, template corev1.ResourceList) corev1.ResourceList {
+	for name, quantity := range template {
+		if list == nil {
+			list = corev1.ResourceList{}
+		}
+		if _, ok := list[name]; !ok {
+			list[name] = quantity
+		}
+	}
+	return list
+}
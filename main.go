@@ -17,6 +17,8 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io"
 	"os"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
@@ -25,10 +27,12 @@ import (
 
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/yaml"
 
 	nbv1 "github.com/tmax-cloud/notebook-controller-go/api/v1"
 	nbv1alpha1 "github.com/tmax-cloud/notebook-controller-go/api/v1alpha1"
@@ -57,6 +61,8 @@ func main() {
 	var metricsAddr, leaderElectionNamespace string
 	var enableLeaderElection bool
 	var probeAddr string
+	var eventComponent string
+	var renderFile string
 	var Burst int
 	var QPS int
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
@@ -65,6 +71,10 @@ func main() {
 		"Determines the namespace in which the leader election configmap will be created.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&eventComponent, "event-component", "notebook-controller",
+		"The source component name of the events emitted on Notebooks.")
+	flag.StringVar(&renderFile, "render", "",
+		"Print the objects generated for the Notebook manifest in this file (- for stdin) and exit, without applying them.")
 	flag.IntVar(&Burst, "burst", 0, "If it's zero, the created RESTClient will use DefaultBurst")
 	flag.IntVar(&QPS, "qps", 0, "If it's zero, the created RESTClient will use DefaultQPS")
 	opts := zap.Options{
@@ -73,6 +83,13 @@ func main() {
 	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	if renderFile != "" {
+		if err := render(renderFile, os.Stdout); err != nil {
+			setupLog.Error(err, "unable to render Notebook")
+			os.Exit(1)
+		}
+		return
+	}
 	cfg := ctrl.GetConfigOrDie()
 	if Burst != 0 {
 		cfg.Burst = Burst
@@ -94,13 +111,15 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controllers.NotebookReconciler{
+	reconciler := &controllers.NotebookReconciler{
 		Client:        mgr.GetClient(),
 		Log:           ctrl.Log.WithName("controllers").WithName("Notebook"),
 		Scheme:        mgr.GetScheme(),
 		Metrics:       controller_metrics.NewMetrics(mgr.GetClient()),
-		EventRecorder: mgr.GetEventRecorderFor("notebook-controller"),
-	}).SetupWithManager(mgr); err != nil {
+		EventRecorder: mgr.GetEventRecorderFor(eventComponent),
+		APIReader:     mgr.GetAPIReader(),
+	}
+	if err = reconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Notebook")
 		os.Exit(1)
 	}
@@ -110,11 +129,33 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := mgr.AddHealthzCheck("reconcile", reconciler.ReconcileHealthCheck); err != nil {
+		setupLog.Error(err, "unable to set up reconcile health check")
+		os.Exit(1)
+	}
+
 	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
 
+	if err := mgr.AddReadyzCheck("cache-sync", controllers.NewCacheSyncCheck(mgr.GetCache())); err != nil {
+		setupLog.Error(err, "unable to set up cache sync check")
+		os.Exit(1)
+	}
+
+	// Serve the notebook logs on the webhook server, as the callers send
+	// their bearer tokens and it only serves TLS, unlike the metrics.
+	if os.Getenv("ENABLE_LOGS_ENDPOINT") == "true" {
+		clientset, err := kubernetes.NewForConfig(cfg)
+		if err != nil {
+			setupLog.Error(err, "unable to create clientset")
+			os.Exit(1)
+		}
+		mgr.GetWebhookServer().Register(controllers.LogsPathPrefix,
+			controllers.NewLogsHandler(mgr.GetClient(), clientset))
+	}
+
 	// uncomment when we need the conversion webhook.
 	// if err = (&nbv1beta1.Notebook{}).SetupWebhookWithManager(mgr); err != nil {
 	// 	setupLog.Error(err, "unable to create webhook", "webhook", "Captain")
@@ -129,3 +170,37 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// render prints the objects generated for a Notebook manifest as a YAML
+// stream. The custom domain is read from CUSTOM_DOMAIN.
+func render(file string, out io.Writer) error {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+	notebook := &nbv1.Notebook{}
+	if err := yaml.UnmarshalStrict(data, notebook); err != nil {
+		return err
+	}
+
+	resources, err := controllers.Render(notebook, os.Getenv("CUSTOM_DOMAIN"))
+	if err != nil {
+		return err
+	}
+	for _, obj := range resources.Objects() {
+		manifest, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(out, "---\n%s", manifest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
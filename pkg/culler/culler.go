@@ -6,12 +6,15 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
-//	"github.com/go-logr/logr"
+	"github.com/go-logr/logr"
 	"github.com/tmax-cloud/notebook-controller-go/pkg/metrics"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 )
 
@@ -25,9 +28,19 @@ var client = &http.Client{
 // All the time numbers correspond to minutes.
 const DEFAULT_CULL_IDLE_TIME = "1440" // One day
 const DEFAULT_IDLENESS_CHECK_PERIOD = "1"
+const DEFAULT_IDLENESS_CHECK_JITTER = "0.1" // Fraction of the period
 const DEFAULT_ENABLE_CULLING = "false"
 const DEFAULT_CLUSTER_DOMAIN = "cluster.local"
 const DEFAULT_DEV = "false"
+const DEFAULT_CULL_WARNING_PERIOD = "0" // No warning
+const DEFAULT_CULLING_PAUSE_TIMEZONE = "UTC"
+const DEFAULT_CULL_BY_KERNEL_ACTIVITY = "false"
+const DEFAULT_CULL_BY_KERNEL_EXECUTION = "false"
+
+// The execution states of a Jupyter kernel, as listed by /api/kernels.
+const KERNEL_EXECUTION_STATE_IDLE = "idle"
+const KERNEL_EXECUTION_STATE_BUSY = "busy"
+const KERNEL_EXECUTION_STATE_STARTING = "starting"
 
 // When a Resource should be stopped/culled, then the controller should add this
 // annotation in the Resource's Metadata. Then, inside the reconcile loop,
@@ -37,9 +50,58 @@ const DEFAULT_DEV = "false"
 //
 // In case of Notebooks, the controller will reduce the replicas to 0 if
 // this annotation is set. If it's not set, then it will make the replicas 1.
+//
+// The keys are the defaults of StopAnnotation and LastActivityAnnotation.
 const STOP_ANNOTATION = "kubeflow-resource-stopped"
 const LAST_ACTIVITY_ANNOTATION = "notebooks.kubeflow.org/last-activity"
 
+// StopAnnotation returns the key of the stop annotation, STOP_ANNOTATION_KEY
+// if it is a valid annotation key, so that the controller can run next to the
+// upstream kubeflow one without both culling the same Notebooks.
+func StopAnnotation() string {
+	return annotationKey("STOP_ANNOTATION_KEY", STOP_ANNOTATION)
+}
+
+// LastActivityAnnotation returns the key of the last activity annotation,
+// ACTIVITY_ANNOTATION_KEY if it is a valid annotation key.
+func LastActivityAnnotation() string {
+	return annotationKey("ACTIVITY_ANNOTATION_KEY", LAST_ACTIVITY_ANNOTATION)
+}
+
+// LastExecutionAnnotation returns the key of the last execution annotation,
+// EXECUTION_ANNOTATION_KEY if it is a valid annotation key.
+func LastExecutionAnnotation() string {
+	return annotationKey("EXECUTION_ANNOTATION_KEY", LAST_EXECUTION_ANNOTATION)
+}
+
+// idleSinceAnnotation returns the key of the annotation the idle time of a
+// Notebook counts from.
+func idleSinceAnnotation() string {
+	if CullByKernelExecution() {
+		return LastExecutionAnnotation()
+	}
+	return LastActivityAnnotation()
+}
+
+func annotationKey(env, defaultKey string) string {
+	if key := os.Getenv(env); key != "" && len(validation.IsQualifiedName(key)) == 0 {
+		return key
+	}
+	return defaultKey
+}
+
+// The last time a kernel of the Notebook was seen executing. Unlike the last
+// activity it ignores the API traffic, e.g. of an idle browser tab polling the
+// Jupyter server, so only it counts when CULL_BY_KERNEL_EXECUTION is "true".
+const LAST_EXECUTION_ANNOTATION = "notebooks.kubeflow.org/last-execution"
+
+// Overrides the cluster-wide CULLING_PAUSE_WINDOW for a Notebook, e.g. with
+// "22:00-06:00" for a night shift. The value "none" never pauses its culling.
+const CULLING_PAUSE_WINDOW_ANNOTATION = "notebooks.kubeflow.org/culling-pause-window"
+
+// now returns the current time, it is replaced in the tests.
+var now = time.Now
+
 type NotebookStatus struct {
 	Started      string `json:"started"`
 	LastActivity string `json:"last_activity"`
@@ -47,6 +109,22 @@ type NotebookStatus struct {
 	Kernels      int    `json:"kernels"`
 }
 
+// KernelStatus is a kernel of the Jupyter server, from /api/kernels.
+type KernelStatus struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	LastActivity   string `json:"last_activity"`
+	ExecutionState string `json:"execution_state"`
+	Connections    int    `json:"connections"`
+}
+
+// SessionStatus is a session of the Jupyter server, from /api/sessions.
+type SessionStatus struct {
+	ID     string        `json:"id"`
+	Path   string        `json:"path"`
+	Kernel *KernelStatus `json:"kernel"`
+}
+
 // Some Utility Functions
 func getEnvDefault(variable string, defaultVal string) string {
 	envVar := os.Getenv(variable)
@@ -69,15 +147,16 @@ func createTimestamp() string {
 	return now.Format(time.RFC3339)
 }
 
-func GetRequeueTime() time.Duration {
-	// The frequency in which we check if the Pod needs culling
+// GetRequeuePeriod returns the period in which we check if the Pod needs
+// culling, without jitter.
+func GetRequeuePeriod() time.Duration {
 	// Uses ENV var: IDLENESS_CHECK_PERIOD
 	cullingPeriod := getEnvDefault(
 		"IDLENESS_CHECK_PERIOD", DEFAULT_IDLENESS_CHECK_PERIOD)
 	realCullingPeriod, err := strconv.Atoi(cullingPeriod)
-	if err != nil {
+	if err != nil || realCullingPeriod <= 0 {
 		log.Info(fmt.Sprintf(
-			"Culling Period should be Int. Got '%s'. Using default value.",
+			"Culling Period should be a positive Int. Got '%s'. Using default value.",
 			cullingPeriod))
 		realCullingPeriod, _ = strconv.Atoi(DEFAULT_IDLENESS_CHECK_PERIOD)
 	}
@@ -85,6 +164,26 @@ func GetRequeueTime() time.Duration {
 	return time.Duration(realCullingPeriod) * time.Minute
 }
 
+// GetRequeueTime returns the culling period plus a random jitter of up to
+// IDLENESS_CHECK_JITTER times the period, so the Notebooks reconciled together
+// don't all requeue at the same time.
+func GetRequeueTime() time.Duration {
+	// Uses ENV var: IDLENESS_CHECK_JITTER
+	jitter := getEnvDefault("IDLENESS_CHECK_JITTER", DEFAULT_IDLENESS_CHECK_JITTER)
+	factor, err := strconv.ParseFloat(jitter, 64)
+	if err != nil || factor < 0 || factor > 1 {
+		log.Info(fmt.Sprintf(
+			"IDLENESS_CHECK_JITTER should be a fraction between 0 and 1. Got '%s'. Using default value.",
+			jitter))
+		factor, _ = strconv.ParseFloat(DEFAULT_IDLENESS_CHECK_JITTER, 64)
+	}
+	period := GetRequeuePeriod()
+	if factor == 0 {
+		return period
+	}
+	return wait.Jitter(period, factor)
+}
+
 func getMaxIdleTime() time.Duration {
 	idleTime := getEnvDefault("CULL_IDLE_TIME", DEFAULT_CULL_IDLE_TIME)
 	realIdleTime, err := strconv.Atoi(idleTime)
@@ -98,6 +197,93 @@ func getMaxIdleTime() time.Duration {
 	return time.Minute * time.Duration(realIdleTime)
 }
 
+func getCullWarningPeriod() time.Duration {
+	// How long before the cull an idle Notebook is warned about it
+	// Uses ENV var: CULL_WARNING_PERIOD
+	warningPeriod := getEnvDefault("CULL_WARNING_PERIOD", DEFAULT_CULL_WARNING_PERIOD)
+	realWarningPeriod, err := strconv.Atoi(warningPeriod)
+	if err != nil {
+		log.Info(fmt.Sprintf(
+			"CULL_WARNING_PERIOD should be Int. Got %s instead. Using default value.",
+			warningPeriod))
+		realWarningPeriod, _ = strconv.Atoi(DEFAULT_CULL_WARNING_PERIOD)
+	}
+
+	return time.Minute * time.Duration(realWarningPeriod)
+}
+
+// GetCullWarningTime returns the time an idle Notebook will be culled, if
+// that is within CULL_WARNING_PERIOD. It returns nil otherwise, and when the
+// Notebook is already stopped or culling is disabled.
+func GetCullWarningTime(meta metav1.ObjectMeta) *metav1.Time {
+	warningPeriod := getCullWarningPeriod()
+	if warningPeriod <= 0 || getEnvDefault("ENABLE_CULLING", DEFAULT_ENABLE_CULLING) != "true" ||
+		StopAnnotationIsSet(meta) {
+		return nil
+	}
+
+	lastActivity, err := time.Parse(time.RFC3339, meta.GetAnnotations()[idleSinceAnnotation()])
+	if err != nil {
+		return nil
+	}
+	cullTime := lastActivity.Add(getMaxIdleTime())
+	if now().Before(cullTime.Add(-warningPeriod)) {
+		return nil
+	}
+	return &metav1.Time{Time: cullTime}
+}
+
+// cullingPaused returns true if t falls within the daily window the culling of
+// the Notebook is paused in, e.g. "09:00-18:00" to not disrupt work during
+// business hours. A window ending before its start spans midnight.
+// Uses ENV var: CULLING_PAUSE_WINDOW, CULLING_PAUSE_TIMEZONE
+func cullingPaused(meta metav1.ObjectMeta, t time.Time) bool {
+	window, ok := meta.GetAnnotations()[CULLING_PAUSE_WINDOW_ANNOTATION]
+	if !ok {
+		window = os.Getenv("CULLING_PAUSE_WINDOW")
+	}
+	if window == "" || window == "none" {
+		return false
+	}
+	start, end, err := parsePauseWindow(window)
+	if err != nil {
+		log.Info(fmt.Sprintf(
+			"Culling pause window should be HH:MM-HH:MM. Got '%s'. Not pausing.", window))
+		return false
+	}
+
+	timezone := getEnvDefault("CULLING_PAUSE_TIMEZONE", DEFAULT_CULLING_PAUSE_TIMEZONE)
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		log.Info(fmt.Sprintf(
+			"CULLING_PAUSE_TIMEZONE should be a known time zone. Got '%s'. Using UTC.", timezone))
+		location = time.UTC
+	}
+	t = t.In(location)
+	minute := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// parsePauseWindow returns the start and end minutes of the day of a window.
+func parsePauseWindow(window string) (int, int, error) {
+	parts := strings.Split(window, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid window %q", window)
+	}
+	var minutes [2]int
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, err
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	return minutes[0], minutes[1], nil
+}
+
 // Stop Annotation handling functions
 func SetStopAnnotation(meta *metav1.ObjectMeta, m *metrics.Metrics) {
 	if meta == nil {
@@ -106,10 +292,10 @@ func SetStopAnnotation(meta *metav1.ObjectMeta, m *metrics.Metrics) {
 	}
 	t := time.Now()
 	if meta.GetAnnotations() != nil {
-		meta.Annotations[STOP_ANNOTATION] = t.Format(time.RFC3339)
+		meta.Annotations[StopAnnotation()] = t.Format(time.RFC3339)
 	} else {
 		meta.SetAnnotations(map[string]string{
-			STOP_ANNOTATION: t.Format(time.RFC3339),
+			StopAnnotation(): t.Format(time.RFC3339),
 		})
 	}
 	if m != nil {
@@ -129,7 +315,7 @@ func StopAnnotationIsSet(meta metav1.ObjectMeta) bool {
 		return false
 	}
 
-	if _, ok := meta.GetAnnotations()[STOP_ANNOTATION]; ok {
+	if _, ok := meta.GetAnnotations()[StopAnnotation()]; ok {
 		return true
 	} else {
 		return false
@@ -170,14 +356,180 @@ func getNotebookApiStatus(nm, ns string) *NotebookStatus {
 	return status
 }
 
+// CullByKernelActivity returns true if the controller updates the
+// LAST_ACTIVITY_ANNOTATION itself, from the kernels of the Jupyter server,
+// instead of relying on an external poller.
+// Uses ENV var: CULL_BY_KERNEL_ACTIVITY
+func CullByKernelActivity() bool {
+	return getEnvDefault("CULL_BY_KERNEL_ACTIVITY", DEFAULT_CULL_BY_KERNEL_ACTIVITY) == "true"
+}
+
+// CullByKernelExecution returns true if only the kernels executing count as
+// activity, rather than any traffic to the Jupyter server. The controller
+// checks the kernels every IDLENESS_CHECK_PERIOD, so shorter executions in
+// between may be missed.
+// Uses ENV var: CULL_BY_KERNEL_EXECUTION
+func CullByKernelExecution() bool {
+	return getEnvDefault("CULL_BY_KERNEL_EXECUTION", DEFAULT_CULL_BY_KERNEL_EXECUTION) == "true"
+}
+
+// getJupyterApi decodes the JSON response of a Jupyter API endpoint. It
+// returns false if the endpoint is unreachable or the response is invalid.
+func getJupyterApi(url string, v interface{}, log logr.Logger) bool {
+	resp, err := client.Get(url)
+	if err != nil {
+		log.Info(fmt.Sprintf("Error talking to %s", url), "error", err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Info(fmt.Sprintf("Warning: GET to %s: %d", url, resp.StatusCode))
+		return false
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		log.Info(fmt.Sprintf("Error parsing the JSON response of %s", url), "error", err)
+		return false
+	}
+	return true
+}
+
+// getNotebookApiKernels returns the kernels of the Jupyter server at baseURL,
+// from /api/kernels and the kernels of /api/sessions merged by id, so they
+// are still read when one of the endpoints is unreachable. It returns nil if
+// both are.
+func getNotebookApiKernels(baseURL string, log logr.Logger) []KernelStatus {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	var kernels []KernelStatus
+	kernelsOK := getJupyterApi(baseURL+"/api/kernels", &kernels, log)
+	var sessions []SessionStatus
+	sessionsOK := getJupyterApi(baseURL+"/api/sessions", &sessions, log)
+	if !kernelsOK && !sessionsOK {
+		return nil
+	}
+
+	merged := []KernelStatus{}
+	seen := make(map[string]bool)
+	for _, kernel := range kernels {
+		seen[kernel.ID] = true
+		merged = append(merged, kernel)
+	}
+	for _, session := range sessions {
+		if session.Kernel != nil && !seen[session.Kernel.ID] {
+			seen[session.Kernel.ID] = true
+			merged = append(merged, *session.Kernel)
+		}
+	}
+	return merged
+}
+
+// allKernelsAreIdle returns true if none of the kernels is busy or starting.
+// A nil list, when the kernels couldn't be read, is never idle.
+func allKernelsAreIdle(kernels []KernelStatus, log logr.Logger) bool {
+	if kernels == nil {
+		return false
+	}
+	for _, kernel := range kernels {
+		if kernel.ExecutionState != KERNEL_EXECUTION_STATE_IDLE {
+			log.Info("Not all kernels are idle")
+			return false
+		}
+	}
+	return true
+}
+
+// getKernelsLastActivity returns the most recent last_activity of the kernels.
+func getKernelsLastActivity(kernels []KernelStatus) (time.Time, bool) {
+	var lastActivity time.Time
+	for _, kernel := range kernels {
+		t, err := time.Parse(time.RFC3339, kernel.LastActivity)
+		if err != nil {
+			continue
+		}
+		if t.After(lastActivity) {
+			lastActivity = t
+		}
+	}
+	return lastActivity, !lastActivity.IsZero()
+}
+
+// UpdateNotebookLastActivityAnnotation sets the LAST_ACTIVITY_ANNOTATION from
+// the kernels of the Jupyter server at baseURL: the current time while a
+// kernel is busy, or else the most recent kernel activity. A server without
+// kernels starts the idle time from now, if the annotation isn't set yet. The
+// annotation never moves back, and is kept as is if the server is
+// unreachable. It returns true if the annotation changed.
+func UpdateNotebookLastActivityAnnotation(meta *metav1.ObjectMeta, baseURL string) bool {
+	if meta == nil {
+		log.Info("Error: Metadata is Nil. Can't set Annotations")
+		return false
+	}
+	log := log.WithValues("notebook", getNamespacedNameFromMeta(*meta))
+
+	kernels := getNotebookApiKernels(baseURL, log)
+	if kernels == nil {
+		log.Info("Could not GET the kernels status. Will not update last-activity.")
+		return false
+	}
+
+	current, err := time.Parse(time.RFC3339, meta.GetAnnotations()[LastActivityAnnotation()])
+	hasCurrent := err == nil
+	lastActivity := now()
+	if allKernelsAreIdle(kernels, log) {
+		var ok bool
+		if lastActivity, ok = getKernelsLastActivity(kernels); !ok {
+			if hasCurrent {
+				return false
+			}
+			lastActivity = now()
+		}
+	}
+	if hasCurrent && !lastActivity.Truncate(time.Second).After(current) {
+		return false
+	}
+
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[LastActivityAnnotation()] = lastActivity.Format(time.RFC3339)
+	return true
+}
+
+// UpdateNotebookLastExecutionAnnotation sets the LAST_EXECUTION_ANNOTATION to
+// the current time while a kernel of the Jupyter server at baseURL is busy or
+// starting. A Notebook without the annotation starts its idle time from now.
+// The last activity of the kernels isn't used, as an open tab keeps talking
+// to them. It returns true if the annotation changed.
+func UpdateNotebookLastExecutionAnnotation(meta *metav1.ObjectMeta, baseURL string) bool {
+	if meta == nil {
+		log.Info("Error: Metadata is Nil. Can't set Annotations")
+		return false
+	}
+	log := log.WithValues("notebook", getNamespacedNameFromMeta(*meta))
+
+	kernels := getNotebookApiKernels(baseURL, log)
+	if kernels == nil {
+		log.Info("Could not GET the kernels status. Will not update last-execution.")
+		return false
+	}
+	if _, ok := meta.GetAnnotations()[LastExecutionAnnotation()]; ok && allKernelsAreIdle(kernels, log) {
+		return false
+	}
+
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[LastExecutionAnnotation()] = now().Format(time.RFC3339)
+	return true
+}
 
 func notebookIsIdle(meta metav1.ObjectMeta) bool {
 	// Being idle means that the Notebook can be culled
 	log := log.WithValues("notebook", getNamespacedNameFromMeta(meta))
 
 	if meta.GetAnnotations() != nil {
-		// Read the current LAST_ACTIVITY_ANNOTATION
-		tempLastActivity := meta.GetAnnotations()[LAST_ACTIVITY_ANNOTATION]
+		// Read the current LAST_ACTIVITY_ANNOTATION, or the
+		// LAST_EXECUTION_ANNOTATION if only the executions count
+		tempLastActivity := meta.GetAnnotations()[idleSinceAnnotation()]
 		LastActivity, err := time.Parse(time.RFC3339, tempLastActivity)
 		if err != nil {
 			log.Error(err, "Error parsing last-activity time")
@@ -185,7 +537,7 @@ func notebookIsIdle(meta metav1.ObjectMeta) bool {
 		}
 
 		timeCap := LastActivity.Add(getMaxIdleTime())
-		if time.Now().After(timeCap) {
+		if now().After(timeCap) {
 			return true
 		}
 	}
@@ -206,5 +558,10 @@ func NotebookNeedsCulling(meta metav1.ObjectMeta) bool {
 		return false
 	}
 
+	if cullingPaused(meta, now()) {
+		log.Info("Culling is paused")
+		return false
+	}
+
 	return notebookIsIdle(meta)
 }
@@ -1,6 +1,9 @@
 package culler
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
@@ -368,3 +371,387 @@ func TestNotebookNeedsCulling(t *testing.T) {
 	}
 
 }
+
+func TestNotebookNeedsCullingPauseWindow(t *testing.T) {
+	seoul, err := time.LoadLocation("Asia/Seoul")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %v", err)
+	}
+	lastActivity := time.Date(2022, 3, 1, 12, 0, 0, 0, seoul)
+
+	testCases := []struct {
+		testName string
+		window   string
+		now      time.Time
+		result   bool
+	}{
+		{
+			testName: "Inside the window",
+			now:      time.Date(2022, 3, 3, 10, 0, 0, 0, seoul),
+			result:   false,
+		},
+		{
+			testName: "After the window",
+			now:      time.Date(2022, 3, 3, 18, 0, 0, 0, seoul),
+			result:   true,
+		},
+		{
+			testName: "Before the window",
+			now:      time.Date(2022, 3, 3, 8, 59, 0, 0, seoul),
+			result:   true,
+		},
+		{
+			testName: "Overridden by the Notebook",
+			window:   "none",
+			now:      time.Date(2022, 3, 3, 10, 0, 0, 0, seoul),
+			result:   true,
+		},
+		{
+			testName: "Inside a window spanning midnight",
+			window:   "22:00-06:00",
+			now:      time.Date(2022, 3, 3, 2, 0, 0, 0, seoul),
+			result:   false,
+		},
+		{
+			testName: "Outside a window spanning midnight",
+			window:   "22:00-06:00",
+			now:      time.Date(2022, 3, 3, 10, 0, 0, 0, seoul),
+			result:   true,
+		},
+	}
+
+	t.Setenv("ENABLE_CULLING", "true")
+	t.Setenv("CULL_IDLE_TIME", "60")
+	t.Setenv("CULLING_PAUSE_WINDOW", "09:00-18:00")
+	t.Setenv("CULLING_PAUSE_TIMEZONE", "Asia/Seoul")
+	defer func() { now = time.Now }()
+	for _, c := range testCases {
+		t.Run(c.testName, func(t *testing.T) {
+			meta := metav1.ObjectMeta{
+				Annotations: map[string]string{
+					LAST_ACTIVITY_ANNOTATION: lastActivity.Format(time.RFC3339),
+				},
+			}
+			if c.window != "" {
+				meta.Annotations[CULLING_PAUSE_WINDOW_ANNOTATION] = c.window
+			}
+			now = func() time.Time { return c.now.UTC() }
+
+			if NotebookNeedsCulling(meta) != c.result {
+				t.Errorf("Wrong result for case: %+v", c)
+			}
+		})
+	}
+}
+
+// newJupyterServer returns a mock Jupyter API serving the kernels and
+// sessions JSON. An empty response makes the endpoint fail.
+func newJupyterServer(t *testing.T, kernels, sessions string) *httptest.Server {
+	mux := http.NewServeMux()
+	for path, body := range map[string]string{
+		"/notebook/ns/nb/api/kernels":  kernels,
+		"/notebook/ns/nb/api/sessions": sessions,
+	} {
+		body := body
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if body == "" {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, body)
+		})
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestUpdateNotebookLastActivityAnnotation(t *testing.T) {
+	current := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		testName     string
+		kernels      string
+		sessions     string
+		lastActivity string
+		result       string
+	}{
+		{
+			testName:     "A busy kernel",
+			kernels:      `[{"id": "a", "execution_state": "idle", "last_activity": "2022-03-01T10:00:00Z"}, {"id": "b", "execution_state": "busy", "last_activity": "2022-03-01T11:00:00Z"}]`,
+			sessions:     `[]`,
+			lastActivity: "2022-03-01T09:00:00Z",
+			result:       current.Format(time.RFC3339),
+		},
+		{
+			testName:     "Idle kernels",
+			kernels:      `[{"id": "a", "execution_state": "idle", "last_activity": "2022-03-01T10:00:00Z"}, {"id": "b", "execution_state": "idle", "last_activity": "2022-03-01T11:00:00Z"}]`,
+			sessions:     `[]`,
+			lastActivity: "2022-03-01T09:00:00Z",
+			result:       "2022-03-01T11:00:00Z",
+		},
+		{
+			testName:     "Idle kernels older than the annotation",
+			kernels:      `[{"id": "a", "execution_state": "idle", "last_activity": "2022-03-01T08:00:00Z"}]`,
+			sessions:     `[]`,
+			lastActivity: "2022-03-01T09:00:00Z",
+			result:       "2022-03-01T09:00:00Z",
+		},
+		{
+			testName: "No kernels and no annotation",
+			kernels:  `[]`,
+			sessions: `[]`,
+			result:   current.Format(time.RFC3339),
+		},
+		{
+			testName:     "No kernels",
+			kernels:      `[]`,
+			sessions:     `[]`,
+			lastActivity: "2022-03-01T09:00:00Z",
+			result:       "2022-03-01T09:00:00Z",
+		},
+		{
+			testName:     "Kernels unreachable, sessions busy",
+			sessions:     `[{"id": "s", "path": "a.ipynb", "kernel": {"id": "a", "execution_state": "busy", "last_activity": "2022-03-01T10:00:00Z"}}]`,
+			lastActivity: "2022-03-01T09:00:00Z",
+			result:       current.Format(time.RFC3339),
+		},
+		{
+			testName:     "Jupyter unreachable",
+			lastActivity: "2022-03-01T09:00:00Z",
+			result:       "2022-03-01T09:00:00Z",
+		},
+		{
+			testName: "Jupyter unreachable and no annotation",
+			result:   "",
+		},
+		{
+			testName:     "Invalid response",
+			kernels:      `not json`,
+			sessions:     `not json`,
+			lastActivity: "2022-03-01T09:00:00Z",
+			result:       "2022-03-01T09:00:00Z",
+		},
+	}
+
+	defer func() { now = time.Now }()
+	now = func() time.Time { return current }
+	for _, c := range testCases {
+		t.Run(c.testName, func(t *testing.T) {
+			server := newJupyterServer(t, c.kernels, c.sessions)
+			meta := &metav1.ObjectMeta{Name: "nb", Namespace: "ns"}
+			if c.lastActivity != "" {
+				meta.Annotations = map[string]string{LAST_ACTIVITY_ANNOTATION: c.lastActivity}
+			}
+
+			updated := UpdateNotebookLastActivityAnnotation(meta, server.URL+"/notebook/ns/nb/")
+			if got := meta.Annotations[LAST_ACTIVITY_ANNOTATION]; got != c.result {
+				t.Errorf("Got last activity %q, expected %q", got, c.result)
+			}
+			if updated != (c.result != c.lastActivity) {
+				t.Errorf("Got updated %v for case: %s", updated, c.testName)
+			}
+		})
+	}
+}
+
+func TestGetRequeueTime(t *testing.T) {
+	tests := []struct {
+		name   string
+		period string
+		jitter string
+		min    time.Duration
+		max    time.Duration
+	}{
+		{
+			name:   "default jitter",
+			period: "10",
+			min:    10 * time.Minute,
+			max:    11 * time.Minute,
+		},
+		{
+			name:   "configured jitter",
+			period: "2",
+			jitter: "0.5",
+			min:    2 * time.Minute,
+			max:    3 * time.Minute,
+		},
+		{
+			name:   "jitter out of range",
+			period: "10",
+			jitter: "5",
+			min:    10 * time.Minute,
+			max:    11 * time.Minute,
+		},
+		{
+			name:   "invalid period",
+			period: "-3",
+			jitter: "0.5",
+			min:    time.Minute,
+			max:    90 * time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("IDLENESS_CHECK_PERIOD", test.period)
+			t.Setenv("IDLENESS_CHECK_JITTER", test.jitter)
+			values := make(map[time.Duration]bool)
+			for i := 0; i < 20; i++ {
+				requeue := GetRequeueTime()
+				if requeue < test.min || requeue > test.max {
+					t.Fatalf("Got requeue time %v, Expected between %v and %v", requeue, test.min, test.max)
+				}
+				values[requeue] = true
+			}
+			if len(values) < 2 {
+				t.Fatalf("Got the same requeue time %d times, Expected varied values", 20)
+			}
+		})
+	}
+
+	t.Run("no jitter", func(t *testing.T) {
+		t.Setenv("IDLENESS_CHECK_PERIOD", "5")
+		t.Setenv("IDLENESS_CHECK_JITTER", "0")
+		if requeue := GetRequeueTime(); requeue != 5*time.Minute {
+			t.Fatalf("Got requeue time %v, Expected %v", requeue, 5*time.Minute)
+		}
+	})
+}
+
+func TestGetCullWarningTime(t *testing.T) {
+	current := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		testName     string
+		lastActivity time.Time
+		warned       bool
+	}{
+		{
+			testName:     "Within the warning period",
+			lastActivity: current.Add(-55 * time.Minute),
+			warned:       true,
+		},
+		{
+			testName:     "Before the warning period",
+			lastActivity: current.Add(-40 * time.Minute),
+		},
+	}
+
+	defer func() { now = time.Now }()
+	now = func() time.Time { return current }
+	for _, c := range testCases {
+		t.Run(c.testName, func(t *testing.T) {
+			t.Setenv("ENABLE_CULLING", "true")
+			t.Setenv("CULL_IDLE_TIME", "60")
+			t.Setenv("CULL_WARNING_PERIOD", "10")
+			meta := metav1.ObjectMeta{Annotations: map[string]string{
+				LAST_ACTIVITY_ANNOTATION: c.lastActivity.Format(time.RFC3339),
+			}}
+			got := GetCullWarningTime(meta)
+			if (got != nil) != c.warned {
+				t.Fatalf("Got cull warning time %v, expected a warning %v", got, c.warned)
+			}
+			if cullTime := c.lastActivity.Add(time.Hour); got != nil && !got.Time.Equal(cullTime) {
+				t.Errorf("Got cull warning time %v, expected %v", got, cullTime)
+			}
+		})
+	}
+}
+
+func TestCustomAnnotationKeys(t *testing.T) {
+	t.Setenv("STOP_ANNOTATION_KEY", "notebooks.example.com/stopped")
+	t.Setenv("ACTIVITY_ANNOTATION_KEY", "notebooks.example.com/last-activity")
+	if key := StopAnnotation(); key != "notebooks.example.com/stopped" {
+		t.Fatalf("Got stop annotation %q, expected the configured key", key)
+	}
+	if key := LastActivityAnnotation(); key != "notebooks.example.com/last-activity" {
+		t.Fatalf("Got last activity annotation %q, expected the configured key", key)
+	}
+
+	meta := &metav1.ObjectMeta{}
+	SetStopAnnotation(meta, nil)
+	if _, ok := meta.Annotations["notebooks.example.com/stopped"]; !ok {
+		t.Errorf("Got annotations %v, expected the configured stop key", meta.Annotations)
+	}
+	if _, ok := meta.Annotations[STOP_ANNOTATION]; ok {
+		t.Errorf("Got annotations %v, expected no default stop key", meta.Annotations)
+	}
+
+	// The annotations of the upstream controller are left to it.
+	upstream := metav1.ObjectMeta{Annotations: map[string]string{STOP_ANNOTATION: createTimestamp()}}
+	if StopAnnotationIsSet(upstream) {
+		t.Errorf("Expected the default stop key to be ignored")
+	}
+
+	t.Setenv("STOP_ANNOTATION_KEY", "not a/valid/key")
+	if key := StopAnnotation(); key != STOP_ANNOTATION {
+		t.Errorf("Got stop annotation %q, expected the default for an invalid key", key)
+	}
+}
+
+func TestNotebookNeedsCullingByKernelExecution(t *testing.T) {
+	current := time.Now().Truncate(time.Second)
+	recent := current.Add(-time.Minute).Format(time.RFC3339)
+	old := current.Add(-2 * time.Hour).Format(time.RFC3339)
+	testCases := []struct {
+		testName      string
+		executionOnly string
+		kernels       string
+		lastExecution string
+		result        string
+		culled        bool
+	}{
+		{
+			testName:      "Idle kernel, active tab",
+			executionOnly: "true",
+			kernels:       `[{"id": "a", "execution_state": "idle", "connections": 1, "last_activity": "` + recent + `"}]`,
+			lastExecution: old,
+			result:        old,
+			culled:        true,
+		},
+		{
+			testName:      "Busy kernel",
+			executionOnly: "true",
+			kernels:       `[{"id": "a", "execution_state": "busy", "connections": 1, "last_activity": "` + old + `"}]`,
+			lastExecution: old,
+			result:        current.Format(time.RFC3339),
+		},
+		{
+			testName:      "No execution seen yet",
+			executionOnly: "true",
+			kernels:       `[]`,
+			result:        current.Format(time.RFC3339),
+		},
+		{
+			testName:      "Idle kernel, active tab, any traffic counts",
+			kernels:       `[{"id": "a", "execution_state": "idle", "connections": 1, "last_activity": "` + recent + `"}]`,
+			lastExecution: old,
+			result:        old,
+		},
+	}
+
+	defer func() { now = time.Now }()
+	now = func() time.Time { return current }
+	for _, c := range testCases {
+		t.Run(c.testName, func(t *testing.T) {
+			t.Setenv("ENABLE_CULLING", "true")
+			t.Setenv("CULL_IDLE_TIME", "60")
+			t.Setenv("CULL_BY_KERNEL_EXECUTION", c.executionOnly)
+			server := newJupyterServer(t, c.kernels, `[]`)
+			// The browser tab polling the Jupyter API keeps the last activity recent.
+			meta := &metav1.ObjectMeta{Name: "nb", Namespace: "ns", Annotations: map[string]string{LAST_ACTIVITY_ANNOTATION: recent}}
+			if c.lastExecution != "" {
+				meta.Annotations[LAST_EXECUTION_ANNOTATION] = c.lastExecution
+			}
+
+			if c.executionOnly == "true" {
+				UpdateNotebookLastExecutionAnnotation(meta, server.URL+"/notebook/ns/nb/")
+			}
+			if got := meta.Annotations[LAST_EXECUTION_ANNOTATION]; got != c.result {
+				t.Errorf("Got last execution %q, expected %q", got, c.result)
+			}
+			if culled := NotebookNeedsCulling(*meta); culled != c.culled {
+				t.Errorf("Got culled %v, expected %v", culled, c.culled)
+			}
+		})
+	}
+}
@@ -2,9 +2,13 @@ package metrics
 
 import (
 	"context"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
 )
@@ -17,6 +21,32 @@ type Metrics struct {
 	NotebookFailCreation     *prometheus.CounterVec
 	NotebookCullingCount     *prometheus.CounterVec
 	NotebookCullingTimestamp *prometheus.GaugeVec
+	NotebookRunning          *prometheus.GaugeVec
+	NotebookStopped          *prometheus.GaugeVec
+	NotebookStartupSeconds   *prometheus.HistogramVec
+
+	mu     sync.Mutex
+	states map[types.NamespacedName]notebookGauge
+	// starts holds when the notebooks that aren't ready yet were first seen
+	// starting.
+	starts map[types.NamespacedName]time.Time
+}
+
+// notebookState is the last observed state of a notebook, used to compute the
+// NotebookRunning and NotebookStopped gauges of its namespace.
+type notebookState int
+
+const (
+	notebookStarting notebookState = iota
+	notebookRunning
+	notebookStopped
+)
+
+// notebookGauge is the last observed state of a notebook, and whether its pod
+// requests GPUs.
+type notebookGauge struct {
+	state notebookState
+	gpu   bool
 }
 
 func NewMetrics(cli client.Client) *Metrics {
@@ -34,7 +64,7 @@ func NewMetrics(cli client.Client) *Metrics {
 				Name: "notebook_create_total",
 				Help: "Total times of creating notebooks",
 			},
-			[]string{"namespace"},
+			[]string{"namespace", "gpu"},
 		),
 		NotebookFailCreation: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
@@ -57,6 +87,30 @@ func NewMetrics(cli client.Client) *Metrics {
 			},
 			[]string{"namespace", "name"},
 		),
+		NotebookRunning: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "notebook_status_running",
+				Help: "Current notebooks with a ready pod",
+			},
+			[]string{"namespace", "gpu"},
+		),
+		NotebookStopped: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "notebook_status_stopped",
+				Help: "Current notebooks stopped by the culler or the user",
+			},
+			[]string{"namespace"},
+		),
+		NotebookStartupSeconds: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "notebook_startup_seconds",
+				Help:    "Seconds from the creation or start of notebooks until they are ready",
+				Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+			},
+			[]string{"namespace"},
+		),
+		states: make(map[types.NamespacedName]notebookGauge),
+		starts: make(map[types.NamespacedName]time.Time),
 	}
 
 	metrics.Registry.MustRegister(m)
@@ -68,6 +122,9 @@ func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
 	m.runningNotebooks.Describe(ch)
 	m.NotebookCreation.Describe(ch)
 	m.NotebookFailCreation.Describe(ch)
+	m.NotebookRunning.Describe(ch)
+	m.NotebookStopped.Describe(ch)
+	m.NotebookStartupSeconds.Describe(ch)
 }
 
 // Collect implements the prometheus.Collector interface.
@@ -76,6 +133,90 @@ func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
 	m.runningNotebooks.Collect(ch)
 	m.NotebookCreation.Collect(ch)
 	m.NotebookFailCreation.Collect(ch)
+	m.NotebookRunning.Collect(ch)
+	m.NotebookStopped.Collect(ch)
+	m.NotebookStartupSeconds.Collect(ch)
+}
+
+// GPULabel returns the value of the gpu label of the metrics of a notebook.
+func GPULabel(gpu bool) string {
+	return strconv.FormatBool(gpu)
+}
+
+// SetNotebookState records the observed state of a notebook and refreshes the
+// running and stopped gauges of its namespace. A notebook that is neither
+// running nor stopped is still starting and counts towards none of them. The
+// running notebooks are counted apart when their pod requests GPUs.
+func (m *Metrics) SetNotebookState(namespace, name string, running, stopped, gpu bool) {
+	state := notebookStarting
+	if stopped {
+		state = notebookStopped
+	} else if running {
+		state = notebookRunning
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.states[types.NamespacedName{Namespace: namespace, Name: name}] = notebookGauge{state: state, gpu: gpu}
+	m.updateNamespaceGauges(namespace)
+}
+
+// DeleteNotebookState forgets a deleted notebook so it no longer counts
+// towards the gauges of its namespace.
+func (m *Metrics) DeleteNotebookState(namespace, name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := types.NamespacedName{Namespace: namespace, Name: name}
+	delete(m.starts, key)
+	if _, ok := m.states[key]; !ok {
+		return
+	}
+	delete(m.states, key)
+	m.updateNamespaceGauges(namespace)
+}
+
+// SetNotebookStarting records when a notebook that isn't ready yet started,
+// unless it was already seen starting.
+func (m *Metrics) SetNotebookStarting(namespace, name string, since time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := types.NamespacedName{Namespace: namespace, Name: name}
+	if _, ok := m.starts[key]; !ok {
+		m.starts[key] = since
+	}
+}
+
+// ObserveNotebookStarted observes the startup latency of a notebook that just
+// became ready, if it was seen starting.
+func (m *Metrics) ObserveNotebookStarted(namespace, name string, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := types.NamespacedName{Namespace: namespace, Name: name}
+	if since, ok := m.starts[key]; ok {
+		m.NotebookStartupSeconds.WithLabelValues(namespace).Observe(now.Sub(since).Seconds())
+		delete(m.starts, key)
+	}
+}
+
+// updateNamespaceGauges must be called with m.mu held.
+func (m *Metrics) updateNamespaceGauges(namespace string) {
+	running := map[bool]int{false: 0, true: 0}
+	stopped := 0
+	for key, gauge := range m.states {
+		if key.Namespace != namespace {
+			continue
+		}
+		switch gauge.state {
+		case notebookRunning:
+			running[gauge.gpu]++
+		case notebookStopped:
+			stopped++
+		}
+	}
+	for gpu, count := range running {
+		m.NotebookRunning.WithLabelValues(namespace, GPULabel(gpu)).Set(float64(count))
+	}
+	m.NotebookStopped.WithLabelValues(namespace).Set(float64(stopped))
 }
 
 // scrape gets current running notebook statefulsets.
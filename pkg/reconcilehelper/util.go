@@ -10,6 +10,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -163,17 +164,13 @@ func VirtualService(ctx context.Context, r client.Client, virtualServiceName, na
 // Returns true if the fields copied from don't match to.
 func CopyStatefulSetFields(from, to *appsv1.StatefulSet) bool {
 	requireUpdate := false
-	for k, v := range to.Labels {
-		if from.Labels[k] != v {
-			requireUpdate = true
-		}
+	if stringMapsDiffer(from.Labels, to.Labels) {
+		requireUpdate = true
 	}
 	to.Labels = from.Labels
 
-	for k, v := range to.Annotations {
-		if from.Annotations[k] != v {
-			requireUpdate = true
-		}
+	if stringMapsDiffer(from.Annotations, to.Annotations) {
+		requireUpdate = true
 	}
 	to.Annotations = from.Annotations
 
@@ -182,6 +179,25 @@ func CopyStatefulSetFields(from, to *appsv1.StatefulSet) bool {
 		requireUpdate = true
 	}
 
+	// The API server defaults the rolling update partition, so only the type
+	// is compared.
+	if to.Spec.UpdateStrategy.Type != from.Spec.UpdateStrategy.Type {
+		to.Spec.UpdateStrategy = from.Spec.UpdateStrategy
+		requireUpdate = true
+	}
+
+	// Only the pod annotations set by the controller are synced, others, e.g.
+	// kubectl.kubernetes.io/restartedAt, are kept.
+	for k, v := range from.Spec.Template.Annotations {
+		if to.Spec.Template.Annotations[k] != v {
+			if to.Spec.Template.Annotations == nil {
+				to.Spec.Template.Annotations = map[string]string{}
+			}
+			to.Spec.Template.Annotations[k] = v
+			requireUpdate = true
+		}
+	}
+
 	if !reflect.DeepEqual(to.Spec.Template.Spec, from.Spec.Template.Spec) {
 		requireUpdate = true
 	}
@@ -192,17 +208,13 @@ func CopyStatefulSetFields(from, to *appsv1.StatefulSet) bool {
 
 func CopyDeploymentSetFields(from, to *appsv1.Deployment) bool {
 	requireUpdate := false
-	for k, v := range to.Labels {
-		if from.Labels[k] != v {
-			requireUpdate = true
-		}
+	if stringMapsDiffer(from.Labels, to.Labels) {
+		requireUpdate = true
 	}
 	to.Labels = from.Labels
 
-	for k, v := range to.Annotations {
-		if from.Annotations[k] != v {
-			requireUpdate = true
-		}
+	if stringMapsDiffer(from.Annotations, to.Annotations) {
+		requireUpdate = true
 	}
 	to.Annotations = from.Annotations
 
@@ -222,27 +234,47 @@ func CopyDeploymentSetFields(from, to *appsv1.Deployment) bool {
 // CopyServiceFields copies the owned fields from one Service to another
 func CopyServiceFields(from, to *corev1.Service) bool {
 	requireUpdate := false
-	for k, v := range to.Labels {
-		if from.Labels[k] != v {
-			requireUpdate = true
-		}
+	if stringMapsDiffer(from.Labels, to.Labels) {
+		requireUpdate = true
 	}
 	to.Labels = from.Labels
 
-	for k, v := range to.Annotations {
-		if from.Annotations[k] != v {
-			requireUpdate = true
-		}
+	if stringMapsDiffer(from.Annotations, to.Annotations) {
+		requireUpdate = true
 	}
 	to.Annotations = from.Annotations
 
-	// Don't copy the entire Spec, because we can't overwrite the clusterIp field
+	// Don't copy the entire Spec, because we can't overwrite the clusterIp field.
+	// It is immutable, so a headless Service keeps its "None" and the fields
+	// the API server defaults from it, e.g. clusterIPs, are left alone too.
+
+	if to.Spec.PublishNotReadyAddresses != from.Spec.PublishNotReadyAddresses {
+		requireUpdate = true
+	}
+	to.Spec.PublishNotReadyAddresses = from.Spec.PublishNotReadyAddresses
 
 	if !reflect.DeepEqual(to.Spec.Selector, from.Spec.Selector) {
 		requireUpdate = true
 	}
 	to.Spec.Selector = from.Spec.Selector
 
+	if to.Spec.Type != from.Spec.Type {
+		requireUpdate = true
+	}
+	to.Spec.Type = from.Spec.Type
+
+	// Keep the node ports allocated by the API server for NodePort and
+	// LoadBalancer services, otherwise the ports would never match.
+	if from.Spec.Type == corev1.ServiceTypeNodePort || from.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		for i := range from.Spec.Ports {
+			for _, p := range to.Spec.Ports {
+				if from.Spec.Ports[i].NodePort == 0 && from.Spec.Ports[i].Name == p.Name {
+					from.Spec.Ports[i].NodePort = p.NodePort
+				}
+			}
+		}
+	}
+
 	if !reflect.DeepEqual(to.Spec.Ports, from.Spec.Ports) {
 		requireUpdate = true
 	}
@@ -252,7 +284,7 @@ func CopyServiceFields(from, to *corev1.Service) bool {
 }
 
 func CopyIngress(from, to *netv1.Ingress) bool {
-	requireUpdate := false
+	requireUpdate := copyMetadata(from, to)
 
 	// Don't copy the entire Spec, because we can't overwrite the clusterIp field
 
@@ -266,16 +298,23 @@ func CopyIngress(from, to *netv1.Ingress) bool {
 	}
 	to.Spec.Rules = from.Spec.Rules
 
+	if !reflect.DeepEqual(to.Spec.IngressClassName, from.Spec.IngressClassName) {
+		requireUpdate = true
+	}
+	to.Spec.IngressClassName = from.Spec.IngressClassName
+
 	return requireUpdate
 }
 
 func CopyCertificate(from, to *unstructured.Unstructured) bool {
+	labelsChanged := copyMetadata(from, to)
+
 	fromSpec, found, err := unstructured.NestedMap(from.Object, "spec")
 	if !found {
-		return false
+		return labelsChanged
 	}
 	if err != nil {
-		return false
+		return labelsChanged
 	}
 
 	toSpec, found, err := unstructured.NestedMap(to.Object, "spec")
@@ -288,18 +327,20 @@ func CopyCertificate(from, to *unstructured.Unstructured) bool {
 	if requiresUpdate {
 		unstructured.SetNestedMap(to.Object, fromSpec, "spec")
 	}
-	return requiresUpdate
+	return requiresUpdate || labelsChanged
 }
 
 // Copy configuration related fields to another instance and returns true if there
 // is a diff and thus needs to update.
 func CopyVirtualService(from, to *unstructured.Unstructured) bool {
+	labelsChanged := copyMetadata(from, to)
+
 	fromSpec, found, err := unstructured.NestedMap(from.Object, "spec")
 	if !found {
-		return false
+		return labelsChanged
 	}
 	if err != nil {
-		return false
+		return labelsChanged
 	}
 
 	toSpec, found, err := unstructured.NestedMap(to.Object, "spec")
@@ -312,5 +353,51 @@ func CopyVirtualService(from, to *unstructured.Unstructured) bool {
 	if requiresUpdate {
 		unstructured.SetNestedMap(to.Object, fromSpec, "spec")
 	}
-	return requiresUpdate
+	return requiresUpdate || labelsChanged
+}
+
+// copyMetadata sets the labels and annotations of from on to, leaving any
+// other labels and annotations of to in place, e.g. the ones added by other
+// controllers. Returns true if one was added or changed.
+func copyMetadata(from, to metav1.Object) bool {
+	requireUpdate := false
+	if labels, changed := mergeStringMap(from.GetLabels(), to.GetLabels()); changed {
+		to.SetLabels(labels)
+		requireUpdate = true
+	}
+	if annotations, changed := mergeStringMap(from.GetAnnotations(), to.GetAnnotations()); changed {
+		to.SetAnnotations(annotations)
+		requireUpdate = true
+	}
+	return requireUpdate
+}
+
+// mergeStringMap sets the entries of from on to. Returns true if one was added
+// or changed.
+func mergeStringMap(from, to map[string]string) (map[string]string, bool) {
+	changed := false
+	for k, v := range from {
+		if current, ok := to[k]; !ok || current != v {
+			if to == nil {
+				to = map[string]string{}
+			}
+			to[k] = v
+			changed = true
+		}
+	}
+	return to, changed
+}
+
+// stringMapsDiffer returns true if the maps don't have the same entries. A nil
+// map is the same as an empty one.
+func stringMapsDiffer(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return true
+	}
+	for k, v := range a {
+		if current, ok := b[k]; !ok || current != v {
+			return true
+		}
+	}
+	return false
 }
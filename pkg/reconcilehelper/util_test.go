@@ -0,0 +1,213 @@
+package reconcile
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func newUnstructured(labels map[string]string, host string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	u.SetLabels(labels)
+	unstructured.SetNestedStringSlice(u.Object, []string{host}, "spec", "hosts")
+	return u
+}
+
+func TestCopyUnstructuredLabels(t *testing.T) {
+	testCases := []struct {
+		testName       string
+		from           *unstructured.Unstructured
+		to             *unstructured.Unstructured
+		requiresUpdate bool
+		labels         map[string]string
+	}{
+		{
+			testName:       "Labels are added",
+			from:           newUnstructured(map[string]string{"notebook-name": "nb"}, "*"),
+			to:             newUnstructured(nil, "*"),
+			requiresUpdate: true,
+			labels:         map[string]string{"notebook-name": "nb"},
+		},
+		{
+			testName:       "Foreign labels are preserved",
+			from:           newUnstructured(map[string]string{"notebook-name": "nb"}, "*"),
+			to:             newUnstructured(map[string]string{"notebook-name": "nb", "team": "a"}, "*"),
+			requiresUpdate: false,
+			labels:         map[string]string{"notebook-name": "nb", "team": "a"},
+		},
+		{
+			testName:       "Changed labels are updated",
+			from:           newUnstructured(map[string]string{"notebook-name": "nb"}, "*"),
+			to:             newUnstructured(map[string]string{"notebook-name": "other", "team": "a"}, "*"),
+			requiresUpdate: true,
+			labels:         map[string]string{"notebook-name": "nb", "team": "a"},
+		},
+	}
+
+	for _, c := range testCases {
+		t.Run(c.testName, func(t *testing.T) {
+			for name, copy := range map[string]func(from, to *unstructured.Unstructured) bool{
+				"Certificate":    CopyCertificate,
+				"VirtualService": CopyVirtualService,
+			} {
+				to := c.to.DeepCopy()
+				if copy(c.from, to) != c.requiresUpdate {
+					t.Errorf("%s: wrong update result for case: %s", name, c.testName)
+				}
+				for k, v := range c.labels {
+					if to.GetLabels()[k] != v {
+						t.Errorf("%s: got labels %v, expected %v", name, to.GetLabels(), c.labels)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCopyServiceFieldsKeepsNodePorts(t *testing.T) {
+	from := &corev1.Service{
+		Spec: corev1.ServiceSpec{
+			Type:  corev1.ServiceTypeLoadBalancer,
+			Ports: []corev1.ServicePort{{Name: "https-nb", Port: 443}},
+		},
+	}
+	to := from.DeepCopy()
+	to.Spec.Ports[0].NodePort = 31443
+
+	if CopyServiceFields(from, to) {
+		t.Errorf("Expected no update for an allocated node port")
+	}
+	if to.Spec.Ports[0].NodePort != 31443 {
+		t.Errorf("Got node port %d, expected 31443", to.Spec.Ports[0].NodePort)
+	}
+
+	from.Spec.Type = corev1.ServiceTypeClusterIP
+	from.Spec.Ports[0].NodePort = 0
+	if !CopyServiceFields(from, to) {
+		t.Errorf("Expected an update when the service type changes")
+	}
+	if to.Spec.Type != corev1.ServiceTypeClusterIP || to.Spec.Ports[0].NodePort != 0 {
+		t.Errorf("Got %v, expected a ClusterIP service without node ports", to.Spec)
+	}
+}
+
+func TestCopyServiceFieldsHeadless(t *testing.T) {
+	from := &corev1.Service{
+		Spec: corev1.ServiceSpec{
+			Type:                     corev1.ServiceTypeClusterIP,
+			ClusterIP:                corev1.ClusterIPNone,
+			PublishNotReadyAddresses: true,
+			Ports:                    []corev1.ServicePort{{Name: "http-nb", Port: 8888, TargetPort: intstr.FromInt(8888)}},
+		},
+	}
+	// The API server fills in the fields defaulted from the cluster ip.
+	to := from.DeepCopy()
+	to.Spec.ClusterIPs = []string{corev1.ClusterIPNone}
+	to.Spec.SessionAffinity = corev1.ServiceAffinityNone
+	to.Spec.IPFamilies = []corev1.IPFamily{corev1.IPv4Protocol}
+
+	if CopyServiceFields(from, to) {
+		t.Errorf("Expected no update for an unchanged headless service")
+	}
+	if to.Spec.ClusterIP != corev1.ClusterIPNone || len(to.Spec.ClusterIPs) != 1 {
+		t.Errorf("Got cluster ips %v, expected them kept", to.Spec.ClusterIPs)
+	}
+
+	from.Spec.PublishNotReadyAddresses = false
+	if !CopyServiceFields(from, to) || to.Spec.PublishNotReadyAddresses {
+		t.Errorf("Expected an update when publishNotReadyAddresses changes")
+	}
+}
+
+func TestCopyStatefulSetFieldsPodAnnotations(t *testing.T) {
+	replicas := int32(1)
+	from := &appsv1.StatefulSet{
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &replicas,
+			Template: corev1.PodTemplateSpec{},
+		},
+	}
+	from.Spec.Template.Annotations = map[string]string{"sidecar.istio.io/inject": "true"}
+	to := from.DeepCopy()
+	to.Spec.Template.Annotations = map[string]string{
+		"sidecar.istio.io/inject":           "false",
+		"kubectl.kubernetes.io/restartedAt": "2022-01-01T00:00:00Z",
+	}
+
+	if !CopyStatefulSetFields(from, to) {
+		t.Errorf("Expected an update when a pod annotation changes")
+	}
+	if to.Spec.Template.Annotations["sidecar.istio.io/inject"] != "true" ||
+		to.Spec.Template.Annotations["kubectl.kubernetes.io/restartedAt"] == "" {
+		t.Errorf("Got pod annotations %v, expected the changed one updated and the others kept", to.Spec.Template.Annotations)
+	}
+	if CopyStatefulSetFields(from, to) {
+		t.Errorf("Expected no update once the pod annotations are synced")
+	}
+}
+
+func TestCopyStatefulSetFieldsUpdateStrategy(t *testing.T) {
+	replicas := int32(1)
+	partition := int32(0)
+	from := &appsv1.StatefulSet{
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:       &replicas,
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{Type: appsv1.RollingUpdateStatefulSetStrategyType},
+		},
+	}
+	to := from.DeepCopy()
+	to.Spec.UpdateStrategy.RollingUpdate = &appsv1.RollingUpdateStatefulSetStrategy{Partition: &partition}
+
+	if CopyStatefulSetFields(from, to) {
+		t.Errorf("Expected no update for a defaulted partition")
+	}
+
+	from.Spec.UpdateStrategy = appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType}
+	if !CopyStatefulSetFields(from, to) {
+		t.Errorf("Expected an update when the update strategy changes")
+	}
+	if to.Spec.UpdateStrategy.Type != appsv1.OnDeleteStatefulSetStrategyType {
+		t.Errorf("Got update strategy %v, expected OnDelete", to.Spec.UpdateStrategy.Type)
+	}
+}
+
+func TestCopyFieldsAddedLabels(t *testing.T) {
+	replicas := int32(1)
+	from := &appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Replicas: &replicas}}
+	from.Labels = map[string]string{"team": "ml"}
+	from.Annotations = map[string]string{"cost-center": "1234"}
+	to := &appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{Replicas: &replicas}}
+	if !CopyStatefulSetFields(from, to) {
+		t.Errorf("StatefulSet: expected an update when a label is added")
+	}
+	if to.Labels["team"] != "ml" || to.Annotations["cost-center"] != "1234" {
+		t.Errorf("StatefulSet: got labels %v and annotations %v", to.Labels, to.Annotations)
+	}
+
+	fromSvc := &corev1.Service{}
+	fromSvc.Labels = map[string]string{"team": "ml"}
+	toSvc := &corev1.Service{}
+	if !CopyServiceFields(fromSvc, toSvc) || toSvc.Labels["team"] != "ml" {
+		t.Errorf("Service: got labels %v, expected the added label", toSvc.Labels)
+	}
+
+	fromIng := &netv1.Ingress{}
+	fromIng.Labels = map[string]string{"team": "ml"}
+	fromIng.Annotations = map[string]string{"cost-center": "1234"}
+	toIng := &netv1.Ingress{}
+	toIng.Annotations = map[string]string{"kubernetes.io/ingress.class": "traefik"}
+	if !CopyIngress(fromIng, toIng) {
+		t.Errorf("Ingress: expected an update when a label is added")
+	}
+	if toIng.Labels["team"] != "ml" || toIng.Annotations["cost-center"] != "1234" ||
+		toIng.Annotations["kubernetes.io/ingress.class"] != "traefik" {
+		t.Errorf("Ingress: got labels %v and annotations %v", toIng.Labels, toIng.Annotations)
+	}
+	if CopyIngress(fromIng, toIng) {
+		t.Errorf("Ingress: expected no update once the labels are synced")
+	}
+}